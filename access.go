@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// accessGuard holds the token that writes of a run are sent with. When ARM
+// rejects the token mid-run it is re-acquired once; when access turns out to be
+// revoked, the affected scope is remembered so that its remaining VMs are not
+// attempted.
+type accessGuard struct {
+	mu       sync.Mutex
+	token    string
+	identity string // client ID of the operator identity, or "" to write with the run's token
+	err      error  // why the operator token could not be acquired
+	renewed  bool
+	lost     map[string]string // lower-cased scope ("/" for everything) → reason
+}
+
+func newAccessGuard(token string) *accessGuard {
+	return &accessGuard{token: token, lost: map[string]string{}}
+}
+
+// newOperatorGuard returns a guard writing as the operator identity with
+// clientID. Its token is only acquired by the first write, so runs that end up
+// performing none never hold it.
+func newOperatorGuard(clientID string) *accessGuard {
+	return &accessGuard{identity: clientID, lost: map[string]string{}}
+}
+
+// current returns the token to send write requests with
+func (g *accessGuard) current(ctx context.Context) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.token == "" && g.err == nil {
+		token, err := getAzureAccessToken(withIdentity(ctx, g.identity))
+		if err != nil {
+			g.err = fmt.Errorf("failed to get the operator token: %w", err)
+			slog.Error(g.err.Error())
+		} else {
+			slog.Info("Acquired the operator token", "identity", g.identity)
+			g.token = token
+		}
+	}
+	return g.token, g.err
+}
+
+// renew replaces the rejected token used, once per run. It returns the token
+// to retry with, or false when the token was already renewed or renewal failed.
+func (g *accessGuard) renew(ctx context.Context, used string) (string, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.token != used {
+		// Another request already renewed it
+		return g.token, true
+	}
+	if g.renewed {
+		return "", false
+	}
+	g.renewed = true
+	token, err := getAzureAccessToken(withIdentity(ctx, g.identity))
+	if err != nil {
+		slog.Error("Failed to re-acquire the Azure token", "error", err)
+		return "", false
+	}
+	slog.Warn("ARM rejected the token mid-run; re-acquired it")
+	g.token = token
+	return token, true
+}
+
+// revoked records lost access when statusCode and the ARM error code show that
+// the identity may no longer act on t, returning the reason, or "" otherwise.
+// A 401 (after renewal) loses everything; an authorization failure loses the
+// resource group of t.
+func (g *accessGuard) revoked(t *vmTarget, statusCode int, code string) string {
+	var scope, reason string
+	switch {
+	case statusCode == http.StatusUnauthorized:
+		scope = "/"
+		reason = fmt.Sprintf("ARM rejected the token (%s) even after it was re-acquired", code)
+	case statusCode == http.StatusForbidden && (code == "AuthorizationFailed" || code == "LinkedAuthorizationFailed"):
+		scope = fmt.Sprintf("/subscriptions/%s/resourceGroups/%s", t.SubscriptionID, t.ResourceGroup)
+		reason = fmt.Sprintf("not authorized in %s any more (%s)", scope, code)
+	default:
+		return ""
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.lost[strings.ToLower(scope)]; !ok {
+		slog.Error("Access lost; remaining VMs in scope are not attempted", "reason", reason, "scope", scope)
+		g.lost[strings.ToLower(scope)] = reason
+	}
+	return reason
+}
+
+// lostFor returns why access to t was lost earlier in the run, or ""
+func (g *accessGuard) lostFor(t *vmTarget) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	id := strings.ToLower(t.ID)
+	for scope, reason := range g.lost {
+		if scope == "/" || strings.HasPrefix(id, scope+"/") {
+			return reason
+		}
+	}
+	return ""
+}
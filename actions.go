@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// vmAction is an operation the pipeline performs on a VM; its value is the
+// name of the ARM virtualMachines action endpoint
+type vmAction string
+
+const (
+	actionStart      vmAction = "start"
+	actionPowerOff   vmAction = "powerOff"
+	actionDeallocate vmAction = "deallocate"
+	actionRestart    vmAction = "restart"
+	actionRedeploy   vmAction = "redeploy"
+)
+
+// knownActions lists the values of every action, as used in grants and configuration files
+var knownActions = []string{string(actionStart), string(actionPowerOff), string(actionDeallocate), string(actionRestart), string(actionRedeploy)}
+
+// parseAction maps the --action names onto actions: "stop" powers the VM off
+// while keeping its compute allocated (and billed), "deallocate" releases it,
+// "restart" reboots the guest in place and "redeploy" moves the VM to a new host
+func parseAction(name string) (vmAction, error) {
+	switch name {
+	case "start":
+		return actionStart, nil
+	case "stop":
+		return actionPowerOff, nil
+	case "deallocate":
+		return actionDeallocate, nil
+	case "restart":
+		return actionRestart, nil
+	case "redeploy":
+		return actionRedeploy, nil
+	}
+	return "", fmt.Errorf("unknown --action %q: expected start, stop, deallocate, restart or redeploy", name)
+}
+
+// powersDown reports whether the action stops or deallocates the VM
+func (a vmAction) powersDown() bool {
+	return a == actionPowerOff || a == actionDeallocate
+}
+
+// disrupts reports whether the action interrupts a running VM: every action
+// but start does. Protected VMs are never subjected to such actions.
+func (a vmAction) disrupts() bool {
+	return a != actionStart
+}
+
+// accepts reports whether statusCode is a successful response to the action.
+// Start, restart and redeploy are always asynchronous; power-off and deallocate
+// answer 200 when the VM already is in the requested state.
+func (a vmAction) accepts(statusCode int) bool {
+	switch a {
+	case actionStart, actionRestart, actionRedeploy:
+		return statusCode == http.StatusAccepted
+	}
+	return statusCode == http.StatusAccepted || statusCode == http.StatusOK
+}
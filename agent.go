@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// agentIntent is an operation queued by the agent: a run of its flags that was
+// due at IntendedAt. Each intent is a file of the queue directory, so that the
+// agent and "agent enqueue" never write the same file.
+type agentIntent struct {
+	ID         string    `json:"id"`
+	IntendedAt time.Time `json:"intendedAt"`
+	Source     string    `json:"source"` // schedule or manual
+	Attempts   int       `json:"attempts"`
+	LastError  string    `json:"lastError,omitempty"`
+
+	path string
+}
+
+// runAgent implements the agent command: a long-running process for hosts with
+// unreliable connectivity. Runs due by its schedule, or queued with
+// "agent enqueue", are persisted in the queue directory and executed once ARM
+// is reachable; intents that piled up while offline are reconciled by a single
+// run, which skips the VMs already in the desired power state.
+func runAgent(ctx context.Context, reporter *errorReporter, args []string) error {
+	if len(args) > 0 && args[0] == "enqueue" {
+		return runAgentEnqueue(args[1:])
+	}
+	opts := &options{}
+	fs := newFlagSet("agent", opts)
+	queueDir := fs.String("queue", "", "directory persisting the queued operations (required)")
+	at := fs.String("at", "", "queue a run every day at this UTC time (HH:MM); without it runs are only queued by agent enqueue")
+	var weekdays stringList
+	fs.Var(&weekdays, "weekday", "with --at, only queue runs on this weekday: mon … sun (repeatable)")
+	retry := fs.Duration("retry", time.Minute, "how often to check whether ARM is reachable while operations are queued")
+	maxDelay := fs.Duration("max-delay", 24*time.Hour, "drop queued operations that could not be executed for this long")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	if err := setupLogging(opts); err != nil {
+		return err
+	}
+	if *queueDir == "" {
+		return fmt.Errorf("--queue is required")
+	}
+	if opts.serveAddr != "" {
+		return fmt.Errorf("--serve cannot be combined with agent mode")
+	}
+	if *retry <= 0 || *maxDelay <= 0 {
+		return fmt.Errorf("--retry and --max-delay must be positive")
+	}
+	var schedule *fleetSchedule
+	if *at != "" {
+		schedule = &fleetSchedule{At: *at, Weekdays: weekdays}
+		if err := schedule.parse(); err != nil {
+			return err
+		}
+	} else if len(weekdays) > 0 {
+		return fmt.Errorf("--weekday requires --at")
+	}
+	if err := os.MkdirAll(*queueDir, 0o700); err != nil {
+		return fmt.Errorf("failed to create queue directory: %w", err)
+	}
+
+	a, err := newApp(opts, reporter)
+	if err != nil {
+		return err
+	}
+	defer a.close()
+	ag := &agent{app: a, dir: *queueDir, maxDelay: *maxDelay, wake: make(chan struct{}, 1)}
+
+	if schedule != nil {
+		slog.Info("Agent queues runs", "schedule", schedule)
+		go runSchedule(ctx, "agent run", opts.catchUp, schedule.next, func(now time.Time) {
+			if err := enqueueIntent(ag.dir, now, "schedule"); err != nil {
+				slog.Error("Failed to queue the scheduled run", "error", err)
+				return
+			}
+			ag.notify()
+		})
+	}
+	ticker := time.NewTicker(*retry)
+	defer ticker.Stop()
+	for {
+		ag.drain(ctx)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		case <-ag.wake:
+		}
+	}
+}
+
+// runAgentEnqueue implements agent enqueue, queueing a run for the agent
+// serving the queue directory
+func runAgentEnqueue(args []string) error {
+	fs := flag.NewFlagSet("agent enqueue", flag.ContinueOnError)
+	queueDir := fs.String("queue", "", "queue directory of the agent (required)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *queueDir == "" {
+		return fmt.Errorf("--queue is required")
+	}
+	if err := os.MkdirAll(*queueDir, 0o700); err != nil {
+		return fmt.Errorf("failed to create queue directory: %w", err)
+	}
+	if err := enqueueIntent(*queueDir, time.Now(), "manual"); err != nil {
+		return err
+	}
+	slog.Info("Run queued", "queue", *queueDir)
+	return nil
+}
+
+// agent executes the queued intents of one queue directory
+type agent struct {
+	app      *app
+	dir      string
+	maxDelay time.Duration
+	wake     chan struct{}
+
+	offline bool // the last reachability check failed
+}
+
+// notify makes the agent look at the queue without waiting for the next retry
+func (ag *agent) notify() {
+	select {
+	case ag.wake <- struct{}{}:
+	default:
+	}
+}
+
+// drain executes the queued intents if ARM can be reached. They are executed
+// together by one run; the intents stay queued if the run could not complete
+// its discovery or any action request got no response, and the next attempt
+// reconciles from the VMs' current power states.
+func (ag *agent) drain(ctx context.Context) {
+	intents, err := loadIntents(ag.dir)
+	if err != nil {
+		slog.Error("Failed to read the agent queue", "error", err)
+		return
+	}
+	now := time.Now()
+	var pending []*agentIntent
+	for _, in := range intents {
+		if now.Sub(in.IntendedAt) > ag.maxDelay {
+			slog.Warn("Dropping operation not executed within --max-delay", "operation", in.ID, "queuedAt", in.IntendedAt.Format(time.RFC3339),
+				"maxDelay", ag.maxDelay, "attempts", in.Attempts, "lastError", in.LastError)
+			ag.app.journal.audit("agent", fmt.Sprintf("intent=%s queued=%s expired=true attempts=%d", in.ID, in.IntendedAt.Format(time.RFC3339), in.Attempts))
+			os.Remove(in.path)
+			continue
+		}
+		pending = append(pending, in)
+	}
+	if len(pending) == 0 {
+		return
+	}
+	if err := armReachable(ctx); err != nil {
+		if !ag.offline {
+			slog.Warn("ARM is unreachable, operations stay queued", "pending", len(pending), "error", err)
+		}
+		ag.offline = true
+		ag.failed(pending, err)
+		return
+	}
+	if ag.offline {
+		slog.Info("ARM is reachable again")
+		ag.offline = false
+	}
+
+	oldest := pending[0]
+	runID := uuid.NewString()
+	ids := make([]string, len(pending))
+	for i, in := range pending {
+		ids[i] = in.ID
+	}
+	ag.app.journal.audit("agent", fmt.Sprintf("run=%s intents=%s queued=%s", runID, strings.Join(ids, ","), oldest.IntendedAt.Format(time.RFC3339)))
+	slog.Info("Starting run for queued operations", "runId", runID, "pending", len(pending),
+		"oldestQueuedAt", oldest.IntendedAt.Format(time.RFC3339), "age", now.Sub(oldest.IntendedAt).Round(time.Second))
+	p, err := ag.app.newPipeline(ctx, runID, ag.app.opts.labels)
+	if err != nil {
+		slog.Error("Run failed", "runId", runID, "error", err)
+		ag.failed(pending, err)
+		return
+	}
+	p.queuedAt = oldest.IntendedAt
+	unanswered := &unansweredSink{}
+	p.sinks = append(p.sinks, unanswered)
+	summary, err := p.run(ctx)
+	if err == nil && unanswered.count > 0 {
+		err = fmt.Errorf("%d action request(s) got no response", unanswered.count)
+	}
+	if err != nil {
+		slog.Error("Run failed, its operations stay queued", "runId", runID, "error", err)
+		ag.failed(pending, err)
+		return
+	}
+	printSummary(summary)
+	for _, in := range pending {
+		os.Remove(in.path)
+	}
+	if len(pending) > 1 {
+		slog.Info("Run reconciled queued operations", "runId", runID, "operations", len(pending))
+	}
+}
+
+// failed records a failed attempt on every intent
+func (ag *agent) failed(intents []*agentIntent, err error) {
+	for _, in := range intents {
+		in.Attempts++
+		in.LastError = err.Error()
+		if werr := writeIntent(in); werr != nil {
+			slog.Error("Failed to update queued operation", "operation", in.ID, "error", werr)
+		}
+	}
+}
+
+// unansweredSink counts the action requests that failed without any response
+// from ARM, as happens when connectivity is lost in the middle of a run
+type unansweredSink struct {
+	count int
+}
+
+func (s *unansweredSink) publish(res *vmResult) {
+	if res.Err != nil && res.StatusCode == 0 && !res.AccessLost && res.SkipReason == "" && res.Duration > 0 {
+		s.count++
+	}
+}
+
+func (s *unansweredSink) close() {}
+
+// armReachable checks that ARM answers HTTP requests at all; any status will do
+func armReachable(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, armEndpoint+"/", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// enqueueIntent persists a new intent due at now
+func enqueueIntent(dir string, now time.Time, source string) error {
+	in := &agentIntent{ID: uuid.NewString(), IntendedAt: now.UTC(), Source: source}
+	in.path = filepath.Join(dir, fmt.Sprintf("%s-%s.json", in.IntendedAt.Format("20060102T150405Z"), in.ID))
+	return writeIntent(in)
+}
+
+// writeIntent writes the intent atomically, through a temporary file
+func writeIntent(in *agentIntent) error {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	tmp := in.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, in.path)
+}
+
+// loadIntents reads the queued intents, oldest first
+func loadIntents(dir string) ([]*agentIntent, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var intents []*agentIntent
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		in := &agentIntent{path: path}
+		if err := json.Unmarshal(data, in); err != nil {
+			return nil, fmt.Errorf("invalid queued operation %s: %w", path, err)
+		}
+		intents = append(intents, in)
+	}
+	sort.Slice(intents, func(i, j int) bool { return intents[i].IntendedAt.Before(intents[j].IntendedAt) })
+	return intents, nil
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// app holds the process-wide state shared by every run
+type app struct {
+	opts      *options
+	reporter  *errorReporter
+	journal   *journal
+	protected *protectionList
+	plan      *runPlan
+	hooks     *hooksFile         // nil without --hooks
+	oob       *oobStartersFile   // nil without --oob-starters
+	views     *instanceViewCache // nil without --instance-view-ttl
+	meta      *metadataCache     // nil without --metadata-ttl
+	dedupe    *dedupeWindow      // nil without --dedupe-window
+	messages  messageCatalog     // nil without --messages
+	snapshot  *inventorySnapshot // nil without --snapshot
+	limits    *guardrails        // nil without --guardrails
+
+	// fleet names the app within a server with --fleets; "" is the default fleet
+	fleet string
+}
+
+// newApp validates the static configuration and opens shared resources
+func newApp(opts *options, reporter *errorReporter) (*app, error) {
+	a := &app{opts: opts, reporter: reporter}
+	if err := resolveSecretRefs(opts); err != nil {
+		return nil, err
+	}
+	var err error
+	if a.protected, err = parseProtectionList(opts.protect); err != nil {
+		return nil, err
+	}
+	if opts.planPath != "" {
+		if a.plan, err = loadPlan(opts.planPath); err != nil {
+			return nil, err
+		}
+	}
+	if opts.hooksPath != "" {
+		if a.hooks, err = loadHooks(opts.hooksPath); err != nil {
+			return nil, err
+		}
+	}
+	if opts.oobStartersPath != "" {
+		if a.oob, err = loadOOBStarters(opts.oobStartersPath); err != nil {
+			return nil, err
+		}
+	}
+	if opts.messagesPath != "" {
+		if a.messages, err = loadMessages(opts.messagesPath); err != nil {
+			return nil, err
+		}
+	}
+	if opts.guardrailsPath != "" {
+		if a.limits, err = loadGuardrails(opts.guardrailsPath); err != nil {
+			return nil, err
+		}
+	}
+	if opts.snapshotPath != "" {
+		if a.snapshot, err = loadSnapshot(opts.snapshotPath, opts.tenant); err != nil {
+			return nil, err
+		}
+		if err := a.snapshot.fresh(opts.snapshotMaxAge, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+	if opts.dedupeWindow > 0 {
+		// Seeded before the journal is opened for this process's own records
+		if a.dedupe, err = newDedupeWindow(opts.dedupeWindow, opts.journalPath); err != nil {
+			return nil, err
+		}
+	}
+	if a.journal, err = openJournal(opts.journalPath); err != nil {
+		return nil, err
+	}
+	if opts.metadataTTL > 0 {
+		a.meta = newMetadataCache(opts.metadataTTL)
+	}
+	if opts.instanceViewTTL > 0 {
+		a.views = newInstanceViewCache(opts.instanceViewTTL)
+	}
+	return a, nil
+}
+
+// close releases shared resources
+func (a *app) close() {
+	a.journal.close()
+}
+
+// dry turns p into a dry run, which leaves no traces: notifiers, approval and
+// the journal are dropped
+func (p *pipeline) dry() {
+	for _, sink := range p.sinks {
+		sink.close()
+	}
+	p.dryRun = true
+	p.sinks, p.observers, p.gates, p.journal = nil, nil, nil, nil
+}
+
+// newDiscoverer returns the configured inventory source
+func (a *app) newDiscoverer(token string) discoverer {
+	opts := a.opts
+	if a.snapshot != nil {
+		return &snapshotDiscoverer{snapshot: a.snapshot, maxAge: opts.snapshotMaxAge}
+	}
+	if opts.discovery == discoveryResourceGraph {
+		return &resourceGraphDiscoverer{
+			token:     token,
+			where:     opts.graphWhere,
+			pageSize:  opts.graphPageSize,
+			skipToken: opts.graphSkipToken,
+			maxPages:  opts.graphMaxPages,
+			arc:       a.oob != nil,
+			scope:     opts.subscriptionScope(),
+			group:     opts.resourceGroup,
+			locations: opts.locations,
+			meta:      a.meta,
+		}
+	}
+	return &armDiscoverer{token: token, filter: opts.armFilter, reporter: a.reporter, meta: a.meta, scope: opts.subscriptionScope(), arc: a.oob != nil, group: opts.resourceGroup}
+}
+
+// inventory discovers every VM without performing any action
+func (a *app) inventory(ctx context.Context) ([]*vmTarget, error) {
+	ctx = withRetries(withTenant(ctx, a.opts.tenant), a.opts.armRetries)
+	token, err := getAzureAccessToken(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Azure token: %w", err)
+	}
+	found := make(chan *vmTarget)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(found)
+		errc <- a.newDiscoverer(token).discover(ctx, found)
+	}()
+	var targets []*vmTarget
+	for t := range found {
+		if t.ResourceGroup == "" {
+			t.ResourceGroup = parseResourceGroup(t.ID)
+		}
+		targets = append(targets, t)
+	}
+	return targets, <-errc
+}
+
+// newPipeline builds the pipeline for a single run labelled with labels. A fresh
+// token and fresh sinks/observers are created per run; extra filters run after
+// the configured ones and skip the VMs they reject as filtered.
+func (a *app) newPipeline(ctx context.Context, runID string, labels map[string]string, extra ...vmFilter) (*pipeline, error) {
+	opts := a.opts
+	ctx = withRetries(withTenant(ctx, opts.tenant), opts.armRetries)
+	if a.fleet != "" {
+		labels = mergeLabels(labels, map[string]string{fleetLabel: a.fleet})
+	}
+
+	token, err := getAzureAccessToken(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Azure token: %w", err)
+	}
+
+	var filters []categorizedFilter
+	if len(opts.names) > 0 {
+		filters = append(filters, categorize(skipFiltered, nameFilter(opts.names, opts.nameFlags))...)
+	}
+	if len(opts.locations) > 0 {
+		filters = append(filters, categorize(skipFiltered, locationFilter(opts.locations))...)
+	}
+	if opts.inheritTags {
+		filters = append(filters, categorize(skipFiltered, inheritedTagsFilter)...)
+	}
+	if len(opts.excludeTags) > 0 {
+		filters = append(filters, categorize(skipFiltered, excludeTagFilter(opts.excludeTags))...)
+	}
+	if len(opts.tags) > 0 {
+		filters = append(filters, categorize(skipFiltered, tagFilter(opts.tags))...)
+	}
+	if a.plan != nil {
+		filters = append(filters, categorize(skipFiltered, a.plan.assign)...)
+	}
+	if a.oob != nil {
+		filters = append(filters, categorize(skipUnsupported, arcFilter(a.oob))...)
+	}
+	if opts.generalized != generalizedOff {
+		filters = append(filters, categorize(skipUnsupported, generalizedFilter(opts.generalized))...)
+	}
+	if !opts.force {
+		filters = append(filters, categorize(skipAlreadyInState, powerStateFilter(opts.action))...)
+	}
+	if opts.policyCheck {
+		filters = append(filters, categorize(skipPolicy, newPolicyCheck(ctx, token).filter)...)
+	}
+	filters = append(filters, categorize(skipFiltered, extra...)...)
+
+	var sinks []resultSink
+	var observers []runObserver
+	if opts.costReport {
+		report := newCostReport(token)
+		sinks = append(sinks, report)
+		observers = append(observers, report)
+	}
+	if opts.webhookURL != "" {
+		sinks = append(sinks, newWebhookSink(opts.webhookURL, os.Getenv("VMSTARTER_WEBHOOK_SECRET"), opts.webhookRetries, runID, labels))
+	}
+	closeSinks := func() {
+		for _, sink := range sinks {
+			sink.close()
+		}
+	}
+
+	if opts.serviceNowInstance != "" {
+		snow, err := newServiceNowObserver(opts.serviceNowInstance, opts.serviceNowTable, opts.serviceNowTemplate, opts.serviceNowRecord, a.messages)
+		if err != nil {
+			closeSinks()
+			return nil, err
+		}
+		observers = append(observers, snow)
+	}
+	if opts.jiraURL != "" {
+		jira, err := newJiraObserver(opts.jiraURL, opts.jiraProject, opts.jiraIssueType, opts.jiraIssue, opts.jiraTemplate, opts.jiraThreshold, a.messages)
+		if err != nil {
+			closeSinks()
+			return nil, err
+		}
+		observers = append(observers, jira)
+	}
+	if opts.grafanaURL != "" {
+		grafana, err := newGrafanaObserver(opts.grafanaURL, opts.grafanaDashboard, opts.grafanaTags, a.messages)
+		if err != nil {
+			closeSinks()
+			return nil, err
+		}
+		observers = append(observers, grafana)
+	}
+
+	if opts.heartbeatURL != "" {
+		observers = append(observers, newHeartbeat(opts.heartbeatURL))
+	}
+
+	var gates []planGate
+	if a.hooks != nil {
+		hooks := newRunHooks(a.hooks, runID, opts.action, labels)
+		sinks = append(sinks, hooks)
+		observers = append(observers, hooks)
+		if len(a.hooks.PreRun) > 0 {
+			gates = append(gates, hooks.gate)
+		}
+	}
+	if opts.approvalChannel != "" {
+		approval, err := newSlackApproval(os.Getenv("SLACK_BOT_TOKEN"), opts.approvalChannel, opts.approvalUsers, opts.approvalTimeout, a.messages)
+		if err != nil {
+			closeSinks()
+			return nil, err
+		}
+		gates = append(gates, approval.gate(runID, labels, opts.action))
+	}
+
+	p := &pipeline{
+		runID:      runID,
+		token:      token,
+		access:     newAccessGuard(token),
+		discoverer: a.newDiscoverer(token),
+		filters:    filters,
+		gates:      gates,
+		sinks:      sinks,
+		observers:  observers,
+		reporter:   a.reporter,
+		journal:    a.journal,
+		force:      opts.force,
+		action:     opts.action,
+		protected:  a.protected,
+		dedupe:     a.dedupe,
+		tagStarted: opts.tagStarted,
+		labels:     labels,
+		tenant:     opts.tenant,
+		retries:    opts.armRetries,
+		requester:  cliRequester(),
+	}
+	if !opts.force {
+		p.maxTargets = opts.maxVMs
+	}
+	if a.limits != nil {
+		// Not lifted by --force, only by --override-cap
+		p.runCap, p.overrideCap = a.limits.MaxVMsPerRun, opts.overrideCap
+		p.production, p.allowProduction = a.limits.production, opts.allowProd
+	}
+	if opts.operatorID != "" {
+		p.access = newOperatorGuard(opts.operatorID)
+	}
+	if opts.pimRole != "" {
+		// Last, so that nothing is activated for plans other gates reject
+		pim := &pimActivation{role: opts.pimRole, scope: opts.pimScope, duration: opts.pimDuration,
+			access: p.access, journal: a.journal, runID: runID, labels: labels}
+		p.gates = append(p.gates, pim.gate)
+	}
+	if opts.opaURL != "" {
+		p.policy = newOPAPolicy(opts.opaURL)
+	}
+	if opts.order == orderResourceGroup {
+		p.batcher = resourceGroupBatcher(a.meta, token, opts.groupPriorityTag)
+		p.parallelism = opts.groupParallelism
+	}
+	p.concurrency, p.subscriptionConcurrency = opts.concurrency, opts.subscriptionConcurrency
+	if opts.vmDeadline > 0 {
+		p.deadline = &startDeadline{deadline: opts.vmDeadline, escalation: opts.vmDeadlineEscalation, poll: deadlinePoll}
+	}
+	if opts.wait {
+		p.wait = &operationWait{interval: opts.waitInterval, timeout: opts.waitTimeout}
+	}
+	p.vmTimeout = opts.vmTimeout
+	p.instanceView = opts.instanceView()
+	p.viewWorkers = opts.instanceViewWorkers
+	p.viewCache = a.views
+	p.teamTag = opts.teamTag
+	if opts.inheritTags {
+		p.inherit = newTagInheritance(a.meta, token)
+	}
+	if opts.ppgBatching {
+		p.batcher = ppgBatcher(p.batcher)
+	}
+	var report *csvReport
+	if opts.reportCSV != "" {
+		// Opened while closeSinks still owns the sinks, which a dry run closes.
+		// Dry runs write it too, so that plans can be attached to change tickets.
+		if report, err = newCSVReport(opts.reportCSV, runID); err != nil {
+			closeSinks()
+			return nil, err
+		}
+	}
+	if opts.dryRun {
+		p.dry()
+		if opts.compareLast {
+			diff := newLastRunDiff(opts.journalPath)
+			p.sinks = append(p.sinks, diff)
+			p.observers = append(p.observers, diff)
+		}
+	} else if a.journal != nil {
+		p.sinks = append(p.sinks, newDecisionLog(a.journal, runID))
+	}
+	if report != nil {
+		p.sinks = append(p.sinks, report)
+	}
+	return p, nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Slack Web API endpoint and the reactions that approve or reject a plan
+const (
+	slackAPI        = "https://slack.com/api"
+	approveReaction = "white_check_mark"
+	rejectReaction  = "x"
+)
+
+// slackApproval posts the plan to a Slack channel and waits until an authorized
+// user reacts with :white_check_mark: (approve) or :x: (reject), or the timeout expires.
+// Reactions are polled, so no inbound endpoint is needed.
+type slackApproval struct {
+	botToken     string
+	channel      string
+	approvers    map[string]bool
+	timeout      time.Duration
+	pollInterval time.Duration
+	messages     messageCatalog
+}
+
+// slackResponse covers the fields used from chat.postMessage and reactions.get
+type slackResponse struct {
+	OK      bool   `json:"ok"`
+	Error   string `json:"error"`
+	Channel string `json:"channel"`
+	TS      string `json:"ts"`
+	Message struct {
+		Reactions []struct {
+			Name  string   `json:"name"`
+			Users []string `json:"users"`
+		} `json:"reactions"`
+	} `json:"message"`
+}
+
+// newSlackApproval builds the gate; approvers are Slack user IDs
+func newSlackApproval(botToken, channel string, approvers []string, timeout time.Duration, messages messageCatalog) (*slackApproval, error) {
+	if botToken == "" {
+		return nil, fmt.Errorf("SLACK_BOT_TOKEN must be set for Slack approval")
+	}
+	if len(approvers) == 0 {
+		return nil, fmt.Errorf("--approval-user is required for Slack approval")
+	}
+	a := &slackApproval{
+		botToken:     botToken,
+		channel:      channel,
+		approvers:    map[string]bool{},
+		timeout:      timeout,
+		pollInterval: 10 * time.Second,
+		messages:     messages,
+	}
+	for _, u := range approvers {
+		a.approvers[u] = true
+	}
+	return a, nil
+}
+
+// call invokes a Slack Web API method
+func (a *slackApproval) call(ctx context.Context, method, apiMethod string, query url.Values, payload interface{}) (*slackResponse, error) {
+	return slackCall(ctx, a.botToken, method, apiMethod, query, payload)
+}
+
+// slackCall invokes a Slack Web API method with a bot token
+func slackCall(ctx context.Context, botToken, method, apiMethod string, query url.Values, payload interface{}) (*slackResponse, error) {
+	var body []byte
+	if payload != nil {
+		var err error
+		if body, err = json.Marshal(payload); err != nil {
+			return nil, err
+		}
+	}
+	apiURL := slackAPI + "/" + apiMethod
+	if query != nil {
+		apiURL += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, apiURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+botToken)
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var out slackResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("failed to parse Slack JSON: %w", err)
+	}
+	if !out.OK {
+		return nil, fmt.Errorf("slack %s: %s", apiMethod, out.Error)
+	}
+	return &out, nil
+}
+
+// planText renders the target list with per-subscription counts
+func planText(targets []*vmTarget, defaultAction vmAction, messages messageCatalog) string {
+	perSub := map[string]int{}
+	for _, t := range targets {
+		perSub[t.SubscriptionID]++
+	}
+	subs := make([]string, 0, len(perSub))
+	for sub := range perSub {
+		subs = append(subs, sub)
+	}
+	sort.Strings(subs)
+
+	var b strings.Builder
+	b.WriteString(messages.format("plan.counts", len(targets), len(subs)) + "\n")
+	for _, sub := range subs {
+		fmt.Fprintf(&b, "  %s: %d\n", sub, perSub[sub])
+	}
+	for i, t := range targets {
+		if i == 50 {
+			b.WriteString("  " + messages.format("more", len(targets)-i) + "\n")
+			break
+		}
+		action := t.Action
+		if action == "" {
+			action = defaultAction
+		}
+		fmt.Fprintf(&b, "  %s %s/%s\n", action, t.ResourceGroup, t.Name)
+	}
+	return b.String()
+}
+
+// gate is a planGate that blocks until the plan is approved
+func (a *slackApproval) gate(runID string, labels map[string]string, defaultAction vmAction) planGate {
+	return func(ctx context.Context, targets []*vmTarget) error {
+		if len(targets) == 0 {
+			return nil
+		}
+		heading := a.messages.format("approval.heading", runID)
+		if len(labels) > 0 {
+			heading += "\n" + a.messages.format("approval.labels", strings.Join(labelPairs(labels, "="), ", "))
+		}
+		text := fmt.Sprintf("%s\n```%s```\n%s", heading, planText(targets, defaultAction, a.messages),
+			a.messages.format("approval.instructions", approveReaction, rejectReaction, a.timeout))
+		posted, err := a.call(ctx, http.MethodPost, "chat.postMessage", nil, map[string]string{"channel": a.channel, "text": text})
+		if err != nil {
+			return fmt.Errorf("failed to request approval: %w", err)
+		}
+		slog.Info("Waiting for approval in Slack", "channel", a.channel, "timeout", a.timeout)
+
+		deadline := time.Now().Add(a.timeout)
+		query := url.Values{"channel": {posted.Channel}, "timestamp": {posted.TS}}
+		for time.Now().Before(deadline) {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(a.pollInterval):
+			}
+			reactions, err := a.call(ctx, http.MethodGet, "reactions.get", query, nil)
+			if err != nil {
+				slog.Error("Failed to poll approval", "error", err)
+				continue
+			}
+			for _, r := range reactions.Message.Reactions {
+				for _, user := range r.Users {
+					if !a.approvers[user] {
+						continue
+					}
+					switch r.Name {
+					case approveReaction:
+						slog.Info("Plan approved", "user", user)
+						return nil
+					case rejectReaction:
+						return fmt.Errorf("plan rejected by %s", user)
+					}
+				}
+			}
+		}
+		return fmt.Errorf("approval timed out after %s", a.timeout)
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// errUnauthenticated is returned when a request carries no valid credentials
+var errUnauthenticated = errors.New("unauthenticated")
+
+// apiGrant allows a set of actions within a set of resource ID scopes,
+// optionally narrowed further to the VMs matched by a selector
+type apiGrant struct {
+	Actions  []string  `json:"actions"`
+	Scopes   []string  `json:"scopes"`
+	Selector *selector `json:"selector,omitempty"`
+}
+
+// principal is an authenticated API caller and everything it was granted
+type principal struct {
+	ID     string // AAD object ID or API key name
+	Name   string // UPN, application or API key name, for logs
+	Method string // how the caller authenticated
+	grants []apiGrant
+}
+
+// key identifies the principal for rate limiting and run ownership
+func (p *principal) key() string {
+	return p.Method + ":" + p.ID
+}
+
+// Run labels attributing the runs submitted through the API to their caller
+const (
+	requestedByLabel   = "requestedBy"   // UPN, application or API key name
+	requestedByIDLabel = "requestedById" // AAD object ID or API key name
+)
+
+// attribution returns the run labels naming the principal as the one who
+// requested a run, recorded with its audit records, notifications and tags
+func (p *principal) attribution() map[string]string {
+	labels := map[string]string{requestedByIDLabel: p.ID}
+	if p.Name != "" {
+		labels[requestedByLabel] = p.Name
+	}
+	return labels
+}
+
+// allows reports whether the principal may perform action on t.
+// Scopes match the resource ID itself or anything below it; "/" matches everything.
+func (p *principal) allows(action vmAction, t *vmTarget) bool {
+	id := strings.ToLower(t.ID)
+	for _, g := range p.grants {
+		if !containsFold(g.Actions, string(action)) {
+			continue
+		}
+		if g.Selector != nil && !g.Selector.matches(t) {
+			continue
+		}
+		for _, scope := range g.Scopes {
+			scope = strings.TrimSuffix(strings.ToLower(scope), "/")
+			if scope == "" || id == scope || strings.HasPrefix(id, scope+"/") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// canSee reports whether any grant of the principal covers t
+func (p *principal) canSee(t *vmTarget) bool {
+	for _, g := range p.grants {
+		for _, action := range g.Actions {
+			if p.allows(vmAction(action), t) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// mayPerform reports whether the principal holds any grant for action
+func (p *principal) mayPerform(action vmAction) bool {
+	for _, g := range p.grants {
+		if containsFold(g.Actions, string(action)) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(values []string, v string) bool {
+	for _, candidate := range values {
+		if strings.EqualFold(candidate, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticator identifies the caller of an API request
+type authenticator interface {
+	authenticate(r *http.Request) (*principal, error)
+}
+
+// apiKeyHeader carries static API keys
+const apiKeyHeader = "X-API-Key"
+
+// apiKey is a static key entry of the API keys file. Either the key itself or
+// its hex SHA-256 digest may be configured; digests keep the file free of secrets.
+type apiKey struct {
+	Name   string `json:"name"`
+	Key    string `json:"key,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	apiGrant
+}
+
+// apiKeyAuthenticator authenticates requests carrying a configured API key
+type apiKeyAuthenticator struct {
+	keys []apiKey
+}
+
+// loadAPIKeys reads and validates the API keys file
+func loadAPIKeys(path string) (*apiKeyAuthenticator, error) {
+	data, err := readConfigFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read API keys: %w", err)
+	}
+	var file struct {
+		Keys []apiKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse API keys: %w", err)
+	}
+	for i, k := range file.Keys {
+		if k.Name == "" {
+			return nil, fmt.Errorf("API key %d has no name", i+1)
+		}
+		if k.Key != "" {
+			sum := sha256.Sum256([]byte(k.Key))
+			file.Keys[i].SHA256 = hex.EncodeToString(sum[:])
+			file.Keys[i].Key = ""
+		}
+		if file.Keys[i].SHA256 == "" {
+			return nil, fmt.Errorf("API key %q has neither key nor sha256", k.Name)
+		}
+	}
+	return &apiKeyAuthenticator{keys: file.Keys}, nil
+}
+
+func (a *apiKeyAuthenticator) authenticate(r *http.Request) (*principal, error) {
+	presented := r.Header.Get(apiKeyHeader)
+	if presented == "" {
+		return nil, errUnauthenticated
+	}
+	sum := sha256.Sum256([]byte(presented))
+	digest := hex.EncodeToString(sum[:])
+	for _, k := range a.keys {
+		if subtle.ConstantTimeCompare([]byte(digest), []byte(strings.ToLower(k.SHA256))) == 1 {
+			return &principal{ID: k.Name, Name: k.Name, Method: "apikey", grants: []apiGrant{k.apiGrant}}, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: unknown API key", errUnauthenticated)
+}
+
+// chainAuthenticator uses API key authentication for requests carrying a key and
+// bearer token authentication otherwise; either may be nil
+type chainAuthenticator struct {
+	keys *apiKeyAuthenticator
+	aad  *aadAuthenticator
+}
+
+func (c *chainAuthenticator) authenticate(r *http.Request) (*principal, error) {
+	if r.Header.Get(apiKeyHeader) != "" && c.keys != nil {
+		return c.keys.authenticate(r)
+	}
+	if c.aad != nil {
+		return c.aad.authenticate(r)
+	}
+	return nil, errUnauthenticated
+}
+
+// loadRoleGrants reads the app role → grant mapping file
+func loadRoleGrants(path string) (map[string]apiGrant, error) {
+	data, err := readConfigFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read API roles: %w", err)
+	}
+	var grants map[string]apiGrant
+	if err := json.Unmarshal(data, &grants); err != nil {
+		return nil, fmt.Errorf("failed to parse API roles: %w", err)
+	}
+	return grants, nil
+}
+
+// aadAuthenticator validates Azure AD bearer tokens issued for audience in tenantID
+// and maps the app roles they carry to grants
+type aadAuthenticator struct {
+	tenantID string
+	audience string
+	roles    map[string]apiGrant
+
+	mu      sync.Mutex
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+}
+
+func newAADAuthenticator(tenantID, audience string, roles map[string]apiGrant) *aadAuthenticator {
+	return &aadAuthenticator{tenantID: tenantID, audience: audience, roles: roles}
+}
+
+// key returns the signing key with the given ID, refreshing the key set at most once a minute
+func (a *aadAuthenticator) key(kid string) (*rsa.PublicKey, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if key, ok := a.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(a.fetched) < time.Minute {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	a.fetched = time.Now()
+
+	jwksURL := fmt.Sprintf("https://login.microsoftonline.com/%s/discovery/v2.0/keys", a.tenantID)
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(jwksURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch signing keys: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch signing keys: unexpected status: %d", resp.StatusCode)
+	}
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return nil, fmt.Errorf("failed to parse signing keys: %w", err)
+	}
+	a.keys = map[string]*rsa.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil {
+			continue
+		}
+		a.keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	if key, ok := a.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func (a *aadAuthenticator) authenticate(r *http.Request) (*principal, error) {
+	raw, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil, errUnauthenticated
+	}
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return a.key(kid)
+	}, jwt.WithValidMethods([]string{"RS256"}), jwt.WithAudience(a.audience), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errUnauthenticated, err)
+	}
+
+	// v1 and v2 tokens use different issuers for the same tenant
+	iss, _ := claims["iss"].(string)
+	if iss != fmt.Sprintf("https://login.microsoftonline.com/%s/v2.0", a.tenantID) &&
+		iss != fmt.Sprintf("https://sts.windows.net/%s/", a.tenantID) {
+		return nil, fmt.Errorf("%w: unexpected issuer %q", errUnauthenticated, iss)
+	}
+
+	// The object ID keys rate limits and run ownership: a token
+	// without one would share them with every other such token
+	p := &principal{Method: "aad"}
+	if p.ID, _ = claims["oid"].(string); p.ID == "" {
+		return nil, fmt.Errorf("%w: the token has no oid claim", errUnauthenticated)
+	}
+	for _, claim := range []string{"upn", "preferred_username", "app_displayname", "appid"} {
+		if name, ok := claims[claim].(string); ok && name != "" {
+			p.Name = name
+			break
+		}
+	}
+	roles, _ := claims["roles"].([]interface{})
+	for _, role := range roles {
+		name, _ := role.(string)
+		if grant, ok := a.roles[name]; ok {
+			p.grants = append(p.grants, grant)
+		}
+	}
+	return p, nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+)
+
+// API version constants
+const (
+	subscriptionAPI = "2022-12-01"
+	vmAPI           = "2025-04-01"
+	resourcesAPI    = "2021-04-01"
+	azureResource   = "https://management.azure.com/.default"
+	armEndpoint     = "https://management.azure.com"
+)
+
+// SubscriptionListResponse represents the Azure subscriptions API response
+type SubscriptionListResponse struct {
+	Value    []subscriptionEntry `json:"value"`
+	NextLink string              `json:"nextLink,omitempty"`
+}
+
+// subscriptionEntry is a subscription of a SubscriptionListResponse
+type subscriptionEntry struct {
+	SubscriptionID string            `json:"subscriptionId"`
+	DisplayName    string            `json:"displayName"`
+	Tags           map[string]string `json:"tags"`
+}
+
+// VirtualMachineListResponse represents the Azure VMs API response
+type VirtualMachineListResponse struct {
+	Value []struct {
+		ID       string            `json:"id"`
+		Name     string            `json:"name"`
+		Location string            `json:"location"`
+		Tags     map[string]string `json:"tags"`
+
+		// Properties are only returned by the Compute list API, not the resources API
+		Properties struct {
+			HardwareProfile struct {
+				VMSize string `json:"vmSize"`
+			} `json:"hardwareProfile"`
+			ProximityPlacementGroup *struct {
+				ID string `json:"id"`
+			} `json:"proximityPlacementGroup"`
+		} `json:"properties"`
+	} `json:"value"`
+	NextLink string `json:"nextLink"`
+}
+
+type tenantKey struct{}
+
+// withTenant makes tokens acquired with ctx be issued by tenant instead of the
+// credential's default tenant; an empty tenant keeps the default
+func withTenant(ctx context.Context, tenant string) context.Context {
+	if tenant == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+type identityKey struct{}
+
+// withIdentity makes tokens acquired with ctx be issued to the identity with
+// clientID instead of the default credential; an empty clientID keeps the default
+func withIdentity(ctx context.Context, clientID string) context.Context {
+	if clientID == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, identityKey{}, clientID)
+}
+
+// identityCredential returns the credential of the identity with clientID: an
+// app registration when VMSTARTER_OPERATOR_CLIENT_SECRET is set, a workload
+// identity when AZURE_FEDERATED_TOKEN_FILE is, and a user-assigned managed
+// identity otherwise
+func identityCredential(clientID, tenant string) (azcore.TokenCredential, error) {
+	if tenant == "" {
+		tenant = os.Getenv("AZURE_TENANT_ID")
+	}
+	if secret := os.Getenv("VMSTARTER_OPERATOR_CLIENT_SECRET"); secret != "" {
+		if tenant == "" {
+			return nil, fmt.Errorf("--tenant or AZURE_TENANT_ID is required with VMSTARTER_OPERATOR_CLIENT_SECRET")
+		}
+		return azidentity.NewClientSecretCredential(tenant, clientID, secret, nil)
+	}
+	if os.Getenv("AZURE_FEDERATED_TOKEN_FILE") != "" {
+		return azidentity.NewWorkloadIdentityCredential(&azidentity.WorkloadIdentityCredentialOptions{ClientID: clientID, TenantID: tenant})
+	}
+	return azidentity.NewManagedIdentityCredential(&azidentity.ManagedIdentityCredentialOptions{ID: azidentity.ClientID(clientID)})
+}
+
+// getAzureAccessToken obtains a Bearer token using azidentity (managed identity/environment/interactive)
+func getAzureAccessToken(ctx context.Context) (string, error) {
+	return getAccessToken(ctx, azureResource)
+}
+
+// getAccessToken obtains a Bearer token for scope with the credential selected by ctx
+func getAccessToken(ctx context.Context, scope string) (string, error) {
+	credOpts := &azidentity.DefaultAzureCredentialOptions{}
+	tokenOpts := policy.TokenRequestOptions{Scopes: []string{scope}}
+	if tenant, ok := ctx.Value(tenantKey{}).(string); ok {
+		// Multi-tenant app registrations authenticate in the other tenant
+		// directly; managed identities cannot leave their own tenant
+		credOpts.TenantID = tenant
+		credOpts.AdditionallyAllowedTenants = []string{tenant}
+		tokenOpts.TenantID = tenant
+	}
+	var cred azcore.TokenCredential
+	var err error
+	if clientID, ok := ctx.Value(identityKey{}).(string); ok {
+		cred, err = identityCredential(clientID, credOpts.TenantID)
+	} else {
+		cred, err = azidentity.NewDefaultAzureCredential(credOpts)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to create credential: %w", err)
+	}
+	token, err := cred.GetToken(ctx, tokenOpts)
+	if err != nil {
+		return "", fmt.Errorf("failed to get token: %w", err)
+	}
+	return token.Token, nil
+}
+
+// sendRequest sends HTTP requests with Bearer token, retrying throttled and
+// transiently failed ones (see sendWithRetries)
+func sendRequest(ctx context.Context, method, url, token string, body []byte) (*http.Response, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	return sendWithRetries(ctx, method, url, func() (*http.Response, error) {
+		var reader io.Reader
+		if body != nil {
+			reader = bytes.NewReader(body)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, url, reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+		if id := correlationID(ctx); id != "" {
+			req.Header.Set(correlationHeader, id)
+		}
+		began := time.Now()
+		resp, err := client.Do(req)
+		if err != nil {
+			slog.Debug("Azure request failed", "method", method, "url", url, "error", err,
+				"duration", time.Since(began).Round(time.Millisecond))
+			return nil, err
+		}
+		slog.Debug("Azure request", "method", method, "url", url, "status", resp.StatusCode,
+			"correlationId", resp.Header.Get(correlationHeader), "requestId", resp.Header.Get("x-ms-request-id"),
+			"duration", time.Since(began).Round(time.Millisecond))
+		return resp, nil
+	})
+}
+
+// getJSON sends a GET request and decodes a 200 OK response into out
+func getJSON(ctx context.Context, url, token string, out interface{}) error {
+	resp, err := sendRequest(ctx, http.MethodGet, url, token, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to parse JSON: %w", err)
+	}
+	return nil
+}
+
+// listSubscriptions lists every subscription visible to the token, following
+// nextLink through all pages
+func listSubscriptions(ctx context.Context, token string) (*SubscriptionListResponse, error) {
+	next := fmt.Sprintf("%s/subscriptions?api-version=%s", armEndpoint, subscriptionAPI)
+	all := &SubscriptionListResponse{}
+	for next != "" {
+		var page SubscriptionListResponse
+		if err := getJSON(ctx, next, token, &page); err != nil {
+			return nil, err
+		}
+		all.Value = append(all.Value, page.Value...)
+		next = page.NextLink
+	}
+	return all, nil
+}
+
+// resourceGroupExists checks whether the subscription has the resource group
+func resourceGroupExists(ctx context.Context, token, subscriptionID, resourceGroup string) (bool, error) {
+	rgURL := fmt.Sprintf("%s/subscriptions/%s/resourceGroups/%s?api-version=%s",
+		armEndpoint, subscriptionID, resourceGroup, resourcesAPI)
+	resp, err := sendRequest(ctx, http.MethodHead, rgURL, token, nil)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNoContent, http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("unexpected status: %d", resp.StatusCode)
+}
+
+// parseResourceGroup extracts the resource group from a resource ID
+// Example resource ID: /subscriptions/{sid}/resourceGroups/{rg}/providers/...
+func parseResourceGroup(resourceID string) string {
+	rgMarker := "/resourceGroups/"
+	rgIdx := strings.Index(resourceID, rgMarker)
+	if rgIdx == -1 {
+		return ""
+	}
+	sub := resourceID[rgIdx+len(rgMarker):]
+	endIdx := strings.Index(sub, "/")
+	if endIdx == -1 {
+		return sub
+	}
+	return sub[:endIdx]
+}
@@ -0,0 +1,269 @@
+// Package client starts and stops Azure virtual machines through the ARM REST
+// API. It is the library counterpart of the vmstarter command for tools that want
+// to drive VMs directly, such as infrastructure-as-code providers and operators.
+//
+//	cred, _ := azidentity.NewDefaultAzureCredential(nil)
+//	c := client.New(cred, client.WithPollInterval(10*time.Second))
+//	err := c.StartAndWait(ctx, "/subscriptions/<id>/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm")
+//
+// Every method takes a context and stops when it is canceled. A pending
+// operation can be handed to another process with Poller.ResumeToken and
+// Client.ResumePoller.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+)
+
+// API versions used by the client
+const (
+	subscriptionAPI = "2022-12-01"
+	vmAPI           = "2025-04-01"
+)
+
+// DefaultEndpoint is the Azure public cloud Resource Manager endpoint
+const DefaultEndpoint = "https://management.azure.com"
+
+// Client performs VM operations with a token credential. It is safe for concurrent use.
+type Client struct {
+	cred         azcore.TokenCredential
+	endpoint     string
+	scope        string
+	httpClient   *http.Client
+	pollInterval time.Duration
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithEndpoint sets the Resource Manager endpoint, e.g. for sovereign clouds
+func WithEndpoint(endpoint string) Option {
+	return func(c *Client) {
+		c.endpoint = strings.TrimRight(endpoint, "/")
+		c.scope = c.endpoint + "/.default"
+	}
+}
+
+// WithHTTPClient sets the HTTP client used for every request
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) { c.httpClient = httpClient }
+}
+
+// WithPollInterval sets how often long-running operations are polled when the
+// service does not ask for a specific interval (default 5s)
+func WithPollInterval(d time.Duration) Option {
+	return func(c *Client) { c.pollInterval = d }
+}
+
+// New returns a client authenticating with cred
+func New(cred azcore.TokenCredential, opts ...Option) *Client {
+	c := &Client{
+		cred:         cred,
+		endpoint:     DefaultEndpoint,
+		scope:        DefaultEndpoint + "/.default",
+		httpClient:   &http.Client{Timeout: 30 * time.Second},
+		pollInterval: 5 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// VM is a virtual machine returned by ListVMs
+type VM struct {
+	ID             string
+	SubscriptionID string
+	ResourceGroup  string
+	Name           string
+	Location       string
+	Tags           map[string]string
+}
+
+// ResponseError is returned when Resource Manager answers with an unexpected status
+type ResponseError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *ResponseError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("unexpected status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("unexpected status %d: %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// do sends an authenticated request to url, which may be relative to the endpoint
+func (c *Client) do(ctx context.Context, method, url string, body []byte) (*http.Response, error) {
+	token, err := c.cred.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{c.scope}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get token: %w", err)
+	}
+	if strings.HasPrefix(url, "/") {
+		url = c.endpoint + url
+	}
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token.Token)
+	req.Header.Set("Content-Type", "application/json")
+	return c.httpClient.Do(req)
+}
+
+// getJSON decodes a 200 OK response to a GET of url into out
+func (c *Client) getJSON(ctx context.Context, url string, out interface{}) error {
+	resp, err := c.do(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to parse JSON: %w", err)
+	}
+	return nil
+}
+
+// responseError builds a ResponseError from an ARM error body, if there is one
+func responseError(resp *http.Response) error {
+	var body struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&body)
+	return &ResponseError{StatusCode: resp.StatusCode, Code: body.Error.Code, Message: body.Error.Message}
+}
+
+// ListSubscriptions returns the IDs of every subscription visible to the credential
+func (c *Client) ListSubscriptions(ctx context.Context) ([]string, error) {
+	var ids []string
+	next := fmt.Sprintf("/subscriptions?api-version=%s", subscriptionAPI)
+	for next != "" {
+		var page struct {
+			Value []struct {
+				SubscriptionID string `json:"subscriptionId"`
+			} `json:"value"`
+			NextLink string `json:"nextLink"`
+		}
+		if err := c.getJSON(ctx, next, &page); err != nil {
+			return nil, fmt.Errorf("failed to list subscriptions: %w", err)
+		}
+		for _, sub := range page.Value {
+			ids = append(ids, sub.SubscriptionID)
+		}
+		next = page.NextLink
+	}
+	return ids, nil
+}
+
+// ListVMs returns every VM in a subscription
+func (c *Client) ListVMs(ctx context.Context, subscriptionID string) ([]VM, error) {
+	var vms []VM
+	next := fmt.Sprintf("/subscriptions/%s/providers/Microsoft.Compute/virtualMachines?api-version=%s", subscriptionID, vmAPI)
+	for next != "" {
+		var page struct {
+			Value []struct {
+				ID       string            `json:"id"`
+				Name     string            `json:"name"`
+				Location string            `json:"location"`
+				Tags     map[string]string `json:"tags"`
+			} `json:"value"`
+			NextLink string `json:"nextLink"`
+		}
+		if err := c.getJSON(ctx, next, &page); err != nil {
+			return nil, fmt.Errorf("failed to list VMs of %s: %w", subscriptionID, err)
+		}
+		for _, v := range page.Value {
+			vms = append(vms, VM{
+				ID:             v.ID,
+				SubscriptionID: subscriptionID,
+				ResourceGroup:  segment(v.ID, "resourceGroups"),
+				Name:           v.Name,
+				Location:       v.Location,
+				Tags:           v.Tags,
+			})
+		}
+		next = page.NextLink
+	}
+	return vms, nil
+}
+
+// segment returns the value following key in a resource ID, matching key case-insensitively
+func segment(resourceID, key string) string {
+	parts := strings.Split(resourceID, "/")
+	for i := 0; i+1 < len(parts); i++ {
+		if strings.EqualFold(parts[i], key) {
+			return parts[i+1]
+		}
+	}
+	return ""
+}
+
+// Start begins starting the VM with the given resource ID
+func (c *Client) Start(ctx context.Context, vmID string) (*Poller, error) {
+	return c.begin(ctx, vmID, "start")
+}
+
+// Stop begins deallocating the VM with the given resource ID, which stops it
+// and releases its compute resources so it is no longer billed
+func (c *Client) Stop(ctx context.Context, vmID string) (*Poller, error) {
+	return c.begin(ctx, vmID, "deallocate")
+}
+
+// StartAndWait starts the VM and waits until the operation completes
+func (c *Client) StartAndWait(ctx context.Context, vmID string) error {
+	p, err := c.Start(ctx, vmID)
+	if err != nil {
+		return err
+	}
+	return p.Wait(ctx)
+}
+
+// StopAndWait deallocates the VM and waits until the operation completes
+func (c *Client) StopAndWait(ctx context.Context, vmID string) error {
+	p, err := c.Stop(ctx, vmID)
+	if err != nil {
+		return err
+	}
+	return p.Wait(ctx)
+}
+
+// begin posts action to the VM and returns a poller for the operation it started
+func (c *Client) begin(ctx context.Context, vmID, action string) (*Poller, error) {
+	if segment(vmID, "virtualMachines") == "" {
+		return nil, fmt.Errorf("invalid VM resource ID %q", vmID)
+	}
+	url := fmt.Sprintf("%s/%s?api-version=%s", strings.TrimRight(vmID, "/"), action, vmAPI)
+	resp, err := c.do(ctx, http.MethodPost, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to %s VM: %w", action, err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return &Poller{client: c, vmID: vmID, action: action, done: true}, nil
+	case http.StatusAccepted:
+		return newPoller(c, vmID, action, resp), nil
+	}
+	return nil, fmt.Errorf("failed to %s VM: %w", action, responseError(resp))
+}
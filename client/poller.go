@@ -0,0 +1,278 @@
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Poller tracks a long-running VM operation until it completes. It is safe for
+// concurrent use, and can be handed to another process with ResumeToken.
+type Poller struct {
+	client    *Client
+	vmID      string
+	action    string
+	statusURL string // Azure-AsyncOperation URL, empty when only Location is known
+	location  string
+
+	mu    sync.Mutex
+	retry time.Duration // interval requested by the service, 0 for the default
+	done  bool
+	err   error
+}
+
+// ErrOperationFailed is wrapped by the error of an operation that failed or was canceled
+var ErrOperationFailed = errors.New("operation failed")
+
+// ErrInvalidResumeToken is wrapped by the error of ResumePoller for tokens it cannot resume
+var ErrInvalidResumeToken = errors.New("invalid resume token")
+
+// resumeTokenType identifies the resume tokens of this package, version 1
+const resumeTokenType = "vmstarter.client/vm-operation/v1"
+
+// resumeToken is the state of a pending poller, serialized by ResumeToken
+type resumeToken struct {
+	Type      string `json:"type"`
+	VMID      string `json:"vmId"`
+	Action    string `json:"action"`
+	StatusURL string `json:"statusUrl,omitempty"`
+	Location  string `json:"location,omitempty"`
+}
+
+func newPoller(c *Client, vmID, action string, resp *http.Response) *Poller {
+	return &Poller{
+		client:    c,
+		vmID:      vmID,
+		action:    action,
+		statusURL: resp.Header.Get("Azure-AsyncOperation"),
+		location:  resp.Header.Get("Location"),
+		retry:     retryAfter(resp),
+	}
+}
+
+// ResumeToken returns an opaque token from which ResumePoller, in this or
+// another process, continues polling the operation. Operations that are
+// already done have no token.
+func (p *Poller) ResumeToken() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.done {
+		return "", errors.New("the operation is done and cannot be resumed")
+	}
+	data, err := json.Marshal(resumeToken{Type: resumeTokenType, VMID: p.vmID, Action: p.action, StatusURL: p.statusURL, Location: p.location})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// ResumePoller returns a poller for the operation of a token returned by
+// Poller.ResumeToken. The operation URLs of the token must be on the endpoint
+// of c, so that a forged token cannot send credentials elsewhere.
+func (c *Client) ResumePoller(token string) (*Poller, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidResumeToken, err)
+	}
+	var t resumeToken
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidResumeToken, err)
+	}
+	if t.Type != resumeTokenType {
+		return nil, fmt.Errorf("%w: unsupported type %q", ErrInvalidResumeToken, t.Type)
+	}
+	if t.StatusURL == "" && t.Location == "" {
+		return nil, fmt.Errorf("%w: no operation URL", ErrInvalidResumeToken)
+	}
+	for _, u := range []string{t.StatusURL, t.Location} {
+		if u != "" && !c.onEndpoint(u) {
+			return nil, fmt.Errorf("%w: operation URL %s is not on %s", ErrInvalidResumeToken, u, c.endpoint)
+		}
+	}
+	return &Poller{client: c, vmID: t.VMID, action: t.Action, statusURL: t.StatusURL, location: t.Location}, nil
+}
+
+// onEndpoint reports whether rawURL has the scheme and host of the endpoint of c
+func (c *Client) onEndpoint(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	endpoint, err := url.Parse(c.endpoint)
+	return err == nil && strings.EqualFold(u.Scheme, endpoint.Scheme) && strings.EqualFold(u.Host, endpoint.Host)
+}
+
+// VMID returns the resource ID of the VM the operation acts on
+func (p *Poller) VMID() string {
+	return p.vmID
+}
+
+// Action returns the VM action that started the operation, e.g. start or deallocate
+func (p *Poller) Action() string {
+	return p.action
+}
+
+// retryAfter returns the polling interval requested by a response, if any
+func retryAfter(resp *http.Response) time.Duration {
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// Done reports whether the operation has completed, successfully or not
+func (p *Poller) Done() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.done
+}
+
+// Poll checks the operation status once and updates Done. It returns an error
+// wrapping ErrOperationFailed when the operation completed unsuccessfully, and
+// other errors when the status could not be read; polling may then be retried.
+func (p *Poller) Poll(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.done {
+		return p.err
+	}
+	if p.statusURL == "" && p.location == "" {
+		// Nothing to poll: the service accepted the request without tracking it
+		p.done = true
+		return nil
+	}
+	if p.statusURL != "" {
+		return p.pollAsyncOperation(ctx)
+	}
+	return p.pollLocation(ctx)
+}
+
+// pollAsyncOperation reads the operation status resource
+func (p *Poller) pollAsyncOperation(ctx context.Context) error {
+	resp, err := p.client.do(ctx, http.MethodGet, p.statusURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to poll operation: %w", err)
+	}
+	defer resp.Body.Close()
+	if d := retryAfter(resp); d > 0 {
+		p.retry = d
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to poll operation: %w", responseError(resp))
+	}
+	var status struct {
+		Status string `json:"status"`
+		Error  struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return fmt.Errorf("failed to parse operation status: %w", err)
+	}
+	switch strings.ToLower(status.Status) {
+	case "succeeded":
+		p.done = true
+	case "canceled":
+		p.done = true
+		p.err = fmt.Errorf("%w: canceled", ErrOperationFailed)
+	case "failed":
+		p.done = true
+		p.err = fmt.Errorf("%w: %s: %s", ErrOperationFailed, status.Error.Code, status.Error.Message)
+	}
+	return p.err
+}
+
+// pollLocation follows the Location header, which answers 202 until the operation is over
+func (p *Poller) pollLocation(ctx context.Context) error {
+	resp, err := p.client.do(ctx, http.MethodGet, p.location, nil)
+	if err != nil {
+		return fmt.Errorf("failed to poll operation: %w", err)
+	}
+	defer resp.Body.Close()
+	if d := retryAfter(resp); d > 0 {
+		p.retry = d
+	}
+	switch resp.StatusCode {
+	case http.StatusAccepted:
+		return nil
+	case http.StatusOK, http.StatusNoContent:
+		p.done = true
+		return nil
+	}
+	if transientStatus(resp.StatusCode) {
+		// The operation may still be running: only the status is not known
+		return fmt.Errorf("failed to poll operation: %w", responseError(resp))
+	}
+	p.done = true
+	p.err = fmt.Errorf("%w: %w", ErrOperationFailed, responseError(resp))
+	return p.err
+}
+
+// Wait polls until the operation completes or ctx is canceled and returns its
+// outcome. Polls failing on network errors, throttling or server errors are
+// retried, at the interval requested by the service or backing off from the
+// poll interval; other errors end the wait.
+func (p *Poller) Wait(ctx context.Context) error {
+	failures := 0
+	for {
+		err := p.Poll(ctx)
+		if p.Done() {
+			return err
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if !transient(err) {
+				return err
+			}
+			failures++
+		} else {
+			failures = 0
+		}
+		p.mu.Lock()
+		interval := p.retry
+		p.mu.Unlock()
+		if interval <= 0 {
+			interval = p.client.pollInterval
+			for i := 1; i < failures && interval < maxPollBackoff; i++ {
+				interval *= 2
+			}
+			interval = min(interval, maxPollBackoff)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// maxPollBackoff bounds the wait between polls retried after failures
+const maxPollBackoff = time.Minute
+
+// transient reports whether a poll failed in a way that a later poll may not:
+// a network error, throttling or a server error
+func transient(err error) bool {
+	var respErr *ResponseError
+	if errors.As(err, &respErr) {
+		return transientStatus(respErr.StatusCode)
+	}
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
+
+// transientStatus reports whether a response status is worth retrying
+func transientStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+}
@@ -0,0 +1,162 @@
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+)
+
+const testVMID = "/subscriptions/sub1/resourceGroups/rg-a/providers/Microsoft.Compute/virtualMachines/web-1"
+
+func TestResumeTokenRoundTrip(t *testing.T) {
+	c := New(nil)
+	tests := []struct {
+		name      string
+		statusURL string
+		location  string
+	}{
+		{"async operation", "https://management.azure.com/subscriptions/sub1/providers/Microsoft.Compute/locations/westeurope/operations/op1?api-version=2025-04-01", ""},
+		{"location only", "", "https://management.azure.com/subscriptions/sub1/providers/Microsoft.Compute/locations/westeurope/operationResults/op1?api-version=2025-04-01"},
+		{"both", "https://management.azure.com/operations/op1", "https://MANAGEMENT.azure.com/operationResults/op1"},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{Header: http.Header{}}
+		resp.Header.Set("Azure-AsyncOperation", tt.statusURL)
+		resp.Header.Set("Location", tt.location)
+		token, err := newPoller(c, testVMID, "start", resp).ResumeToken()
+		if err != nil {
+			t.Errorf("%s: ResumeToken: %v", tt.name, err)
+			continue
+		}
+		p, err := c.ResumePoller(token)
+		if err != nil {
+			t.Errorf("%s: ResumePoller: %v", tt.name, err)
+			continue
+		}
+		if p.VMID() != testVMID || p.Action() != "start" || p.statusURL != tt.statusURL || p.location != tt.location || p.Done() {
+			t.Errorf("%s: resumed %s %s %q %q done=%v", tt.name, p.VMID(), p.Action(), p.statusURL, p.location, p.Done())
+		}
+	}
+}
+
+func TestResumeTokenOfDoneOperation(t *testing.T) {
+	p := &Poller{client: New(nil), vmID: testVMID, action: "start", done: true}
+	if token, err := p.ResumeToken(); err == nil {
+		t.Errorf("ResumeToken of a done operation = %q, want an error", token)
+	}
+}
+
+func TestResumePollerInvalid(t *testing.T) {
+	encode := func(s string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(s))
+	}
+	tests := []struct {
+		name   string
+		client *Client
+		token  string
+	}{
+		{"not base64", New(nil), "!!!"},
+		{"not JSON", New(nil), encode("start")},
+		{"other type", New(nil), encode(`{"type":"other/v2","vmId":"vm","action":"start","statusUrl":"https://management.azure.com/op"}`)},
+		{"no operation URL", New(nil), encode(`{"type":"` + resumeTokenType + `","vmId":"vm","action":"start"}`)},
+		{"foreign host", New(nil), encode(`{"type":"` + resumeTokenType + `","vmId":"vm","action":"start","statusUrl":"https://attacker.example/op"}`)},
+		{"foreign location", New(nil), encode(`{"type":"` + resumeTokenType + `","vmId":"vm","action":"start","statusUrl":"https://management.azure.com/op","location":"https://attacker.example/op"}`)},
+		{"plain HTTP", New(nil), encode(`{"type":"` + resumeTokenType + `","vmId":"vm","action":"start","location":"http://management.azure.com/op"}`)},
+		{"other cloud", New(nil, WithEndpoint("https://management.usgovcloudapi.net/")), encode(`{"type":"` + resumeTokenType + `","vmId":"vm","action":"start","location":"https://management.azure.com/op"}`)},
+	}
+	for _, tt := range tests {
+		if _, err := tt.client.ResumePoller(tt.token); !errors.Is(err, ErrInvalidResumeToken) {
+			t.Errorf("%s: ResumePoller error = %v, want ErrInvalidResumeToken", tt.name, err)
+		}
+	}
+}
+
+// staticToken is a credential handing out a fixed token
+type staticToken struct{}
+
+func (staticToken) GetToken(context.Context, policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	return azcore.AccessToken{Token: "token", ExpiresOn: time.Now().Add(time.Hour)}, nil
+}
+
+func TestPollerWait(t *testing.T) {
+	type reply struct {
+		status int
+		body   string
+	}
+	running := reply{http.StatusOK, `{"status":"InProgress"}`}
+	succeeded := reply{http.StatusOK, `{"status":"Succeeded"}`}
+	failed := reply{http.StatusOK, `{"status":"Failed","error":{"code":"AllocationFailed","message":"no capacity"}}`}
+	tests := []struct {
+		name     string
+		location bool // poll the Location URL instead of the Azure-AsyncOperation one
+		replies  []reply
+		wantErr  error // nil for success
+		polls    int
+	}{
+		{"succeeds", false, []reply{running, succeeded}, nil, 2},
+		{"fails", false, []reply{running, failed}, ErrOperationFailed, 2},
+		{"retries server errors", false, []reply{{http.StatusServiceUnavailable, ""}, {http.StatusInternalServerError, ""}, succeeded}, nil, 3},
+		{"retries throttling", false, []reply{{http.StatusTooManyRequests, ""}, succeeded}, nil, 2},
+		{"gives up on client errors", false, []reply{running, {http.StatusNotFound, `{"error":{"code":"NotFound"}}`}, succeeded}, &ResponseError{}, 2},
+		{"location succeeds", true, []reply{{http.StatusAccepted, ""}, {http.StatusOK, ""}}, nil, 2},
+		{"location retries server errors", true, []reply{{http.StatusBadGateway, ""}, {http.StatusAccepted, ""}, {http.StatusNoContent, ""}}, nil, 3},
+		{"location fails", true, []reply{{http.StatusAccepted, ""}, {http.StatusConflict, ""}}, ErrOperationFailed, 2},
+	}
+	for _, tt := range tests {
+		var polls atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := int(polls.Add(1))
+			r2 := tt.replies[min(n, len(tt.replies))-1]
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(r2.status)
+			fmt.Fprint(w, r2.body)
+		}))
+		c := New(staticToken{}, WithEndpoint(srv.URL), WithHTTPClient(srv.Client()), WithPollInterval(time.Millisecond))
+		p := &Poller{client: c, vmID: testVMID, action: "start"}
+		if tt.location {
+			p.location = srv.URL + "/operationResults/op1"
+		} else {
+			p.statusURL = srv.URL + "/operations/op1"
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := p.Wait(ctx)
+		cancel()
+		srv.Close()
+
+		var respErr *ResponseError
+		switch {
+		case tt.wantErr == nil && err != nil:
+			t.Errorf("%s: Wait = %v, want success", tt.name, err)
+		case errors.As(tt.wantErr, &respErr) && !errors.As(err, &respErr):
+			t.Errorf("%s: Wait = %v, want a ResponseError", tt.name, err)
+		case tt.wantErr == ErrOperationFailed && !errors.Is(err, ErrOperationFailed):
+			t.Errorf("%s: Wait = %v, want ErrOperationFailed", tt.name, err)
+		}
+		if got := int(polls.Load()); got != tt.polls {
+			t.Errorf("%s: %d polls, want %d", tt.name, got, tt.polls)
+		}
+	}
+}
+
+func TestPollerWaitCanceled(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	c := New(staticToken{}, WithEndpoint(srv.URL), WithHTTPClient(srv.Client()), WithPollInterval(time.Millisecond))
+	p := &Poller{client: c, vmID: testVMID, action: "start", statusURL: srv.URL + "/operations/op1"}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := p.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Wait = %v, want the context error", err)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+)
+
+// decisionText describes a decision about a VM: its action, or why it was skipped
+func decisionText(action vmAction, skipReason string) string {
+	if skipReason != "" {
+		return "skip (" + skipReason + ")"
+	}
+	return string(action)
+}
+
+// decisionLog collects the decision of every VM of a run and writes them to
+// the journal when the run is over, for later dry runs to compare with
+type decisionLog struct {
+	journal *journal
+	runID   string
+	recs    []journalRecord
+}
+
+func newDecisionLog(j *journal, runID string) *decisionLog {
+	return &decisionLog{journal: j, runID: runID}
+}
+
+func (d *decisionLog) publish(res *vmResult) {
+	d.recs = append(d.recs, journalRecord{
+		Action:     string(res.Action),
+		ResourceID: res.Target.ID,
+		Team:       res.Target.Team,
+		Detail:     res.SkipReason,
+	})
+}
+
+func (d *decisionLog) close() {
+	d.journal.decisions(d.runID, d.recs)
+}
+
+// lastRunDiff compares the decisions of a dry run with those of the last run
+// recorded in the journal and prints the VMs that were added, removed or decided differently
+type lastRunDiff struct {
+	journalPath string
+	current     map[string]*vmResult // lower-cased VM ID → result
+}
+
+func newLastRunDiff(journalPath string) *lastRunDiff {
+	return &lastRunDiff{journalPath: journalPath, current: map[string]*vmResult{}}
+}
+
+func (d *lastRunDiff) publish(res *vmResult) {
+	d.current[strings.ToLower(res.Target.ID)] = res
+}
+
+func (d *lastRunDiff) close() {}
+
+func (d *lastRunDiff) runStarted(ctx context.Context, run *runInfo) {}
+
+func (d *lastRunDiff) runFinished(ctx context.Context, run *runInfo, summary *runSummary) {
+	lastRun, at, previous, err := lastDecisions(d.journalPath)
+	if err != nil {
+		slog.Error("Failed to compare with the last run", "error", err)
+		return
+	}
+	if lastRun == "" {
+		slog.Info("No earlier run is recorded, nothing to compare with", "journal", d.journalPath)
+		return
+	}
+
+	ids := make([]string, 0, len(d.current)+len(previous))
+	for id := range d.current {
+		ids = append(ids, id)
+	}
+	for id := range previous {
+		if _, ok := d.current[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	var lines []string
+	var added, removed, changed, same int
+	for _, id := range ids {
+		res, isCurrent := d.current[id]
+		rec, wasPrevious := previous[id]
+		switch {
+		case !wasPrevious:
+			added++
+			lines = append(lines, fmt.Sprintf("  + %s: %s", vmLabel(res.Target.ID), decisionText(res.Action, res.SkipReason)))
+		case !isCurrent:
+			removed++
+			lines = append(lines, fmt.Sprintf("  - %s: was %s", vmLabel(rec.ResourceID), decisionText(vmAction(rec.Action), rec.Detail)))
+		default:
+			was, now := decisionText(vmAction(rec.Action), rec.Detail), decisionText(res.Action, res.SkipReason)
+			if was == now {
+				same++
+				continue
+			}
+			changed++
+			lines = append(lines, fmt.Sprintf("  ~ %s: %s → %s", vmLabel(res.Target.ID), was, now))
+		}
+	}
+	slog.Info("Compared with the last run", "runId", lastRun, "at", at.Format(time.RFC3339),
+		"new", added, "removed", removed, "changed", changed, "unchanged", same)
+	for _, line := range lines {
+		fmt.Println(line)
+	}
+}
+
+// lastDecisions reads the decision records of the last run in the journal at
+// path, returning an empty run ID when no run recorded any
+func lastDecisions(path string) (string, time.Time, map[string]*journalRecord, error) {
+	var runID string
+	var at time.Time
+	decisions := map[string]*journalRecord{}
+	err := readJournal(path, func(rec *journalRecord) {
+		if rec.Phase != journalDecision {
+			return
+		}
+		if rec.RunID != runID {
+			runID, at, decisions = rec.RunID, rec.Time, map[string]*journalRecord{}
+		}
+		decisions[strings.ToLower(rec.ResourceID)] = rec
+	})
+	return runID, at, decisions, err
+}
+
+// vmLabel shortens a VM resource ID to subscription/resource group/name
+func vmLabel(id string) string {
+	return fmt.Sprintf("%s/%s/%s", subscriptionOf(id), parseResourceGroup(id), id[strings.LastIndex(id, "/")+1:])
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+//go:embed schema/plan.schema.json
+var planSchema []byte
+
+// configReport collects the problems found while validating the configuration
+type configReport struct {
+	errors   []string
+	warnings []string
+}
+
+func (r *configReport) errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func (r *configReport) warnf(format string, args ...interface{}) {
+	r.warnings = append(r.warnings, fmt.Sprintf(format, args...))
+}
+
+// runConfig implements the config command and its validate, schema and messages subcommands
+func runConfig(ctx context.Context, reporter *errorReporter, args []string) error {
+	usage := fmt.Errorf("usage: config validate [flags] | config schema | config messages")
+	if len(args) == 0 {
+		return usage
+	}
+	switch args[0] {
+	case "schema":
+		_, err := os.Stdout.Write(planSchema)
+		return err
+	case "validate":
+		return validateConfig(args[1:])
+	case "messages":
+		out, err := json.MarshalIndent(defaultMessages, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Println(string(out))
+		return err
+	}
+	return usage
+}
+
+// validateConfig checks every configuration file and value named by the run
+// flags in args, reporting all problems at once instead of stopping at the first
+func validateConfig(args []string) error {
+	opts := &options{}
+	fs := newFlagSet("config validate", opts)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	r := checkConfig(opts)
+	r.print(os.Stdout)
+	if len(r.errors) > 0 {
+		return fmt.Errorf("configuration is invalid: %d error(s)", len(r.errors))
+	}
+	slog.Info("Configuration is valid", "warnings", len(r.warnings))
+	return nil
+}
+
+// checkConfig validates the flags parsed into opts and every file they name
+func checkConfig(opts *options) *configReport {
+	r := &configReport{}
+	if err := opts.validate(); err != nil {
+		r.errorf("flags: %v", err)
+	}
+	validateFiles(r, opts)
+	if opts.fleetsPath != "" {
+		fleets, err := loadFleets(opts.fleetsPath)
+		if err != nil {
+			r.errorf("--fleets: %v", err)
+		}
+		for _, f := range fleets {
+			fr := &configReport{}
+			validateFiles(fr, f.opts)
+			for _, e := range fr.errors {
+				r.errorf("fleet %s: %s", f.name, e)
+			}
+			for _, w := range fr.warnings {
+				r.warnf("fleet %s: %s", f.name, w)
+			}
+		}
+	}
+	return r
+}
+
+// print writes the warnings, then the errors, one per line
+func (r *configReport) print(w io.Writer) {
+	for _, warning := range r.warnings {
+		fmt.Fprintf(w, "[WRN]: %s\n", warning)
+	}
+	for _, e := range r.errors {
+		fmt.Fprintf(w, "[ERR]: %s\n", e)
+	}
+}
+
+// validateFiles checks the configuration files and values named by opts
+func validateFiles(r *configReport, opts *options) {
+	if _, err := parseProtectionList(opts.protect); err != nil {
+		r.errorf("--protect: %v", err)
+	}
+	if _, err := secretRefs(opts); err != nil {
+		r.errorf("%v", err)
+	}
+	if opts.planPath != "" {
+		validatePlanFile(r, opts.planPath)
+	}
+	if opts.hooksPath != "" {
+		validateHooksFile(r, opts.hooksPath)
+	}
+	if opts.oobStartersPath != "" {
+		if _, err := loadOOBStarters(opts.oobStartersPath); err != nil {
+			r.errorf("--oob-starters: %v", err)
+		}
+	}
+	if opts.guardrailsPath != "" {
+		if _, err := loadGuardrails(opts.guardrailsPath); err != nil {
+			r.errorf("--guardrails: %v", err)
+		}
+	}
+	if opts.snapshotPath != "" {
+		if s, err := loadSnapshot(opts.snapshotPath, opts.tenant); err != nil {
+			r.errorf("--snapshot: %v", err)
+		} else if err := s.fresh(opts.snapshotMaxAge, time.Now()); err != nil {
+			r.warnf("--snapshot: %v", err)
+		}
+	}
+	var messages messageCatalog
+	if opts.messagesPath != "" {
+		var err error
+		if messages, err = loadMessages(opts.messagesPath); err != nil {
+			r.errorf("--messages: %v", err)
+		}
+	}
+	if opts.apiKeysPath != "" {
+		validateGrantsFile(r, opts.apiKeysPath, true)
+	}
+	if opts.apiRolesPath != "" {
+		validateGrantsFile(r, opts.apiRolesPath, false)
+	}
+	templates := []struct{ flag, path string }{
+		{"--servicenow-template", opts.serviceNowTemplate},
+		{"--jira-template", opts.jiraTemplate},
+	}
+	for _, t := range templates {
+		if t.path == "" {
+			continue
+		}
+		if _, err := template.New(path.Base(t.path)).Funcs(messages.funcs()).ParseFiles(t.path); err != nil {
+			r.errorf("%s: %v", t.flag, err)
+		}
+	}
+}
+
+// validateHooksFile loads the hooks like a run would and checks that their commands can be found
+func validateHooksFile(r *configReport, path string) {
+	hooks, err := loadHooks(path)
+	if err != nil {
+		r.errorf("--hooks: %v", err)
+		return
+	}
+	for _, list := range [][]hookCommand{hooks.PreRun, hooks.PostVMStart, hooks.PostRun} {
+		for _, h := range list {
+			if _, err := exec.LookPath(h.Command[0]); err != nil {
+				r.warnf("--hooks: %v", err)
+			}
+		}
+	}
+}
+
+// decodeStrict decodes JSON data into v, rejecting unknown keys
+func decodeStrict(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// validatePlanFile loads the plan like a run would and lints its rules
+func validatePlanFile(r *configReport, planPath string) {
+	plan, err := loadPlan(planPath)
+	if err != nil {
+		r.errorf("--plan: %v", err)
+		return
+	}
+	names := map[string]int{}
+	for j := range plan.Rules {
+		rule := &plan.Rules[j]
+		label := ruleLabel(rule, j)
+		if rule.Name != "" {
+			if first, ok := names[rule.Name]; ok {
+				r.errorf("--plan: %s: name already used by rule %d", label, first+1)
+			} else {
+				names[rule.Name] = j
+			}
+		}
+		for i := 0; i < j; i++ {
+			earlier := &plan.Rules[i]
+			switch {
+			case earlier.Selector.covers(&rule.Selector):
+				r.errorf("--plan: %s never applies: every VM it selects is matched first by %s", label, ruleLabel(earlier, i))
+			case earlier.State != rule.State && !rule.Selector.empty() && !earlier.Selector.disjoint(&rule.Selector):
+				// A later catch-all is the usual default rule, so only specific rules are reported
+				r.warnf("--plan: %s (%s) overlaps %s (%s); VMs matched by both are %s",
+					label, rule.State, ruleLabel(earlier, i), earlier.State, earlier.State)
+			}
+		}
+	}
+}
+
+func ruleLabel(rule *planRule, i int) string {
+	if rule.Name == "" {
+		return fmt.Sprintf("rule %d", i+1)
+	}
+	return fmt.Sprintf("rule %d %q", i+1, rule.Name)
+}
+
+// covers reports whether every VM matched by other is certainly matched by s
+func (s *selector) covers(other *selector) bool {
+	if len(s.Names) > 0 {
+		if len(other.Names) == 0 {
+			return false
+		}
+		for _, name := range other.Names {
+			if !isLiteral(name) && !containsFold(s.Names, name) && !containsFold(s.Names, "*") {
+				return false
+			}
+			if isLiteral(name) && !matchAny(s.Names, name, true) {
+				return false
+			}
+		}
+	}
+	if !coversList(s.ResourceGroups, other.ResourceGroups) || !coversList(s.Subscriptions, other.Subscriptions) {
+		return false
+	}
+	for key, want := range s.Tags {
+		if got, ok := other.Tags[key]; !ok || got != want {
+			return false
+		}
+	}
+	return true
+}
+
+// empty reports whether the selector matches every VM
+func (s *selector) empty() bool {
+	return len(s.Names) == 0 && len(s.ResourceGroups) == 0 && len(s.Subscriptions) == 0 && len(s.Tags) == 0
+}
+
+// coversList reports whether a list filter allows every value the other one allows
+func coversList(list, other []string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	if len(other) == 0 {
+		return false
+	}
+	for _, v := range other {
+		if !containsFold(list, v) {
+			return false
+		}
+	}
+	return true
+}
+
+// disjoint reports whether no VM can be matched by both selectors
+func (s *selector) disjoint(other *selector) bool {
+	if disjointList(s.ResourceGroups, other.ResourceGroups) || disjointList(s.Subscriptions, other.Subscriptions) {
+		return true
+	}
+	for key, want := range s.Tags {
+		if got, ok := other.Tags[key]; ok && got != want {
+			return true
+		}
+	}
+	// Name globs can only be proven disjoint when both sides are literal names
+	if len(s.Names) == 0 || len(other.Names) == 0 {
+		return false
+	}
+	for _, name := range append(append([]string{}, s.Names...), other.Names...) {
+		if !isLiteral(name) {
+			return false
+		}
+	}
+	return disjointList(s.Names, other.Names)
+}
+
+// disjointList reports whether two populated list filters share no value
+func disjointList(a, b []string) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return false
+	}
+	for _, v := range b {
+		if containsFold(a, v) {
+			return false
+		}
+	}
+	return true
+}
+
+// isLiteral reports whether a name pattern contains no glob metacharacters
+func isLiteral(pattern string) bool {
+	return !strings.ContainsAny(pattern, `*?[\`)
+}
+
+// validateGrantsFile checks an API keys file (keys) or an API roles file strictly,
+// including the actions and selectors of every grant
+func validateGrantsFile(r *configReport, grantsPath string, keys bool) {
+	flagName := "--api-roles"
+	if keys {
+		flagName = "--api-keys"
+	}
+	data, err := readConfigFile(grantsPath)
+	if err != nil {
+		r.errorf("%s: %v", flagName, err)
+		return
+	}
+	grants := map[string]apiGrant{}
+	if keys {
+		var file struct {
+			Keys []apiKey `json:"keys"`
+		}
+		if err := decodeStrict(data, &file); err != nil {
+			r.errorf("%s: %v", flagName, err)
+			return
+		}
+		if _, err := loadAPIKeys(grantsPath); err != nil {
+			r.errorf("%s: %v", flagName, err)
+		}
+		for i, k := range file.Keys {
+			name := k.Name
+			if name == "" {
+				name = fmt.Sprintf("#%d", i+1)
+			}
+			if k.Key != "" {
+				r.warnf("%s: key %s stores the plain key; store its sha256 instead", flagName, name)
+			}
+			grants["key "+name] = k.apiGrant
+		}
+	} else {
+		var roles map[string]apiGrant
+		if err := decodeStrict(data, &roles); err != nil {
+			r.errorf("%s: %v", flagName, err)
+			return
+		}
+		for role, g := range roles {
+			grants["role "+role] = g
+		}
+	}
+
+	labels := make([]string, 0, len(grants))
+	for label := range grants {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	known := knownActions
+	for _, label := range labels {
+		g := grants[label]
+		if len(g.Actions) == 0 {
+			r.warnf("%s: %s allows no actions", flagName, label)
+		}
+		for _, action := range g.Actions {
+			if !containsFold(known, action) {
+				r.errorf("%s: %s: unknown action %q (expected one of %s)", flagName, label, action, strings.Join(known, ", "))
+			}
+		}
+		if len(g.Scopes) == 0 {
+			r.warnf("%s: %s has no scopes and matches no VM", flagName, label)
+		}
+		for _, scope := range g.Scopes {
+			if !strings.HasPrefix(scope, "/") {
+				r.errorf("%s: %s: scope %q is not a resource ID", flagName, label, scope)
+			}
+		}
+		if g.Selector != nil {
+			for _, name := range g.Selector.Names {
+				if _, err := path.Match(name, ""); err != nil {
+					r.errorf("%s: %s: invalid name pattern %q", flagName, label, name)
+				}
+			}
+		}
+	}
+}
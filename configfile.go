@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Headers of age-encrypted files, binary and armored
+const (
+	ageHeader        = "age-encryption.org/v1\n"
+	ageArmoredHeader = "-----BEGIN AGE ENCRYPTED FILE-----"
+)
+
+// decryptTimeout bounds the sops and age commands decrypting a file
+const decryptTimeout = time.Minute
+
+// readConfigFile reads a JSON configuration file. Files encrypted with SOPS
+// (as JSON) or age are decrypted in memory by the sops and age commands, so
+// that they can live in a Git repository; the plaintext is never written to
+// disk. sops finds its keys like it always does (SOPS_AGE_KEY_FILE, Azure Key
+// Vault, …); age uses the identity file in SOPS_AGE_KEY_FILE as well.
+func readConfigFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(data, []byte(ageHeader)) || bytes.HasPrefix(bytes.TrimSpace(data), []byte(ageArmoredHeader)):
+		identity := os.Getenv("SOPS_AGE_KEY_FILE")
+		if identity == "" {
+			return nil, fmt.Errorf("%s is age-encrypted: set SOPS_AGE_KEY_FILE to the identity file", path)
+		}
+		return decryptFile("age", "--decrypt", "--identity", identity, path)
+	case sopsEncrypted(data):
+		return decryptFile("sops", "--decrypt", "--input-type", "json", "--output-type", "json", path)
+	}
+	return data, nil
+}
+
+// sopsEncrypted reports whether data is a SOPS-encrypted JSON document, which
+// carries its metadata in a top-level sops object
+func sopsEncrypted(data []byte) bool {
+	var doc struct {
+		Sops *struct {
+			MAC string `json:"mac"`
+		} `json:"sops"`
+	}
+	return json.Unmarshal(data, &doc) == nil && doc.Sops != nil && doc.Sops.MAC != ""
+}
+
+// decryptFile runs a decryption command and returns its output
+func decryptFile(name string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), decryptTimeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return nil, fmt.Errorf("%s is needed to decrypt %s: %w", name, args[len(args)-1], err)
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s failed to decrypt %s: %s", name, args[len(args)-1], msg)
+		}
+		return nil, fmt.Errorf("%s failed to decrypt %s: %w", name, args[len(args)-1], err)
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// confirmGate is a planGate showing the targets of a command-line run and
+// asking for confirmation, so that a mistyped filter does not act on the whole
+// tenant. Without a terminal to ask on, the run is refused; automation passes
+// --yes.
+func confirmGate(in *os.File, out io.Writer, action vmAction) planGate {
+	return func(ctx context.Context, targets []*vmTarget) error {
+		if len(targets) == 0 {
+			return nil
+		}
+		bySub := map[string][]*vmTarget{}
+		for _, t := range targets {
+			bySub[t.SubscriptionID] = append(bySub[t.SubscriptionID], t)
+		}
+		subs := make([]string, 0, len(bySub))
+		for sub := range bySub {
+			subs = append(subs, sub)
+		}
+		sort.Strings(subs)
+
+		fmt.Fprintf(out, "About to act on %d VM(s) in %d subscription(s):\n", len(targets), len(subs))
+		for _, sub := range subs {
+			list := bySub[sub]
+			sort.Slice(list, func(i, j int) bool { return strings.ToLower(list[i].ID) < strings.ToLower(list[j].ID) })
+			fmt.Fprintf(out, "  subscription %s: %d VM(s)\n", sub, len(list))
+			for _, t := range list {
+				a := t.Action
+				if a == "" {
+					a = action
+				}
+				fmt.Fprintf(out, "    %-10s %s/%s\n", a, t.ResourceGroup, t.Name)
+			}
+		}
+		return askConfirmation(in, out)
+	}
+}
+
+// askConfirmation asks the operator on in whether to proceed and returns an
+// error unless they answer yes. Without a terminal nothing is asked and the
+// answer is no.
+func askConfirmation(in *os.File, out io.Writer) error {
+	if info, err := in.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return fmt.Errorf("not confirmed: stdin is not a terminal, pass --yes to run without confirmation")
+	}
+	fmt.Fprintf(out, "Proceed? [y/N] ")
+	answer, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && answer == "" {
+		fmt.Fprintln(out)
+		return fmt.Errorf("not confirmed: no answer, pass --yes to run without confirmation")
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return nil
+	}
+	return fmt.Errorf("not confirmed by the operator")
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+)
+
+// Reservation and savings plan API versions
+const (
+	reservationsAPI = "2022-11-01"
+	savingsPlansAPI = "2022-11-01"
+)
+
+// vmReservation is a VM reservation the token can read
+type vmReservation struct {
+	Name     string `json:"name"`
+	Location string `json:"location"`
+	SKU      struct {
+		Name string `json:"name"`
+	} `json:"sku"`
+	Properties struct {
+		DisplayName          string   `json:"displayName"`
+		ReservedResourceType string   `json:"reservedResourceType"`
+		Quantity             int      `json:"quantity"`
+		ProvisioningState    string   `json:"provisioningState"`
+		AppliedScopeType     string   `json:"appliedScopeType"`
+		AppliedScopes        []string `json:"appliedScopes"`
+	} `json:"properties"`
+
+	remaining int // instances not yet attributed to a started VM
+}
+
+// appliesTo reports whether the reservation discount can apply to t. Management
+// group scopes are not resolved and are assumed to include every subscription.
+func (r *vmReservation) appliesTo(t *vmTarget) bool {
+	if !strings.EqualFold(r.Properties.ReservedResourceType, "VirtualMachines") ||
+		!strings.EqualFold(r.Properties.ProvisioningState, "Succeeded") ||
+		!strings.EqualFold(r.SKU.Name, t.Size) ||
+		!strings.EqualFold(normalizeLocation(r.Location), normalizeLocation(t.Location)) {
+		return false
+	}
+	switch strings.ToLower(r.Properties.AppliedScopeType) {
+	case "single", "singleresourcegroup":
+		for _, scope := range r.Properties.AppliedScopes {
+			if strings.HasPrefix(strings.ToLower(t.ID)+"/", strings.ToLower(strings.TrimSuffix(scope, "/"))+"/") {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// label names the reservation in the report
+func (r *vmReservation) label() string {
+	if r.Properties.DisplayName != "" {
+		return r.Properties.DisplayName
+	}
+	return r.Name
+}
+
+// savingsPlan is an active compute savings plan the token can read
+type savingsPlan struct {
+	Properties struct {
+		DisplayProvisioningState string `json:"displayProvisioningState"`
+		Commitment               struct {
+			Amount       float64 `json:"amount"`
+			CurrencyCode string  `json:"currencyCode"`
+			Grain        string  `json:"grain"`
+		} `json:"commitment"`
+	} `json:"properties"`
+}
+
+// costReport collects the VMs a run started and, when the run finishes, logs
+// which of them a reservation covers and which run at pay-as-you-go rates
+type costReport struct {
+	token   string
+	started []*vmTarget
+}
+
+func newCostReport(token string) *costReport {
+	return &costReport{token: token}
+}
+
+func (c *costReport) publish(res *vmResult) {
+	if res.Action == actionStart && res.outcome() == outcomeAccepted {
+		c.started = append(c.started, res.Target)
+	}
+}
+
+func (c *costReport) close() {}
+
+func (c *costReport) runStarted(ctx context.Context, run *runInfo) {}
+
+func (c *costReport) runFinished(ctx context.Context, run *runInfo, summary *runSummary) {
+	// Under --quiet the report would not be shown: spare the reservation lookups
+	if !slog.Default().Enabled(ctx, slog.LevelInfo) {
+		return
+	}
+	slog.Info("Cost report", "started", len(c.started))
+	if len(c.started) == 0 {
+		return
+	}
+
+	reservations, err := c.reservations(ctx)
+	if err != nil {
+		slog.Error("Failed to list reservations, coverage is unknown", "error", err)
+	}
+
+	type sizeGroup struct {
+		team, size, location string
+		started, payg        int
+		covered              map[string]int // reservation label → VMs covered
+	}
+	groups := map[string]*sizeGroup{}
+	var unknown int
+	for _, t := range c.started {
+		if t.Size == "" {
+			unknown++
+			continue
+		}
+		key := t.Team + "/" + strings.ToLower(normalizeLocation(t.Location)+"/"+t.Size)
+		g, ok := groups[key]
+		if !ok {
+			g = &sizeGroup{team: t.Team, size: t.Size, location: normalizeLocation(t.Location), covered: map[string]int{}}
+			groups[key] = g
+		}
+		g.started++
+		if r := claimReservation(reservations, t); r != nil {
+			g.covered[r.label()]++
+		} else {
+			g.payg++
+		}
+	}
+
+	keys := make([]string, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	payg := 0
+	for _, key := range keys {
+		g := groups[key]
+		payg += g.payg
+		attrs := []any{"size", g.size, "location", g.location, "started", g.started}
+		if g.team != "" {
+			attrs = append([]any{"team", g.team}, attrs...)
+		}
+		if err != nil {
+			slog.Info("Started by size", attrs...)
+			continue
+		}
+		labels := make([]string, 0, len(g.covered))
+		for label, n := range g.covered {
+			labels = append(labels, fmt.Sprintf("%s ×%d", label, n))
+		}
+		sort.Strings(labels)
+		attrs = append(attrs, "reserved", g.started-g.payg)
+		if len(labels) > 0 {
+			attrs = append(attrs, "reservations", strings.Join(labels, ", "))
+		}
+		slog.Info("Started by size", append(attrs, "payAsYouGo", g.payg)...)
+	}
+	if unknown > 0 {
+		slog.Info("Started VMs of unknown size (--arm-filter discovery does not return VM sizes)", "count", unknown)
+	}
+	if err != nil {
+		return
+	}
+	slog.Info("Reservation coverage assumes exact size matches and does not count instances already used by VMs running before this run")
+
+	if payg == 0 {
+		return
+	}
+	plans, err := c.savingsPlans(ctx)
+	if err != nil {
+		slog.Error("Failed to list savings plans", "error", err)
+		return
+	}
+	if len(plans) > 0 {
+		commitments := map[string]float64{}
+		for _, plan := range plans {
+			commit := plan.Properties.Commitment
+			commitments[commit.CurrencyCode+"/"+commit.Grain] += commit.Amount
+		}
+		var parts []string
+		for unit, amount := range commitments {
+			currency, grain, _ := strings.Cut(unit, "/")
+			parts = append(parts, fmt.Sprintf("%.2f %s (%s)", amount, currency, strings.ToLower(grain)))
+		}
+		sort.Strings(parts)
+		slog.Info("Active savings plans may discount the pay-as-you-go starts",
+			"plans", len(plans), "commitment", strings.Join(parts, ", "), "payAsYouGo", payg)
+	}
+}
+
+// claimReservation attributes t to a reservation with unused instances, if any
+func claimReservation(reservations []*vmReservation, t *vmTarget) *vmReservation {
+	for _, r := range reservations {
+		if r.remaining > 0 && r.appliesTo(t) {
+			r.remaining--
+			return r
+		}
+	}
+	return nil
+}
+
+// reservations lists the VM reservations visible to the token across the tenant
+func (c *costReport) reservations(ctx context.Context) ([]*vmReservation, error) {
+	next := fmt.Sprintf("%s/providers/Microsoft.Capacity/reservations?api-version=%s", armEndpoint, reservationsAPI)
+	var all []*vmReservation
+	for next != "" {
+		var page struct {
+			Value    []*vmReservation `json:"value"`
+			NextLink string           `json:"nextLink"`
+		}
+		if err := getJSON(ctx, next, c.token, &page); err != nil {
+			return nil, err
+		}
+		for _, r := range page.Value {
+			r.remaining = r.Properties.Quantity
+			all = append(all, r)
+		}
+		next = page.NextLink
+	}
+	return all, nil
+}
+
+// savingsPlans lists the savings plans visible to the token that are in effect
+func (c *costReport) savingsPlans(ctx context.Context) ([]*savingsPlan, error) {
+	next := fmt.Sprintf("%s/providers/Microsoft.BillingBenefits/savingsPlans?api-version=%s", armEndpoint, savingsPlansAPI)
+	var active []*savingsPlan
+	for next != "" {
+		var page struct {
+			Value    []*savingsPlan `json:"value"`
+			NextLink string         `json:"nextLink"`
+		}
+		if err := getJSON(ctx, next, c.token, &page); err != nil {
+			return nil, err
+		}
+		for _, plan := range page.Value {
+			if strings.EqualFold(plan.Properties.DisplayProvisioningState, "Succeeded") {
+				active = append(active, plan)
+			}
+		}
+		next = page.NextLink
+	}
+	return active, nil
+}
+
+// normalizeLocation turns display names such as "West Europe" into location names
+func normalizeLocation(location string) string {
+	return strings.ToLower(strings.ReplaceAll(location, " ", ""))
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// csvReportHeader is the first row of --report-csv files
+var csvReportHeader = []string{
+	"run_id", "subscription", "resource_group", "vm", "action", "outcome", "status_code", "duration_ms", "error", "skip_category", "skip_reason",
+}
+
+// csvReport writes the results of a run to a CSV file for audit spreadsheets
+// and ticket attachments. The file is created with the pipeline, so that an
+// unwritable path fails the run before anything is done, and written once the
+// run is over.
+type csvReport struct {
+	f       *os.File
+	runID   string
+	results []*vmResult
+}
+
+func newCSVReport(path, runID string) (*csvReport, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create --report-csv file: %w", err)
+	}
+	return &csvReport{f: f, runID: runID}, nil
+}
+
+func (r *csvReport) publish(res *vmResult) {
+	r.results = append(r.results, res)
+}
+
+func (r *csvReport) close() {
+	w := csv.NewWriter(r.f)
+	w.Write(csvReportHeader)
+	for _, res := range r.results {
+		t := res.Target
+		status := ""
+		if res.StatusCode != 0 {
+			status = strconv.Itoa(res.StatusCode)
+		}
+		errText := ""
+		if res.Err != nil {
+			errText = res.Err.Error()
+		}
+		w.Write(csvCells(r.runID, t.SubscriptionID, t.ResourceGroup, t.Name, string(res.Action), res.outcome(), status,
+			strconv.FormatInt(res.Duration.Milliseconds(), 10), errText, res.SkipCategory, res.SkipReason))
+	}
+	w.Flush()
+	err := w.Error()
+	if cerr := r.f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		slog.Error("Failed to write CSV report", "path", r.f.Name(), "error", err)
+		return
+	}
+	slog.Info("Wrote CSV report", "path", r.f.Name(), "results", len(r.results))
+}
+
+// csvCells returns values as CSV cells, quoting those that spreadsheets would
+// evaluate as formulas, such as error messages starting with "-"
+func csvCells(values ...string) []string {
+	for i, v := range values {
+		if v != "" && strings.ContainsRune("=+-@\t\r", rune(v[0])) {
+			values[i] = "'" + v
+		}
+	}
+	return values
+}
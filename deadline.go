@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Escalations of a VM that does not reach running within --vm-deadline
+const (
+	escalateDegraded = "degraded" // report the start as accepted but degraded
+	escalateNotify   = "notify"   // report the start as failed, so failure notifications fire
+	escalateRedeploy = "redeploy" // redeploy the VM and wait once more, then notify
+)
+
+var knownEscalations = []string{escalateDegraded, escalateNotify, escalateRedeploy}
+
+// deadlinePoll is how often the power state of an awaited VM is checked
+const deadlinePoll = 15 * time.Second
+
+// errMissedDeadline is wrapped by the error of starts that missed the deadline
+var errMissedDeadline = errors.New("missed the start deadline")
+
+// startDeadline waits, after a start was accepted, until the VM reports
+// PowerState/running, and escalates when it does not within deadline
+type startDeadline struct {
+	deadline   time.Duration
+	escalation string
+	poll       time.Duration
+}
+
+// applies reports whether res is a start whose outcome must be awaited. Arc
+// machines started out of band are not awaited.
+func (d *startDeadline) applies(res *vmResult) bool {
+	return d != nil && res.Action == actionStart && res.outcome() == outcomeAccepted && !res.Target.Arc
+}
+
+// awaitRunning waits until the VM of res is running and escalates on the
+// results of starts that miss the deadline
+func (p *pipeline) awaitRunning(ctx context.Context, res *vmResult) {
+	d, t := p.deadline, res.Target
+	state, ok := p.waitRunning(ctx, t, d.deadline)
+	if ok && t.state() != vmStateRunning {
+		t.transition(vmStateRunning)
+	}
+	if ok || ctx.Err() != nil {
+		return
+	}
+	missed := fmt.Sprintf("did not reach running within %s (power state %s)", d.deadline, state)
+	slog.Warn("VM "+missed+", escalating", vmAttrs(t), "escalation", d.escalation)
+	p.journal.audit("deadline", fmt.Sprintf("run=%s vm=%s state=%s escalation=%s", p.runID, t.ID, state, d.escalation))
+
+	switch d.escalation {
+	case escalateDegraded:
+		res.Degraded = missed
+		return
+	case escalateRedeploy:
+		// A redeploy disrupts the VM like any other action: it must pass the
+		// same checks, and falls back to notifying when they hold it back
+		if held, _ := p.admit(ctx, t, actionRedeploy); held != nil {
+			reason := held.SkipReason
+			if held.Err != nil {
+				reason = held.Err.Error()
+			}
+			slog.Warn("Not redeploying the VM", vmAttrs(t), "reason", reason)
+			missed += ", and it was not redeployed: " + reason
+			break
+		}
+		t.transition(vmStateRequested)
+		redeploy := p.perform(ctx, t, actionRedeploy)
+		if redeploy.Err != nil {
+			p.dedupe.release(t, actionRedeploy)
+			res.Err = fmt.Errorf("%w: %s, and redeploying it failed: %v", errMissedDeadline, missed, redeploy.Err)
+			return
+		}
+		t.transition(vmStateAccepted)
+		slog.Info("Redeploy request accepted, waiting once more", vmAttrs(t), "deadline", d.deadline)
+		if state, ok = p.waitRunning(ctx, t, d.deadline); ok {
+			t.transition(vmStateRunning)
+			res.Degraded = missed + ", running after a redeploy"
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		missed += fmt.Sprintf(", nor within %s after a redeploy (power state %s)", d.deadline, state)
+	}
+	res.Err = fmt.Errorf("%w: %s", errMissedDeadline, missed)
+}
+
+// waitRunning polls the instance view of t until it reports running, for at
+// most timeout; it returns the last power state seen
+func (p *pipeline) waitRunning(ctx context.Context, t *vmTarget, timeout time.Duration) (string, bool) {
+	state := "unknown"
+	deadline := time.Now().Add(timeout)
+	for {
+		token, err := p.access.current(ctx)
+		if err == nil {
+			err = fetchInstanceView(ctx, token, t)
+		}
+		if err != nil {
+			slog.Error("Failed to read the power state", vmAttrs(t), "error", err)
+		} else if state = t.status("PowerState"); state == "running" {
+			return state, true
+		} else if state == "" {
+			state = "unknown"
+		}
+		wait := min(p.deadline.poll, time.Until(deadline))
+		if wait <= 0 {
+			return state, false
+		}
+		select {
+		case <-ctx.Done():
+			return state, false
+		case <-time.After(wait):
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeadlineRedeployChecks(t *testing.T) {
+	protected, err := parseProtectionList([]string{"tag:critical"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		tags       map[string]string
+		redeployed bool
+		detail     string
+	}{
+		{"protected", map[string]string{"critical": "yes"}, false, "not redeployed: protected by tag critical=yes"},
+		{"unprotected", nil, true, "redeploying it failed"},
+	}
+	for _, tt := range tests {
+		p := &pipeline{
+			runID:     "test",
+			protected: protected,
+			// Without a token neither the power state nor the redeploy reach ARM
+			access:   &accessGuard{err: errors.New("no token"), lost: map[string]string{}},
+			deadline: &startDeadline{deadline: time.Millisecond, escalation: escalateRedeploy, poll: time.Millisecond},
+		}
+		target := testTarget("sub1", "rg-a", "dc-1", tt.tags)
+		target.transition(vmStateAccepted)
+		res := &vmResult{Target: target, Action: actionStart, StatusCode: 202}
+		p.awaitRunning(context.Background(), res)
+
+		if !errors.Is(res.Err, errMissedDeadline) || !strings.Contains(res.Err.Error(), tt.detail) {
+			t.Errorf("%s: result error %v, want one about %q", tt.name, res.Err, tt.detail)
+		}
+		if redeployed := target.state() == vmStateRequested; redeployed != tt.redeployed {
+			t.Errorf("%s: redeploy requested = %v, want %v", tt.name, redeployed, tt.redeployed)
+		}
+	}
+}
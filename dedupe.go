@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dedupeWindow suppresses an action on a VM when the same action was accepted
+// for it, by this or an earlier run, less than window ago. Runs within the
+// process share it; earlier processes are seen through the journal.
+// A nil *dedupeWindow suppresses nothing.
+type dedupeWindow struct {
+	window time.Duration
+
+	mu   sync.Mutex
+	last map[string]time.Time // lower-cased VM ID + "/" + action → last request
+}
+
+// newDedupeWindow builds the window, seeded from the done records of the
+// journal at journalPath when one is configured
+func newDedupeWindow(window time.Duration, journalPath string) (*dedupeWindow, error) {
+	d := &dedupeWindow{window: window, last: map[string]time.Time{}}
+	if journalPath == "" {
+		return d, nil
+	}
+	since := time.Now().Add(-window)
+	err := readJournal(journalPath, func(rec *journalRecord) {
+		if rec.Phase == journalDone && rec.ResourceID != "" && rec.Time.After(since) {
+			d.last[d.key(rec.ResourceID, vmAction(rec.Action))] = rec.Time
+		}
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *dedupeWindow) key(resourceID string, action vmAction) string {
+	return strings.ToLower(resourceID) + "/" + string(action)
+}
+
+// claim returns why action on t is a duplicate, or "" after reserving it for
+// the caller, which must release the claim if the request is not accepted
+func (d *dedupeWindow) claim(t *vmTarget, action vmAction) string {
+	if d == nil {
+		return ""
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	key := d.key(t.ID, action)
+	if last, ok := d.last[key]; ok {
+		if ago := time.Since(last); ago < d.window {
+			return fmt.Sprintf("duplicate: %s already requested %s ago (within the %s duplicate window)",
+				action, ago.Round(time.Second), d.window)
+		}
+	}
+	d.last[key] = time.Now()
+	return ""
+}
+
+// release forgets a claim whose request was not accepted
+func (d *dedupeWindow) release(t *vmTarget, action vmAction) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.last, d.key(t.ID, action))
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Digest periods and the public Azure retail prices endpoint used for cost estimates
+const (
+	digestDaily     = "daily"
+	digestWeekly    = "weekly"
+	retailPricesAPI = "https://prices.azure.com/api/retail/prices"
+)
+
+// digestGroup accumulates the activity of one plan rule (or resource group) of a team over a digest period
+type digestGroup struct {
+	starts   int
+	stops    int
+	usage    map[string]time.Duration // "location/size" → VM uptime
+	failures []string
+}
+
+// uptimeSpan is a VM started through the server that has not been powered down since
+type uptimeSpan struct {
+	group    string
+	usageKey string
+	since    time.Time
+}
+
+// digest summarizes every run of a server over a day or a week and sends the
+// summary to Slack and/or by email. It is a resultSink shared by all runs.
+// Uptime is only known for VMs started and powered down through the server.
+type digest struct {
+	period       string
+	at           time.Duration // send time after midnight UTC
+	slackToken   string
+	slackChannel string
+	mail         *mailer
+	emails       []string
+	messages     messageCatalog
+
+	mu       sync.Mutex
+	since    time.Time
+	groups   map[string]*digestGroup
+	up       map[string]*uptimeSpan // lower-cased VM ID → open span
+	prices   map[string]float64     // "location/size" → hourly price, cached across periods
+	currency string
+}
+
+// newDigest builds the digest. Slack uses SLACK_BOT_TOKEN; email uses SMTP_ADDR
+// (host:port), SMTP_FROM and optionally SMTP_USERNAME/SMTP_PASSWORD.
+func newDigest(period, at, slackChannel string, emails []string, messages messageCatalog) (*digest, error) {
+	offset, err := time.Parse("15:04", at)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --digest-time %q: expected HH:MM", at)
+	}
+	d := &digest{
+		period:       period,
+		at:           time.Duration(offset.Hour())*time.Hour + time.Duration(offset.Minute())*time.Minute,
+		slackChannel: slackChannel,
+		emails:       emails,
+		messages:     messages,
+		since:        time.Now().UTC(),
+		groups:       map[string]*digestGroup{},
+		up:           map[string]*uptimeSpan{},
+		prices:       map[string]float64{},
+		currency:     "USD",
+	}
+	if slackChannel != "" {
+		if d.slackToken = os.Getenv("SLACK_BOT_TOKEN"); d.slackToken == "" {
+			return nil, fmt.Errorf("SLACK_BOT_TOKEN must be set for the Slack digest")
+		}
+	}
+	if len(emails) > 0 {
+		if d.mail = newMailer(); d.mail == nil {
+			return nil, fmt.Errorf("SMTP_ADDR and SMTP_FROM must be set for the email digest")
+		}
+	}
+	return d, nil
+}
+
+// groupName names the group t is counted in: its plan rule, or else its
+// resource group, within its team when teams are configured
+func (d *digest) groupName(t *vmTarget) string {
+	name := d.messages.format("digest.plan", t.Rule)
+	if t.Rule == "" {
+		name = d.messages.format("digest.resource_group", t.ResourceGroup)
+	}
+	if t.Team != "" {
+		name = d.messages.format("digest.team", t.Team, name)
+	}
+	return name
+}
+
+// group returns the accumulator of the named group
+func (d *digest) group(name string) *digestGroup {
+	g, ok := d.groups[name]
+	if !ok {
+		g = &digestGroup{usage: map[string]time.Duration{}}
+		d.groups[name] = g
+	}
+	return g
+}
+
+func (d *digest) publish(res *vmResult) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	t := res.Target
+	now := time.Now().UTC()
+	id := strings.ToLower(t.ID)
+	name := d.groupName(t)
+	switch res.outcome() {
+	case outcomeFailed, outcomeAccessLost:
+		g := d.group(name)
+		g.failures = append(g.failures, d.messages.format("digest.failure", t.Name, res.Action, res.Err))
+	case outcomeAccepted:
+		g := d.group(name)
+		if res.Action == actionStart {
+			g.starts++
+			if _, ok := d.up[id]; !ok {
+				d.up[id] = &uptimeSpan{group: name, usageKey: normalizeLocation(t.Location) + "/" + t.Size, since: now}
+			}
+			return
+		}
+		if !res.Action.powersDown() {
+			return
+		}
+		g.stops++
+		if span, ok := d.up[id]; ok {
+			d.addUsage(span, now)
+			delete(d.up, id)
+		}
+	}
+}
+
+// addUsage credits the uptime of span up to now to its group
+func (d *digest) addUsage(span *uptimeSpan, now time.Time) {
+	d.group(span.group).usage[span.usageKey] += now.Sub(span.since)
+}
+
+// close is a no-op: the digest outlives the runs it is attached to
+func (d *digest) close() {}
+
+// loop sends a digest at every period boundary until ctx is done; digests
+// missed while the host was suspended are handled by the catchUp policy
+func (d *digest) loop(ctx context.Context, catchUp string) {
+	runSchedule(ctx, d.period+" digest", catchUp, d.next, func(now time.Time) {
+		d.send(ctx, d.flush(now.UTC()))
+	})
+}
+
+// next returns the first send time after now: daily at the configured time,
+// weekly on Mondays
+func (d *digest) next(now time.Time) time.Time {
+	now = now.UTC()
+	next := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).Add(d.at)
+	for !next.After(now) || (d.period == digestWeekly && next.Weekday() != time.Monday) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// flush renders the digest of the period ending at now and starts a new period
+func (d *digest) flush(now time.Time) string {
+	d.mu.Lock()
+	for _, span := range d.up {
+		d.addUsage(span, now)
+		span.since = now
+	}
+	groups, since := d.groups, d.since
+	d.groups, d.since = map[string]*digestGroup{}, now
+	d.mu.Unlock()
+
+	var b strings.Builder
+	line := func(id string, args ...interface{}) {
+		b.WriteString(d.messages.format(id, args...) + "\n")
+	}
+	line("digest.title", d.period, since.Format("2006-01-02 15:04"), now.Format("2006-01-02 15:04"))
+	if len(groups) == 0 {
+		line("digest.empty")
+		return b.String()
+	}
+
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var total float64
+	var failures []string
+	unpriced := false
+	for _, name := range names {
+		g := groups[name]
+		var hours, cost float64
+		for key, uptime := range g.usage {
+			hours += uptime.Hours()
+			price, ok := d.price(key)
+			if !ok {
+				unpriced = true
+			}
+			cost += price * uptime.Hours()
+		}
+		total += cost
+		line("digest.group", name, g.starts, g.stops, hours, cost, d.currency)
+		for _, failure := range g.failures {
+			failures = append(failures, name+": "+failure)
+		}
+	}
+	line("digest.cost", total, d.currency)
+	if unpriced {
+		line("digest.unpriced")
+	}
+	line("digest.failures", len(failures))
+	for i, failure := range failures {
+		if i == 20 {
+			b.WriteString("  " + d.messages.format("more", len(failures)-i) + "\n")
+			break
+		}
+		fmt.Fprintf(&b, "  %s\n", failure)
+	}
+	return b.String()
+}
+
+// price returns the hourly Linux pay-as-you-go price of a "location/size" key
+func (d *digest) price(key string) (float64, bool) {
+	if price, ok := d.prices[key]; ok {
+		return price, true
+	}
+	location, size, _ := strings.Cut(key, "/")
+	if size == "" {
+		return 0, false
+	}
+	filter := fmt.Sprintf("serviceName eq 'Virtual Machines' and priceType eq 'Consumption' and armRegionName eq '%s' and armSkuName eq '%s'",
+		location, size)
+	priceURL := retailPricesAPI + "?$filter=" + strings.ReplaceAll(url.QueryEscape(filter), "+", "%20")
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(priceURL)
+	if err != nil {
+		slog.Error("Failed to look up the price", "size", size, "location", location, "error", err)
+		return 0, false
+	}
+	defer resp.Body.Close()
+	var page struct {
+		Items []struct {
+			RetailPrice   float64 `json:"retailPrice"`
+			CurrencyCode  string  `json:"currencyCode"`
+			UnitOfMeasure string  `json:"unitOfMeasure"`
+			ProductName   string  `json:"productName"`
+			SkuName       string  `json:"skuName"`
+		} `json:"Items"`
+	}
+	if resp.StatusCode != http.StatusOK {
+		slog.Error("Failed to look up the price: unexpected status", "size", size, "location", location, "statusCode", resp.StatusCode)
+		return 0, false
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		slog.Error("Failed to look up the price: failed to parse JSON", "size", size, "location", location, "error", err)
+		return 0, false
+	}
+	for _, item := range page.Items {
+		if item.UnitOfMeasure != "1 Hour" || strings.Contains(item.ProductName, "Windows") ||
+			strings.Contains(item.SkuName, "Spot") || strings.Contains(item.SkuName, "Low Priority") {
+			continue
+		}
+		d.prices[key] = item.RetailPrice
+		d.currency = item.CurrencyCode
+		return item.RetailPrice, true
+	}
+	return 0, false
+}
+
+// send delivers the digest text to every configured destination
+func (d *digest) send(ctx context.Context, text string) {
+	sent := true
+	if d.slackChannel != "" {
+		_, err := slackCall(ctx, d.slackToken, http.MethodPost, "chat.postMessage", nil, map[string]string{
+			"channel": d.slackChannel,
+			"text":    "```" + text + "```",
+		})
+		if err != nil {
+			slog.Error("Failed to post the digest to Slack", "error", err)
+			sent = false
+		}
+	}
+	if len(d.emails) > 0 {
+		subject, _, _ := strings.Cut(text, "\n")
+		if err := d.mail.send(d.emails, subject, text); err != nil {
+			slog.Error("Failed to email the digest", "error", err)
+			sent = false
+		}
+	}
+	if sent {
+		slog.Info("Sent the digest", "period", d.period)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Authorization API version used to read the caller's effective permissions
+const permissionsAPI = "2022-04-01"
+
+// maxClockSkew is the skew beyond which token validation starts failing
+const maxClockSkew = 5 * time.Minute
+
+// requiredActions are the RBAC actions a run needs on the VMs it starts
+var requiredActions = []string{
+	"Microsoft.Compute/virtualMachines/read",
+	"Microsoft.Compute/virtualMachines/start/action",
+}
+
+// diagnosis collects the outcome of the doctor checks and prints them to out
+type diagnosis struct {
+	out    io.Writer
+	failed int
+}
+
+func (d *diagnosis) ok(check, format string, args ...interface{}) {
+	fmt.Fprintf(d.out, "[INF]: %-13s ok: %s\n", check, fmt.Sprintf(format, args...))
+}
+
+func (d *diagnosis) warn(check, detail, hint string) {
+	fmt.Fprintf(d.out, "[WRN]: %-13s %s\n    hint: %s\n", check, detail, hint)
+}
+
+func (d *diagnosis) fail(check, detail, hint string) {
+	d.failed++
+	fmt.Fprintf(d.out, "[ERR]: %-13s %s\n    hint: %s\n", check, detail, hint)
+}
+
+// runDoctor implements the doctor command, checking that runs can succeed in
+// this environment and explaining how to fix what would make them fail
+func runDoctor(ctx context.Context, reporter *errorReporter, args []string) error {
+	fs := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	scope := fs.String("scope", "", "resource ID to check RBAC permissions on (default: the first visible subscription)")
+	operator := fs.String("operator-client-id", "", "client ID of the operator identity runs send action requests with")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	d := &diagnosis{out: os.Stdout}
+	d.run(ctx, *scope, *operator)
+	return d.result()
+}
+
+// run performs every check, on scope (or the first visible subscription) and,
+// when operator is set, for the operator identity as well
+func (d *diagnosis) run(ctx context.Context, scope, operator string) {
+	d.ok("credential", "%s", credentialSource())
+	d.checkReachability(ctx)
+
+	token, err := getAzureAccessToken(ctx)
+	if err != nil {
+		d.fail("token", err.Error(),
+			"sign in with `az login`, or set AZURE_TENANT_ID, AZURE_CLIENT_ID and AZURE_CLIENT_SECRET, or assign a managed identity")
+		return
+	}
+	d.checkToken(token)
+
+	if scope == "" {
+		subs, err := listSubscriptions(ctx, token)
+		if err != nil {
+			d.fail("subscriptions", err.Error(), "check that the identity can reach Resource Manager and is not blocked by Conditional Access")
+			return
+		}
+		if len(subs.Value) == 0 {
+			d.fail("subscriptions", "no subscriptions are visible",
+				"grant the identity a role (e.g. Virtual Machine Contributor) on the subscriptions or resource groups to manage")
+			return
+		}
+		d.ok("subscriptions", "%d visible", len(subs.Value))
+		scope = "/subscriptions/" + subs.Value[0].SubscriptionID
+	}
+	if operator == "" {
+		d.checkPermissions(ctx, "rbac", token, scope, false)
+		return
+	}
+
+	// The default credential only reads; the operator identity starts
+	d.checkPermissions(ctx, "rbac", token, scope, true)
+	operatorToken, err := getAzureAccessToken(withIdentity(ctx, operator))
+	if err != nil {
+		d.fail("operator", err.Error(),
+			"assign the user-assigned managed identity to this host, or set VMSTARTER_OPERATOR_CLIENT_SECRET for an app registration")
+		return
+	}
+	d.ok("operator", "token acquired for %s", operator)
+	d.checkPermissions(ctx, "operator rbac", operatorToken, scope, false)
+}
+
+func (d *diagnosis) result() error {
+	if d.failed > 0 {
+		return fmt.Errorf("%d check(s) failed", d.failed)
+	}
+	return nil
+}
+
+// credentialSource describes which DefaultAzureCredential source the environment selects
+func credentialSource() string {
+	switch {
+	case os.Getenv("AZURE_CLIENT_ID") != "" && os.Getenv("AZURE_CLIENT_SECRET") != "":
+		return "service principal with client secret (AZURE_CLIENT_SECRET)"
+	case os.Getenv("AZURE_CLIENT_ID") != "" && os.Getenv("AZURE_CLIENT_CERTIFICATE_PATH") != "":
+		return "service principal with certificate (AZURE_CLIENT_CERTIFICATE_PATH)"
+	case os.Getenv("AZURE_FEDERATED_TOKEN_FILE") != "":
+		return "workload identity (AZURE_FEDERATED_TOKEN_FILE)"
+	case os.Getenv("IDENTITY_ENDPOINT") != "" || os.Getenv("MSI_ENDPOINT") != "":
+		return "managed identity (IDENTITY_ENDPOINT)"
+	}
+	return "no environment credential; trying managed identity (IMDS), then Azure CLI and Azure Developer CLI"
+}
+
+// checkReachability sends an unauthenticated request to Resource Manager, which
+// tests DNS, proxy and TLS independently of credentials, and compares clocks
+func (d *diagnosis) checkReachability(ctx context.Context) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, armEndpoint+"/subscriptions?api-version="+subscriptionAPI, nil)
+	if err != nil {
+		d.fail("arm", err.Error(), "check the Resource Manager endpoint")
+		return
+	}
+	via := "directly"
+	if proxy, err := http.ProxyFromEnvironment(req); err == nil && proxy != nil {
+		via = "via proxy " + proxy.Redacted()
+	}
+	began := time.Now()
+	resp, err := (&http.Client{Timeout: 15 * time.Second}).Do(req)
+	if err != nil {
+		d.fail("arm", fmt.Sprintf("%s unreachable %s: %v", armEndpoint, via, err),
+			"allow outbound HTTPS to management.azure.com, or set HTTPS_PROXY (and NO_PROXY for local endpoints)")
+		return
+	}
+	resp.Body.Close()
+	d.ok("arm", "%s reachable %s in %s", armEndpoint, via, time.Since(began).Round(time.Millisecond))
+
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		d.warn("clock", "Resource Manager sent no usable Date header", "compare the system clock with an NTP source manually")
+		return
+	}
+	skew := time.Since(date).Round(time.Second)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > maxClockSkew {
+		d.fail("clock", fmt.Sprintf("local clock is %s off Resource Manager", skew),
+			"enable time synchronization (NTP); tokens are rejected once the skew exceeds a few minutes")
+		return
+	}
+	d.ok("clock", "skew %s", skew)
+}
+
+// checkToken reports who the token identifies and when it expires. The token is
+// not verified here; Resource Manager does that on every call.
+func (d *diagnosis) checkToken(token string) {
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(token, claims); err != nil {
+		d.ok("token", "acquired (not a JWT, claims unavailable)")
+		return
+	}
+	identity := claims["upn"]
+	if identity == nil {
+		identity = claims["appid"]
+	}
+	detail := fmt.Sprintf("tenant %v, identity %v, object ID %v", claims["tid"], identity, claims["oid"])
+	if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+		detail += fmt.Sprintf(", expires in %s", time.Until(exp.Time).Round(time.Minute))
+	}
+	d.ok("token", "%s", detail)
+}
+
+// checkPermissions verifies that the effective permissions of token on scope
+// allow starting VMs, or only listing them when readOnly
+func (d *diagnosis) checkPermissions(ctx context.Context, check, token, scope string, readOnly bool) {
+	var perms struct {
+		Value []struct {
+			Actions    []string `json:"actions"`
+			NotActions []string `json:"notActions"`
+		} `json:"value"`
+	}
+	url := fmt.Sprintf("%s%s/providers/Microsoft.Authorization/permissions?api-version=%s",
+		armEndpoint, strings.TrimRight(scope, "/"), permissionsAPI)
+	if err := getJSON(ctx, url, token, &perms); err != nil {
+		d.fail(check, fmt.Sprintf("cannot read permissions on %s: %v", scope, err), "check that the scope exists and is visible to the identity")
+		return
+	}
+	required, role := requiredActions, "Virtual Machine Contributor"
+	if readOnly {
+		required, role = requiredActions[:1], "Reader"
+	}
+	var missing []string
+	for _, action := range required {
+		allowed := false
+		for _, p := range perms.Value {
+			if matchesAnyAction(p.Actions, action) && !matchesAnyAction(p.NotActions, action) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			missing = append(missing, action)
+		}
+	}
+	if len(missing) > 0 {
+		d.fail(check, fmt.Sprintf("missing on %s: %s", scope, strings.Join(missing, ", ")),
+			fmt.Sprintf("az role assignment create --assignee <object ID> --role \"%s\" --scope %s", role, scope))
+		return
+	}
+	if readOnly {
+		d.ok(check, "VMs can be listed on %s", scope)
+		return
+	}
+	d.ok(check, "VMs can be listed and started on %s", scope)
+}
+
+// matchesAnyAction reports whether action matches one of the RBAC action
+// patterns, where * matches any sequence of characters
+func matchesAnyAction(patterns []string, action string) bool {
+	for _, pattern := range patterns {
+		if matchAction(strings.ToLower(pattern), strings.ToLower(action)) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAction(pattern, action string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == action
+	}
+	if !strings.HasPrefix(action, parts[0]) {
+		return false
+	}
+	action = action[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(action, part)
+		if i == -1 {
+			return false
+		}
+		action = action[i+len(part):]
+	}
+	return strings.HasSuffix(action, parts[len(parts)-1])
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// runExplain implements the explain command: it discovers the VMs named by the
+// argument and prints every decision a run with the same flags would make about them
+func runExplain(ctx context.Context, reporter *errorReporter, args []string) error {
+	opts := &options{}
+	fs := newFlagSet("explain", opts)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: explain [flags] <vm name or resource ID>")
+	}
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	if err := setupLogging(opts); err != nil {
+		return err
+	}
+	vm := fs.Arg(0)
+
+	// Explaining must not leave traces, so the journal is never opened
+	opts.journalPath = ""
+	a, err := newApp(opts, reporter)
+	if err != nil {
+		return err
+	}
+	targets, err := a.quietInventory(ctx)
+	if err != nil {
+		return err
+	}
+	ctx = withRetries(withTenant(ctx, opts.tenant), opts.armRetries)
+	token, err := getAzureAccessToken(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get Azure token: %w", err)
+	}
+	found := 0
+	for _, t := range targets {
+		if strings.EqualFold(t.Name, vm) || strings.EqualFold(t.ID, vm) {
+			found++
+			a.explain(ctx, token, t)
+		}
+	}
+	if found == 0 {
+		return fmt.Errorf("VM %q was not discovered: check the spelling, that the identity can read it (see `doctor`) "+
+			"and that --arm-filter or --rg-where do not exclude it", vm)
+	}
+	return nil
+}
+
+// explain prints the decision chain of a run for t, following the order of the
+// pipeline stages: discovery, instance view, plan rules, action, protection and approval
+func (a *app) explain(ctx context.Context, token string, t *vmTarget) {
+	opts := a.opts
+	step := 0
+	say := func(format string, args ...interface{}) {
+		step++
+		fmt.Printf("  %d. %s\n", step, fmt.Sprintf(format, args...))
+	}
+
+	fmt.Printf("VM %s (%s)\n", t.Name, t.ID)
+	say("discovered via %s in subscription %s, resource group %s", opts.discovery, t.SubscriptionID, t.ResourceGroup)
+
+	if len(opts.names) > 0 {
+		if keep, reason := nameFilter(opts.names, opts.nameFlags)(t); !keep {
+			fmt.Printf("  => skipped: %s\n", reason)
+			return
+		}
+		say("name: matches a --name-filter")
+	}
+	if len(opts.locations) > 0 {
+		if keep, reason := locationFilter(opts.locations)(t); !keep {
+			fmt.Printf("  => skipped: %s\n", reason)
+			return
+		}
+		say("location: %s is selected by --location", t.Location)
+	}
+
+	if opts.inheritTags {
+		if err := newTagInheritance(a.meta, token).apply(ctx, t); err != nil {
+			say("tag inheritance: %v", err)
+			fmt.Printf("  => skipped: effective tags unknown\n")
+			return
+		}
+		say("effective tags, inherited from the resource group and subscription: %v", t.Tags)
+	}
+
+	if len(opts.excludeTags) > 0 {
+		if keep, reason := excludeTagFilter(opts.excludeTags)(t); !keep {
+			fmt.Printf("  => skipped: %s\n", reason)
+			return
+		}
+		say("tags: carries no --exclude-tag")
+	}
+	if len(opts.tags) > 0 {
+		if keep, reason := tagFilter(opts.tags)(t); !keep {
+			fmt.Printf("  => skipped: %s\n", reason)
+			return
+		}
+		say("tags: carries every --tag")
+	}
+
+	if opts.instanceView() && !t.Arc {
+		if err := fetchInstanceView(ctx, token, t); err != nil {
+			say("instance view: %v", err)
+		} else {
+			say("instance view: power state %q, OS state %q", t.status("PowerState"), t.status("OSState"))
+		}
+	}
+
+	action := opts.action
+	if a.plan != nil {
+		matched := false
+		for i := range a.plan.Rules {
+			rule := &a.plan.Rules[i]
+			if reason := rule.Selector.mismatch(t); reason != "" {
+				say("plan %s: not matched, %s", ruleLabel(rule, i), reason)
+				continue
+			}
+			if rule.State == stateDeallocated {
+				action = actionDeallocate
+			}
+			say("plan %s: matched, desired state %s", ruleLabel(rule, i), rule.State)
+			matched = true
+			break
+		}
+		if !matched {
+			fmt.Printf("  => skipped: not matched by any plan rule\n")
+			return
+		}
+	}
+	if opts.generalized != generalizedOff {
+		if keep, reason := generalizedFilter(opts.generalized)(t); !keep {
+			fmt.Printf("  => skipped: %s\n", reason)
+			return
+		}
+	}
+	if !opts.force {
+		if keep, reason := powerStateFilter(action)(t); !keep {
+			fmt.Printf("  => skipped: %s\n", reason)
+			return
+		}
+	}
+	if opts.policyCheck {
+		if keep, reason := newPolicyCheck(ctx, token).filter(t); !keep {
+			fmt.Printf("  => skipped: %s\n", reason)
+			return
+		}
+		say("policy pre-check: no deny assignment reports the VM as non-compliant")
+	}
+	say("action: %s", action)
+	if t.Arc {
+		if keep, reason := arcFilter(a.oob)(t); !keep {
+			fmt.Printf("  => skipped: %s\n", reason)
+			return
+		}
+		if reason := t.OOB.supports(action); reason != "" {
+			fmt.Printf("  => skipped: %s\n", reason)
+			return
+		}
+		say("Arc-enabled server: acted on by out-of-band starter %s at %s", t.OOB.Name, t.OOB.URL)
+	}
+
+	if action.disrupts() {
+		if reason := a.protected.protects(t); reason != "" {
+			say("protection list: %s (never overridden, not even by --force)", reason)
+			fmt.Printf("  => skipped: %s\n", reason)
+			return
+		}
+		say("protection list: not protected")
+	}
+	if opts.opaURL != "" {
+		p := &pipeline{runID: "explain", requester: cliRequester(), labels: opts.labels, force: opts.force, dryRun: true}
+		decision, err := newOPAPolicy(opts.opaURL).decide(ctx, p.policyInput(t, action))
+		if err != nil {
+			say("policy: evaluation failed: %v", err)
+			fmt.Printf("  => fails: not attempted, policy evaluation failed\n")
+			return
+		}
+		if !decision.Allow {
+			say("policy: vetoed: %s", decision.Reason)
+			fmt.Printf("  => skipped: vetoed by policy\n")
+			return
+		}
+		say("policy: allowed, annotations %v", decision.Annotations)
+	}
+	if opts.approvalChannel != "" {
+		say("approval: the whole plan must be approved in Slack channel %s within %s", opts.approvalChannel, opts.approvalTimeout)
+	}
+	fmt.Printf("  => would %s\n", action)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// fleetLabel is the run label naming the fleet a run belongs to
+const fleetLabel = "fleet"
+
+// fleetNamePattern restricts fleet names to what is safe in labels, tags and log lines
+var fleetNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// daemonFlags configure the server process itself and cannot be set per fleet
+var daemonFlags = map[string]bool{
+	"serve": true, "api-tenant": true, "api-audience": true, "api-roles": true, "api-keys": true,
+	"api-rate": true, "api-burst": true, "api-max-runs": true, "api-max-queued": true,
+	"digest": true, "digest-time": true, "digest-slack-channel": true, "digest-email": true,
+	"fleets": true, "public-url": true, "log-level": true, "quiet": true, "verbose": true, "log-format": true,
+	"log-file": true, "log-max-size": true, "log-rotate-every": true, "log-keep": true,
+}
+
+// fleetsFile is the --fleets file
+type fleetsFile struct {
+	Fleets []fleetConfig `json:"fleets"`
+}
+
+// fleetConfig declares a fleet: the run flags of its app and, optionally,
+// when the server starts it on its own
+type fleetConfig struct {
+	Name     string         `json:"name"`
+	Args     []string       `json:"args"`
+	Schedule *fleetSchedule `json:"schedule,omitempty"`
+}
+
+// fleetSchedule starts a fleet, or queues an agent run, at a UTC time of day
+// on the given weekdays (mon … sun, every day when empty)
+type fleetSchedule struct {
+	At       string   `json:"at"`
+	Weekdays []string `json:"weekdays,omitempty"`
+
+	at   time.Duration // after midnight UTC
+	days map[time.Weekday]bool
+}
+
+// fleet is a namespace of a server: an independent app with its own flags
+// (tenant, discovery, plan, journal, notifiers) and schedule
+type fleet struct {
+	name     string
+	opts     *options
+	schedule *fleetSchedule
+}
+
+// loadFleets reads and validates the --fleets file
+func loadFleets(path string) ([]*fleet, error) {
+	data, err := readConfigFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fleets file: %w", err)
+	}
+	var file fleetsFile
+	if err := decodeStrict(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid fleets file %s: %w", path, err)
+	}
+	if len(file.Fleets) == 0 {
+		return nil, fmt.Errorf("fleets file %s declares no fleets", path)
+	}
+	seen := map[string]bool{}
+	journals := map[string]string{} // path → fleet writing it
+	fleets := make([]*fleet, 0, len(file.Fleets))
+	for _, cfg := range file.Fleets {
+		if !fleetNamePattern.MatchString(cfg.Name) {
+			return nil, fmt.Errorf("invalid fleet name %q: use lower-case letters, digits and dashes", cfg.Name)
+		}
+		if seen[cfg.Name] {
+			return nil, fmt.Errorf("fleet %q is declared twice", cfg.Name)
+		}
+		seen[cfg.Name] = true
+		f, err := newFleet(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("fleet %s: %w", cfg.Name, err)
+		}
+		if path := f.opts.journalPath; path != "" {
+			if other, ok := journals[path]; ok {
+				return nil, fmt.Errorf("fleets %s and %s share the journal %s; audit records must stay separate", other, cfg.Name, path)
+			}
+			journals[path] = cfg.Name
+		}
+		fleets = append(fleets, f)
+	}
+	return fleets, nil
+}
+
+// newFleet parses the flags and schedule of a fleet
+func newFleet(cfg fleetConfig) (*fleet, error) {
+	opts := &options{}
+	fs := newFlagSet("fleet "+cfg.Name, opts)
+	if err := fs.Parse(cfg.Args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+	var daemon []string
+	fs.Visit(func(fl *flag.Flag) {
+		if daemonFlags[fl.Name] {
+			daemon = append(daemon, "--"+fl.Name)
+		}
+	})
+	if len(daemon) > 0 {
+		return nil, fmt.Errorf("%s configure the server and cannot be set per fleet", strings.Join(daemon, ", "))
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	if cfg.Schedule != nil {
+		if err := cfg.Schedule.parse(); err != nil {
+			return nil, err
+		}
+	} else if opts.stopNotice > 0 {
+		return nil, fmt.Errorf("--stop-notice requires a schedule")
+	}
+	if opts.interactive {
+		return nil, fmt.Errorf("--interactive cannot be set per fleet: nobody answers a server's runs")
+	}
+	return &fleet{name: cfg.Name, opts: opts, schedule: cfg.Schedule}, nil
+}
+
+// parse checks the schedule and resolves its time and weekdays
+func (s *fleetSchedule) parse() error {
+	at, err := time.Parse("15:04", s.At)
+	if err != nil {
+		return fmt.Errorf("invalid schedule time %q: expected HH:MM", s.At)
+	}
+	s.at = time.Duration(at.Hour())*time.Hour + time.Duration(at.Minute())*time.Minute
+	s.days = map[time.Weekday]bool{}
+	for _, day := range s.Weekdays {
+		found := false
+		for d := time.Sunday; d <= time.Saturday; d++ {
+			if strings.EqualFold(day, d.String()[:3]) {
+				s.days[d], found = true, true
+			}
+		}
+		if !found {
+			return fmt.Errorf("invalid schedule weekday %q: expected mon, tue, wed, thu, fri, sat or sun", day)
+		}
+	}
+	return nil
+}
+
+// next returns the first scheduled start after now
+func (s *fleetSchedule) next(now time.Time) time.Time {
+	now = now.UTC()
+	next := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).Add(s.at)
+	for !next.After(now) || (len(s.days) > 0 && !s.days[next.Weekday()]) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// String describes the schedule for logs
+func (s *fleetSchedule) String() string {
+	days := "every day"
+	if len(s.Weekdays) > 0 {
+		days = strings.Join(s.Weekdays, ", ")
+	}
+	return fmt.Sprintf("%s UTC, %s", s.At, days)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// grafanaAnnotation is the body of the Grafana annotations API
+type grafanaAnnotation struct {
+	DashboardUID string   `json:"dashboardUID,omitempty"`
+	Time         int64    `json:"time,omitempty"`
+	TimeEnd      int64    `json:"timeEnd,omitempty"`
+	Tags         []string `json:"tags,omitempty"`
+	Text         string   `json:"text"`
+}
+
+// grafanaObserver marks each run as a region annotation: created when the run
+// starts and extended to its end time when it finishes
+type grafanaObserver struct {
+	baseURL      string
+	apiToken     string
+	dashboardUID string
+	tags         []string
+	messages     messageCatalog
+
+	annotationID int64
+}
+
+// runTags returns the annotation tags of run: the configured ones and its labels as key:value
+func (g *grafanaObserver) runTags(run *runInfo) []string {
+	return append(append([]string{}, g.tags...), labelPairs(run.Labels, ":")...)
+}
+
+// newGrafanaObserver builds the observer; the API token is read from GRAFANA_TOKEN
+func newGrafanaObserver(baseURL, dashboardUID string, tags []string, messages messageCatalog) (*grafanaObserver, error) {
+	apiToken := os.Getenv("GRAFANA_TOKEN")
+	if apiToken == "" {
+		return nil, fmt.Errorf("GRAFANA_TOKEN must be set")
+	}
+	return &grafanaObserver{
+		baseURL:      strings.TrimSuffix(baseURL, "/"),
+		apiToken:     apiToken,
+		dashboardUID: dashboardUID,
+		tags:         append([]string{"vm-starter"}, tags...),
+		messages:     messages,
+	}, nil
+}
+
+func (g *grafanaObserver) runStarted(ctx context.Context, run *runInfo) {
+	var created struct {
+		ID int64 `json:"id"`
+	}
+	err := g.send(ctx, http.MethodPost, "/api/annotations", grafanaAnnotation{
+		DashboardUID: g.dashboardUID,
+		Time:         run.StartedAt.UnixMilli(),
+		Tags:         g.runTags(run),
+		Text:         g.messages.format("grafana.started", run.ID),
+	}, &created)
+	if err != nil {
+		slog.Error("Failed to create Grafana annotation", "error", err)
+		return
+	}
+	g.annotationID = created.ID
+}
+
+func (g *grafanaObserver) runFinished(ctx context.Context, run *runInfo, summary *runSummary) {
+	annotation := grafanaAnnotation{
+		DashboardUID: g.dashboardUID,
+		Time:         run.StartedAt.UnixMilli(),
+		TimeEnd:      run.FinishedAt.UnixMilli(),
+		Tags:         g.runTags(run),
+		Text:         g.messages.format("grafana.finished", run.ID, summary.Accepted, summary.Failed, summary.Skipped),
+	}
+	method, path := http.MethodPost, "/api/annotations"
+	if g.annotationID != 0 {
+		method, path = http.MethodPatch, fmt.Sprintf("/api/annotations/%d", g.annotationID)
+	}
+	if err := g.send(ctx, method, path, annotation, nil); err != nil {
+		slog.Error("Failed to update Grafana annotation", "error", err)
+	}
+}
+
+// send calls the Grafana HTTP API, decoding the response into out when it is non-nil
+func (g *grafanaObserver) send(ctx context.Context, method, path string, payload, out interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, g.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+g.apiToken)
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
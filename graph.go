@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	graphEndpoint = "https://graph.microsoft.com/v1.0"
+	graphScope    = "https://graph.microsoft.com/.default"
+
+	// ownerCacheTTL is how long a resolved owner is reused
+	ownerCacheTTL = time.Hour
+	// maxGroupRecipients bounds the members of a group mailed one by one
+	maxGroupRecipients = 100
+)
+
+// ownerDirectory resolves owners naming Azure AD users or groups to the
+// addresses reaching them, through Microsoft Graph, so that owner tags can
+// hold the names people already manage in the directory:
+//
+//	alice@contoso.com    a user principal name, mailed at the user's mail address
+//	Platform Team        a group: the email address of the primary channel of
+//	                     its team, else its own mail address, else the mail
+//	                     addresses of its members
+//
+// The identity needs the User.Read.All, GroupMember.Read.All and
+// Channel.ReadBasic.All application permissions. Slack and webhook owners are
+// left as they are.
+type ownerDirectory struct {
+	mu    sync.Mutex
+	cache map[string]resolvedOwner // by tenant and owner
+}
+
+// resolvedOwner is an owner resolved at some time
+type resolvedOwner struct {
+	targets []string
+	at      time.Time
+}
+
+func newOwnerDirectory() *ownerDirectory {
+	return &ownerDirectory{cache: map[string]resolvedOwner{}}
+}
+
+// graphUser is the part of a Graph user the directory reads
+type graphUser struct {
+	Mail              string `json:"mail"`
+	UserPrincipalName string `json:"userPrincipalName"`
+	AccountEnabled    bool   `json:"accountEnabled"`
+}
+
+// graphGroup is the part of a Graph group the directory reads
+type graphGroup struct {
+	ID                          string   `json:"id"`
+	Mail                        string   `json:"mail"`
+	MailEnabled                 bool     `json:"mailEnabled"`
+	ResourceProvisioningOptions []string `json:"resourceProvisioningOptions"`
+}
+
+// resolve returns the addresses reaching owner, in the tenant of ctx
+func (d *ownerDirectory) resolve(ctx context.Context, owner string) ([]string, error) {
+	if strings.HasPrefix(owner, "slack:") || strings.HasPrefix(owner, "https://") {
+		return []string{owner}, nil
+	}
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	key := tenant + "\n" + strings.ToLower(owner)
+	d.mu.Lock()
+	cached, ok := d.cache[key]
+	d.mu.Unlock()
+	if ok && time.Since(cached.at) < ownerCacheTTL {
+		return cached.targets, nil
+	}
+
+	token, err := getAccessToken(ctx, graphScope)
+	if err != nil {
+		return nil, err
+	}
+	var targets []string
+	if strings.Contains(owner, "@") {
+		targets, err = resolveUser(ctx, token, owner)
+	} else {
+		targets, err = resolveGroup(ctx, token, owner)
+	}
+	if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	d.cache[key] = resolvedOwner{targets: targets, at: time.Now()}
+	d.mu.Unlock()
+	return targets, nil
+}
+
+// resolveUser returns the mail address of the user whose UPN is upn. Addresses
+// that are no user of the directory, such as external ones, are kept as they are.
+func resolveUser(ctx context.Context, token, upn string) ([]string, error) {
+	u := fmt.Sprintf("%s/users/%s?$select=mail,userPrincipalName,accountEnabled", graphEndpoint, url.PathEscape(upn))
+	resp, err := sendRequest(ctx, http.MethodGet, u, token, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return []string{upn}, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("looking up user %s: unexpected status: %d", upn, resp.StatusCode)
+	}
+	var user graphUser
+	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
+		return nil, fmt.Errorf("failed to parse JSON: %w", err)
+	}
+	if !user.AccountEnabled {
+		return nil, fmt.Errorf("the account of %s is disabled", upn)
+	}
+	if user.Mail == "" {
+		return nil, fmt.Errorf("user %s has no mail address", upn)
+	}
+	return []string{user.Mail}, nil
+}
+
+// resolveGroup returns the addresses reaching the group named name: the
+// primary channel of its team, the group's mailbox or its members'
+func resolveGroup(ctx context.Context, token, name string) ([]string, error) {
+	filter := url.Values{
+		"$filter": {"displayName eq '" + strings.ReplaceAll(name, "'", "''") + "'"},
+		"$select": {"id,mail,mailEnabled,resourceProvisioningOptions"},
+	}
+	var groups struct {
+		Value []graphGroup `json:"value"`
+	}
+	if err := getJSON(ctx, graphEndpoint+"/groups?"+filter.Encode(), token, &groups); err != nil {
+		return nil, fmt.Errorf("looking up group %s: %w", name, err)
+	}
+	switch len(groups.Value) {
+	case 0:
+		return nil, fmt.Errorf("no user or group is named %q", name)
+	case 1:
+	default:
+		return nil, fmt.Errorf("%d groups are named %q", len(groups.Value), name)
+	}
+	g := groups.Value[0]
+
+	if slices.Contains(g.ResourceProvisioningOptions, "Team") {
+		var channel struct {
+			Email string `json:"email"`
+		}
+		if err := getJSON(ctx, graphEndpoint+"/teams/"+g.ID+"/primaryChannel?$select=email", token, &channel); err != nil {
+			slog.Debug("Team channel address not available", "group", name, "error", err)
+		} else if channel.Email != "" {
+			return []string{channel.Email}, nil
+		}
+	}
+	if g.MailEnabled && g.Mail != "" {
+		return []string{g.Mail}, nil
+	}
+
+	var mails []string
+	next := graphEndpoint + "/groups/" + g.ID + "/transitiveMembers/microsoft.graph.user?$select=mail,userPrincipalName,accountEnabled"
+	for next != "" {
+		var page struct {
+			Value    []graphUser `json:"value"`
+			NextLink string      `json:"@odata.nextLink"`
+		}
+		if err := getJSON(ctx, next, token, &page); err != nil {
+			return nil, fmt.Errorf("listing the members of group %s: %w", name, err)
+		}
+		for _, user := range page.Value {
+			if user.AccountEnabled && user.Mail != "" {
+				mails = append(mails, user.Mail)
+			}
+		}
+		if len(mails) > maxGroupRecipients {
+			return nil, fmt.Errorf("group %s has more than %d members with a mail address: give it a mailbox or a team", name, maxGroupRecipients)
+		}
+		next = page.NextLink
+	}
+	if len(mails) == 0 {
+		return nil, fmt.Errorf("group %s has no member with a mail address", name)
+	}
+	return mails, nil
+}
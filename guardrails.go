@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+)
+
+// errRunCapExceeded is wrapped by the error of runs that selected more VMs than
+// max_vms_per_run allows
+var errRunCapExceeded = errors.New("run cap exceeded")
+
+// errProductionSelected is wrapped by the error of runs that selected VMs
+// carrying a production tag without --allow-production
+var errProductionSelected = errors.New("production VMs selected")
+
+// guardrails is the --guardrails file: limits a platform team sets for every
+// run, kept apart from the run flags so that a typo in a filter cannot also
+// change them. Unlike --max-vms they are not lifted by --force.
+type guardrails struct {
+	// MaxVMsPerRun aborts runs selecting more VMs, unless --override-cap is given (0 = no cap)
+	MaxVMsPerRun int `json:"max_vms_per_run"`
+
+	// ProductionTags mark production VMs, as key or key=value: runs selecting
+	// one are aborted unless --allow-production is given
+	ProductionTags []string `json:"production_tags,omitempty"`
+
+	production map[string][]string // parsed ProductionTags, nil when there are none
+}
+
+// loadGuardrails reads and validates the --guardrails file
+func loadGuardrails(path string) (*guardrails, error) {
+	data, err := readConfigFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read guardrails file: %w", err)
+	}
+	var g guardrails
+	if err := decodeStrict(data, &g); err != nil {
+		return nil, fmt.Errorf("invalid guardrails file %s: %w", path, err)
+	}
+	if g.MaxVMsPerRun < 0 {
+		return nil, fmt.Errorf("guardrails file %s: max_vms_per_run must not be negative", path)
+	}
+	if len(g.ProductionTags) > 0 {
+		if g.production, err = parseTagExclusions(g.ProductionTags); err != nil {
+			return nil, fmt.Errorf("guardrails file %s: production_tags: %w", path, err)
+		}
+	}
+	return &g, nil
+}
+
+// guard applies the guardrails to the selected targets before any gate. It
+// returns the error aborting the run with the skip category of its targets;
+// dry runs and overridden guardrails are only logged.
+func (p *pipeline) guard(targets []*vmTarget) (string, error) {
+	checks := []struct {
+		category, event, hint string
+		err                   error
+		overridden            bool
+	}{
+		{skipCap, "override-cap", "check the filters for a typo, or pass --override-cap if this many VMs are meant",
+			checkRunCap(len(targets), p.runCap), p.overrideCap},
+		{skipRejected, "allow-production", "pass --allow-production to act on them",
+			checkProduction(targets, p.production), p.allowProduction},
+	}
+	for _, c := range checks {
+		switch {
+		case c.err == nil:
+		case c.overridden:
+			slog.Warn("Proceeding because of --"+c.event, "error", c.err)
+			p.journal.audit(c.event, fmt.Sprintf("run=%s user=%s %v", p.runID, os.Getenv("USER"), c.err))
+		case p.dryRun:
+			slog.Warn("A real run would be aborted", "error", c.err)
+		default:
+			return c.category, fmt.Errorf("%w: %s", c.err, c.hint)
+		}
+	}
+	return "", nil
+}
+
+// checkRunCap returns an error when more than limit targets are selected
+func checkRunCap(selected, limit int) error {
+	if limit <= 0 || selected <= limit {
+		return nil
+	}
+	return fmt.Errorf("%w: %d VM(s) selected, more than max_vms_per_run %d allows", errRunCapExceeded, selected, limit)
+}
+
+// checkProduction returns an error naming the targets that carry one of the
+// production tags
+func checkProduction(targets []*vmTarget, production map[string][]string) error {
+	if production == nil {
+		return nil
+	}
+	marked := excludeTagFilter(production)
+	var names []string
+	for _, t := range targets {
+		if keep, _ := marked(t); !keep {
+			names = append(names, t.Name)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Strings(names)
+	count := len(names)
+	if count > 5 {
+		names = append(names[:5], fmt.Sprintf("%d more", count-5))
+	}
+	return fmt.Errorf("%w: %d VM(s) carry a production tag (%s)", errProductionSelected, count, strings.Join(names, ", "))
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// heartbeatAttempts bounds the pings sent after a successful run, so that a
+// single network blip does not make the monitor raise a false alarm
+const heartbeatAttempts = 3
+
+// heartbeat pings a dead man's switch URL (healthchecks.io, Cronitor, …) after
+// every successful run. The monitor alerts when the pings stop, which catches
+// a scheduler that silently stopped running VMStarter as well as failing runs.
+type heartbeat struct {
+	url string
+}
+
+func newHeartbeat(url string) *heartbeat {
+	return &heartbeat{url: url}
+}
+
+func (h *heartbeat) runStarted(ctx context.Context, run *runInfo) {}
+
+// runFinished pings the URL unless discovery failed or any VM failed
+func (h *heartbeat) runFinished(ctx context.Context, run *runInfo, summary *runSummary) {
+	if run.Err != nil || summary.Failed > 0 {
+		slog.Info("Run did not succeed, heartbeat not sent", "runId", run.ID)
+		return
+	}
+	var err error
+	for attempt := 1; attempt <= heartbeatAttempts; attempt++ {
+		if err = h.ping(ctx); err == nil {
+			return
+		}
+		if attempt < heartbeatAttempts {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Duration(attempt) * 2 * time.Second):
+			}
+		}
+	}
+	slog.Error("Failed to send heartbeat", "error", err)
+}
+
+// ping sends a single GET request to the heartbeat URL
+func (h *heartbeat) ping(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.url, nil)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Hook points of the --hooks file
+const (
+	hookPreRun      = "pre_run"
+	hookPostVMStart = "post_vm_start"
+	hookPostRun     = "post_run"
+)
+
+// defaultHookTimeout bounds hooks whose timeout is not set
+const defaultHookTimeout = time.Minute
+
+// hooksFile is the --hooks file: the commands run at each hook point, in order
+type hooksFile struct {
+	PreRun      []hookCommand `json:"pre_run,omitempty"`
+	PostVMStart []hookCommand `json:"post_vm_start,omitempty"`
+	PostRun     []hookCommand `json:"post_run,omitempty"`
+}
+
+// hookCommand is an external command; it is executed directly, without a shell
+type hookCommand struct {
+	Command []string `json:"command"`
+	Timeout string   `json:"timeout,omitempty"`
+
+	timeout time.Duration
+}
+
+// hookPayload is the run context written as JSON to the stdin of every hook
+type hookPayload struct {
+	Hook    string            `json:"hook"`
+	RunID   string            `json:"runId"`
+	Action  string            `json:"action"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	VMs     []hookVM          `json:"vms,omitempty"`     // pre_run: the VMs about to be acted on
+	Result  *resultRecord     `json:"result,omitempty"`  // post_vm_start: the accepted action
+	Summary *hookSummary      `json:"summary,omitempty"` // post_run: the outcome of the run
+}
+
+// hookVM is a VM the run is about to act on
+type hookVM struct {
+	ID             string `json:"id"`
+	Name           string `json:"name"`
+	ResourceGroup  string `json:"resourceGroup"`
+	SubscriptionID string `json:"subscriptionId"`
+	Action         string `json:"action"`
+}
+
+// hookSummary is the outcome of a run as seen by post_run hooks
+type hookSummary struct {
+	Accepted int `json:"accepted"`
+	Failed   int `json:"failed"`
+	Skipped  int `json:"skipped"`
+	// SkippedBy counts the skipped VMs per skip category
+	SkippedBy map[string]int `json:"skippedBy,omitempty"`
+	Error     string         `json:"error,omitempty"` // why discovery failed
+}
+
+// loadHooks reads and validates the --hooks file
+func loadHooks(path string) (*hooksFile, error) {
+	data, err := readConfigFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hooks file: %w", err)
+	}
+	var hooks hooksFile
+	if err := decodeStrict(data, &hooks); err != nil {
+		return nil, fmt.Errorf("invalid hooks file %s: %w", path, err)
+	}
+	points := []struct {
+		name     string
+		commands []hookCommand
+	}{
+		{hookPreRun, hooks.PreRun},
+		{hookPostVMStart, hooks.PostVMStart},
+		{hookPostRun, hooks.PostRun},
+	}
+	for _, point := range points {
+		for i := range point.commands {
+			h := &point.commands[i]
+			if len(h.Command) == 0 || h.Command[0] == "" {
+				return nil, fmt.Errorf("%s hook %d: command is empty", point.name, i+1)
+			}
+			h.timeout = defaultHookTimeout
+			if h.Timeout != "" {
+				if h.timeout, err = time.ParseDuration(h.Timeout); err != nil || h.timeout <= 0 {
+					return nil, fmt.Errorf("%s hook %d: invalid timeout %q", point.name, i+1, h.Timeout)
+				}
+			}
+		}
+	}
+	return &hooks, nil
+}
+
+// run executes the command with env added to the environment of the process
+// and payload on its stdin. Its output goes to the output of the process.
+func (h *hookCommand) run(ctx context.Context, env []string, payload *hookPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, h.Command[0], h.Command[1:]...)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%s timed out after %s", h.Command[0], h.timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", h.Command[0], err)
+	}
+	return nil
+}
+
+// runHooks runs the hooks of a single run. pre_run hooks gate the plan: the
+// first one that fails skips every VM. post_vm_start hooks run in order after
+// every accepted action, on a worker so that the report stage is not held up,
+// and post_run hooks when the run is over; their failures are only logged.
+type runHooks struct {
+	hooks  *hooksFile
+	runID  string
+	action vmAction
+	labels map[string]string
+
+	queue chan *vmResult
+	wg    sync.WaitGroup
+}
+
+// newRunHooks starts the post_vm_start worker
+func newRunHooks(hooks *hooksFile, runID string, action vmAction, labels map[string]string) *runHooks {
+	h := &runHooks{hooks: hooks, runID: runID, action: action, labels: labels, queue: make(chan *vmResult, 256)}
+	h.wg.Add(1)
+	go h.worker()
+	return h
+}
+
+// payload returns the run context common to every hook point
+func (h *runHooks) payload(hook string) *hookPayload {
+	return &hookPayload{Hook: hook, RunID: h.runID, Action: string(h.action), Labels: h.labels}
+}
+
+// env returns the run context common to every hook point as environment variables
+func (h *runHooks) env(hook string) []string {
+	return []string{
+		"VMSTARTER_HOOK=" + hook,
+		"VMSTARTER_RUN_ID=" + h.runID,
+		"VMSTARTER_ACTION=" + string(h.action),
+	}
+}
+
+// gate is a planGate running the pre_run hooks
+func (h *runHooks) gate(ctx context.Context, targets []*vmTarget) error {
+	payload := h.payload(hookPreRun)
+	payload.VMs = make([]hookVM, 0, len(targets))
+	for _, t := range targets {
+		action := t.Action
+		if action == "" {
+			action = h.action
+		}
+		payload.VMs = append(payload.VMs, hookVM{
+			ID:             t.ID,
+			Name:           t.Name,
+			ResourceGroup:  t.ResourceGroup,
+			SubscriptionID: t.SubscriptionID,
+			Action:         string(action),
+		})
+	}
+	env := append(h.env(hookPreRun), "VMSTARTER_VM_COUNT="+strconv.Itoa(len(targets)))
+	for _, cmd := range h.hooks.PreRun {
+		if err := cmd.run(ctx, env, payload); err != nil {
+			return fmt.Errorf("%s hook failed: %w", hookPreRun, err)
+		}
+	}
+	return nil
+}
+
+func (h *runHooks) publish(res *vmResult) {
+	if len(h.hooks.PostVMStart) > 0 && res.outcome() == outcomeAccepted {
+		h.queue <- res
+	}
+}
+
+func (h *runHooks) close() {
+	close(h.queue)
+	h.wg.Wait()
+}
+
+func (h *runHooks) worker() {
+	defer h.wg.Done()
+	for res := range h.queue {
+		rec := res.record(h.runID)
+		rec.Labels = h.labels
+		payload := h.payload(hookPostVMStart)
+		payload.Result = &rec
+		env := append(h.env(hookPostVMStart),
+			"VMSTARTER_VM_ID="+res.Target.ID,
+			"VMSTARTER_VM_NAME="+res.Target.Name,
+			"VMSTARTER_RESOURCE_GROUP="+res.Target.ResourceGroup,
+			"VMSTARTER_SUBSCRIPTION_ID="+res.Target.SubscriptionID,
+			"VMSTARTER_VM_ACTION="+string(res.Action),
+		)
+		for _, cmd := range h.hooks.PostVMStart {
+			// Not tied to the run context: the VM was acted on, so its hooks still run
+			if err := cmd.run(context.Background(), env, payload); err != nil {
+				slog.Error("Hook failed", "hook", hookPostVMStart, vmAttrs(res.Target), "error", err)
+			}
+		}
+	}
+}
+
+func (h *runHooks) runStarted(ctx context.Context, run *runInfo) {}
+
+// runFinished runs the post_run hooks, even when the run was interrupted
+func (h *runHooks) runFinished(ctx context.Context, run *runInfo, summary *runSummary) {
+	payload := h.payload(hookPostRun)
+	payload.Summary = &hookSummary{Accepted: summary.Accepted, Failed: summary.Failed, Skipped: summary.Skipped, SkippedBy: summary.SkippedBy}
+	if run.Err != nil {
+		payload.Summary.Error = run.Err.Error()
+	}
+	env := append(h.env(hookPostRun),
+		"VMSTARTER_ACCEPTED="+strconv.Itoa(summary.Accepted),
+		"VMSTARTER_FAILED="+strconv.Itoa(summary.Failed),
+		"VMSTARTER_SKIPPED="+strconv.Itoa(summary.Skipped),
+	)
+	for _, cmd := range h.hooks.PostRun {
+		if err := cmd.run(context.WithoutCancel(ctx), env, payload); err != nil {
+			slog.Error("Hook failed", "hook", hookPostRun, "error", err)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// tagInheritance merges resource group and subscription tags into the tags of
+// VMs: VM tags override resource group tags, which override subscription tags.
+// Lookups are shared by the VMs of a run and go through the metadata cache.
+// It is not safe for concurrent use.
+type tagInheritance struct {
+	meta  *metadataCache
+	token string
+	subs  map[string]map[string]string // lower-cased subscription ID → tags, nil until loaded
+	rgs   map[string]map[string]string // lower-cased subscription/resource group → tags
+}
+
+func newTagInheritance(meta *metadataCache, token string) *tagInheritance {
+	return &tagInheritance{meta: meta, token: token, rgs: map[string]map[string]string{}}
+}
+
+// apply replaces the tags of t with its effective tag set. On error the tags
+// of t are left as they are.
+func (h *tagInheritance) apply(ctx context.Context, t *vmTarget) error {
+	if h.subs == nil {
+		subs, err := h.meta.subscriptions(ctx, h.token)
+		if err != nil {
+			return fmt.Errorf("failed to read subscription tags: %w", err)
+		}
+		h.subs = map[string]map[string]string{}
+		for _, sub := range subs.Value {
+			h.subs[strings.ToLower(sub.SubscriptionID)] = sub.Tags
+		}
+	}
+	key := strings.ToLower(t.SubscriptionID + "/" + t.ResourceGroup)
+	rgTags, ok := h.rgs[key]
+	if !ok {
+		var err error
+		if rgTags, err = h.meta.resourceGroupTags(ctx, h.token, t.SubscriptionID, t.ResourceGroup); err != nil {
+			return fmt.Errorf("failed to read the tags of resource group %s: %w", t.ResourceGroup, err)
+		}
+		h.rgs[key] = rgTags
+	}
+
+	effective := map[string]string{}
+	overlayTags(effective, h.subs[strings.ToLower(t.SubscriptionID)])
+	overlayTags(effective, rgTags)
+	overlayTags(effective, t.Tags)
+	t.Tags = effective
+	return nil
+}
+
+// overlayTags copies src into dst, replacing keys that only differ in case
+// because Azure tag names are case-insensitive
+func overlayTags(dst, src map[string]string) {
+	for k, v := range src {
+		for existing := range dst {
+			if strings.EqualFold(existing, k) {
+				delete(dst, existing)
+			}
+		}
+		dst[k] = v
+	}
+}
+
+// inheritedTagsFilter skips VMs whose effective tags could not be determined,
+// since tag selectors and protections would otherwise see an incomplete set
+func inheritedTagsFilter(t *vmTarget) (bool, string) {
+	if t.inheritErr != nil {
+		return false, fmt.Sprintf("effective tags unknown: %v", t.inheritErr)
+	}
+	return true, ""
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Handling of generalized VMs
+const (
+	generalizedSkip = "skip"
+	generalizedWarn = "warn"
+	generalizedOff  = "off"
+)
+
+// fetchInstanceView loads the instance view status codes of t, such as
+// PowerState/running or OSState/generalized
+func fetchInstanceView(ctx context.Context, token string, t *vmTarget) error {
+	viewURL := fmt.Sprintf("%s%s/instanceView?api-version=%s", armEndpoint, t.ID, vmAPI)
+	var view struct {
+		Statuses []struct {
+			Code string `json:"code"`
+		} `json:"statuses"`
+	}
+	if err := getJSON(ctx, viewURL, token, &view); err != nil {
+		return fmt.Errorf("failed to fetch instance view: %w", err)
+	}
+	t.Statuses = make([]string, len(view.Statuses))
+	for i, s := range view.Statuses {
+		t.Statuses[i] = s.Code
+	}
+	return nil
+}
+
+// instanceViewCache keeps instance view statuses across runs for ttl, so that
+// frequent runs in server mode don't reload every VM. A nil cache fetches every time.
+type instanceViewCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]cachedInstanceView // lower-cased VM ID
+}
+
+type cachedInstanceView struct {
+	statuses []string
+	fetched  time.Time
+}
+
+func newInstanceViewCache(ttl time.Duration) *instanceViewCache {
+	return &instanceViewCache{ttl: ttl, entries: map[string]cachedInstanceView{}}
+}
+
+// fetch sets the statuses of t from the cache, or loads and caches them
+func (c *instanceViewCache) fetch(ctx context.Context, token string, t *vmTarget) error {
+	if c == nil {
+		return fetchInstanceView(ctx, token, t)
+	}
+	key := strings.ToLower(t.ID)
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && time.Since(entry.fetched) < c.ttl {
+		t.Statuses = entry.statuses
+		return nil
+	}
+	if err := fetchInstanceView(ctx, token, t); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.entries[key] = cachedInstanceView{statuses: t.Statuses, fetched: time.Now()}
+	c.mu.Unlock()
+	return nil
+}
+
+// status returns the value of the instance view status with the given kind,
+// e.g. "running" for kind PowerState, or "" when the status is unknown
+func (t *vmTarget) status(kind string) string {
+	prefix := strings.ToLower(kind) + "/"
+	for _, code := range t.Statuses {
+		if strings.HasPrefix(strings.ToLower(code), prefix) {
+			return strings.ToLower(code[len(prefix):])
+		}
+	}
+	return ""
+}
+
+// generalizedFilter rejects generalized VMs, which Azure refuses to start; in
+// warn mode they are only reported and still attempted
+func generalizedFilter(mode string) vmFilter {
+	return func(t *vmTarget) (bool, string) {
+		if t.status("OSState") != "generalized" {
+			return true, ""
+		}
+		reason := "VM is generalized and cannot be started; create an image from it and delete it, or redeploy it from a specialized disk"
+		if mode == generalizedWarn {
+			slog.Warn(reason, vmAttrs(t))
+			return true, ""
+		}
+		return false, reason
+	}
+}
+
+// powerStateFilter skips VMs that are already in, or on their way to, the state
+// their action leads to, saving the request: starts are only sent to stopped or
+// deallocated VMs, and VMs still stopping are left for a later run. VMs whose
+// power state is unknown are always attempted, and restart and redeploy apply
+// in any state.
+func powerStateFilter(defaultAction vmAction) vmFilter {
+	return func(t *vmTarget) (bool, string) {
+		action := t.Action
+		if action == "" {
+			action = defaultAction
+		}
+		state := t.status("PowerState")
+		if state == "" {
+			return true, ""
+		}
+		var wanted []string
+		switch action {
+		case actionStart:
+			switch state {
+			case "stopped", "deallocated":
+				return true, ""
+			case "stopping", "deallocating":
+				return false, "still " + state + ": start it once it is down"
+			}
+			return false, "already " + state
+		case actionPowerOff:
+			wanted = []string{"stopping", "stopped", "deallocating", "deallocated"}
+		case actionDeallocate:
+			wanted = []string{"deallocating", "deallocated"}
+		}
+		for _, w := range wanted {
+			if state == w {
+				return false, "already " + state
+			}
+		}
+		return true, ""
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+)
+
+// interactivePicker is a targetPicker listing the targets of a command-line
+// run as a checklist on the terminal, for ad-hoc runs where filters are too
+// blunt: only the VMs the operator checks are acted on. Checking them
+// confirms the run, so no other confirmation is asked.
+func interactivePicker(in, out *os.File, action vmAction) targetPicker {
+	return func(ctx context.Context, targets []*vmTarget) ([]*vmTarget, error) {
+		if len(targets) == 0 {
+			return nil, nil
+		}
+		fd := int(in.Fd())
+		if !term.IsTerminal(fd) {
+			return nil, fmt.Errorf("not selected: --interactive requires stdin to be a terminal")
+		}
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return nil, fmt.Errorf("not selected: %w", err)
+		}
+		defer term.Restore(fd, state)
+		// Draw on the alternate screen, leaving the logs of the run untouched
+		io.WriteString(out, "\x1b[?1049h\x1b[?25l")
+		defer io.WriteString(out, "\x1b[?25h\x1b[?1049l")
+
+		c := newChecklist(targets, action)
+		buf := make([]byte, 64)
+		for {
+			width, height, err := term.GetSize(int(out.Fd()))
+			if err != nil {
+				width, height = 80, 24
+			}
+			c.render(out, width, height)
+			n, err := in.Read(buf)
+			if err != nil {
+				return nil, fmt.Errorf("not selected: %w", err)
+			}
+			switch c.handle(buf[:n]) {
+			case checklistConfirm:
+				return c.selected(), nil
+			case checklistCancel:
+				return nil, fmt.Errorf("not selected: cancelled by the operator")
+			}
+		}
+	}
+}
+
+// checklistEvent is what a key press did to a checklist
+type checklistEvent int
+
+const (
+	checklistContinue checklistEvent = iota
+	checklistConfirm
+	checklistCancel
+)
+
+// checklist is the state of the interactive picker
+type checklist struct {
+	action  vmAction
+	rows    []*vmTarget // by subscription, resource group and name
+	checked []bool
+	filter  string
+	editing bool  // keys go to the filter
+	shown   []int // indexes of the rows the filter matches
+	cursor  int   // index into shown
+	top     int   // first shown row on screen
+	page    int   // rows on screen
+}
+
+func newChecklist(targets []*vmTarget, action vmAction) *checklist {
+	rows := append([]*vmTarget(nil), targets...)
+	sort.Slice(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		if a.SubscriptionID != b.SubscriptionID {
+			return a.SubscriptionID < b.SubscriptionID
+		}
+		if !strings.EqualFold(a.ResourceGroup, b.ResourceGroup) {
+			return strings.ToLower(a.ResourceGroup) < strings.ToLower(b.ResourceGroup)
+		}
+		return strings.ToLower(a.Name) < strings.ToLower(b.Name)
+	})
+	c := &checklist{action: action, rows: rows, checked: make([]bool, len(rows)), page: 10}
+	c.refilter()
+	return c
+}
+
+// selected returns the checked targets
+func (c *checklist) selected() []*vmTarget {
+	var out []*vmTarget
+	for i, t := range c.rows {
+		if c.checked[i] {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// refilter recomputes the rows the filter matches and keeps the cursor on them
+func (c *checklist) refilter() {
+	c.shown = c.shown[:0]
+	for i, t := range c.rows {
+		if checklistMatch(t, c.filter) {
+			c.shown = append(c.shown, i)
+		}
+	}
+	c.move(0)
+}
+
+// checklistMatch reports whether t matches every word of filter: a part of
+// its name, sub:<part of the subscription ID>, rg:<part of the resource
+// group> or tag:<key>[=<part of the value>], case-insensitively
+func checklistMatch(t *vmTarget, filter string) bool {
+	for _, word := range strings.Fields(strings.ToLower(filter)) {
+		var ok bool
+		switch {
+		case strings.HasPrefix(word, "sub:"):
+			ok = strings.Contains(strings.ToLower(t.SubscriptionID), word[len("sub:"):])
+		case strings.HasPrefix(word, "rg:"):
+			ok = strings.Contains(strings.ToLower(t.ResourceGroup), word[len("rg:"):])
+		case strings.HasPrefix(word, "tag:"):
+			key, value, hasValue := strings.Cut(word[len("tag:"):], "=")
+			var got string
+			got, ok = lookupTag(t.Tags, key)
+			ok = ok && (!hasValue || strings.Contains(strings.ToLower(got), value))
+		default:
+			ok = strings.Contains(strings.ToLower(t.Name), word)
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// move moves the cursor by delta shown rows, within bounds
+func (c *checklist) move(delta int) {
+	c.cursor = max(0, min(c.cursor+delta, len(c.shown)-1))
+}
+
+// handle applies the keys of one read from the terminal
+func (c *checklist) handle(keys []byte) checklistEvent {
+	for len(keys) > 0 {
+		key := keys[0]
+		keys = keys[1:]
+		if key == 0x03 { // Ctrl-C
+			return checklistCancel
+		}
+		if key == 0x1b {
+			if len(keys) >= 2 && keys[0] == '[' {
+				seq := keys[1]
+				keys = keys[2:]
+				if (seq == '5' || seq == '6') && len(keys) > 0 && keys[0] == '~' {
+					keys = keys[1:]
+					if seq == '5' {
+						c.move(-c.page)
+					} else {
+						c.move(c.page)
+					}
+				}
+				switch seq {
+				case 'A':
+					c.move(-1)
+				case 'B':
+					c.move(1)
+				case 'H':
+					c.move(-len(c.shown))
+				case 'F':
+					c.move(len(c.shown))
+				}
+				continue
+			}
+			// A lone Esc leaves the filter, or cancels
+			if c.editing {
+				c.editing = false
+				continue
+			}
+			return checklistCancel
+		}
+		if c.editing {
+			switch {
+			case key == '\r' || key == '\n':
+				c.editing = false
+			case key == 0x7f || key == 0x08:
+				_, size := utf8.DecodeLastRuneInString(c.filter)
+				c.filter = c.filter[:len(c.filter)-size]
+				c.refilter()
+			case key >= 0x20:
+				c.filter += string([]byte{key})
+				c.refilter()
+			}
+			continue
+		}
+		switch key {
+		case '\r', '\n':
+			return checklistConfirm
+		case 'q':
+			return checklistCancel
+		case 'k':
+			c.move(-1)
+		case 'j':
+			c.move(1)
+		case ' ':
+			if len(c.shown) > 0 {
+				i := c.shown[c.cursor]
+				c.checked[i] = !c.checked[i]
+				c.move(1)
+			}
+		case 'a':
+			// Check every shown row, or uncheck them all when they already are
+			all := true
+			for _, i := range c.shown {
+				all = all && c.checked[i]
+			}
+			for _, i := range c.shown {
+				c.checked[i] = !all
+			}
+		case '/':
+			c.editing = true
+		}
+	}
+	return checklistContinue
+}
+
+// render draws the checklist on a terminal of the given size
+func (c *checklist) render(w io.Writer, width, height int) {
+	var s strings.Builder
+	line := func(format string, args ...interface{}) {
+		s.WriteString(truncateRunes(fmt.Sprintf(format, args...), width) + "\x1b[K\r\n")
+	}
+	s.WriteString("\x1b[H")
+	line("Select the VMs to %s: ↑/↓ move, space check, a check all shown, / filter, enter %s, q cancel", c.action, c.action)
+	switch {
+	case c.editing:
+		line("Filter: %s▏", c.filter)
+	case c.filter == "":
+		line("Filter: none (by name, sub:<subscription>, rg:<resource group>, tag:<key>[=<value>])")
+	default:
+		line("Filter: %s", c.filter)
+	}
+	line("")
+
+	c.page = max(1, height-5)
+	if c.cursor < c.top {
+		c.top = c.cursor
+	} else if c.cursor >= c.top+c.page {
+		c.top = c.cursor - c.page + 1
+	}
+	c.top = max(0, min(c.top, len(c.shown)-c.page))
+	nameWidth, groupWidth := 4, 14
+	for _, t := range c.rows {
+		nameWidth = min(max(nameWidth, utf8.RuneCountInString(t.Name)), 32)
+		groupWidth = min(max(groupWidth, utf8.RuneCountInString(t.ResourceGroup)), 28)
+	}
+	for row := 0; row < c.page; row++ {
+		if c.top+row >= len(c.shown) {
+			line("")
+			continue
+		}
+		i := c.shown[c.top+row]
+		t := c.rows[i]
+		cursor, box := " ", "[ ]"
+		if c.top+row == c.cursor {
+			cursor = ">"
+		}
+		if c.checked[i] {
+			box = "[x]"
+		}
+		line("%s %s %-*s  %-*s  %-36s  %s", cursor, box, nameWidth, truncateRunes(t.Name, nameWidth),
+			groupWidth, truncateRunes(t.ResourceGroup, groupWidth), t.SubscriptionID, formatTags(t.Tags))
+	}
+	line("")
+	checked := 0
+	for _, ok := range c.checked {
+		if ok {
+			checked++
+		}
+	}
+	s.WriteString(truncateRunes(fmt.Sprintf("%d of %d VM(s) checked, %d shown", checked, len(c.rows), len(c.shown)), width) + "\x1b[K\x1b[J")
+	io.WriteString(w, s.String())
+}
+
+// truncateRunes cuts s to at most n runes, marking the cut with an ellipsis
+func truncateRunes(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	if n <= 0 {
+		return ""
+	}
+	runes := []rune(s)
+	return string(runes[:n-1]) + "…"
+}
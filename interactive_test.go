@@ -0,0 +1,68 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestChecklistHandle(t *testing.T) {
+	targets := []*vmTarget{
+		{Name: "web-2", ResourceGroup: "rg-a", SubscriptionID: "sub1"},
+		{Name: "db-1", ResourceGroup: "rg-b", SubscriptionID: "sub1", Tags: map[string]string{"env": "prod"}},
+		{Name: "web-1", ResourceGroup: "rg-a", SubscriptionID: "sub1"},
+		{Name: "api-1", ResourceGroup: "rg-c", SubscriptionID: "sub2", Tags: map[string]string{"Env": "test"}},
+	}
+	// Rows are sorted by subscription, resource group and name:
+	// web-1, web-2, db-1, api-1
+	tests := []struct {
+		name     string
+		keys     []string // one read from the terminal each
+		event    checklistEvent
+		selected []string
+	}{
+		{"confirm nothing", []string{"\r"}, checklistConfirm, nil},
+		{"check the first row", []string{" ", "\r"}, checklistConfirm, []string{"web-1"}},
+		{"check in one read", []string{"  \r"}, checklistConfirm, []string{"web-1", "web-2"}},
+		{"move down with j and the arrow", []string{"j", "\x1b[B", " ", "\n"}, checklistConfirm, []string{"db-1"}},
+		{"move up stops at the top", []string{"k\x1b[A ", "\r"}, checklistConfirm, []string{"web-1"}},
+		{"end and home", []string{"\x1b[F ", "\x1b[H ", "\r"}, checklistConfirm, []string{"web-1", "api-1"}},
+		{"page down", []string{"\x1b[6~ ", "\r"}, checklistConfirm, []string{"api-1"}},
+		{"uncheck", []string{" k ", "\r"}, checklistConfirm, nil},
+		{"check all", []string{"a", "\r"}, checklistConfirm, []string{"web-1", "web-2", "db-1", "api-1"}},
+		{"check all twice unchecks", []string{"aa", "\r"}, checklistConfirm, nil},
+		{"filter by name", []string{"/web\r", "a", "\r"}, checklistConfirm, []string{"web-1", "web-2"}},
+		{"filter by resource group", []string{"/rg:b\r", " ", "\r"}, checklistConfirm, []string{"db-1"}},
+		{"filter by tag key and value", []string{"/tag:env=te\r", "a\r"}, checklistConfirm, []string{"api-1"}},
+		{"filter by subscription", []string{"/sub:sub2", "\ra\r"}, checklistConfirm, []string{"api-1"}},
+		{"backspace edits the filter", []string{"/dbx\x7f\r", "a\r"}, checklistConfirm, []string{"db-1"}},
+		{"esc leaves the filter", []string{"/web\x1b", "a", "\r"}, checklistConfirm, []string{"web-1", "web-2"}},
+		{"filter keeps checks of hidden rows", []string{" ", "/db\r", " ", "\r"}, checklistConfirm, []string{"web-1", "db-1"}},
+		{"keys typed in the filter do not act", []string{"/q a\r"}, checklistContinue, nil},
+		{"q cancels", []string{" ", "q"}, checklistCancel, nil},
+		{"esc cancels", []string{"\x1b"}, checklistCancel, nil},
+		{"ctrl-c cancels while filtering", []string{"/w\x03"}, checklistCancel, nil},
+		{"keys after the confirmation are ignored", []string{"\r q"}, checklistConfirm, nil},
+	}
+	for _, tt := range tests {
+		c := newChecklist(targets, actionStart)
+		event := checklistContinue
+		for _, keys := range tt.keys {
+			if event = c.handle([]byte(keys)); event != checklistContinue {
+				break
+			}
+		}
+		if event != tt.event {
+			t.Errorf("%s: event = %d, want %d", tt.name, event, tt.event)
+		}
+		if event != checklistConfirm {
+			continue
+		}
+		var names []string
+		for _, target := range c.selected() {
+			names = append(names, target.Name)
+		}
+		if !reflect.DeepEqual(names, tt.selected) {
+			t.Errorf("%s: selected %q, want %q", tt.name, names, tt.selected)
+		}
+	}
+}
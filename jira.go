@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// defaultJiraTemplate renders the issue description or comment in Jira wiki markup
+const defaultJiraTemplate = `{{msg "jira.description" .Run.ID .Summary.Failed .Summary.Accepted .Summary.Skipped}}{{range $key, $value := .Run.Labels}}
+*{{$key}}*: {{$value}}{{end}}
+
+{{msg "jira.failures_table"}}
+{{range .Summary.Failures}}|{{.Target.SubscriptionID}}|{{.Target.ResourceGroup}}|{{.Target.Name}}|{{.Action}}|{{.Err}}|
+{{end}}`
+
+// jiraTemplateData is the data available to the body template
+type jiraTemplateData struct {
+	Run     *runInfo
+	Summary *runSummary
+}
+
+// jiraObserver files a Jira issue, or comments on an existing one, when a run
+// ends with at least threshold failed VMs
+type jiraObserver struct {
+	baseURL   string
+	project   string
+	issueType string
+	issueKey  string
+	threshold int
+	user      string
+	apiToken  string
+	tmpl      *template.Template
+	messages  messageCatalog
+}
+
+// newJiraObserver builds the observer; issueKey comments on an existing issue instead of creating one
+func newJiraObserver(baseURL, project, issueType, issueKey, templatePath string, threshold int, messages messageCatalog) (*jiraObserver, error) {
+	if project == "" && issueKey == "" {
+		return nil, fmt.Errorf("--jira-project or --jira-issue is required with --jira-url")
+	}
+	text := defaultJiraTemplate
+	if templatePath != "" {
+		data, err := os.ReadFile(templatePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Jira template: %w", err)
+		}
+		text = string(data)
+	}
+	tmpl, err := template.New("jira").Funcs(messages.funcs()).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Jira template: %w", err)
+	}
+	user, apiToken := os.Getenv("JIRA_USER"), os.Getenv("JIRA_API_TOKEN")
+	if user == "" || apiToken == "" {
+		return nil, fmt.Errorf("JIRA_USER and JIRA_API_TOKEN must be set")
+	}
+	return &jiraObserver{
+		baseURL:   strings.TrimSuffix(baseURL, "/"),
+		project:   project,
+		issueType: issueType,
+		issueKey:  issueKey,
+		threshold: threshold,
+		user:      user,
+		apiToken:  apiToken,
+		tmpl:      tmpl,
+		messages:  messages,
+	}, nil
+}
+
+func (j *jiraObserver) runStarted(ctx context.Context, run *runInfo) {}
+
+func (j *jiraObserver) runFinished(ctx context.Context, run *runInfo, summary *runSummary) {
+	if summary.Failed == 0 || summary.Failed < j.threshold {
+		return
+	}
+	var body bytes.Buffer
+	if err := j.tmpl.Execute(&body, jiraTemplateData{Run: run, Summary: summary}); err != nil {
+		slog.Error("Failed to render Jira template", "error", err)
+		return
+	}
+
+	if j.issueKey != "" {
+		if _, err := j.post(ctx, "/rest/api/2/issue/"+j.issueKey+"/comment", map[string]interface{}{"body": body.String()}); err != nil {
+			slog.Error("Failed to comment on Jira issue", "issue", j.issueKey, "error", err)
+			return
+		}
+		slog.Info("Commented on Jira issue", "issue", j.issueKey)
+		return
+	}
+
+	fields := map[string]interface{}{
+		"project":     map[string]string{"key": j.project},
+		"issuetype":   map[string]string{"name": j.issueType},
+		"summary":     j.messages.format("jira.summary", summary.Failed, run.ID),
+		"description": body.String(),
+	}
+	created, err := j.post(ctx, "/rest/api/2/issue", map[string]interface{}{"fields": fields})
+	if err != nil {
+		slog.Error("Failed to create Jira issue", "error", err)
+		return
+	}
+	slog.Info("Created Jira issue", "issue", created["key"])
+}
+
+// post sends a JSON request to the Jira REST API and decodes the response object
+func (j *jiraObserver) post(ctx context.Context, path string, payload interface{}) (map[string]interface{}, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, j.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(j.user, j.apiToken)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+	var out map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("failed to parse Jira JSON: %w", err)
+	}
+	return out, nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Journal record phases
+const (
+	journalIntent = "intent"
+	journalDone   = "done"
+	journalFailed = "failed"
+	journalAudit  = "audit"
+
+	// journalDecision records what a run decided about a VM: its action, or
+	// why it was skipped; written in one batch when the run is over
+	journalDecision = "decision"
+
+	// journalSnooze postpones the scheduled stops of a VM until a time
+	journalSnooze = "snooze"
+)
+
+// journalRecord is a single line of the write-ahead journal
+type journalRecord struct {
+	Time       time.Time `json:"time"`
+	Seq        int64     `json:"seq"`
+	Phase      string    `json:"phase"`
+	Action     string    `json:"action"`
+	ResourceID string    `json:"resourceId,omitempty"`
+	Team       string    `json:"team,omitempty"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Detail     string    `json:"detail,omitempty"`
+	RunID      string    `json:"runId,omitempty"`
+	Until      time.Time `json:"until,omitzero"`
+}
+
+// journal is an append-only, durable log of issued operations.
+// An intent record is durable before the request is sent, so after a crash
+// every intent without a matching done/failed record may or may not have happened.
+// A nil *journal is valid and records nothing.
+type journal struct {
+	mu    sync.Mutex
+	store journalStore
+	seq   int64
+}
+
+// openJournal opens (or creates) the journal at location (see openStore),
+// returning nil when location is empty
+func openJournal(location string) (*journal, error) {
+	if location == "" {
+		return nil, nil
+	}
+	store, err := openStore(location, true)
+	if err != nil {
+		return nil, err
+	}
+	// Seed the sequence from the clock so records stay unique across runs
+	return &journal{store: store, seq: time.Now().UnixNano()}, nil
+}
+
+// runs returns the store of server runs, or nil when the journal keeps none
+func (j *journal) runs() runStore {
+	if j == nil {
+		return nil
+	}
+	rs, _ := j.store.(runStore)
+	return rs
+}
+
+// append writes a record and flushes it to stable storage
+func (j *journal) append(rec journalRecord) error {
+	return j.appendAll([]journalRecord{rec})
+}
+
+// appendAll writes records with a single flush to stable storage
+func (j *journal) appendAll(recs []journalRecord) error {
+	now := time.Now().UTC()
+	for i := range recs {
+		recs[i].Time = now
+	}
+	return j.store.append(recs)
+}
+
+// record writes records nothing depends on being written, logging failures
+func (j *journal) record(recs ...journalRecord) {
+	if err := j.appendAll(recs); err != nil {
+		slog.Error("Failed to write journal record", "error", err)
+	}
+}
+
+// intent records that run runID is about to issue action for resourceID, owned
+// by team (if known), and returns its sequence number. The action must not be
+// issued when the intent could not be written: after a crash the journal would
+// not know it may have happened.
+func (j *journal) intent(runID, action, resourceID, team string) (int64, error) {
+	if j == nil {
+		return 0, nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.seq++
+	if err := j.append(journalRecord{Seq: j.seq, Phase: journalIntent, Action: action, ResourceID: resourceID, Team: team, RunID: runID}); err != nil {
+		return 0, fmt.Errorf("failed to record the intent in the journal: %w", err)
+	}
+	return j.seq, nil
+}
+
+// complete marks the intent seq as done (err == nil) or failed
+func (j *journal) complete(seq int64, action, resourceID, team string, statusCode int, err error) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	rec := journalRecord{Seq: seq, Phase: journalDone, Action: action, ResourceID: resourceID, Team: team, StatusCode: statusCode}
+	if err != nil {
+		rec.Phase = journalFailed
+		rec.Error = err.Error()
+	}
+	j.record(rec)
+}
+
+// decisions records the decision records of run runID in one batch
+func (j *journal) decisions(runID string, recs []journalRecord) {
+	if j == nil || len(recs) == 0 {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for i := range recs {
+		j.seq++
+		recs[i].Seq, recs[i].Phase, recs[i].RunID = j.seq, journalDecision, runID
+	}
+	j.record(recs...)
+}
+
+// audit records a run-level event, such as safety checks being bypassed
+func (j *journal) audit(event, detail string) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.seq++
+	j.record(journalRecord{Seq: j.seq, Phase: journalAudit, Action: event, Detail: detail})
+}
+
+// snooze records that the scheduled stops of resourceID are postponed until
+// until, for the reasons in detail. Unlike other records its failure is
+// returned: a snooze that was not written would not keep the VM up.
+func (j *journal) snooze(resourceID string, until time.Time, detail string) error {
+	if j == nil {
+		return fmt.Errorf("snoozes are recorded in the journal, and there is none")
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.seq++
+	if err := j.append(journalRecord{Seq: j.seq, Phase: journalSnooze, Action: "snooze", ResourceID: resourceID, Until: until.UTC(), Detail: detail}); err != nil {
+		return fmt.Errorf("failed to record the snooze: %w", err)
+	}
+	return nil
+}
+
+// readJournal calls fn with every record of the journal at location, in order
+func readJournal(location string, fn func(rec *journalRecord)) error {
+	store, err := openStore(location, false)
+	if err != nil {
+		return err
+	}
+	defer store.close()
+	return store.read(fn)
+}
+
+// close flushes and closes the journal store
+func (j *journal) close() error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.store.close()
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// failingStore is a journal store whose writes fail
+type failingStore struct{}
+
+func (failingStore) append(recs []journalRecord) error      { return errors.New("disk full") }
+func (failingStore) read(fn func(rec *journalRecord)) error { return nil }
+func (failingStore) close() error                           { return nil }
+
+func TestPerformWithoutIntent(t *testing.T) {
+	p := &pipeline{
+		runID:   "test",
+		journal: &journal{store: failingStore{}},
+		// A request that got past the journal would fail on the token instead
+		access: &accessGuard{token: "token", lost: map[string]string{}},
+	}
+	for _, target := range []*vmTarget{
+		testTarget("sub1", "rg-a", "web-1", nil),
+		{ID: "/subscriptions/sub1/resourceGroups/rg-a/providers/Microsoft.HybridCompute/machines/edge-1", Name: "edge-1", Arc: true, OOB: &oobStarter{Name: "edge", URL: "http://127.0.0.1:1/start"}},
+	} {
+		res := p.perform(context.Background(), target, actionStart)
+		if res.Err == nil || !strings.Contains(res.Err.Error(), "not attempted") || !strings.Contains(res.Err.Error(), "disk full") {
+			t.Errorf("%s: result error %v, want the request not attempted", target.Name, res.Err)
+		}
+		if res.StatusCode != 0 || res.Duration != 0 {
+			t.Errorf("%s: request sent, status %d", target.Name, res.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Key Vault API version and token scope
+const (
+	keyVaultAPI   = "7.4"
+	keyVaultScope = "https://vault.azure.net/.default"
+)
+
+// keyVaultRefPrefix starts a Key Vault reference, in the syntax App Service uses
+const keyVaultRefPrefix = "@Microsoft.KeyVault("
+
+// keyVaultSuffixes are the DNS suffixes of Key Vault in the Azure clouds; the
+// vault token is never sent anywhere else
+var keyVaultSuffixes = []string{".vault.azure.net", ".vault.azure.cn", ".vault.usgovcloudapi.net"}
+
+// parseKeyVaultRef returns the URL of the secret a reference names, in either
+// form:
+//
+//	@Microsoft.KeyVault(SecretUri=https://myvault.vault.azure.net/secrets/name[/version])
+//	@Microsoft.KeyVault(VaultName=myvault;SecretName=name[;SecretVersion=version])
+func parseKeyVaultRef(ref string) (string, error) {
+	body, ok := strings.CutPrefix(ref, keyVaultRefPrefix)
+	if !ok || !strings.HasSuffix(body, ")") {
+		return "", fmt.Errorf("expected %s…)", keyVaultRefPrefix)
+	}
+	params := map[string]string{}
+	for _, part := range strings.Split(strings.TrimSuffix(body, ")"), ";") {
+		key, value, _ := strings.Cut(part, "=")
+		params[strings.ToLower(strings.TrimSpace(key))] = strings.TrimSpace(value)
+	}
+	secretURL := params["secreturi"]
+	if secretURL == "" {
+		if params["vaultname"] == "" || params["secretname"] == "" {
+			return "", fmt.Errorf("expected SecretUri, or VaultName and SecretName")
+		}
+		secretURL = fmt.Sprintf("https://%s%s/secrets/%s", params["vaultname"], keyVaultSuffixes[0], params["secretname"])
+		if version := params["secretversion"]; version != "" {
+			secretURL += "/" + version
+		}
+	}
+	u, err := url.Parse(secretURL)
+	if err != nil || u.Scheme != "https" || !strings.HasPrefix(u.Path, "/secrets/") {
+		return "", fmt.Errorf("invalid secret URI %q", secretURL)
+	}
+	for _, suffix := range keyVaultSuffixes {
+		if strings.HasSuffix(strings.ToLower(u.Hostname()), suffix) {
+			return strings.TrimRight(secretURL, "/"), nil
+		}
+	}
+	return "", fmt.Errorf("secret URI %q is not a Key Vault", secretURL)
+}
+
+// secretRef is a configuration value holding a Key Vault reference
+type secretRef struct {
+	name  string // flag or environment variable
+	url   string
+	apply func(secret string)
+}
+
+// secretRefs finds the configuration values holding Key Vault references: every
+// environment variable except the credential's own (AZURE_*), which are needed
+// to reach Key Vault in the first place, and the flags whose URLs embed secrets
+func secretRefs(opts *options) ([]secretRef, error) {
+	var refs []secretRef
+	add := func(name, value string, apply func(string)) error {
+		if !strings.HasPrefix(value, keyVaultRefPrefix) {
+			return nil
+		}
+		secretURL, err := parseKeyVaultRef(value)
+		if err != nil {
+			return fmt.Errorf("invalid Key Vault reference in %s: %w", name, err)
+		}
+		refs = append(refs, secretRef{name: name, url: secretURL, apply: apply})
+		return nil
+	}
+	for _, entry := range os.Environ() {
+		name, value, _ := strings.Cut(entry, "=")
+		if strings.HasPrefix(name, "AZURE_") {
+			continue
+		}
+		if err := add(name, value, func(secret string) { os.Setenv(name, secret) }); err != nil {
+			return nil, err
+		}
+	}
+	flags := []struct {
+		name  string
+		value *string
+	}{
+		{"--webhook-url", &opts.webhookURL},
+		{"--heartbeat-url", &opts.heartbeatURL},
+	}
+	for _, f := range flags {
+		value := f.value
+		if err := add(f.name, *value, func(secret string) { *value = secret }); err != nil {
+			return nil, err
+		}
+	}
+	return refs, nil
+}
+
+// resolveSecretRefs replaces every Key Vault reference in the configuration
+// with its secret, read with the run credential (in --tenant); the secrets
+// are only held in memory
+func resolveSecretRefs(opts *options) error {
+	refs, err := secretRefs(opts)
+	if err != nil || len(refs) == 0 {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(withTenant(context.Background(), opts.tenant), time.Minute)
+	defer cancel()
+	token, err := getAccessToken(ctx, keyVaultScope)
+	if err != nil {
+		return fmt.Errorf("failed to get Key Vault token: %w", err)
+	}
+	secrets := map[string]string{}
+	for _, ref := range refs {
+		secret, ok := secrets[ref.url]
+		if !ok {
+			var out struct {
+				Value string `json:"value"`
+			}
+			if err := getJSON(ctx, ref.url+"?api-version="+keyVaultAPI, token, &out); err != nil {
+				return fmt.Errorf("failed to read the Key Vault secret of %s: %w", ref.name, err)
+			}
+			secret, secrets[ref.url] = out.Value, out.Value
+		}
+		ref.apply(secret)
+		slog.Debug("Resolved from Key Vault", "reference", ref.name)
+	}
+	slog.Info("Resolved Key Vault references", "count", len(refs))
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Run labels are written onto started VMs under this tag key prefix, and the
+// run ID is sent in this header so that ARM records it as the correlation ID
+// of every operation of the run in the Activity Log
+const (
+	labelTagPrefix        = "vm-starter:label:"
+	correlationHeader     = "x-ms-correlation-request-id"
+	maxLabelKeyLength     = 512 - len(labelTagPrefix)
+	maxLabelValueLength   = 256
+	labelInvalidKeyTokens = "<>%&\\?/"
+)
+
+// parseLabels parses repeated key=value labels; a later label overrides an earlier one
+func parseLabels(list []string) (map[string]string, error) {
+	labels := map[string]string{}
+	for _, label := range list {
+		key, value, ok := strings.Cut(label, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid --label %q: expected key=value", label)
+		}
+		if err := validLabel(key, value); err != nil {
+			return nil, err
+		}
+		labels[key] = value
+	}
+	return labels, nil
+}
+
+// validLabel checks that a label can be written as a VM tag
+func validLabel(key, value string) error {
+	if key == "" || len(key) > maxLabelKeyLength || strings.ContainsAny(key, labelInvalidKeyTokens) {
+		return fmt.Errorf("invalid label key %q: must be 1 to %d characters without any of %s", key, maxLabelKeyLength, labelInvalidKeyTokens)
+	}
+	if len(value) > maxLabelValueLength {
+		return fmt.Errorf("invalid value of label %q: longer than %d characters", key, maxLabelValueLength)
+	}
+	return nil
+}
+
+// mergeLabels returns base overridden by extra, without modifying either
+func mergeLabels(base, extra map[string]string) map[string]string {
+	merged := make(map[string]string, len(base)+len(extra))
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range extra {
+		merged[k] = v
+	}
+	return merged
+}
+
+// labelPairs renders the labels as key<sep>value strings, sorted by key
+func labelPairs(labels map[string]string, sep string) []string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+sep+v)
+	}
+	sort.Strings(pairs)
+	return pairs
+}
+
+// labelTags returns the tags recording the labels on a started VM
+func labelTags(labels map[string]string) map[string]string {
+	tags := make(map[string]string, len(labels))
+	for k, v := range labels {
+		tags[labelTagPrefix+k] = v
+	}
+	return tags
+}
+
+type correlationKey struct{}
+
+// withCorrelationID makes every ARM request sent with ctx carry id as its correlation ID
+func withCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationKey{}, id)
+}
+
+// correlationID returns the correlation ID carried by ctx, or ""
+func correlationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationKey{}).(string)
+	return id
+}
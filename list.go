@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// Output formats of the list command
+const (
+	listText       = "text"
+	listJSON       = "json"
+	listTFExternal = "tf-external"
+)
+
+// runList implements the list command, printing the discovered VMs
+func runList(ctx context.Context, reporter *errorReporter, args []string) error {
+	opts := &options{}
+	fs := newFlagSet("list", opts)
+	format := fs.String("format", listText, "output format: text, json or tf-external (Terraform external data source)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	if err := setupLogging(opts); err != nil {
+		return err
+	}
+
+	var sel selector
+	switch *format {
+	case listText, listJSON:
+	case listTFExternal:
+		var err error
+		if sel, err = readTerraformQuery(os.Stdin); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown --format %q", *format)
+	}
+
+	a := &app{opts: opts, reporter: reporter}
+	targets, err := a.quietInventory(ctx)
+	if err != nil {
+		return err
+	}
+	vms := []vmRecord{}
+	for _, t := range targets {
+		if sel.matches(t) {
+			vms = append(vms, newVMRecord(t))
+		}
+	}
+	sort.Slice(vms, func(i, j int) bool { return vms[i].ID < vms[j].ID })
+
+	switch *format {
+	case listJSON:
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(vms)
+	case listTFExternal:
+		return json.NewEncoder(os.Stdout).Encode(terraformResult(vms))
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SUBSCRIPTION\tRESOURCE GROUP\tNAME")
+	for _, vm := range vms {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", vm.SubscriptionID, vm.ResourceGroup, vm.Name)
+	}
+	return tw.Flush()
+}
+
+// quietInventory runs inventory with its progress logs diverted from stdout to
+// stderr, so that commands printing the result to stdout can be piped or parsed
+func (a *app) quietInventory(ctx context.Context) ([]*vmTarget, error) {
+	out := os.Stdout
+	os.Stdout = os.Stderr
+	defer func() { os.Stdout = out }()
+	return a.inventory(ctx)
+}
+
+// readTerraformQuery reads the query object Terraform's external data source
+// writes to stdin and turns it into a selector. Terraform only passes string
+// values, so lists are comma separated and tags are written as key=value pairs.
+// Nothing is read when stdin is a terminal.
+func readTerraformQuery(r *os.File) (selector, error) {
+	var sel selector
+	if info, err := r.Stat(); err != nil || info.Mode()&os.ModeCharDevice != 0 {
+		return sel, nil
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return sel, fmt.Errorf("failed to read Terraform query: %w", err)
+	}
+	if strings.TrimSpace(string(data)) == "" {
+		return sel, nil
+	}
+	var query map[string]string
+	if err := json.Unmarshal(data, &query); err != nil {
+		return sel, fmt.Errorf("invalid Terraform query: %w", err)
+	}
+	split := func(v string) []string {
+		var items []string
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		return items
+	}
+	for key, value := range query {
+		switch key {
+		case "names":
+			sel.Names = split(value)
+		case "resource_groups":
+			sel.ResourceGroups = split(value)
+		case "subscriptions":
+			sel.Subscriptions = split(value)
+		case "tags":
+			sel.Tags = map[string]string{}
+			for _, pair := range split(value) {
+				k, v, _ := strings.Cut(pair, "=")
+				sel.Tags[k] = v
+			}
+		default:
+			return sel, fmt.Errorf("unknown Terraform query key %q (expected names, resource_groups, subscriptions or tags)", key)
+		}
+	}
+	return sel, nil
+}
+
+// terraformResult flattens the inventory into the string-valued object the
+// external data source requires; vms holds the full list as JSON for jsondecode()
+func terraformResult(vms []vmRecord) map[string]string {
+	ids := make([]string, len(vms))
+	names := make([]string, len(vms))
+	for i, vm := range vms {
+		ids[i] = vm.ID
+		names[i] = vm.Name
+	}
+	encoded, _ := json.Marshal(vms)
+	return map[string]string{
+		"count": strconv.Itoa(len(vms)),
+		"ids":   strings.Join(ids, ","),
+		"names": strings.Join(names, ","),
+		"vms":   string(encoded),
+	}
+}
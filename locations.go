@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// locationName matches normalized Azure region names such as westeurope
+var locationName = regexp.MustCompile(`^[a-z0-9]+$`)
+
+// parseLocations normalizes the --location values
+func parseLocations(list []string) ([]string, error) {
+	locations := make([]string, 0, len(list))
+	for _, entry := range list {
+		location := normalizeLocation(entry)
+		if !locationName.MatchString(location) {
+			return nil, fmt.Errorf("invalid --location %q", entry)
+		}
+		locations = append(locations, location)
+	}
+	return locations, nil
+}
+
+// locationFilter keeps the VMs in one of the locations
+func locationFilter(locations []string) vmFilter {
+	return func(t *vmTarget) (bool, string) {
+		location := normalizeLocation(t.Location)
+		for _, l := range locations {
+			if l == location {
+				return true, ""
+			}
+		}
+		return false, fmt.Sprintf("location %s is not one of %s", t.Location, strings.Join(locations, ", "))
+	}
+}
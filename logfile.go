@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotatedSuffix is the layout of the time appended to rotated log files
+const rotatedSuffix = "20060102T150405Z"
+
+// rotatingFile is a log file that is moved aside once it grows beyond maxSize
+// bytes or its period of length every is over, keeping the keep most recent
+// rotated files (0 keeps all of them). Zero maxSize and every disable rotation
+// by size and by time.
+type rotatingFile struct {
+	path    string
+	maxSize int64
+	every   time.Duration
+	keep    int
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	period time.Time // start of the period the file is written in
+}
+
+// openRotatingFile opens (or creates) the log file at path for appending
+func openRotatingFile(path string, maxSize int64, every time.Duration, keep int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, every: every, keep: keep}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// open opens the file at r.path, resuming its size and period
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	r.f, r.size = f, info.Size()
+	// A file left by an earlier process belongs to the period it was last written in
+	r.period = r.periodOf(time.Now())
+	if r.size > 0 {
+		r.period = r.periodOf(info.ModTime())
+	}
+	return nil
+}
+
+func (r *rotatingFile) periodOf(t time.Time) time.Time {
+	if r.every <= 0 {
+		return time.Time{}
+	}
+	return t.UTC().Truncate(r.every)
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	full := r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize
+	if full || !r.periodOf(now).Equal(r.period) {
+		if err := r.rotate(now); err != nil {
+			// Keep writing to the current file rather than losing records. Not
+			// logged with slog, whose handler writes to this file under r.mu.
+			fmt.Fprintf(os.Stderr, "Failed to rotate log file %s: %v\n", r.path, err)
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current file aside, named after now, opens a new one and
+// removes the rotated files beyond r.keep
+func (r *rotatingFile) rotate(now time.Time) error {
+	ext := filepath.Ext(r.path)
+	base := strings.TrimSuffix(r.path, ext)
+	rotated := base + "-" + now.UTC().Format(rotatedSuffix) + ext
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	renameErr := os.Rename(r.path, rotated)
+	if err := r.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+	r.period = r.periodOf(now)
+	if r.keep <= 0 {
+		return nil
+	}
+	old, err := filepath.Glob(base + "-*" + ext)
+	if err != nil {
+		return err
+	}
+	var backups []string
+	for _, name := range old {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(name, base+"-"), ext)
+		if _, err := time.Parse(rotatedSuffix, stamp); err == nil {
+			backups = append(backups, name)
+		}
+	}
+	sort.Strings(backups)
+	for len(backups) > r.keep {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log formats
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// setupLogging makes the logger configured by opts the default one. With
+// --log-file every record is written to the rotated file as well.
+func setupLogging(opts *options) error {
+	logger := newLogger(opts.level, opts.logFormat)
+	if opts.logFile != "" {
+		f, err := openRotatingFile(opts.logFile, opts.logMaxSize*1024*1024, opts.logRotate, opts.logKeep)
+		if err != nil {
+			return err
+		}
+		logger = slog.New(fanoutHandler{logger.Handler(), newFileHandler(f, opts.level, opts.logFormat)})
+	}
+	slog.SetDefault(logger)
+	return nil
+}
+
+// newLogger returns a logger writing records of at least level in format.
+// Debug and info records go to stdout and warnings and errors to stderr, like
+// the logs always did, so that --output json can divert stdout from the logs.
+func newLogger(level slog.Level, format string) *slog.Logger {
+	if format == logFormatJSON {
+		hopts := &slog.HandlerOptions{Level: level}
+		return slog.New(&streamHandler{
+			out: slog.NewJSONHandler(stdoutWriter{}, hopts),
+			err: slog.NewJSONHandler(stderrWriter{}, hopts),
+		})
+	}
+	return slog.New(&textHandler{level: level, writer: levelWriter, mu: &sync.Mutex{}})
+}
+
+// newFileHandler returns a handler writing records of at least level to w in
+// format; text records are timestamped, since nothing else records when they happened
+func newFileHandler(w io.Writer, level slog.Level, format string) slog.Handler {
+	if format == logFormatJSON {
+		return slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level})
+	}
+	return &textHandler{level: level, writer: func(slog.Level) io.Writer { return w }, timestamps: true, mu: &sync.Mutex{}}
+}
+
+// console serializes the log writes to the terminal with the progress bar
+// drawn below them, when one is shown
+var console struct {
+	mu  sync.Mutex
+	bar *progressBar
+}
+
+// stdoutWriter writes to the current os.Stdout, which main and quietInventory
+// redirect to stderr while stdout carries a document. Nothing is written while
+// a progress bar is shown, which takes the place of the informational records.
+type stdoutWriter struct{}
+
+func (stdoutWriter) Write(p []byte) (int, error) {
+	console.mu.Lock()
+	defer console.mu.Unlock()
+	if console.bar != nil {
+		return len(p), nil
+	}
+	return os.Stdout.Write(p)
+}
+
+// stderrWriter writes to the current os.Stderr, above the progress bar
+type stderrWriter struct{}
+
+func (stderrWriter) Write(p []byte) (int, error) {
+	console.mu.Lock()
+	defer console.mu.Unlock()
+	bar := console.bar
+	if bar == nil {
+		return os.Stderr.Write(p)
+	}
+	bar.mu.Lock()
+	defer bar.mu.Unlock()
+	bar.clear()
+	defer bar.draw()
+	return os.Stderr.Write(p)
+}
+
+// levelWriter returns where records of level are written to
+func levelWriter(level slog.Level) io.Writer {
+	if level >= slog.LevelWarn {
+		return stderrWriter{}
+	}
+	return stdoutWriter{}
+}
+
+// streamHandler sends debug and info records to out and the others to err
+type streamHandler struct {
+	out, err slog.Handler
+}
+
+func (h *streamHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.out.Enabled(ctx, level)
+}
+
+func (h *streamHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelWarn {
+		return h.err.Handle(ctx, r)
+	}
+	return h.out.Handle(ctx, r)
+}
+
+func (h *streamHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &streamHandler{out: h.out.WithAttrs(attrs), err: h.err.WithAttrs(attrs)}
+}
+
+func (h *streamHandler) WithGroup(name string) slog.Handler {
+	return &streamHandler{out: h.out.WithGroup(name), err: h.err.WithGroup(name)}
+}
+
+// fanoutHandler passes every record to all of its handlers
+type fanoutHandler []slog.Handler
+
+func (h fanoutHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, handler := range h {
+		if handler.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h fanoutHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, handler := range h {
+		if handler.Enabled(ctx, r.Level) {
+			errs = append(errs, handler.Handle(ctx, r.Clone()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (h fanoutHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := make(fanoutHandler, len(h))
+	for i, handler := range h {
+		out[i] = handler.WithAttrs(attrs)
+	}
+	return out
+}
+
+func (h fanoutHandler) WithGroup(name string) slog.Handler {
+	out := make(fanoutHandler, len(h))
+	for i, handler := range h {
+		out[i] = handler.WithGroup(name)
+	}
+	return out
+}
+
+// textHandler writes records for people: "[INF]: message key=value ..."
+type textHandler struct {
+	level      slog.Level
+	writer     func(slog.Level) io.Writer
+	timestamps bool
+	attrs      []slog.Attr
+	prefix     string // of the keys of the current group
+	mu         *sync.Mutex
+}
+
+// levelTags are the tags the text format marks records of each level with
+var levelTags = map[slog.Level]string{
+	slog.LevelDebug: "DBG",
+	slog.LevelInfo:  "INF",
+	slog.LevelWarn:  "WRN",
+	slog.LevelError: "ERR",
+}
+
+func (h *textHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *textHandler) Handle(_ context.Context, r slog.Record) error {
+	tag, ok := levelTags[r.Level]
+	if !ok {
+		tag = r.Level.String()
+	}
+	var b strings.Builder
+	if h.timestamps {
+		b.WriteString(r.Time.UTC().Format(time.RFC3339) + " ")
+	}
+	fmt.Fprintf(&b, "[%s]: %s", tag, r.Message)
+	for _, a := range h.attrs {
+		appendAttr(&b, "", a)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		appendAttr(&b, h.prefix, a)
+		return true
+	})
+	b.WriteByte('\n')
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.writer(r.Level), b.String())
+	return err
+}
+
+func (h *textHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *h
+	c.attrs = append([]slog.Attr(nil), h.attrs...)
+	for _, a := range attrs {
+		c.attrs = append(c.attrs, slog.Attr{Key: h.prefix + a.Key, Value: a.Value})
+	}
+	return &c
+}
+
+func (h *textHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	c := *h
+	c.prefix = h.prefix + name + "."
+	return &c
+}
+
+// appendAttr writes a as " key=value", flattening groups into dotted keys
+func appendAttr(b *strings.Builder, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, ga := range a.Value.Group() {
+			appendAttr(b, prefix, ga)
+		}
+		return
+	}
+	var v string
+	switch a.Value.Kind() {
+	case slog.KindTime:
+		v = a.Value.Time().Format(time.RFC3339)
+	default:
+		v = a.Value.String()
+	}
+	if v == "" || strings.ContainsAny(v, " \t\r\n\"=") || !strconv.CanBackquote(v) {
+		v = strconv.Quote(v)
+	}
+	fmt.Fprintf(b, " %s%s=%s", prefix, a.Key, v)
+}
+
+// parseLogLevel parses a --log-level value
+func parseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("unknown --log-level %q: expected debug, info, warn or error", s)
+	}
+	return level, nil
+}
+
+// vmAttrs are the fields identifying t in log records
+func vmAttrs(t *vmTarget) slog.Attr {
+	return slog.Group("", slog.String("subscription", t.SubscriptionID),
+		slog.String("resourceGroup", t.ResourceGroup), slog.String("vm", t.Name))
+}
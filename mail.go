@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"net/smtp"
+	"os"
+	"strings"
+)
+
+// mailer sends plain text email through the SMTP server in SMTP_ADDR
+// (host:port), from SMTP_FROM, authenticating with SMTP_USERNAME/SMTP_PASSWORD when set
+type mailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+// newMailer returns the mailer configured by the environment, or nil when
+// SMTP_ADDR or SMTP_FROM is not set
+func newMailer() *mailer {
+	m := &mailer{addr: os.Getenv("SMTP_ADDR"), from: os.Getenv("SMTP_FROM")}
+	if m.addr == "" || m.from == "" {
+		return nil
+	}
+	if user := os.Getenv("SMTP_USERNAME"); user != "" {
+		host := m.addr
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		m.auth = smtp.PlainAuth("", user, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	return m
+}
+
+// send emails text to every address of to
+func (m *mailer) send(to []string, subject, text string) error {
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s",
+		m.from, strings.Join(to, ", "), subject, strings.ReplaceAll(text, "\n", "\r\n"))
+	return smtp.SendMail(m.addr, m.auth, m.from, to, []byte(msg))
+}
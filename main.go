@@ -2,163 +2,238 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"net/http"
+	"log/slog"
 	"os"
+	"sort"
 	"strings"
 	"time"
 
-	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
-	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/google/uuid"
 )
 
-// API version constants
-const (
-	subscriptionAPI = "2022-12-01"
-	vmAPI           = "2025-04-01"
-	azureResource   = "https://management.azure.com/.default"
-)
-
-// SubscriptionListResponse represents the Azure subscriptions API response
-type SubscriptionListResponse struct {
-	Value []struct {
-		SubscriptionID string `json:"subscriptionId"`
-	} `json:"value"`
-}
-
-// VirtualMachineListResponse represents the Azure VMs API response
-type VirtualMachineListResponse struct {
-	Value []struct {
-		ID            string `json:"id"`
-		Name          string `json:"name"`
-		ResourceGroup string // will be set from parsing
-	} `json:"value"`
+// fatalf prints the error, reports it and terminates the process
+func fatalf(reporter *errorReporter, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	slog.Error(msg)
+	reporter.capture("fatal", msg)
+	os.Exit(exitFailure)
 }
 
-// getAzureAccessToken obtains a Bearer token using azidentity (managed identity/environment/interactive)
-func getAzureAccessToken(ctx context.Context) (string, error) {
-	cred, err := azidentity.NewDefaultAzureCredential(nil)
-	if err != nil {
-		return "", fmt.Errorf("failed to create credential: %w", err)
+// printSummary prints the result table and logs the end-of-run counts, unless
+// informational output is turned off, as by --quiet
+func printSummary(summary *runSummary) {
+	if !slog.Default().Enabled(context.Background(), slog.LevelInfo) {
+		return
 	}
-	token, err := cred.GetToken(ctx, policy.TokenRequestOptions{
-		Scopes: []string{azureResource},
-	})
-	if err != nil {
-		return "", fmt.Errorf("failed to get token: %w", err)
+	printResultTable(summary.Results)
+	slog.Info("Run finished", "accepted", summary.Accepted, "failed", summary.Failed, "skipped", summary.Skipped)
+	if summary.Throttled > 0 {
+		slog.Info("VM requests throttled by ARM; lower --concurrency if this persists", "count", summary.Throttled)
+	}
+	if len(summary.SkippedBy) > 0 {
+		slog.Info("Skipped by category", skipCounts(summary.SkippedBy)...)
+	}
+	if summary.Planned > 0 {
+		slog.Info("Dry run: actions that would have been sent", "count", summary.Planned)
+		plan := append([]*vmResult(nil), summary.Plan...)
+		sort.Slice(plan, func(i, j int) bool {
+			if plan[i].Action != plan[j].Action {
+				return plan[i].Action < plan[j].Action
+			}
+			return strings.ToLower(plan[i].Target.ID) < strings.ToLower(plan[j].Target.ID)
+		})
+		for _, res := range plan {
+			t := res.Target
+			slog.Info("Planned", "action", res.Action, "subscription", t.SubscriptionID, "resourceGroup", t.ResourceGroup, "vm", t.Name)
+		}
+	}
+	if summary.Degraded > 0 {
+		slog.Info("Started but degraded: not running within --vm-deadline", "count", summary.Degraded)
+	}
+	if summary.TimedOut > 0 {
+		slog.Info("Failed because they exceeded --vm-timeout", "count", summary.TimedOut)
+	}
+	if summary.AccessLost > 0 {
+		slog.Info("Failed because access was lost during the run", "count", summary.AccessLost)
+	}
+	for _, g := range rollupFailures(summary.Failures) {
+		t := g.Example.Target
+		attrs := []any{"cause", g.Cause, "count", g.Count, "example", t.SubscriptionID + "/" + t.ResourceGroup + "/" + t.Name}
+		if hint := remediationHint(g.Example); hint != "" {
+			attrs = append(attrs, "hint", hint)
+		}
+		slog.Info("Failures by cause", attrs...)
+	}
+	actions := make([]string, 0, len(summary.ByAction))
+	for action := range summary.ByAction {
+		actions = append(actions, string(action))
+	}
+	sort.Strings(actions)
+	for _, action := range actions {
+		slog.Info("Accepted by action", "action", action, "accepted", summary.ByAction[vmAction(action)])
+	}
+	for _, team := range sortedTeams(summary.ByTeam) {
+		counts := summary.ByTeam[team]
+		slog.Info("Results by team", "team", team, "accepted", counts.Accepted, "failed", counts.Failed, "skipped", counts.Skipped)
 	}
-	return token.Token, nil
 }
 
-// sendRequest sends HTTP requests with Bearer token
-func sendRequest(ctx context.Context, method, url, token string, body []byte) (*http.Response, error) {
-	req, err := http.NewRequestWithContext(ctx, method, url, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
-	}
-	req.Header.Set("Authorization", "Bearer "+token)
-	req.Header.Set("Content-Type", "application/json")
-	client := &http.Client{Timeout: 30 * time.Second}
-	return client.Do(req)
+// command is a subcommand, invoked as the first argument
+type command struct {
+	summary string
+	run     func(ctx context.Context, reporter *errorReporter, args []string) error
 }
 
-// parseResourceGroup extracts the resource group from a resource ID
-// Example resource ID: /subscriptions/{sid}/resourceGroups/{rg}/providers/...
-func parseResourceGroup(resourceID string) string {
-	rgMarker := "/resourceGroups/"
-	rgIdx := strings.Index(resourceID, rgMarker)
-	if rgIdx == -1 {
-		return ""
-	}
-	sub := resourceID[rgIdx+len(rgMarker):]
-	endIdx := strings.Index(sub, "/")
-	if endIdx == -1 {
-		return sub
-	}
-	return sub[:endIdx]
+var commands = map[string]command{
+	"agent":          {"execute runs from a local queue once ARM is reachable (agent [flags] | agent enqueue --queue <dir>)", runAgent},
+	"api-spec":       {"print the OpenAPI document of the server API", runAPISpec},
+	"config":         {"validate the configuration (config validate [flags]) or print the plan JSON Schema (config schema)", runConfig},
+	"doctor":         {"check credentials, connectivity and permissions", runDoctor},
+	"explain":        {"show why a run would or would not act on a VM", runExplain},
+	"list":           {"print the discovered VM inventory without acting on it", runList},
+	"schedule":       {"turn an uptime matrix exported from a spreadsheet into fleet schedules or tag commands (schedule import <matrix.csv>)", runScheduleImport},
+	"snapshot":       {"write the discovered inventory to a file that runs can act on with --snapshot (snapshot export [flags] <file>)", runSnapshot},
+	"snooze":         {"postpone the scheduled stops of a VM (snooze [flags] <vm> --for 2h [--reason <text>])", runSnooze},
+	"support-bundle": {"collect logs, sanitized configuration, version, last run results and diagnostics into a zip for issues (support-bundle [flags] [--logs <file>])", runSupportBundle},
+	"tag":            {"set or remove tags on the selected VMs (tag --selector key=value --set key=value | --unset key)", runTag},
+	"usage":          {"report the VM hours started by VMStarter, from the journal", runUsage},
 }
 
 func main() {
 	ctx := context.Background()
+	// Until the flags are parsed
+	slog.SetDefault(newLogger(slog.LevelInfo, logFormatText))
 
-	token, err := getAzureAccessToken(ctx)
+	reporter, err := newErrorReporter()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "[ERR]: Failed to get Azure token: %v\n", err)
-		os.Exit(1)
+		slog.Error("Error reporting disabled", "error", err)
+	}
+	defer reporter.recoverPanic()
+	reporter.setContext("started_at", time.Now().UTC().Format(time.RFC3339))
+
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			err := cmd.run(ctx, reporter, os.Args[2:])
+			if errors.Is(err, flag.ErrHelp) {
+				os.Exit(0)
+			}
+			if err != nil {
+				fatalf(reporter, "%v", err)
+			}
+			return
+		}
 	}
 
-	subscriptionURL := fmt.Sprintf("https://management.azure.com/subscriptions?api-version=%s", subscriptionAPI)
-	resp, err := sendRequest(ctx, http.MethodGet, subscriptionURL, token, nil)
+	opts, err := parseOptions(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "[ERR]: Failed to fetch subscriptions: %v\n", err)
-		os.Exit(1)
+		slog.Error(err.Error())
+		os.Exit(exitUsage)
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		fmt.Fprintf(os.Stderr, "[ERR]: Unexpected status for subscriptions: %d\n", resp.StatusCode)
-		os.Exit(1)
+	if err := setupLogging(opts); err != nil {
+		fatalf(reporter, "%v", err)
 	}
 
-	var subsResp SubscriptionListResponse
-	if err := json.NewDecoder(resp.Body).Decode(&subsResp); err != nil {
-		fmt.Fprintf(os.Stderr, "[ERR]: Failed to parse subscriptions JSON: %v\n", err)
-		os.Exit(1)
+	// With --output json or markdown, stdout only carries the report
+	stdout := os.Stdout
+	if opts.output == outputJSON || opts.output == outputMarkdown {
+		os.Stdout = os.Stderr
 	}
 
-	for _, sub := range subsResp.Value {
-		subscriptionID := sub.SubscriptionID
-		fmt.Printf("[INF]: Processing subscription %s\n", subscriptionID)
+	a, err := newApp(opts, reporter)
+	if err != nil {
+		fatalf(reporter, "%v", err)
+	}
+	defer a.close()
+
+	if opts.force {
+		user := os.Getenv("USER")
+		hostname, _ := os.Hostname()
+		slog.Warn("FORCE MODE: all safety checks are bypassed for this run", "user", user, "host", hostname, "args", fmt.Sprintf("%q", os.Args[1:]))
+		a.journal.audit("force", fmt.Sprintf("user=%s host=%s args=%q", user, hostname, os.Args[1:]))
+		reporter.setContext("force", "true")
+	}
 
-		vmURL := fmt.Sprintf("https://management.azure.com/subscriptions/%s/providers/Microsoft.Compute/virtualMachines?api-version=%s",
-			subscriptionID, vmAPI)
-		vmResp, err := sendRequest(ctx, http.MethodGet, vmURL, token, nil)
+	if opts.serveAddr != "" {
+		srv, err := newServer(a)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "[ERR]: Failed to fetch VMs for %s: %v\n", subscriptionID, err)
-			continue
+			fatalf(reporter, "%v", err)
 		}
-		defer vmResp.Body.Close()
-
-		if vmResp.StatusCode != http.StatusOK {
-			fmt.Fprintf(os.Stderr, "[ERR]: Unexpected status for VMs: %d\n", vmResp.StatusCode)
-			continue
+		if err := srv.listenAndServe(opts.serveAddr); err != nil {
+			srv.close()
+			a.close()
+			fatalf(reporter, "Server stopped: %v", err)
 		}
+		return
+	}
 
-		var vms VirtualMachineListResponse
-		if err := json.NewDecoder(vmResp.Body).Decode(&vms); err != nil {
-			fmt.Fprintf(os.Stderr, "[ERR]: Failed to parse VMs JSON: %v\n", err)
-			continue
+	runID := uuid.NewString()
+	reporter.setContext("run_id", runID)
+	p, err := a.newPipeline(ctx, runID, opts.labels)
+	if err != nil {
+		a.close()
+		fatalf(reporter, "%v", err)
+	}
+	if opts.interactive {
+		// Checking the VMs confirms the run
+		p.pick = interactivePicker(os.Stdin, os.Stdout, opts.action)
+	} else if !opts.dryRun && !opts.yes && !opts.force {
+		// Before every other gate, so that nothing is requested for plans the operator rejects
+		p.gates = append([]planGate{confirmGate(os.Stdin, os.Stdout, opts.action)}, p.gates...)
+	}
+	if opts.runTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, opts.runTimeout, errRunTimeout)
+		defer cancel()
+	}
+	slog.Info("Starting run", "runId", runID)
+	if showProgressBar(opts) {
+		p.bar = newProgressBar(os.Stdout)
+	}
+	startedAt := time.Now()
+	summary, err := p.run(ctx)
+	writeReports := func(code int) {
+		var err error
+		switch opts.output {
+		case outputJSON:
+			err = newRunDocument(runID, opts, startedAt, time.Now(), summary, code).write(stdout)
+		case outputMarkdown:
+			err = writeMarkdownSummary(stdout, runID, opts, summary, code)
+		case outputAzureDevOps:
+			err = writeAzureDevOpsCommands(stdout, summary, code)
 		}
-
-		for i := range vms.Value {
-			vms.Value[i].ResourceGroup = parseResourceGroup(vms.Value[i].ID)
+		if err != nil {
+			slog.Error("Failed to write the report", "output", opts.output, "error", err)
 		}
-
-		for _, vm := range vms.Value {
-			startURL := fmt.Sprintf(
-				"https://management.azure.com/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/virtualMachines/%s/start?api-version=%s",
-				subscriptionID, vm.ResourceGroup, vm.Name, vmAPI)
-
-			fmt.Printf(
-				"[DBG]: Sending %s request to start VM.\n    SubscriptionID: %s\n    ResourceGroup: %s\n    VM Name: %s\n    URL: %s\n",
-				http.MethodPost, subscriptionID, vm.ResourceGroup, vm.Name, startURL,
-			)
-
-			startResp, err := sendRequest(ctx, http.MethodPost, startURL, token, nil)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "[ERR]: Failed to start VM %s: %v\n", vm.Name, err)
-				continue
-			}
-			defer startResp.Body.Close()
-			if startResp.StatusCode != http.StatusAccepted {
-				fmt.Fprintf(os.Stderr,
-					"[ERR]: Unexpected status for starting VM %s: %d\n    SubscriptionID: %s\n    ResourceGroup: %s\n    VM Name: %s\n    URL: %s\n",
-					vm.Name, startResp.StatusCode, subscriptionID, vm.ResourceGroup, vm.Name, startURL,
-				)
-				continue
-			}
-			fmt.Printf("[INF]: VM %s start request accepted\n", vm.Name)
+		if err := appendStepSummary(runID, opts, summary, code); err != nil {
+			slog.Error("Failed to write the GitHub Actions job summary", "error", err)
 		}
 	}
+	if runTimedOut(ctx) {
+		if err != nil {
+			slog.Error(err.Error())
+		}
+		printSummary(summary)
+		slog.Error("Run exceeded --run-timeout: the summary is partial", "runId", runID, "timeout", opts.runTimeout)
+		a.journal.audit("run-timeout", fmt.Sprintf("run=%s timeout=%s", runID, opts.runTimeout))
+		writeReports(exitRunTimeout)
+		a.close()
+		os.Exit(exitRunTimeout)
+	}
+	if err != nil {
+		a.close()
+		fatalf(reporter, "%v", err)
+	}
+	printSummary(summary)
+	code := summary.exitCode()
+	writeReports(code)
+	if code != exitSuccess {
+		a.close()
+		os.Exit(code)
+	}
 }
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"text/template"
+)
+
+// messageCatalog maps message IDs to the fmt format strings of the texts sent
+// to people: Slack, digests, stop notices, Grafana, Jira and ServiceNow. A catalog loaded
+// with --messages only holds overrides; missing IDs fall back to English.
+type messageCatalog map[string]string
+
+// defaultMessages is the built-in English catalog
+var defaultMessages = messageCatalog{
+	"approval.heading":      "*VMStarter run %s is waiting for approval*",
+	"approval.labels":       "Labels: %s",
+	"approval.instructions": "React with :%s: to approve or :%s: to reject within %s.",
+	"plan.counts":           "%d VM(s) in %d subscription(s):",
+	"more":                  "… and %d more",
+
+	"digest.title":          "VMStarter %s digest, %s to %s UTC",
+	"digest.empty":          "No VMs were started or powered down.",
+	"digest.group":          "%s: %d start(s), %d stop(s), %.1f VM hour(s), ~%.2f %s",
+	"digest.cost":           "Estimated compute cost: ~%.2f %s at Linux pay-as-you-go list prices; reservations, savings plans, licenses and disks are not included",
+	"digest.unpriced":       "Some VM sizes could not be priced and count as 0",
+	"digest.failures":       "Failures: %d",
+	"digest.failure":        "%s: %s failed: %v",
+	"digest.plan":           "plan %s",
+	"digest.resource_group": "resource group %s",
+	"digest.team":           "team %s, %s",
+	"grafana.started":       "VMStarter run %s started",
+	"grafana.finished":      "VMStarter run %s: %d accepted, %d failed, %d skipped",
+	"jira.summary":          "VMStarter: %d VM(s) failed in run %s",
+	"jira.description":      "VMStarter run %s finished with %d failed VM(s) (%d accepted, %d skipped).",
+	"jira.failures_table":   "||Subscription||Resource group||VM||Action||Error||",
+	"notice.subject":        "VMStarter will %s %d VM(s) at %s UTC",
+	"notice.vm":             "%s (resource group %s, subscription %s)",
+	"notice.snooze":         "Keep it running %s longer: %s",
+
+	"servicenow.short_description": "VMStarter run %s",
+	"servicenow.description":       "Automated VM power operation started at %s by VMStarter.",
+	"servicenow.started":           "VMStarter run %s started.",
+	"servicenow.finished":          "VMStarter run %s finished in %s: %d accepted, %d failed, %d skipped.",
+}
+
+// formatVerb matches the verbs of a format string, with their optional
+// explicit argument index, flags, width and precision
+var formatVerb = regexp.MustCompile(`%(?:\[(\d+)\])?[-+# 0]*(?:\d+|\*)?(?:\.\d*)?([a-zA-Z%])`)
+
+// loadMessages reads a --messages file: a JSON object of message IDs to
+// translated format strings
+func loadMessages(path string) (messageCatalog, error) {
+	data, err := readConfigFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read messages file: %w", err)
+	}
+	var c messageCatalog
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("invalid messages file %s: %w", path, err)
+	}
+	ids := make([]string, 0, len(c))
+	for id := range c {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		def, ok := defaultMessages[id]
+		if !ok {
+			return nil, fmt.Errorf("%s: unknown message %q", path, id)
+		}
+		if err := sameArguments(c[id], def); err != nil {
+			return nil, fmt.Errorf("%s: message %q: %w", path, id, err)
+		}
+	}
+	return c, nil
+}
+
+// sameArguments checks that text uses every argument of def, each with the
+// same verb or %v. Arguments may be reordered with explicit indexes ("%[2]s"),
+// as translations often need to.
+func sameArguments(text, def string) error {
+	want, got := formatArguments(def), formatArguments(text)
+	for i := range got {
+		if i < 0 || i >= len(want) {
+			return fmt.Errorf("argument %d does not exist, the message has %d", i+1, len(want))
+		}
+	}
+	for i, verb := range want {
+		switch v, ok := got[i]; {
+		case !ok:
+			return fmt.Errorf("argument %d (%%%c) is not used", i+1, verb)
+		case v != verb && v != 'v':
+			return fmt.Errorf("argument %d is formatted with %%%c instead of %%%c", i+1, v, verb)
+		}
+	}
+	return nil
+}
+
+// formatArguments returns the verb of every argument index a format string
+// uses, following the argument numbering rules of fmt
+func formatArguments(format string) map[int]rune {
+	args := map[int]rune{}
+	next := 0
+	for _, m := range formatVerb.FindAllStringSubmatch(format, -1) {
+		if m[2] == "%" {
+			continue
+		}
+		if m[1] != "" {
+			n, _ := strconv.Atoi(m[1])
+			next = n - 1
+		}
+		args[next] = rune(m[2][0])
+		next++
+	}
+	return args
+}
+
+// format renders a message; a nil catalog renders English
+func (c messageCatalog) format(id string, args ...interface{}) string {
+	text, ok := c[id]
+	if !ok {
+		text = defaultMessages[id]
+	}
+	return fmt.Sprintf(text, args...)
+}
+
+// funcs are the functions of notification templates: json escapes a value
+// and msg renders a message of the catalog
+func (c messageCatalog) funcs() template.FuncMap {
+	return template.FuncMap{"json": templateJSON, "msg": c.format}
+}
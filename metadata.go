@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metadataCache keeps slow-changing ARM metadata, the subscription list and
+// resource group tags, across runs for ttl. Expired entries are refreshed
+// lazily on their next use; failed lookups are not cached. A nil cache always
+// queries ARM.
+type metadataCache struct {
+	ttl time.Duration
+
+	mu       sync.Mutex
+	subs     *SubscriptionListResponse
+	subsTime time.Time
+	rgTags   map[string]cachedTags // lower-cased subscription/resource group
+}
+
+type cachedTags struct {
+	tags    map[string]string
+	fetched time.Time
+}
+
+func newMetadataCache(ttl time.Duration) *metadataCache {
+	return &metadataCache{ttl: ttl, rgTags: map[string]cachedTags{}}
+}
+
+// subscriptions lists the subscriptions visible to the token
+func (c *metadataCache) subscriptions(ctx context.Context, token string) (*SubscriptionListResponse, error) {
+	if c != nil {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.subs != nil && time.Since(c.subsTime) < c.ttl {
+			return c.subs, nil
+		}
+	}
+	subs, err := listSubscriptions(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	if c != nil {
+		c.subs, c.subsTime = subs, time.Now()
+	}
+	return subs, nil
+}
+
+// resourceGroupTags returns the tags of a resource group
+func (c *metadataCache) resourceGroupTags(ctx context.Context, token, subscriptionID, resourceGroup string) (map[string]string, error) {
+	key := strings.ToLower(subscriptionID + "/" + resourceGroup)
+	if c != nil {
+		c.mu.Lock()
+		entry, ok := c.rgTags[key]
+		c.mu.Unlock()
+		if ok && time.Since(entry.fetched) < c.ttl {
+			return entry.tags, nil
+		}
+	}
+	rgURL := fmt.Sprintf("%s/subscriptions/%s/resourceGroups/%s?api-version=%s",
+		armEndpoint, subscriptionID, resourceGroup, resourcesAPI)
+	var rg struct {
+		Tags map[string]string `json:"tags"`
+	}
+	if err := getJSON(ctx, rgURL, token, &rg); err != nil {
+		return nil, err
+	}
+	if c != nil {
+		c.mu.Lock()
+		c.rgTags[key] = cachedTags{tags: rg.Tags, fetched: time.Now()}
+		c.mu.Unlock()
+	}
+	return rg.Tags, nil
+}
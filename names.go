@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// namePattern is a --name-filter. Patterns anchored with ^ or $ are regular
+// expressions; any other pattern is a glob, where * matches any run of
+// characters, ? a single one and [...] a character class, matched against the
+// whole name. Both ignore case, like Azure does.
+type namePattern struct {
+	text string
+	re   *regexp.Regexp // nil for globs
+}
+
+// parseNamePatterns compiles the --name-filter patterns
+func parseNamePatterns(list []string) ([]namePattern, error) {
+	var patterns []namePattern
+	for _, text := range list {
+		p := namePattern{text: text}
+		if strings.HasPrefix(text, "^") || strings.HasSuffix(text, "$") {
+			re, err := regexp.Compile("(?i)" + text)
+			if err != nil {
+				return nil, fmt.Errorf("invalid --name-filter %q: %w", text, err)
+			}
+			p.re = re
+		} else {
+			p.text = strings.ToLower(text)
+			if _, err := path.Match(p.text, ""); err != nil {
+				return nil, fmt.Errorf("invalid --name-filter %q: %w", text, err)
+			}
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+func (p namePattern) matches(name string) bool {
+	if p.re != nil {
+		return p.re.MatchString(name)
+	}
+	ok, _ := path.Match(p.text, strings.ToLower(name))
+	return ok
+}
+
+// nameFilter keeps the VMs whose name matches any of the patterns
+func nameFilter(patterns []namePattern, list []string) vmFilter {
+	return func(t *vmTarget) (bool, string) {
+		for _, p := range patterns {
+			if p.matches(t.Name) {
+				return true, ""
+			}
+		}
+		return false, fmt.Sprintf("name matches no --name-filter (%s)", strings.Join(list, ", "))
+	}
+}
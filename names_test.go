@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+func TestNameFilter(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		name     string
+		keep     bool
+	}{
+		{[]string{"web-*"}, "web-1", true},
+		{[]string{"web-*"}, "WEB-1", true},
+		{[]string{"web-*"}, "db-1", false},
+		{[]string{"web-?"}, "web-12", false},
+		{[]string{"web-[0-9]"}, "web-7", true},
+		{[]string{"web"}, "web-1", false},
+		{[]string{"^web-\\d+$"}, "Web-42", true},
+		{[]string{"^web-\\d+$"}, "web-x", false},
+		{[]string{"-prod$"}, "api-prod", true},
+		{[]string{"^api"}, "api-test", true},
+		{[]string{"db-*", "web-*"}, "web-1", true},
+	}
+	for _, tt := range tests {
+		patterns, err := parseNamePatterns(tt.patterns)
+		if err != nil {
+			t.Fatalf("parseNamePatterns(%q): %v", tt.patterns, err)
+		}
+		keep, reason := nameFilter(patterns, tt.patterns)(&vmTarget{Name: tt.name})
+		if keep != tt.keep {
+			t.Errorf("%q against %q: keep = %v, want %v", tt.name, tt.patterns, keep, tt.keep)
+		}
+		if !keep && reason == "" {
+			t.Errorf("%q against %q: rejected without a reason", tt.name, tt.patterns)
+		}
+	}
+}
+
+func TestParseNamePatternsInvalid(t *testing.T) {
+	for _, pattern := range []string{"web-[", "^web-(", "^(a$"} {
+		if _, err := parseNamePatterns([]string{pattern}); err == nil {
+			t.Errorf("parseNamePatterns(%q) succeeded, want an error", pattern)
+		}
+	}
+}
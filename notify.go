@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// ownerNotifier delivers messages to the owners of VMs on the channel their
+// owner tag names:
+//
+//	alice@contoso.com          email, through the SMTP server of SMTP_ADDR
+//	slack:U0123ABCD            Slack member or channel ID, with SLACK_BOT_TOKEN
+//	https://…                  incoming webhook, such as Teams' or Slack's
+//
+// Several owners are separated by commas or semicolons. With --resolve-owners,
+// user principal names and group names are first resolved through the
+// directory.
+type ownerNotifier struct {
+	slackToken string
+	mail       *mailer
+	client     *http.Client
+	directory  *ownerDirectory
+}
+
+func newOwnerNotifier() *ownerNotifier {
+	return &ownerNotifier{
+		slackToken: os.Getenv("SLACK_BOT_TOKEN"),
+		mail:       newMailer(),
+		client:     &http.Client{Timeout: 30 * time.Second},
+		directory:  newOwnerDirectory(),
+	}
+}
+
+// resolve replaces the owners naming users or groups of the directory of the
+// tenant of ctx by the addresses reaching them, without duplicates. Owners that
+// cannot be resolved are logged, and kept when they may be mail addresses.
+func (n *ownerNotifier) resolve(ctx context.Context, owners []string) []string {
+	var out []string
+	seen := map[string]bool{}
+	for _, owner := range owners {
+		targets, err := n.directory.resolve(ctx, owner)
+		if err != nil {
+			slog.Warn("Owner not resolved", "owner", owner, "error", err)
+			if !strings.Contains(owner, "@") {
+				continue
+			}
+			targets = []string{owner}
+		}
+		for _, target := range targets {
+			if !seen[strings.ToLower(target)] {
+				seen[strings.ToLower(target)] = true
+				out = append(out, target)
+			}
+		}
+	}
+	return out
+}
+
+// parseOwners splits the value of an owner tag into owners
+func parseOwners(value string) []string {
+	var owners []string
+	for _, owner := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ';' }) {
+		if owner = strings.TrimSpace(owner); owner != "" {
+			owners = append(owners, owner)
+		}
+	}
+	return owners
+}
+
+// send delivers subject and text to owner
+func (n *ownerNotifier) send(ctx context.Context, owner, subject, text string) error {
+	switch {
+	case strings.HasPrefix(owner, "slack:"):
+		if n.slackToken == "" {
+			return fmt.Errorf("SLACK_BOT_TOKEN must be set to notify %s", owner)
+		}
+		_, err := slackCall(ctx, n.slackToken, http.MethodPost, "chat.postMessage", nil, map[string]string{
+			"channel": strings.TrimPrefix(owner, "slack:"),
+			"text":    "*" + subject + "*\n" + text,
+		})
+		return err
+	case strings.HasPrefix(owner, "https://"):
+		body, _ := json.Marshal(map[string]string{"text": subject + "\n\n" + text})
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, owner, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := n.client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("webhook answered %d", resp.StatusCode)
+		}
+		return nil
+	case strings.Contains(owner, "@"):
+		if n.mail == nil {
+			return fmt.Errorf("SMTP_ADDR and SMTP_FROM must be set to notify %s", owner)
+		}
+		return n.mail.send([]string{owner}, subject, text)
+	}
+	return fmt.Errorf("unknown owner %q: expected an email address, slack:<ID> or an https:// webhook URL, or a group name with --resolve-owners", owner)
+}
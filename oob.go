@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Hybrid Compute API version, used to list Azure Arc-enabled servers
+const hybridComputeAPI = "2024-07-10"
+
+// arcStatusConnected is the status of an Arc machine whose agent is online,
+// which requires its operating system to be running
+const arcStatusConnected = "Connected"
+
+// arcMachineListResponse represents the Hybrid Compute machines API response
+type arcMachineListResponse struct {
+	Value []struct {
+		ID         string            `json:"id"`
+		Name       string            `json:"name"`
+		Location   string            `json:"location"`
+		Tags       map[string]string `json:"tags"`
+		Properties struct {
+			Status string `json:"status"`
+		} `json:"properties"`
+	} `json:"value"`
+	NextLink string `json:"nextLink"`
+}
+
+// oobStartersFile is the --oob-starters file
+type oobStartersFile struct {
+	Starters []oobStarter `json:"starters"`
+}
+
+// oobStarter acts on Arc-enabled servers that Azure cannot power on itself,
+// such as machines on hypervisors without Arc resource bridge, by calling a
+// webhook (a wake-on-LAN or IPMI gateway, …) for every machine its selector matches
+type oobStarter struct {
+	Name     string            `json:"name"`
+	Selector selector          `json:"selector"`
+	URL      string            `json:"url"`
+	Headers  map[string]string `json:"headers,omitempty"` // values may reference environment variables as ${NAME}
+	Actions  []string          `json:"actions,omitempty"` // default: start
+	Payload  json.RawMessage   `json:"payload,omitempty"` // passed through to the webhook
+}
+
+// oobRequest is the body POSTed to an out-of-band starter
+type oobRequest struct {
+	RunID   string            `json:"runId"`
+	Action  string            `json:"action"`
+	Machine oobMachine        `json:"machine"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Payload json.RawMessage   `json:"payload,omitempty"`
+}
+
+// oobMachine is the Arc machine an out-of-band request is about
+type oobMachine struct {
+	ID             string            `json:"id"`
+	Name           string            `json:"name"`
+	ResourceGroup  string            `json:"resourceGroup"`
+	SubscriptionID string            `json:"subscriptionId"`
+	Tags           map[string]string `json:"tags,omitempty"`
+}
+
+// loadOOBStarters reads and validates the --oob-starters file
+func loadOOBStarters(path string) (*oobStartersFile, error) {
+	data, err := readConfigFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read out-of-band starters file: %w", err)
+	}
+	var file oobStartersFile
+	if err := decodeStrict(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid out-of-band starters file %s: %w", path, err)
+	}
+	for i := range file.Starters {
+		s := &file.Starters[i]
+		if s.Name == "" {
+			s.Name = fmt.Sprintf("starter %d", i+1)
+		}
+		if u, err := url.Parse(s.URL); err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+			return nil, fmt.Errorf("%s: invalid url %q", s.Name, s.URL)
+		}
+		if len(s.Actions) == 0 {
+			s.Actions = []string{string(actionStart)}
+		}
+		for _, name := range s.Actions {
+			if !containsFold(knownActions, name) {
+				return nil, fmt.Errorf("%s: unknown action %q: expected one of %s", s.Name, name, strings.Join(knownActions, ", "))
+			}
+		}
+	}
+	return &file, nil
+}
+
+// starterFor returns the first starter whose selector matches t, or nil
+func (f *oobStartersFile) starterFor(t *vmTarget) *oobStarter {
+	for i := range f.Starters {
+		if f.Starters[i].Selector.matches(t) {
+			return &f.Starters[i]
+		}
+	}
+	return nil
+}
+
+// arcFilter assigns its out-of-band starter to every Arc machine, skipping
+// those that no starter covers; Azure VMs pass through
+func arcFilter(starters *oobStartersFile) vmFilter {
+	return func(t *vmTarget) (bool, string) {
+		if !t.Arc {
+			return true, ""
+		}
+		if t.OOB = starters.starterFor(t); t.OOB == nil {
+			return false, "Arc machine is not covered by any out-of-band starter"
+		}
+		return true, ""
+	}
+}
+
+// listArcMachines sends the Arc-enabled servers of a subscription to out. The
+// power state of connected machines is known to be running.
+func (d *armDiscoverer) listArcMachines(ctx context.Context, subscriptionID string, out chan<- *vmTarget) error {
+	listURL := fmt.Sprintf("%s/providers/Microsoft.HybridCompute/machines?api-version=%s", d.scopeURL(subscriptionID), hybridComputeAPI)
+	if d.filter != "" {
+		filter := fmt.Sprintf("resourceType eq 'Microsoft.HybridCompute/machines' and (%s)", d.filter)
+		listURL = fmt.Sprintf("%s/resources?api-version=%s&$filter=%s",
+			d.scopeURL(subscriptionID), resourcesAPI, strings.ReplaceAll(url.QueryEscape(filter), "+", "%20"))
+	}
+	for next := listURL; next != ""; {
+		var machines arcMachineListResponse
+		if err := getJSON(ctx, next, d.token, &machines); err != nil {
+			return err
+		}
+		for _, m := range machines.Value {
+			t := &vmTarget{SubscriptionID: subscriptionID, Name: m.Name, ID: m.ID, Tags: m.Tags, Location: m.Location, Arc: true}
+			if m.Properties.Status == arcStatusConnected {
+				t.Statuses = []string{"PowerState/running"}
+			}
+			out <- t
+		}
+		next = machines.NextLink
+	}
+	return nil
+}
+
+// supports returns why the out-of-band starter of t cannot perform action, or ""
+func (s *oobStarter) supports(action vmAction) string {
+	if containsFold(s.Actions, string(action)) {
+		return ""
+	}
+	return fmt.Sprintf("out-of-band starter %s does not support %s", s.Name, action)
+}
+
+// performOutOfBand asks the out-of-band starter of t to perform action and
+// records it in the journal like an ARM request
+func (p *pipeline) performOutOfBand(ctx context.Context, t *vmTarget, action vmAction) *vmResult {
+	res := &vmResult{Target: t, Action: action}
+	slog.Debug("Sending request to out-of-band starter", vmAttrs(t), "action", action, "starter", t.OOB.Name)
+	body, err := json.Marshal(oobRequest{
+		RunID:  p.runID,
+		Action: string(action),
+		Machine: oobMachine{
+			ID:             t.ID,
+			Name:           t.Name,
+			ResourceGroup:  t.ResourceGroup,
+			SubscriptionID: t.SubscriptionID,
+			Tags:           t.Tags,
+		},
+		Labels:  p.labels,
+		Payload: t.OOB.Payload,
+	})
+	if err != nil {
+		res.Err = err
+		return res
+	}
+
+	began := time.Now()
+	if !p.queuedAt.IsZero() {
+		res.Delay = began.Sub(p.queuedAt)
+	}
+	seq, err := p.journal.intent(p.runID, string(action), t.ID, t.Team)
+	if err != nil {
+		res.Err = fmt.Errorf("not attempted: %w", err)
+		return res
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.OOB.URL, bytes.NewReader(body))
+	if err == nil {
+		req.Header.Set("Content-Type", "application/json")
+		for name, value := range t.OOB.Headers {
+			req.Header.Set(name, os.ExpandEnv(value))
+		}
+		var resp *http.Response
+		client := &http.Client{Timeout: 30 * time.Second}
+		if resp, err = client.Do(req); err == nil {
+			resp.Body.Close()
+			res.StatusCode = resp.StatusCode
+			if resp.StatusCode < 200 || resp.StatusCode > 299 {
+				err = fmt.Errorf("out-of-band starter %s answered %d", t.OOB.Name, resp.StatusCode)
+			}
+		}
+	}
+	res.Duration = time.Since(began)
+	res.Err = err
+	p.journal.complete(seq, string(action), t.ID, t.Team, res.StatusCode, res.Err)
+	return res
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/user"
+	"time"
+)
+
+// opaPolicy asks an Open Policy Agent server whether each planned action may
+// be performed. The security team owns the policy: its Rego (or Wasm
+// compiled) bundle is loaded into OPA, not into this tool.
+type opaPolicy struct {
+	url    string // data API URL of the decision, e.g. http://localhost:8181/v1/data/vmstarter/decision
+	client *http.Client
+}
+
+func newOPAPolicy(url string) *opaPolicy {
+	return &opaPolicy{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// opaInput is the input document of a decision
+type opaInput struct {
+	RunID     string            `json:"runId"`
+	Action    string            `json:"action"`
+	Requester string            `json:"requester"`
+	Time      string            `json:"time"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Force     bool              `json:"force"`
+	DryRun    bool              `json:"dryRun"`
+	VM        opaVM             `json:"vm"`
+}
+
+// opaVM is the metadata of the VM a decision is about
+type opaVM struct {
+	ID             string            `json:"id"`
+	Name           string            `json:"name"`
+	ResourceGroup  string            `json:"resourceGroup"`
+	SubscriptionID string            `json:"subscriptionId"`
+	Location       string            `json:"location"`
+	Size           string            `json:"size"`
+	Tags           map[string]string `json:"tags"`
+	Team           string            `json:"team,omitempty"`
+	PowerState     string            `json:"powerState,omitempty"`
+	Rule           string            `json:"rule,omitempty"`
+}
+
+// opaDecision is the decision document: either a boolean or an object with
+// allow, an optional reason and annotations attached to the result
+type opaDecision struct {
+	Allow       bool              `json:"allow"`
+	Reason      string            `json:"reason"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+// decide evaluates the policy for input. An undefined decision denies the
+// action, so that a missing or misnamed policy never lets everything through.
+func (o *opaPolicy) decide(ctx context.Context, input *opaInput) (*opaDecision, error) {
+	body, err := json.Marshal(struct {
+		Input *opaInput `json:"input"`
+	}{input})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+	var out struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+	if len(out.Result) == 0 {
+		return &opaDecision{Reason: "policy decision is undefined"}, nil
+	}
+	decision := &opaDecision{}
+	if err := json.Unmarshal(out.Result, &decision.Allow); err == nil {
+		return decision, nil
+	}
+	if err := json.Unmarshal(out.Result, decision); err != nil {
+		return nil, fmt.Errorf("invalid decision: expected a boolean or an object with allow, reason and annotations")
+	}
+	return decision, nil
+}
+
+// cliRequester identifies the local user as the requester of command-line runs
+func cliRequester() string {
+	name := os.Getenv("USER")
+	if name == "" {
+		if u, err := user.Current(); err == nil {
+			name = u.Username
+		}
+	}
+	return "user:" + name
+}
+
+// policyInput builds the decision input for performing action on t
+func (p *pipeline) policyInput(t *vmTarget, action vmAction) *opaInput {
+	return &opaInput{
+		RunID:     p.runID,
+		Action:    string(action),
+		Requester: p.requester,
+		Time:      time.Now().UTC().Format(time.RFC3339),
+		Labels:    p.labels,
+		Force:     p.force,
+		DryRun:    p.dryRun,
+		VM: opaVM{
+			ID:             t.ID,
+			Name:           t.Name,
+			ResourceGroup:  t.ResourceGroup,
+			SubscriptionID: t.SubscriptionID,
+			Location:       t.Location,
+			Size:           t.Size,
+			Tags:           t.Tags,
+			Team:           t.Team,
+			PowerState:     t.status("PowerState"),
+			Rule:           t.Rule,
+		},
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"os"
+)
+
+// apiVersion is the version of the REST API described by the OpenAPI document
+const apiVersion = "1.0.0"
+
+// object is a JSON object in the OpenAPI document
+type object = map[string]interface{}
+
+func schemaRef(name string) object {
+	return object{"$ref": "#/components/schemas/" + name}
+}
+
+func arrayOf(items object) object {
+	return object{"type": "array", "items": items}
+}
+
+func jsonContent(schema object, description string) object {
+	return object{
+		"description": description,
+		"content":     object{"application/json": object{"schema": schema}},
+	}
+}
+
+// openAPISpec returns the OpenAPI 3 document of the server API; serverURL is
+// listed as the API server when set
+func openAPISpec(serverURL string) object {
+	str := object{"type": "string"}
+	integer := object{"type": "integer"}
+	dateTime := object{"type": "string", "format": "date-time"}
+	stringList := arrayOf(str)
+	tags := object{"type": "object", "additionalProperties": str}
+
+	apiErr := func(description string) object {
+		return jsonContent(schemaRef("Error"), description)
+	}
+	// Every authenticated endpoint shares these failure responses
+	withErrors := func(responses object) object {
+		responses["401"] = apiErr("Missing or invalid credentials")
+		responses["429"] = apiErr("Rate limit exceeded; see the Retry-After header")
+		return responses
+	}
+	runID := object{"name": "id", "in": "path", "required": true, "schema": str, "description": "Run ID"}
+
+	spec := object{
+		"openapi": "3.0.3",
+		"info": object{
+			"title":       "VMStarter API",
+			"version":     apiVersion,
+			"description": "Start Azure virtual machines and follow the runs doing so.",
+		},
+		"security": []object{{"bearerAuth": []string{}}, {"apiKey": []string{}}},
+		"paths": object{
+			"/healthz": object{
+				"get": object{
+					"operationId": "health",
+					"summary":     "Liveness probe",
+					"security":    []object{},
+					"responses":   object{"200": object{"description": "The server is up"}},
+				},
+			},
+			"/v1/start": object{
+				"post": object{
+					"operationId": "startVMs",
+					"summary":     "Queue a run starting the selected VMs",
+					"description": "VMs outside the caller's granted scopes are reported as skipped.",
+					"requestBody": object{
+						"required": false,
+						"content":  object{"application/json": object{"schema": schemaRef("RunRequest")}},
+					},
+					"responses": withErrors(object{
+						"202": object{
+							"description": "The run was queued",
+							"headers": object{
+								"Location": object{"description": "URL of the run status", "schema": str},
+							},
+							"content": object{"application/json": object{"schema": schemaRef("RunStatus")}},
+						},
+						"400": apiErr("Invalid selector"),
+						"403": apiErr("The caller may not start VMs"),
+						"404": apiErr("Unknown fleet"),
+					}),
+				},
+			},
+			"/v1/snooze": object{
+				"post": object{
+					"operationId": "snoozeVM",
+					"summary":     "Postpone the scheduled stops of a VM",
+					"description": "Records a snooze in the journal of a fleet that stops VMs on a schedule; its stops skip the VM until the snooze ends. A later snooze of the VM replaces an earlier one. Requires a start grant covering the VM.",
+					"requestBody": object{
+						"required": true,
+						"content":  object{"application/json": object{"schema": schemaRef("SnoozeRequest")}},
+					},
+					"responses": withErrors(object{
+						"200": jsonContent(schemaRef("Snooze"), "The snooze was recorded"),
+						"400": apiErr("Invalid request, or the fleet does not stop VMs on a schedule"),
+						"403": apiErr("The caller may not start the VM"),
+						"404": apiErr("Unknown fleet or VM"),
+						"409": apiErr("Several VMs have that name; give the resource ID"),
+						"500": apiErr("The snooze could not be written to the journal"),
+						"502": apiErr("Discovery failed"),
+					}),
+				},
+			},
+			"/v1/vms": object{
+				"get": object{
+					"operationId": "listVMs",
+					"summary":     "List the VMs within the caller's granted scopes",
+					"parameters": []object{{"name": "fleet", "in": "query", "required": false, "schema": str,
+						"description": "fleet to list (default: the default fleet)"}},
+					"responses": withErrors(object{
+						"200": jsonContent(arrayOf(schemaRef("VM")), "The visible VMs"),
+						"404": apiErr("Unknown fleet"),
+						"502": apiErr("Discovery failed"),
+					}),
+				},
+			},
+			"/v1/runs": object{
+				"get": object{
+					"operationId": "listRuns",
+					"summary":     "List the caller's runs, newest first",
+					"responses": withErrors(object{
+						"200": jsonContent(arrayOf(schemaRef("RunStatus")), "The caller's runs, without results"),
+					}),
+				},
+			},
+			"/v1/runs/{id}": object{
+				"get": object{
+					"operationId": "getRun",
+					"summary":     "Get the status of a run",
+					"description": "Per-VM results are included once the run is over.",
+					"parameters":  []object{runID},
+					"responses": withErrors(object{
+						"200": jsonContent(schemaRef("RunStatus"), "The run status"),
+						"404": apiErr("Unknown run"),
+					}),
+				},
+			},
+			"/v1/runs/{id}/events": object{
+				"get": object{
+					"operationId": "streamRunEvents",
+					"summary":     "Stream a run as Server-Sent Events",
+					"description": "Sends a `status` event on connect, a `result` event (Result) per VM and a final `status` event (RunStatus) before closing.",
+					"parameters":  []object{runID},
+					"responses": withErrors(object{
+						"200": object{
+							"description": "Event stream",
+							"content":     object{"text/event-stream": object{"schema": str}},
+						},
+						"404": apiErr("Unknown run"),
+					}),
+				},
+			},
+		},
+		"components": object{
+			"securitySchemes": object{
+				"bearerAuth": object{"type": "http", "scheme": "bearer", "bearerFormat": "JWT",
+					"description": "Azure AD access token for the API app registration"},
+				"apiKey": object{"type": "apiKey", "in": "header", "name": apiKeyHeader},
+			},
+			"schemas": object{
+				"Error": object{
+					"type":       "object",
+					"required":   []string{"error"},
+					"properties": object{"error": str},
+				},
+				"Selector": object{
+					"type": "object",
+					"properties": object{
+						"names":          object{"type": "array", "items": str, "description": "VM name glob patterns"},
+						"resourceGroups": stringList,
+						"subscriptions":  stringList,
+						"tags":           tags,
+					},
+				},
+				"RunRequest": object{
+					"allOf": []object{
+						schemaRef("Selector"),
+						{
+							"type": "object",
+							"properties": object{
+								"labels": object{"type": "object", "additionalProperties": str,
+									"description": "labels attached to the run, overriding the fleet's --label ones; requestedBy and requestedById are reserved for the caller's identity"},
+								"fleet": object{"type": "string", "description": "fleet to run in (default: the default fleet)"},
+							},
+						},
+					},
+				},
+				"SnoozeRequest": object{
+					"type":     "object",
+					"required": []string{"vm", "for"},
+					"properties": object{
+						"vm":     object{"type": "string", "description": "VM name or resource ID"},
+						"fleet":  object{"type": "string", "description": "scheduled fleet whose stops are postponed (default: the default fleet)"},
+						"for":    object{"type": "string", "description": "how long from now the VM stays up, as a Go duration such as 2h"},
+						"reason": object{"type": "string", "description": "why the VM must stay up, recorded in the journal"},
+					},
+				},
+				"Snooze": object{
+					"type":     "object",
+					"required": []string{"vm", "until", "by"},
+					"properties": object{
+						"vm":     object{"type": "string", "description": "resource ID"},
+						"fleet":  str,
+						"until":  dateTime,
+						"by":     str,
+						"reason": str,
+					},
+				},
+				"VM": object{
+					"type":     "object",
+					"required": []string{"subscriptionId", "resourceGroup", "name", "id"},
+					"properties": object{
+						"subscriptionId": str,
+						"resourceGroup":  str,
+						"name":           str,
+						"id":             str,
+						"tags":           tags,
+					},
+				},
+				"Result": object{
+					"type":     "object",
+					"required": []string{"runId", "time", "subscriptionId", "resourceGroup", "name", "id", "outcome", "durationMs"},
+					"properties": object{
+						"runId":          str,
+						"time":           dateTime,
+						"subscriptionId": str,
+						"resourceGroup":  str,
+						"name":           str,
+						"id":             str,
+						"team":           str,
+						"labels":         tags,
+						"annotations":    tags,
+						"action":         str,
+						"outcome":        object{"type": "string", "enum": []string{outcomeAccepted, outcomeFailed, outcomeSkipped, outcomeAccessLost}},
+						"statusCode":     integer,
+						"error":          str,
+						"errorCode":      object{"type": "string", "description": "ARM error code the action was rejected with"},
+						"hint":           object{"type": "string", "description": "what to do about the failure"},
+						"skipReason":     str,
+						"skipCategory":   object{"type": "string", "enum": knownSkipCategories},
+						"durationMs":     integer,
+						"delayMs":        object{"type": "integer", "description": "how long after it was queued the action was sent (agent mode)"},
+						"degraded":       object{"type": "string", "description": "why an accepted start is degraded: the VM missed --vm-deadline"},
+						"operation":      object{"type": "string", "enum": []string{operationSucceeded, operationFailed, operationCanceled}, "description": "final status of the long-running operation of the action (--wait)"},
+						"timedOut":       object{"type": "boolean", "description": "the VM exceeded --vm-timeout"},
+						"throttled":      object{"type": "integer", "description": "how often the action request was throttled with 429"},
+						"history": object{
+							"type":        "array",
+							"description": "the states the VM went through in the run, oldest first",
+							"items": object{
+								"type":     "object",
+								"required": []string{"state", "at"},
+								"properties": object{
+									"state": object{"type": "string", "enum": []string{vmStateDiscovered, vmStateFiltered, vmStateQueued, vmStateRequested, vmStateAccepted, vmStateRunning, vmStateCompleted, vmStateFailed, vmStateSkipped, vmStatePlanned}},
+									"at":    object{"type": "string", "format": "date-time"},
+								},
+							},
+						},
+					},
+				},
+				"RunStatus": object{
+					"type":     "object",
+					"required": []string{"runId", "state", "progress", "discovered", "done", "accepted", "failed", "skipped", "createdAt"},
+					"properties": object{
+						"runId":      str,
+						"fleet":      str,
+						"state":      object{"type": "string", "enum": []string{runQueued, runDiscovering, runExecuting, runFinished, runFailed}},
+						"progress":   object{"type": "string", "description": "<done>/<discovered>"},
+						"discovered": integer,
+						"done":       integer,
+						"accepted":   integer,
+						"failed":     integer,
+						"skipped":    integer,
+						"skippedBy":  object{"type": "object", "description": "skipped results per skip category", "additionalProperties": integer},
+						"error":      str,
+						"createdAt":  dateTime,
+						"startedAt":  dateTime,
+						"finishedAt": dateTime,
+						"results":    arrayOf(schemaRef("Result")),
+					},
+				},
+			},
+		},
+	}
+	if serverURL != "" {
+		spec["servers"] = []object{{"url": serverURL}}
+	}
+	return spec
+}
+
+// handleOpenAPI serves the OpenAPI document; it needs no credentials so SDK
+// generators can fetch it
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, openAPISpec(""))
+}
+
+// runAPISpec implements the api-spec command, printing the OpenAPI document
+func runAPISpec(ctx context.Context, reporter *errorReporter, args []string) error {
+	fs := flag.NewFlagSet("api-spec", flag.ContinueOnError)
+	serverURL := fs.String("server-url", "", "base URL of the server to list in the document")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(openAPISpec(*serverURL))
+}
@@ -0,0 +1,541 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// stringList is a repeatable string flag
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// Discovery sources
+const (
+	discoveryARM           = "arm"
+	discoveryResourceGraph = "resource-graph"
+)
+
+// options holds the command-line configuration of a run
+type options struct {
+	journalPath  string
+	actionName   string
+	action       vmAction
+	armFilter    string
+	tenant       string
+	operatorID   string
+	force        bool
+	dryRun       bool
+	yes          bool
+	interactive  bool
+	maxVMs       int
+	overrideCap  bool
+	allowProd    bool
+	compareLast  bool
+	output       string
+	progress     bool
+	logLevel     string
+	quiet        bool
+	verbose      bool
+	level        slog.Level
+	logFormat    string
+	logFile      string
+	logMaxSize   int64
+	logKeep      int
+	logRotate    time.Duration
+	dedupeWindow time.Duration
+	tagStarted   bool
+	labelFlags   stringList
+	labels       map[string]string
+	protect      stringList
+	opaURL       string
+	tagFlags     stringList
+	tags         map[string]string
+	excludeFlags stringList
+	excludeTags  map[string][]string
+	planPath     string
+
+	order                   string
+	groupPriorityTag        string
+	groupParallelism        int
+	concurrency             int
+	armRetries              int
+	vmDeadline              time.Duration
+	vmDeadlineEscalation    string
+	wait                    bool
+	waitInterval            time.Duration
+	waitTimeout             time.Duration
+	vmTimeout               time.Duration
+	runTimeout              time.Duration
+	subscriptionConcurrency int
+	ppgBatching             bool
+	generalized             string
+	instanceViewWorkers     int
+	instanceViewTTL         time.Duration
+	metadataTTL             time.Duration
+	policyCheck             bool
+	costReport              bool
+	reportCSV               string
+	teamTag                 string
+	inheritTags             bool
+
+	webhookURL     string
+	webhookRetries int
+
+	serviceNowInstance string
+	serviceNowTable    string
+	serviceNowTemplate string
+	serviceNowRecord   string
+
+	jiraURL       string
+	jiraProject   string
+	jiraIssueType string
+	jiraIssue     string
+	jiraTemplate  string
+	jiraThreshold int
+
+	grafanaURL       string
+	grafanaDashboard string
+	grafanaTags      stringList
+
+	heartbeatURL string
+	hooksPath    string
+
+	oobStartersPath string
+	messagesPath    string
+	guardrailsPath  string
+
+	approvalChannel string
+	approvalUsers   stringList
+	approvalTimeout time.Duration
+
+	serveAddr    string
+	fleetsPath   string
+	apiTenant    string
+	apiAudience  string
+	apiRolesPath string
+	apiKeysPath  string
+	apiRate      int
+	apiBurst     int
+	apiMaxRuns   int
+	apiMaxQueued int
+
+	digest             string
+	digestTime         string
+	digestSlackChannel string
+	digestEmails       stringList
+	catchUp            string
+	publicURL          string
+	stopNotice         time.Duration
+	snoozeExtension    time.Duration
+	ownerTag           string
+	resolveOwners      bool
+
+	discovery      string
+	graphWhere     stringList
+	graphPageSize  int
+	graphSkipToken string
+	graphMaxPages  int
+	snapshotPath   string
+	snapshotMaxAge time.Duration
+
+	subscriptions        stringList
+	excludeSubscriptions stringList
+	resourceGroup        string
+	nameFlags            stringList
+	names                []namePattern
+	locationFlags        stringList
+	locations            []string
+
+	pimRole     string
+	pimScope    string
+	pimDuration time.Duration
+}
+
+// resourceGroupName matches valid resource group names, which keeps them safe
+// to embed in URLs and KQL literals
+var resourceGroupName = regexp.MustCompile(`^[-\w.()]{1,90}$`)
+
+// newFlagSet returns a flag set named name that parses into opts
+func newFlagSet(name string, opts *options) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&opts.actionName, "action", "start", "operation performed on the selected VMs: start, stop (power off, still billed), deallocate, restart or redeploy")
+	fs.StringVar(&opts.journalPath, "journal", "", "append-only journal recording every issued operation: a JSON lines file, a SQLite database (*.db, sqlite:<path>), postgres://... or azuretable://<account>/<table>")
+	fs.BoolVar(&opts.dryRun, "dry-run", false, "evaluate every VM but send no action requests, notifications or journal records")
+	fs.BoolVar(&opts.yes, "yes", false, "act on the selected VMs without asking for confirmation (required when stdin is not a terminal)")
+	fs.BoolVar(&opts.interactive, "interactive", false, "list the selected VMs as a checklist on the terminal and act on the checked ones only, instead of asking for confirmation")
+	fs.IntVar(&opts.maxVMs, "max-vms", 0, "refuse to act when more VMs than this are selected, unless --force is given (0 = no cap)")
+	fs.StringVar(&opts.output, "output", outputText, "output of a run: text, json for a document of its subscriptions and per-VM results, markdown for a report table, or azure-devops to add Azure Pipelines logging commands to the text logs; json and markdown are printed to stdout, with logs on stderr")
+	fs.BoolVar(&opts.progress, "progress", true, "on a terminal, show per-subscription progress bars in place of the per-VM log lines of runs that ask for no confirmation")
+	fs.StringVar(&opts.logLevel, "log-level", "info", "least severe log records written: debug, info, warn or error")
+	fs.BoolVar(&opts.quiet, "quiet", false, "only log errors and print no summary, e.g. for cron jobs; same as --log-level error")
+	fs.BoolVar(&opts.verbose, "verbose", false, "also log every Azure request with its URL, status, correlation ID and duration; same as --log-level debug")
+	fs.StringVar(&opts.logFormat, "log-format", logFormatText, "log record format: text, or json with one object per line for Log Analytics, Loki and the like")
+	fs.StringVar(&opts.logFile, "log-file", "", "also write every log record to this file, timestamped, as a persistent local audit trail")
+	fs.Int64Var(&opts.logMaxSize, "log-max-size", 100, "with --log-file, rotate the file once it would grow beyond this many MB (0 = no size limit)")
+	fs.DurationVar(&opts.logRotate, "log-rotate-every", 0, "with --log-file, also rotate the file at the start of every period of this length, e.g. 24h (0 = only by size)")
+	fs.IntVar(&opts.logKeep, "log-keep", 7, "with --log-file, rotated files to keep; older ones are removed (0 = keep all)")
+	fs.StringVar(&opts.guardrailsPath, "guardrails", "", "JSON file of limits for every run, such as max_vms_per_run; not lifted by --force")
+	fs.BoolVar(&opts.overrideCap, "override-cap", false, "run even when more VMs are selected than max_vms_per_run of --guardrails allows; audited")
+	fs.BoolVar(&opts.allowProd, "allow-production", false, "act even when selected VMs carry a production_tags tag of --guardrails; audited")
+	fs.BoolVar(&opts.compareLast, "compare-last", false, "with --dry-run, show how the decisions differ from the last run recorded in --journal")
+	fs.BoolVar(&opts.force, "force", false, "bypass all safety checks (power state, confirmation, guards, caps); audited")
+	fs.DurationVar(&opts.dedupeWindow, "dedupe-window", 0, "skip an action on a VM already requested within this window, by this or an earlier run (seen via --journal); 0 disables")
+	fs.BoolVar(&opts.tagStarted, "tag-started", false, "merge vm-starter:last-started and vm-starter:last-run-id tags onto started VMs")
+	fs.StringVar(&opts.opaURL, "opa-url", "", "OPA data API URL of the decision that must allow every action (e.g. http://localhost:8181/v1/data/vmstarter/decision)")
+	fs.Var(&opts.subscriptions, "subscription", "only discover VMs in this subscription, by ID or display name (repeatable)")
+	fs.Var(&opts.excludeSubscriptions, "exclude-subscription", "never discover VMs in this subscription, by ID or display name (repeatable)")
+	fs.StringVar(&opts.resourceGroup, "resource-group", "", "only discover VMs in this resource group (of every selected subscription)")
+	fs.Var(&opts.nameFlags, "name-filter", "only act on VMs whose name matches this glob (dev-*) or, anchored with ^ or $, regular expression (repeatable, any may match)")
+	fs.Var(&opts.locationFlags, "location", "only act on VMs in this region, e.g. westeurope (repeatable)")
+	fs.Var(&opts.tagFlags, "tag", "only act on VMs carrying this key=value tag (repeatable, all must match)")
+	fs.Var(&opts.excludeFlags, "exclude-tag", "always skip VMs carrying this key or key=value tag, whatever else matches (repeatable)")
+	fs.Var(&opts.labelFlags, "label", "key=value label attached to the run and propagated to audit records, notifications and --tag-started tags (repeatable)")
+	fs.Var(&opts.protect, "protect", "VM that must never be powered down: tag:key[=value], name:<vm> or id:<resource id> (repeatable)")
+	fs.StringVar(&opts.planPath, "plan", "", "desired-state plan file mixing running and deallocated selectors")
+	fs.StringVar(&opts.order, "order", orderDiscovery, "execution order: discovery, or resource-group to process one resource group at a time")
+	fs.StringVar(&opts.groupPriorityTag, "group-priority-tag", "", "resource group tag holding a numeric priority; lower values are processed first")
+	fs.IntVar(&opts.armRetries, "arm-retries", defaultRequestRetries, "retries of Azure requests that are throttled (429, honoring Retry-After) or fail with 5xx or network errors")
+	fs.DurationVar(&opts.vmDeadline, "vm-deadline", 0, "after a start is accepted, wait until the VM is running for this long and escalate if it is not (0 = don't wait)")
+	fs.StringVar(&opts.vmDeadlineEscalation, "vm-deadline-escalation", escalateDegraded, "when a VM misses --vm-deadline: degraded (report the start as degraded), notify (report it as failed) or redeploy (redeploy, wait again, then notify)")
+	fs.BoolVar(&opts.wait, "wait", false, "after an action is accepted, poll its Azure-AsyncOperation until it succeeds or fails and report the final outcome")
+	fs.DurationVar(&opts.waitInterval, "wait-interval", 10*time.Second, "with --wait, how often the operation of an action is polled")
+	fs.DurationVar(&opts.waitTimeout, "wait-timeout", 15*time.Minute, "with --wait, how long an operation may take before the action is reported as failed")
+	fs.DurationVar(&opts.vmTimeout, "vm-timeout", 0, "longest a single VM may take, from sending its action through --wait and --vm-deadline, before it is reported as failed (0 = no limit)")
+	fs.DurationVar(&opts.runTimeout, "run-timeout", 0, "longest the whole run may take; requests and waits still in flight are then cancelled, the partial summary is printed and the exit code is 3 (0 = no limit)")
+	fs.IntVar(&opts.concurrency, "concurrency", 1, "action requests sent at the same time (1 acts on VMs one after another); resource group and proximity placement group batches have their own parallelism")
+	fs.IntVar(&opts.subscriptionConcurrency, "subscription-concurrency", 0, "with --concurrency, action requests sent at the same time within one subscription (0 = no limit of its own)")
+	fs.IntVar(&opts.groupParallelism, "group-parallelism", 8, "VMs of a resource group started at the same time with --order resource-group")
+	fs.BoolVar(&opts.ppgBatching, "ppg-batching", false, "start the members of each proximity placement group together, before other VMs")
+	fs.StringVar(&opts.generalized, "generalized", generalizedSkip, "generalized VMs, detected from the instance view: skip, warn (attempt anyway) or off (no instance view lookups together with --force)")
+	fs.IntVar(&opts.instanceViewWorkers, "instance-view-workers", 8, "instance views loaded at the same time during enrichment")
+	fs.DurationVar(&opts.instanceViewTTL, "instance-view-ttl", 0, "reuse instance views loaded by earlier runs for this long (server mode; 0 disables)")
+	fs.DurationVar(&opts.metadataTTL, "metadata-ttl", 0, "reuse the subscription list and resource group tags of earlier runs for this long (server mode; 0 disables)")
+	fs.BoolVar(&opts.policyCheck, "policy-check", false, "skip VMs that are non-compliant with a deny Azure Policy assignment (Policy Insights)")
+	fs.BoolVar(&opts.costReport, "cost-report", false, "after the run, report which started VM sizes are covered by reservations and which run pay-as-you-go")
+	fs.StringVar(&opts.reportCSV, "report-csv", "", "write the result of every VM (subscription, resource group, VM, action, outcome, duration, error) to this CSV file")
+	fs.BoolVar(&opts.inheritTags, "inherit-tags", false, "evaluate VMs against their tags merged over their resource group's and subscription's (VM overrides resource group overrides subscription)")
+	fs.StringVar(&opts.teamTag, "team-tag", "", "tag key naming the team that owns a VM; reports, results and the journal are broken down by it")
+	fs.StringVar(&opts.webhookURL, "webhook-url", "", "POST every VM result to this URL, signed with VMSTARTER_WEBHOOK_SECRET (required)")
+	fs.IntVar(&opts.webhookRetries, "webhook-retries", 5, "retries for failed webhook deliveries")
+	fs.StringVar(&opts.serviceNowInstance, "servicenow-instance", "", "ServiceNow instance host (e.g. mycompany.service-now.com) to track runs in")
+	fs.StringVar(&opts.serviceNowTable, "servicenow-table", "change_request", "ServiceNow table to create the run record in")
+	fs.StringVar(&opts.serviceNowTemplate, "servicenow-template", "", "Go template file rendering the JSON fields of the new record")
+	fs.StringVar(&opts.serviceNowRecord, "servicenow-record", "", "sys_id of an existing record to attach work notes to instead of creating one")
+	fs.StringVar(&opts.jiraURL, "jira-url", "", "Jira base URL (e.g. https://mycompany.atlassian.net) to report failed runs to")
+	fs.StringVar(&opts.jiraProject, "jira-project", "", "Jira project key for new issues")
+	fs.StringVar(&opts.jiraIssueType, "jira-issue-type", "Task", "Jira issue type for new issues")
+	fs.StringVar(&opts.jiraIssue, "jira-issue", "", "existing Jira issue key to comment on instead of creating issues")
+	fs.StringVar(&opts.jiraTemplate, "jira-template", "", "Go template file rendering the issue description or comment")
+	fs.IntVar(&opts.jiraThreshold, "jira-threshold", 1, "minimum number of failed VMs that triggers a Jira report")
+	fs.StringVar(&opts.grafanaURL, "grafana-url", "", "Grafana base URL to push run annotations to (token in GRAFANA_TOKEN)")
+	fs.StringVar(&opts.grafanaDashboard, "grafana-dashboard-uid", "", "limit annotations to this dashboard (default: organization-wide)")
+	fs.Var(&opts.grafanaTags, "grafana-tag", "extra tag for Grafana annotations (repeatable)")
+	fs.StringVar(&opts.heartbeatURL, "heartbeat-url", "", "dead man's switch URL pinged after every run without failures (healthchecks.io style)")
+	fs.StringVar(&opts.oobStartersPath, "oob-starters", "", "JSON file of webhooks starting Azure Arc-enabled servers out of band; enables Arc discovery")
+	fs.StringVar(&opts.hooksPath, "hooks", "", "JSON file of pre_run, post_vm_start and post_run commands to execute")
+	fs.StringVar(&opts.messagesPath, "messages", "", "JSON file translating the notification messages (see config messages); untranslated messages stay English")
+	fs.StringVar(&opts.approvalChannel, "approval-slack-channel", "", "Slack channel ID to request plan approval in before executing")
+	fs.Var(&opts.approvalUsers, "approval-user", "Slack user ID allowed to approve or reject the plan (repeatable)")
+	fs.DurationVar(&opts.approvalTimeout, "approval-timeout", 30*time.Minute, "cancel the run if the plan is not approved in time")
+	fs.StringVar(&opts.serveAddr, "serve", "", "serve the REST API on this address (e.g. :8080) instead of running once")
+	fs.StringVar(&opts.fleetsPath, "fleets", "", "JSON file of named fleets, each with its own run flags and schedule, served next to the default one")
+	fs.StringVar(&opts.apiTenant, "api-tenant", "", "Azure AD tenant ID whose tokens the API accepts")
+	fs.StringVar(&opts.apiAudience, "api-audience", "", "expected audience (application ID URI or client ID) of API tokens")
+	fs.StringVar(&opts.apiRolesPath, "api-roles", "", "JSON file mapping app roles to allowed actions and scopes")
+	fs.StringVar(&opts.apiKeysPath, "api-keys", "", "JSON file of static API keys with their allowed actions, scopes and selectors")
+	fs.IntVar(&opts.apiRate, "api-rate", 30, "API requests per minute allowed per client")
+	fs.IntVar(&opts.apiBurst, "api-burst", 5, "API requests a client may burst above its rate")
+	fs.IntVar(&opts.apiMaxRuns, "api-max-runs", 2, "maximum number of runs executing at the same time in server mode")
+	fs.IntVar(&opts.apiMaxQueued, "api-max-queued", 10, "maximum number of unfinished (queued or running) runs in server mode")
+	fs.StringVar(&opts.digest, "digest", "", "in server mode, send a daily or weekly digest of starts, uptime, failures and estimated cost")
+	fs.StringVar(&opts.digestTime, "digest-time", "08:00", "UTC time of day (HH:MM) the digest is sent at; weekly digests go out on Mondays")
+	fs.StringVar(&opts.digestSlackChannel, "digest-slack-channel", "", "Slack channel ID to post the digest in (bot token in SLACK_BOT_TOKEN)")
+	fs.Var(&opts.digestEmails, "digest-email", "email address to send the digest to via SMTP_ADDR (repeatable)")
+	fs.StringVar(&opts.catchUp, "catch-up", catchUpOnce, "scheduled fire times missed while the host was suspended or its clock jumped: once (fire once when noticed) or skip")
+	fs.StringVar(&opts.publicURL, "public-url", "", "in server mode, the URL the server is reached at by people, for the snooze links of stop notices")
+	fs.DurationVar(&opts.stopNotice, "stop-notice", 0, "for a scheduled fleet that stops or deallocates VMs, notify the owners of the VMs this long before the stop, with links to snooze it (0 = no notice)")
+	fs.DurationVar(&opts.snoozeExtension, "snooze-extension", time.Hour, "how long a snooze link of a stop notice keeps the VM up after the scheduled stop")
+	fs.StringVar(&opts.ownerTag, "owner-tag", "owner", "tag key naming whom to notify about a VM: email addresses, slack:<ID> or https:// webhook URLs")
+	fs.BoolVar(&opts.resolveOwners, "resolve-owners", false, "resolve owners that are user principal names or group names through Microsoft Graph to the mail addresses or Teams channels reaching them")
+	fs.StringVar(&opts.tenant, "tenant", "", "Azure AD tenant ID to acquire tokens in (default: the credential's own tenant)")
+	fs.StringVar(&opts.operatorID, "operator-client-id", "", "client ID of the identity sending action requests; the default credential is then only used to read")
+	fs.StringVar(&opts.pimRole, "pim-role", "", "activate this eligible Azure role (display name or role definition ID) through PIM before acting on VMs")
+	fs.StringVar(&opts.pimScope, "pim-scope", "", "with --pim-role, the scope to look up the eligibility on, e.g. /subscriptions/<ID>")
+	fs.DurationVar(&opts.pimDuration, "pim-duration", time.Hour, "how long the PIM activation lasts; it is left to expire after the run")
+	fs.StringVar(&opts.armFilter, "arm-filter", "", "OData $filter applied server-side to the ARM VM list (e.g. \"location eq 'westeurope'\")")
+	fs.StringVar(&opts.discovery, "discovery", discoveryARM, "VM discovery source: arm or resource-graph")
+	fs.StringVar(&opts.snapshotPath, "snapshot", "", "act on the VMs of an inventory snapshot written by snapshot export instead of discovering them")
+	fs.DurationVar(&opts.snapshotMaxAge, "snapshot-max-age", 24*time.Hour, "refuse --snapshot files taken longer ago than this (0 = any age)")
+	fs.Var(&opts.graphWhere, "rg-where", "KQL where clause appended to the Resource Graph query (repeatable, ANDed)")
+	fs.IntVar(&opts.graphPageSize, "rg-page-size", 1000, "Resource Graph page size (1-1000)")
+	fs.StringVar(&opts.graphSkipToken, "rg-skip-token", "", "Resource Graph skip token to resume paging from")
+	fs.IntVar(&opts.graphMaxPages, "rg-max-pages", 0, "stop Resource Graph paging after this many pages (0 = no limit)")
+	return fs
+}
+
+// parseOptions parses command-line arguments into options
+func parseOptions(args []string) (*options, error) {
+	opts := &options{}
+	fs := newFlagSet("vmstarter", opts)
+	fs.Usage = func() {
+		out := fs.Output()
+		fmt.Fprintf(out, "Usage: vmstarter [flags]\n       vmstarter <command> [flags]\n\nCommands:\n")
+		names := make([]string, 0, len(commands))
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(out, "  %-12s %s\n", name, commands[name].summary)
+		}
+		fmt.Fprintf(out, "\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+// instanceView reports whether runs load the instance view of every VM: for the
+// generalized check, and for the power state checks that --force turns off
+func (opts *options) instanceView() bool {
+	return opts.generalized != generalizedOff || !opts.force
+}
+
+// validate checks the combination of parsed options
+func (opts *options) validate() error {
+	aadConfigured := opts.apiTenant != "" || opts.apiAudience != "" || opts.apiRolesPath != ""
+	if aadConfigured && (opts.apiTenant == "" || opts.apiAudience == "" || opts.apiRolesPath == "") {
+		return fmt.Errorf("--api-tenant, --api-audience and --api-roles must be used together")
+	}
+	if opts.serveAddr != "" && !aadConfigured && opts.apiKeysPath == "" {
+		return fmt.Errorf("--serve requires Azure AD (--api-tenant) or API key (--api-keys) authentication")
+	}
+
+	if opts.dryRun && opts.serveAddr != "" {
+		return fmt.Errorf("--dry-run cannot be combined with --serve")
+	}
+	if opts.interactive && (opts.serveAddr != "" || opts.yes) {
+		return fmt.Errorf("--interactive cannot be combined with --serve or --yes: it asks on the terminal")
+	}
+	if opts.interactive && opts.output != outputText {
+		return fmt.Errorf("--interactive cannot be combined with --output %s: the checklist takes over the terminal", opts.output)
+	}
+	switch opts.output {
+	case outputText:
+	case outputAzureDevOps:
+	case outputJSON, outputMarkdown:
+		if opts.serveAddr != "" {
+			return fmt.Errorf("--output %s cannot be combined with --serve: it describes a single run", opts.output)
+		}
+	default:
+		return fmt.Errorf("--output must be text, json, markdown or azure-devops")
+	}
+	level, err := parseLogLevel(opts.logLevel)
+	if err != nil {
+		return err
+	}
+	switch {
+	case opts.quiet && opts.verbose:
+		return fmt.Errorf("--quiet and --verbose cannot be combined")
+	case (opts.quiet || opts.verbose) && level != slog.LevelInfo:
+		return fmt.Errorf("--quiet and --verbose cannot be combined with --log-level")
+	case opts.quiet:
+		level = slog.LevelError
+	case opts.verbose:
+		level = slog.LevelDebug
+	}
+	opts.level = level
+	switch opts.logFormat {
+	case logFormatText, logFormatJSON:
+	default:
+		return fmt.Errorf("--log-format must be text or json")
+	}
+	if opts.logMaxSize < 0 || opts.logRotate < 0 || opts.logKeep < 0 {
+		return fmt.Errorf("--log-max-size, --log-rotate-every and --log-keep must not be negative")
+	}
+	if opts.compareLast && (!opts.dryRun || opts.journalPath == "") {
+		return fmt.Errorf("--compare-last requires --dry-run and --journal")
+	}
+
+	if opts.reportCSV != "" && opts.serveAddr != "" {
+		return fmt.Errorf("--report-csv cannot be combined with --serve: runs would overwrite each other's report")
+	}
+
+	if opts.fleetsPath != "" && opts.serveAddr == "" {
+		return fmt.Errorf("--fleets requires --serve")
+	}
+
+	if opts.apiRate < 1 || opts.apiBurst < 1 || opts.apiMaxRuns < 1 || opts.apiMaxQueued < 1 {
+		return fmt.Errorf("--api-rate, --api-burst, --api-max-runs and --api-max-queued must be positive")
+	}
+
+	if opts.webhookURL != "" && os.Getenv("VMSTARTER_WEBHOOK_SECRET") == "" {
+		return fmt.Errorf("--webhook-url requires VMSTARTER_WEBHOOK_SECRET: results are not posted unsigned")
+	}
+
+	switch opts.digest {
+	case "":
+		if opts.digestSlackChannel != "" || len(opts.digestEmails) > 0 {
+			return fmt.Errorf("--digest-slack-channel and --digest-email require --digest")
+		}
+	case digestDaily, digestWeekly:
+		if opts.serveAddr == "" {
+			return fmt.Errorf("--digest requires --serve")
+		}
+		if opts.digestSlackChannel == "" && len(opts.digestEmails) == 0 {
+			return fmt.Errorf("--digest requires --digest-slack-channel or --digest-email")
+		}
+	default:
+		return fmt.Errorf("unknown --digest %q", opts.digest)
+	}
+
+	action, err := parseAction(opts.actionName)
+	if err != nil {
+		return err
+	}
+	opts.action = action
+	if action != actionStart && opts.planPath != "" {
+		return fmt.Errorf("--action cannot be combined with --plan, whose rules set the action of every VM")
+	}
+
+	labels, err := parseLabels(opts.labelFlags)
+	if err != nil {
+		return err
+	}
+	opts.labels = labels
+	if opts.tags, err = parseTagSelectors("--tag", opts.tagFlags); err != nil {
+		return err
+	}
+	if opts.excludeTags, err = parseTagExclusions(opts.excludeFlags); err != nil {
+		return err
+	}
+	if opts.names, err = parseNamePatterns(opts.nameFlags); err != nil {
+		return err
+	}
+	if opts.locations, err = parseLocations(opts.locationFlags); err != nil {
+		return err
+	}
+	if (opts.pimRole == "") != (opts.pimScope == "") {
+		return fmt.Errorf("--pim-role and --pim-scope must be used together")
+	}
+	if opts.pimRole != "" && !strings.HasPrefix(opts.pimScope, "/") {
+		return fmt.Errorf("invalid --pim-scope %q: expected a resource ID", opts.pimScope)
+	}
+	if opts.pimDuration < 5*time.Minute {
+		return fmt.Errorf("--pim-duration must be at least 5m")
+	}
+	if opts.maxVMs < 0 {
+		return fmt.Errorf("--max-vms must not be negative")
+	}
+	for _, sub := range opts.subscriptions {
+		if containsFold(opts.excludeSubscriptions, sub) {
+			return fmt.Errorf("subscription %q is both included and excluded", sub)
+		}
+	}
+	if opts.snapshotPath != "" && (len(opts.subscriptions) > 0 || len(opts.excludeSubscriptions) > 0 || opts.resourceGroup != "" ||
+		opts.armFilter != "" || opts.discovery != discoveryARM) {
+		return fmt.Errorf("--snapshot cannot be combined with --subscription, --exclude-subscription, --resource-group, --arm-filter or --discovery: scope the snapshot when exporting it")
+	}
+	if opts.snapshotMaxAge < 0 {
+		return fmt.Errorf("--snapshot-max-age must not be negative")
+	}
+	if opts.resourceGroup != "" && (!resourceGroupName.MatchString(opts.resourceGroup) || strings.HasSuffix(opts.resourceGroup, ".")) {
+		return fmt.Errorf("invalid --resource-group %q", opts.resourceGroup)
+	}
+
+	switch opts.catchUp {
+	case catchUpOnce, catchUpSkip:
+	default:
+		return fmt.Errorf("unknown --catch-up %q", opts.catchUp)
+	}
+	if opts.stopNotice < 0 || opts.snoozeExtension <= 0 {
+		return fmt.Errorf("--stop-notice must not be negative and --snooze-extension must be positive")
+	}
+	if opts.stopNotice > 0 && (!opts.action.powersDown() || opts.journalPath == "") {
+		return fmt.Errorf("--stop-notice requires --action stop or deallocate and a --journal to record snoozes in")
+	}
+	if opts.resolveOwners && opts.stopNotice == 0 {
+		return fmt.Errorf("--resolve-owners requires --stop-notice: it resolves the owners notified before stops")
+	}
+	if opts.publicURL != "" && !strings.HasPrefix(opts.publicURL, "https://") && !strings.HasPrefix(opts.publicURL, "http://") {
+		return fmt.Errorf("invalid --public-url %q: expected an http(s) URL", opts.publicURL)
+	}
+
+	switch opts.order {
+	case orderDiscovery:
+		if opts.groupPriorityTag != "" {
+			return fmt.Errorf("--group-priority-tag requires --order %s", orderResourceGroup)
+		}
+	case orderResourceGroup:
+		if opts.groupParallelism < 1 {
+			return fmt.Errorf("--group-parallelism must be positive")
+		}
+	default:
+		return fmt.Errorf("unknown --order %q", opts.order)
+	}
+
+	switch opts.generalized {
+	case generalizedSkip, generalizedWarn, generalizedOff:
+	default:
+		return fmt.Errorf("unknown --generalized %q", opts.generalized)
+	}
+	if opts.instanceViewWorkers < 1 {
+		return fmt.Errorf("--instance-view-workers must be positive")
+	}
+	if opts.armRetries < 0 {
+		return fmt.Errorf("--arm-retries must not be negative")
+	}
+	if opts.vmDeadline < 0 {
+		return fmt.Errorf("--vm-deadline must not be negative")
+	}
+	if !containsFold(knownEscalations, opts.vmDeadlineEscalation) {
+		return fmt.Errorf("unknown --vm-deadline-escalation %q: expected one of %s", opts.vmDeadlineEscalation, strings.Join(knownEscalations, ", "))
+	}
+	opts.vmDeadlineEscalation = strings.ToLower(opts.vmDeadlineEscalation)
+	if opts.vmTimeout < 0 || opts.runTimeout < 0 {
+		return fmt.Errorf("--vm-timeout and --run-timeout must not be negative")
+	}
+	if opts.waitInterval <= 0 || opts.waitTimeout <= 0 {
+		return fmt.Errorf("--wait-interval and --wait-timeout must be positive")
+	}
+	if opts.concurrency < 1 {
+		return fmt.Errorf("--concurrency must be positive")
+	}
+	if opts.subscriptionConcurrency < 0 {
+		return fmt.Errorf("--subscription-concurrency must not be negative")
+	}
+
+	switch opts.discovery {
+	case discoveryARM:
+		if len(opts.graphWhere) > 0 || opts.graphSkipToken != "" || opts.graphMaxPages != 0 {
+			return fmt.Errorf("--rg-* flags require --discovery %s", discoveryResourceGraph)
+		}
+	case discoveryResourceGraph:
+		if opts.armFilter != "" {
+			return fmt.Errorf("--arm-filter requires --discovery %s; use --rg-where instead", discoveryARM)
+		}
+		if opts.graphPageSize < 1 || opts.graphPageSize > 1000 {
+			return fmt.Errorf("--rg-page-size must be between 1 and 1000")
+		}
+	default:
+		return fmt.Errorf("unknown --discovery %q", opts.discovery)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Execution orders
+const (
+	orderDiscovery     = "discovery"
+	orderResourceGroup = "resource-group"
+)
+
+// resourceGroupBatcher returns a batcher that executes one resource group at a
+// time. Groups are ordered by the numeric value of their priorityTag (lowest
+// first, groups without it last) and then alphabetically; with no priorityTag
+// the order is alphabetical. Tags are read through meta.
+func resourceGroupBatcher(meta *metadataCache, token, priorityTag string) batcher {
+	return func(ctx context.Context, targets []*vmTarget) []targetBatch {
+		type group struct {
+			subscriptionID string
+			name           string
+			priority       int
+			prioritized    bool
+			targets        []*vmTarget
+		}
+		groups := map[string]*group{}
+		for _, t := range targets {
+			key := strings.ToLower(t.SubscriptionID + "/" + t.ResourceGroup)
+			g, ok := groups[key]
+			if !ok {
+				g = &group{subscriptionID: t.SubscriptionID, name: t.ResourceGroup}
+				groups[key] = g
+			}
+			g.targets = append(g.targets, t)
+		}
+
+		ordered := make([]*group, 0, len(groups))
+		for _, g := range groups {
+			if priorityTag != "" {
+				g.priority, g.prioritized = resourceGroupPriority(ctx, meta, token, g.subscriptionID, g.name, priorityTag)
+			}
+			ordered = append(ordered, g)
+		}
+		sort.Slice(ordered, func(i, j int) bool {
+			a, b := ordered[i], ordered[j]
+			if a.prioritized != b.prioritized {
+				return a.prioritized
+			}
+			if a.priority != b.priority {
+				return a.priority < b.priority
+			}
+			if !strings.EqualFold(a.name, b.name) {
+				return strings.ToLower(a.name) < strings.ToLower(b.name)
+			}
+			return a.subscriptionID < b.subscriptionID
+		})
+
+		batches := make([]targetBatch, len(ordered))
+		for i, g := range ordered {
+			label := fmt.Sprintf("resource group %s (%s)", g.name, g.subscriptionID)
+			if g.prioritized {
+				label += fmt.Sprintf(", priority %d", g.priority)
+			}
+			batches[i] = targetBatch{label: label, targets: g.targets}
+		}
+		return batches
+	}
+}
+
+// resourceGroupPriority reads the numeric priority tag of a resource group;
+// ok is false when the group has no valid priority
+func resourceGroupPriority(ctx context.Context, meta *metadataCache, token, subscriptionID, resourceGroup, tag string) (priority int, ok bool) {
+	tags, err := meta.resourceGroupTags(ctx, token, subscriptionID, resourceGroup)
+	if err != nil {
+		slog.Error("Failed to read tags of resource group", "resourceGroup", resourceGroup, "error", err)
+		return 0, false
+	}
+	for key, value := range tags {
+		if !strings.EqualFold(key, tag) {
+			continue
+		}
+		priority, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			slog.Error("Resource group has a non-numeric priority tag", "resourceGroup", resourceGroup, "tag", key, "value", value)
+			return 0, false
+		}
+		return priority, true
+	}
+	return 0, false
+}
+
+// ppgBatcher returns a batcher that starts the members of every proximity
+// placement group together, all at once and before any other VM, which gives
+// co-located allocation the best chance to succeed. The remaining targets are
+// batched by next, or executed one by one when next is nil.
+func ppgBatcher(next batcher) batcher {
+	return func(ctx context.Context, targets []*vmTarget) []targetBatch {
+		groups := map[string][]*vmTarget{}
+		var ids []string
+		var rest []*vmTarget
+		for _, t := range targets {
+			if t.PPG == "" {
+				rest = append(rest, t)
+				continue
+			}
+			id := strings.ToLower(t.PPG)
+			if _, ok := groups[id]; !ok {
+				ids = append(ids, id)
+			}
+			groups[id] = append(groups[id], t)
+		}
+		sort.Strings(ids)
+
+		var batches []targetBatch
+		for _, id := range ids {
+			members := groups[id]
+			ppg := members[0].PPG
+			batches = append(batches, targetBatch{
+				label:       fmt.Sprintf("proximity placement group %s (%s)", ppg[strings.LastIndex(ppg, "/")+1:], parseResourceGroup(ppg)),
+				targets:     members,
+				parallelism: len(members),
+			})
+		}
+		if next != nil {
+			return append(batches, next(ctx, rest)...)
+		}
+		for _, t := range rest {
+			batches = append(batches, targetBatch{targets: []*vmTarget{t}})
+		}
+		return batches
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Output modes of a run
+const (
+	outputText     = "text"
+	outputJSON     = "json"
+	outputMarkdown = "markdown"
+	// outputAzureDevOps keeps the text logs and adds Azure Pipelines logging commands
+	outputAzureDevOps = "azure-devops"
+)
+
+// githubStepSummary names the file GitHub Actions renders as the job summary
+const githubStepSummary = "GITHUB_STEP_SUMMARY"
+
+// runDocument is what a run prints to stdout with --output json: the
+// subscriptions it processed and the result of every VM it targeted
+type runDocument struct {
+	RunID         string                 `json:"runId"`
+	StartedAt     string                 `json:"startedAt"`
+	FinishedAt    string                 `json:"finishedAt"`
+	DurationMs    int64                  `json:"durationMs"`
+	Action        string                 `json:"action"`
+	DryRun        bool                   `json:"dryRun,omitempty"`
+	RunTimedOut   bool                   `json:"runTimedOut,omitempty"`
+	ExitCode      int                    `json:"exitCode"`
+	Accepted      int                    `json:"accepted"`
+	Failed        int                    `json:"failed"`
+	Skipped       int                    `json:"skipped"`
+	Planned       int                    `json:"planned,omitempty"`
+	SkippedBy     map[string]int         `json:"skippedBy,omitempty"`
+	Subscriptions []subscriptionDocument `json:"subscriptions"`
+	VMs           []resultRecord         `json:"vms"`
+}
+
+// subscriptionDocument counts the results of the VMs of one subscription
+type subscriptionDocument struct {
+	SubscriptionID string `json:"subscriptionId"`
+	VMs            int    `json:"vms"`
+	Accepted       int    `json:"accepted"`
+	Failed         int    `json:"failed"`
+	Skipped        int    `json:"skipped"`
+	Planned        int    `json:"planned,omitempty"`
+}
+
+// newRunDocument builds the document of a finished run, with its subscriptions
+// and VMs ordered by ID
+func newRunDocument(runID string, opts *options, startedAt, finishedAt time.Time, summary *runSummary, exitCode int) *runDocument {
+	doc := &runDocument{
+		RunID:         runID,
+		StartedAt:     startedAt.UTC().Format(time.RFC3339),
+		FinishedAt:    finishedAt.UTC().Format(time.RFC3339),
+		DurationMs:    finishedAt.Sub(startedAt).Milliseconds(),
+		Action:        string(opts.action),
+		DryRun:        opts.dryRun,
+		RunTimedOut:   exitCode == exitRunTimeout,
+		ExitCode:      exitCode,
+		Accepted:      summary.Accepted,
+		Failed:        summary.Failed,
+		Skipped:       summary.Skipped,
+		Planned:       summary.Planned,
+		SkippedBy:     summary.SkippedBy,
+		Subscriptions: []subscriptionDocument{},
+		VMs:           []resultRecord{},
+	}
+	subs := map[string]*subscriptionDocument{}
+	for _, res := range summary.Results {
+		doc.VMs = append(doc.VMs, res.record(runID))
+		key := strings.ToLower(res.Target.SubscriptionID)
+		sub, ok := subs[key]
+		if !ok {
+			sub = &subscriptionDocument{SubscriptionID: res.Target.SubscriptionID}
+			subs[key] = sub
+		}
+		sub.VMs++
+		switch res.outcome() {
+		case outcomeAccepted:
+			sub.Accepted++
+		case outcomeFailed, outcomeAccessLost:
+			sub.Failed++
+		case outcomeSkipped:
+			sub.Skipped++
+		case outcomePlanned:
+			sub.Planned++
+		}
+	}
+	for _, sub := range subs {
+		doc.Subscriptions = append(doc.Subscriptions, *sub)
+	}
+	sort.Slice(doc.Subscriptions, func(i, j int) bool {
+		return strings.ToLower(doc.Subscriptions[i].SubscriptionID) < strings.ToLower(doc.Subscriptions[j].SubscriptionID)
+	})
+	sort.Slice(doc.VMs, func(i, j int) bool { return strings.ToLower(doc.VMs[i].ID) < strings.ToLower(doc.VMs[j].ID) })
+	return doc
+}
+
+// write prints the document as indented JSON
+func (d *runDocument) write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(d)
+}
+
+// writeMarkdownSummary writes the results of a run as a Markdown report: its
+// counts and a table of the VMs it started, skipped or failed on
+func writeMarkdownSummary(w io.Writer, runID string, opts *options, summary *runSummary, exitCode int) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "### VMStarter run `%s`\n\n", runID)
+	mode := ""
+	if opts.dryRun {
+		mode = " (dry run)"
+	}
+	fmt.Fprintf(&b, "**%s**%s: %d accepted, %d failed, %d skipped", opts.action, mode, summary.Accepted, summary.Failed, summary.Skipped)
+	if summary.Planned > 0 {
+		fmt.Fprintf(&b, ", %d planned", summary.Planned)
+	}
+	fmt.Fprintf(&b, " · exit code %d\n\n", exitCode)
+	if exitCode == exitRunTimeout {
+		fmt.Fprintf(&b, "> **Warning:** the run exceeded `--run-timeout`; the results are partial.\n\n")
+	}
+	rows, filtered := resultRows(summary.Results)
+	if len(rows) > 0 {
+		b.WriteString("| Result | Action | Subscription | Resource group | VM | Duration | Detail |\n")
+		b.WriteString("| --- | --- | --- | --- | --- | ---: | --- |\n")
+		for _, res := range rows {
+			t := res.Target
+			duration := ""
+			if res.Duration > 0 {
+				duration = res.Duration.Round(time.Millisecond).String()
+			}
+			fmt.Fprintf(&b, "| %s | %s | %s | %s | %s | %s | %s |\n", resultLabel(res), markdownCell(orDash(string(res.Action))),
+				markdownCell(t.SubscriptionID), markdownCell(t.ResourceGroup), markdownCell(t.Name), duration, markdownCell(resultDetail(res)))
+		}
+		b.WriteString("\n")
+	}
+	if filtered > 0 {
+		fmt.Fprintf(&b, "_%d VM(s) excluded by filters are not listed._\n\n", filtered)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// appendStepSummary appends the Markdown report of a run to the job summary
+// of GitHub Actions, when the run is a step of a workflow
+func appendStepSummary(runID string, opts *options, summary *runSummary, exitCode int) error {
+	path := os.Getenv(githubStepSummary)
+	if path == "" {
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := writeMarkdownSummary(f, runID, opts, summary, exitCode); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// markdownCell escapes s for a Markdown table cell
+func markdownCell(s string) string {
+	return strings.NewReplacer("|", "\\|", "\n", " ", "\r", "").Replace(s)
+}
+
+// azureDevOpsIssueSkips are the skip categories reported as warnings to Azure
+// Pipelines: VMs that were meant to be acted on but were not
+var azureDevOpsIssueSkips = map[string]bool{skipCap: true, skipRejected: true, skipRunTimeout: true}
+
+// writeAzureDevOpsCommands writes the results of a run as Azure Pipelines
+// logging commands: an error issue per failed VM, a warning per degraded start
+// or VM rejected as a whole, and the result of the task, so that they show up
+// in the summary of the pipeline run
+func writeAzureDevOpsCommands(w io.Writer, summary *runSummary, exitCode int) error {
+	var b strings.Builder
+	warnings := 0
+	rows, _ := resultRows(summary.Results)
+	for _, res := range rows {
+		t := res.Target
+		vm := t.SubscriptionID + "/" + t.ResourceGroup + "/" + t.Name
+		switch {
+		case resultLabel(res) == outcomeFailed:
+			fmt.Fprintf(&b, "##vso[task.logissue type=error]VM %s: %s failed: %s\n", azureDevOpsEscape(vm), res.Action, azureDevOpsEscape(resultDetail(res)))
+		case res.Degraded != "" || azureDevOpsIssueSkips[res.SkipCategory]:
+			warnings++
+			fmt.Fprintf(&b, "##vso[task.logissue type=warning]VM %s: %s\n", azureDevOpsEscape(vm), azureDevOpsEscape(resultDetail(res)))
+		}
+	}
+	result := "Succeeded"
+	switch {
+	case exitCode == exitPartialFailure || (exitCode == exitSuccess && warnings > 0):
+		result = "SucceededWithIssues"
+	case exitCode != exitSuccess:
+		result = "Failed"
+	}
+	fmt.Fprintf(&b, "##vso[task.complete result=%s;]%d accepted, %d failed, %d skipped\n", result, summary.Accepted, summary.Failed, summary.Skipped)
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// azureDevOpsEscape escapes s for the message of a logging command
+func azureDevOpsEscape(s string) string {
+	return strings.NewReplacer("%", "%AZP25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
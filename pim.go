@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// Authorization API version of the PIM role eligibility and activation APIs
+const pimAPI = "2020-10-01"
+
+// PIM activation request statuses
+const (
+	pimStatusProvisioned     = "Provisioned"
+	pimStatusPendingApproval = "PendingApproval"
+)
+
+// pimMaxJustification is the longest justification PIM accepts
+const pimMaxJustification = 500
+
+// pimEligibilityResponse represents the role eligibility schedule instances API response
+type pimEligibilityResponse struct {
+	Value []struct {
+		Properties struct {
+			Scope                     string `json:"scope"`
+			RoleDefinitionID          string `json:"roleDefinitionId"`
+			RoleEligibilityScheduleID string `json:"roleEligibilityScheduleId"`
+			ExpandedProperties        struct {
+				RoleDefinition struct {
+					DisplayName string `json:"displayName"`
+				} `json:"roleDefinition"`
+			} `json:"expandedProperties"`
+		} `json:"properties"`
+	} `json:"value"`
+}
+
+// pimActivationRequest is a role assignment schedule request activating an eligible role
+type pimActivationRequest struct {
+	Properties struct {
+		PrincipalID                     string `json:"principalId"`
+		RoleDefinitionID                string `json:"roleDefinitionId"`
+		RequestType                     string `json:"requestType"`
+		LinkedRoleEligibilityScheduleID string `json:"linkedRoleEligibilityScheduleId"`
+		Justification                   string `json:"justification"`
+		ScheduleInfo                    struct {
+			Expiration struct {
+				Type     string `json:"type"`
+				Duration string `json:"duration"`
+			} `json:"expiration"`
+		} `json:"scheduleInfo"`
+		TicketInfo *pimTicketInfo `json:"ticketInfo,omitempty"`
+	} `json:"properties"`
+}
+
+type pimTicketInfo struct {
+	TicketNumber string `json:"ticketNumber"`
+}
+
+// pimActivation activates an eligible Azure role through Privileged Identity
+// Management before a run acts on any VM, so that the identity holds no
+// standing write access. The activation is not revoked after the run; it
+// expires on its own after duration.
+type pimActivation struct {
+	role     string // display name or role definition ID
+	scope    string // where eligibilities are looked up
+	duration time.Duration
+	access   *accessGuard
+	journal  *journal
+	runID    string
+	labels   map[string]string
+}
+
+// gate is a planGate activating the role for the identity that sends the
+// action requests. Plans without Azure VMs need no activation.
+func (a *pimActivation) gate(ctx context.Context, targets []*vmTarget) error {
+	needed := false
+	for _, t := range targets {
+		needed = needed || !t.Arc
+	}
+	if !needed {
+		return nil
+	}
+	token, err := a.access.current(ctx)
+	if err != nil {
+		return err
+	}
+	principal, err := tokenObjectID(token)
+	if err != nil {
+		return fmt.Errorf("PIM activation: %w", err)
+	}
+
+	var eligible pimEligibilityResponse
+	listURL := fmt.Sprintf("%s%s/providers/Microsoft.Authorization/roleEligibilityScheduleInstances?api-version=%s&$filter=%s",
+		armEndpoint, strings.TrimRight(a.scope, "/"), pimAPI, url.QueryEscape("asTarget()"))
+	if err := getJSON(ctx, listURL, token, &eligible); err != nil {
+		return fmt.Errorf("failed to list eligible PIM roles: %w", err)
+	}
+	var req pimActivationRequest
+	var scope string
+	for _, e := range eligible.Value {
+		props := e.Properties
+		if strings.EqualFold(props.ExpandedProperties.RoleDefinition.DisplayName, a.role) ||
+			strings.EqualFold(props.RoleDefinitionID, a.role) ||
+			strings.HasSuffix(strings.ToLower(props.RoleDefinitionID), "/"+strings.ToLower(a.role)) {
+			scope = props.Scope
+			req.Properties.RoleDefinitionID = props.RoleDefinitionID
+			req.Properties.LinkedRoleEligibilityScheduleID = props.RoleEligibilityScheduleID
+			break
+		}
+	}
+	if scope == "" {
+		return fmt.Errorf("identity %s is not eligible for role %s on %s", principal, a.role, a.scope)
+	}
+	req.Properties.PrincipalID = principal
+	req.Properties.RequestType = "SelfActivate"
+	req.Properties.Justification = a.justification()
+	req.Properties.ScheduleInfo.Expiration.Type = "AfterDuration"
+	req.Properties.ScheduleInfo.Expiration.Duration = fmt.Sprintf("PT%dM", int(a.duration.Minutes()))
+	if ticket := a.labels["ticket"]; ticket != "" {
+		req.Properties.TicketInfo = &pimTicketInfo{TicketNumber: ticket}
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	requestURL := fmt.Sprintf("%s%s/providers/Microsoft.Authorization/roleAssignmentScheduleRequests/%s?api-version=%s",
+		armEndpoint, scope, uuid.NewString(), pimAPI)
+	slog.Info("Activating PIM role", "role", a.role, "scope", scope, "duration", a.duration)
+	resp, err := sendRequest(ctx, http.MethodPut, requestURL, token, body)
+	if err != nil {
+		return fmt.Errorf("PIM activation failed: %w", err)
+	}
+	var out struct {
+		Properties struct {
+			Status string `json:"status"`
+		} `json:"properties"`
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&out)
+	resp.Body.Close()
+	if out.Error.Code == "RoleAssignmentExists" {
+		slog.Info("PIM role is already active", "role", a.role, "scope", scope)
+		return nil
+	}
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("PIM activation failed: unexpected status %d (%s: %s)", resp.StatusCode, out.Error.Code, out.Error.Message)
+	}
+	a.journal.audit("pim", fmt.Sprintf("run=%s role=%s scope=%s duration=%s", a.runID, a.role, scope, a.duration))
+
+	// Wait until the assignment exists; approvals are not waited for
+	status := out.Properties.Status
+	for deadline := time.Now().Add(2 * time.Minute); status != pimStatusProvisioned; {
+		if status == pimStatusPendingApproval {
+			return fmt.Errorf("PIM activation of %s on %s is pending approval", a.role, scope)
+		}
+		if strings.HasPrefix(status, "Denied") || strings.HasPrefix(status, "Failed") || status == "Canceled" {
+			return fmt.Errorf("PIM activation of %s on %s ended as %s", a.role, scope, status)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("PIM activation of %s on %s is still %s", a.role, scope, status)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+		}
+		if err := getJSON(ctx, requestURL, token, &out); err != nil {
+			return fmt.Errorf("failed to check the PIM activation: %w", err)
+		}
+		status = out.Properties.Status
+	}
+	slog.Info("PIM role is active", "role", a.role, "scope", scope)
+	return nil
+}
+
+// justification is the justification label when set, and otherwise describes
+// the run by its ID and labels
+func (a *pimActivation) justification() string {
+	text := a.labels["justification"]
+	if text == "" {
+		text = "vm-starter run " + a.runID
+		if pairs := labelPairs(a.labels, "="); len(pairs) > 0 {
+			text += " (" + strings.Join(pairs, ", ") + ")"
+		}
+	}
+	if len(text) > pimMaxJustification {
+		text = text[:pimMaxJustification]
+	}
+	return text
+}
+
+// tokenObjectID returns the object ID of the principal a token was issued to
+func tokenObjectID(token string) (string, error) {
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(token, claims); err != nil {
+		return "", fmt.Errorf("cannot read the token claims: %w", err)
+	}
+	oid, _ := claims["oid"].(string)
+	if oid == "" {
+		return "", fmt.Errorf("the token has no object ID")
+	}
+	return oid, nil
+}
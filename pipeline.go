@@ -0,0 +1,839 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// vmTarget is a virtual machine flowing through the pipeline
+type vmTarget struct {
+	SubscriptionID string
+	ResourceGroup  string
+	Name           string
+	ID             string
+	Tags           map[string]string
+	PPG            string // proximity placement group resource ID, if known
+	Location       string
+	Size           string // VM size, e.g. Standard_D2s_v5; unknown with --arm-filter
+	Team           string // value of the --team-tag tag, set by the enrich stage
+
+	// Statuses are the instance view status codes, loaded by the enrich stage when enabled
+	Statuses []string
+
+	// Action overrides the pipeline action for this target, e.g. from a plan rule
+	Action vmAction
+	Rule   string
+
+	// inheritErr is why resource group and subscription tags could not be merged into Tags
+	inheritErr error
+
+	// Arc marks an Azure Arc-enabled server, acted on by its out-of-band starter OOB
+	Arc bool
+	OOB *oobStarter
+
+	// History is the states the target went through in the run, oldest first
+	History []stateTransition
+}
+
+// vmResult is the outcome of executing an action against a vmTarget
+type vmResult struct {
+	Target       *vmTarget
+	Action       vmAction
+	StatusCode   int
+	Err          error
+	Duration     time.Duration
+	SkipReason   string // set when the target never reached execution
+	SkipCategory string // one of knownSkipCategories, set with SkipReason
+	AccessLost   bool   // the identity lost access to the target's scope during the run
+	TimedOut     bool   // the target exceeded --vm-timeout
+	Throttled    int    // 429 responses to the action request, retried or not
+	DryRun       bool   // the action would have been performed but was not sent
+
+	// Annotations are attached by the policy that allowed the action
+	Annotations map[string]string
+
+	// Delay is how long after it was queued the action was sent, for runs of queued operations
+	Delay time.Duration
+
+	// ARMError is the error ARM rejected the action with, if it sent one
+	ARMError *armError
+
+	// Degraded explains why an accepted start is degraded: the VM missed --vm-deadline
+	Degraded string
+
+	// Operation is the URL of the long-running operation of an accepted action,
+	// from its Azure-AsyncOperation or Location header, and OperationStatus its
+	// final status once --wait followed it
+	Operation       string
+	OperationStatus string
+}
+
+// runSummary aggregates the results of a run
+type runSummary struct {
+	Accepted int
+	Failed   int
+	Skipped  int
+	Planned  int // actions a dry run would have performed
+	Degraded int // accepted starts whose VM missed --vm-deadline, also included in Accepted
+	// AccessLost counts the failures caused by revoked access, also included in Failed
+	AccessLost int
+	TimedOut   int                     // failures of targets that exceeded --vm-timeout, also included in Failed
+	Throttled  int                     // targets whose action request was throttled at least once
+	ByAction   map[vmAction]int        // accepted requests per action
+	SkippedBy  map[string]int          // skipped results per skip category
+	ByTeam     map[string]*teamSummary // counts per team, empty without --team-tag
+	Failures   []*vmResult
+	Plan       []*vmResult // the actions a dry run would have performed
+	Results    []*vmResult // every result, in the order they were reported
+}
+
+// teamSummary counts the results of one team's VMs
+type teamSummary struct {
+	Accepted int
+	Failed   int
+	Skipped  int
+}
+
+// discoverer enumerates candidate VMs; every inventory source implements it.
+// discover sends targets to out and returns a non-nil error only if discovery
+// could not run at all (per-scope failures are logged and skipped).
+type discoverer interface {
+	discover(ctx context.Context, out chan<- *vmTarget) error
+}
+
+// vmFilter decides whether a target proceeds; when it doesn't, reason explains why
+type vmFilter func(t *vmTarget) (keep bool, reason string)
+
+// planGate inspects the complete target list before anything is executed and
+// returns an error to reject the whole plan (e.g. an approval that was denied)
+type planGate func(ctx context.Context, targets []*vmTarget) error
+
+// targetPicker narrows the complete target list down to the targets to act
+// on, before the guards and gates see it; an error rejects the plan
+type targetPicker func(ctx context.Context, targets []*vmTarget) ([]*vmTarget, error)
+
+// targetBatch is a group of targets executed together, in parallel; batches
+// are executed one after another
+type targetBatch struct {
+	label   string // describes the batch in logs, empty for single-target batches
+	targets []*vmTarget
+
+	// parallelism overrides the pipeline parallelism for this batch when positive
+	parallelism int
+}
+
+// batcher partitions the complete target list into the batches to execute, in order
+type batcher func(ctx context.Context, targets []*vmTarget) []targetBatch
+
+// pipeline runs the discover → enrich → filter → schedule → execute → report stages.
+// Stages are connected by channels and run concurrently, so execution of the first
+// VMs overlaps with discovery of the rest.
+type pipeline struct {
+	runID      string
+	token      string
+	discoverer discoverer
+	filters    []categorizedFilter
+	gates      []planGate
+	pick       targetPicker
+	sinks      []resultSink
+	observers  []runObserver
+	progress   *runProgress
+	reporter   *errorReporter
+	journal    *journal
+
+	// force disables every safety check; checks must consult it before refusing a target
+	force bool
+
+	// dryRun evaluates every target but sends no action requests
+	dryRun bool
+
+	// maxTargets, when positive, refuses plans with more targets; 0 when forced
+	maxTargets int
+
+	// runCap, when positive, aborts runs selecting more targets, unless
+	// overrideCap is set
+	runCap      int
+	overrideCap bool
+
+	// production, when set, aborts runs selecting a VM carrying one of its
+	// tags, unless allowProduction is set
+	production      map[string][]string
+	allowProduction bool
+
+	// abortErr is why a guardrail, the cap or a plan gate aborted the run
+	abortErr error
+
+	// action is the operation performed on scheduled targets that don't set their own
+	action vmAction
+
+	// access holds the token actions are sent with (the run's, or the operator
+	// identity's), renewing it once when ARM rejects it mid-run
+	access *accessGuard
+
+	// dedupe suppresses repeated actions on the same VM; not applied with force
+	dedupe *dedupeWindow
+
+	// protected VMs are never powered down, not even with force
+	protected *protectionList
+
+	// policy, when set, must allow every action; not bypassed by force either.
+	// requester identifies who asked for the run in its input.
+	policy    *opaPolicy
+	requester string
+
+	// tagStarted merges last-start metadata tags onto VMs whose start was accepted
+	tagStarted bool
+
+	// labels are attached to the run by its caller for traceability
+	labels map[string]string
+
+	// tenant, when set, is the tenant tokens are re-acquired in
+	tenant string
+
+	// retries is how often throttled or transiently failed requests are retried
+	retries int
+
+	// deadline, when set, awaits accepted starts until their VM is running
+	deadline *startDeadline
+	// wait, when set, follows the operation of accepted actions until it ends
+	wait *operationWait
+	// vmTimeout, when positive, bounds the execution and wait of every target
+	vmTimeout time.Duration
+
+	// batcher, when set, orders the targets into batches once discovery is
+	// complete; otherwise every target is executed on its own as it arrives
+	batcher batcher
+
+	// parallelism bounds how many targets of a batch are executed at the same time
+	parallelism int
+
+	// concurrency bounds how many targets outside of batches are executed at
+	// the same time, overall and, when subscriptionConcurrency is positive,
+	// within one subscription
+	concurrency             int
+	subscriptionConcurrency int
+
+	// instanceView makes the enrich stage load the instance view of every target,
+	// up to viewWorkers at a time, through viewCache when set
+	instanceView bool
+	viewWorkers  int
+	viewCache    *instanceViewCache
+
+	// inherit, when set, makes the enrich stage merge resource group and
+	// subscription tags into the tags of every target
+	inherit *tagInheritance
+
+	// teamTag is the tag key whose value attributes targets to a team in reports
+	teamTag string
+
+	// queuedAt, when set, is when the operation executed by the run was queued
+	queuedAt time.Time
+
+	// bar, when set, draws the progress of the run on the terminal
+	bar *progressBar
+}
+
+// run executes the pipeline to completion and returns its summary
+func (p *pipeline) run(ctx context.Context) (*runSummary, error) {
+	ctx = withRetries(withTenant(withCorrelationID(ctx, p.runID), p.tenant), p.retries)
+	info := &runInfo{ID: p.runID, StartedAt: time.Now().UTC(), Args: os.Args[1:], Labels: p.labels}
+	if len(p.labels) > 0 {
+		p.journal.audit("run", fmt.Sprintf("run=%s labels=%s", p.runID, strings.Join(labelPairs(p.labels, "="), ",")))
+		slog.Info("Run labels", "runId", p.runID, "labels", strings.Join(labelPairs(p.labels, "="), ","))
+	}
+	for _, o := range p.observers {
+		o.runStarted(ctx, info)
+	}
+
+	p.progress.setState(runDiscovering)
+	discovered := make(chan *vmTarget)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(discovered)
+		errc <- p.discoverer.discover(ctx, discovered)
+		p.progress.setState(runExecuting)
+		p.bar.discoveryOver()
+	}()
+
+	filterSkipped := make(chan *vmResult)
+	scheduleSkipped := make(chan *vmResult)
+	enriched := p.enrich(ctx, discovered)
+	filtered := p.filter(ctx, enriched, filterSkipped)
+	scheduled := p.schedule(ctx, filtered, scheduleSkipped)
+	results := p.execute(ctx, scheduled)
+	summary := p.report(mergeResults(results, filterSkipped, scheduleSkipped))
+	p.bar.finish()
+	err := <-errc
+	if err == nil {
+		// Set by the schedule stage, which has finished once the report is done
+		err = p.abortErr
+	}
+	p.progress.finish(err)
+	for _, sink := range p.sinks {
+		sink.close()
+	}
+
+	info.FinishedAt = time.Now().UTC()
+	info.Err = err
+	// A run cut short by --run-timeout is still reported
+	ctx = context.WithoutCancel(ctx)
+	for _, o := range p.observers {
+		o.runFinished(ctx, info, summary)
+	}
+	return summary, err
+}
+
+// mergeResults fans several result channels into one that closes after all of them
+func mergeResults(ins ...<-chan *vmResult) <-chan *vmResult {
+	out := make(chan *vmResult)
+	var wg sync.WaitGroup
+	for _, in := range ins {
+		wg.Add(1)
+		go func(in <-chan *vmResult) {
+			defer wg.Done()
+			for res := range in {
+				out <- res
+			}
+		}(in)
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out
+}
+
+// enrich fills in fields derived from the resource ID and, when enabled, the instance view
+func (p *pipeline) enrich(ctx context.Context, in <-chan *vmTarget) <-chan *vmTarget {
+	out := make(chan *vmTarget)
+	workers := p.viewWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	// Instance views load concurrently; pending keeps the targets in discovery order
+	pending := make(chan chan *vmTarget, workers)
+	go func() {
+		defer close(pending)
+		sem := make(chan struct{}, workers)
+		for t := range in {
+			p.progress.discovered()
+			p.bar.discovered(t)
+			t.transition(vmStateDiscovered)
+			if t.ResourceGroup == "" {
+				t.ResourceGroup = parseResourceGroup(t.ID)
+			}
+			if p.inherit != nil {
+				t.inheritErr = p.inherit.apply(ctx, t)
+			}
+			if p.teamTag != "" {
+				t.Team = teamOf(t, p.teamTag)
+			}
+			done := make(chan *vmTarget, 1)
+			pending <- done
+			if !p.instanceView || t.Arc {
+				done <- t
+				continue
+			}
+			sem <- struct{}{}
+			go func(t *vmTarget) {
+				defer func() { <-sem }()
+				if err := p.viewCache.fetch(ctx, p.token, t); err != nil {
+					slog.Error("Failed to load the instance view", vmAttrs(t), "error", err)
+				}
+				done <- t
+			}(t)
+		}
+	}()
+	go func() {
+		defer close(out)
+		for done := range pending {
+			out <- <-done
+		}
+	}()
+	return out
+}
+
+// filter drops targets rejected by any of the configured filters, sending a
+// skipped result for each of them; it closes skipped when done
+func (p *pipeline) filter(ctx context.Context, in <-chan *vmTarget, skipped chan<- *vmResult) <-chan *vmTarget {
+	out := make(chan *vmTarget)
+	go func() {
+		defer close(out)
+		defer close(skipped)
+	targets:
+		for t := range in {
+			for _, f := range p.filters {
+				if keep, reason := f.keep(t); !keep {
+					skipped <- &vmResult{Target: t, SkipReason: reason, SkipCategory: f.category}
+					continue targets
+				}
+			}
+			t.transition(vmStateFiltered)
+			out <- t
+		}
+	}()
+	return out
+}
+
+// schedule decides the order in which targets are executed. When a picker, plan
+// gates or a batcher are configured it waits for the complete target list; the
+// targets the picker leaves out are sent to skipped, and the rest are only
+// released if every gate passes, otherwise each target is sent to skipped. It
+// closes skipped when done.
+func (p *pipeline) schedule(ctx context.Context, in <-chan *vmTarget, skipped chan<- *vmResult) <-chan targetBatch {
+	out := make(chan targetBatch)
+	go func() {
+		defer close(out)
+		defer close(skipped)
+		if len(p.gates) == 0 && p.pick == nil && p.batcher == nil && p.maxTargets == 0 && p.runCap == 0 && p.production == nil {
+			for t := range in {
+				out <- targetBatch{targets: []*vmTarget{t}}
+			}
+			return
+		}
+
+		var targets []*vmTarget
+		for t := range in {
+			targets = append(targets, t)
+		}
+		if p.pick != nil {
+			picked, err := p.pick(ctx, targets)
+			if err != nil {
+				slog.Error("Plan rejected", "error", err)
+				p.abortErr = err
+				for _, t := range targets {
+					skipped <- &vmResult{Target: t, SkipReason: err.Error(), SkipCategory: skipRejected}
+				}
+				return
+			}
+			kept := make(map[*vmTarget]bool, len(picked))
+			for _, t := range picked {
+				kept[t] = true
+			}
+			for _, t := range targets {
+				if !kept[t] {
+					skipped <- &vmResult{Target: t, SkipReason: "not selected interactively", SkipCategory: skipFiltered}
+				}
+			}
+			slog.Info("VMs selected interactively", "selected", len(picked), "discovered", len(targets))
+			targets = picked
+		}
+		if category, err := p.guard(targets); err != nil {
+			slog.Error("Run aborted", "error", err)
+			p.abortErr = err
+			for _, t := range targets {
+				skipped <- &vmResult{Target: t, SkipReason: err.Error(), SkipCategory: category}
+			}
+			return
+		}
+		if p.maxTargets > 0 && len(targets) > p.maxTargets {
+			err := fmt.Errorf("%d VM(s) selected, more than --max-vms %d: narrow the filters, raise the cap or pass --force", len(targets), p.maxTargets)
+			if p.dryRun {
+				slog.Warn("A real run would be refused", "error", err)
+			} else {
+				slog.Error("Plan rejected", "error", err)
+				p.abortErr = err
+				for _, t := range targets {
+					skipped <- &vmResult{Target: t, SkipReason: err.Error(), SkipCategory: skipCap}
+				}
+				return
+			}
+		}
+		for _, gate := range p.gates {
+			if err := gate(ctx, targets); err != nil {
+				// A run nobody confirmed did nothing: it must not report success
+				slog.Error("Plan rejected", "error", err)
+				p.abortErr = err
+				for _, t := range targets {
+					skipped <- &vmResult{Target: t, SkipReason: err.Error(), SkipCategory: skipRejected}
+				}
+				return
+			}
+		}
+		if p.batcher == nil {
+			for _, t := range targets {
+				out <- targetBatch{targets: []*vmTarget{t}}
+			}
+			return
+		}
+		for _, batch := range p.batcher(ctx, targets) {
+			out <- batch
+		}
+	}()
+	return out
+}
+
+// execute performs the action of every target, batch by batch. Targets that
+// are not part of a batch go through the worker pool.
+func (p *pipeline) execute(ctx context.Context, in <-chan targetBatch) <-chan *vmResult {
+	out := make(chan *vmResult)
+	go func() {
+		defer close(out)
+		// Accepted actions are awaited without holding a worker or the batch
+		var awaiting sync.WaitGroup
+		defer awaiting.Wait()
+		// run executes t, and awaits its result, within --vm-timeout
+		run := func(t *vmTarget) {
+			targetCtx, cancel := p.targetContext(ctx)
+			res := p.executeTarget(targetCtx, t)
+			if !p.awaits(res) {
+				p.checkTimeout(ctx, targetCtx, res)
+				cancel()
+				out <- res
+				return
+			}
+			awaiting.Add(1)
+			go func() {
+				defer awaiting.Done()
+				defer cancel()
+				p.await(targetCtx, res)
+				p.checkTimeout(ctx, targetCtx, res)
+				out <- res
+			}()
+		}
+		pool := newWorkerPool(p.concurrency, p.subscriptionConcurrency)
+		defer pool.wait()
+		for batch := range in {
+			if len(batch.targets) == 1 {
+				t := batch.targets[0]
+				t.transition(vmStateQueued)
+				pool.submit(t.SubscriptionID, func() { run(t) })
+				continue
+			}
+			// Batches are executed one after another, after the targets submitted before them
+			pool.wait()
+			slog.Info("Starting batch", "batch", batch.label, "vms", len(batch.targets))
+			parallelism := p.parallelism
+			if batch.parallelism > 0 {
+				parallelism = batch.parallelism
+			}
+			slots := make(chan struct{}, max(parallelism, 1))
+			var wg sync.WaitGroup
+			for _, t := range batch.targets {
+				t.transition(vmStateQueued)
+				slots <- struct{}{}
+				wg.Add(1)
+				go func(t *vmTarget) {
+					defer wg.Done()
+					run(t)
+					<-slots
+				}(t)
+			}
+			wg.Wait()
+		}
+	}()
+	return out
+}
+
+// executeTarget resolves the action of t and performs it unless admit holds
+// it back
+func (p *pipeline) executeTarget(ctx context.Context, t *vmTarget) (res *vmResult) {
+	action := t.Action
+	if action == "" {
+		action = p.action
+	}
+	if runTimedOut(ctx) {
+		return &vmResult{Target: t, Action: action, SkipReason: "not attempted, the run exceeded --run-timeout", SkipCategory: skipRunTimeout}
+	}
+	res, annotations := p.admit(ctx, t, action)
+	if len(annotations) > 0 {
+		defer func() { res.Annotations = annotations }()
+	}
+	if res != nil {
+		return res
+	}
+	t.transition(vmStateRequested)
+	res = p.perform(ctx, t, action)
+	if res.Err != nil {
+		p.dedupe.release(t, action)
+	} else {
+		t.transition(vmStateAccepted)
+	}
+	return res
+}
+
+// admit applies the checks every action request goes through, whoever sends
+// it: the protection list, out-of-band support, the policy, lost access and,
+// unless forced, duplicate suppression. It returns the result of t when the
+// action must not be sent, or is not in a dry run, along with the annotations
+// of the policy. An admitted action is claimed against duplicates; release it
+// when the request fails.
+func (p *pipeline) admit(ctx context.Context, t *vmTarget, action vmAction) (*vmResult, map[string]string) {
+	if action.disrupts() {
+		if reason := p.protected.protects(t); reason != "" {
+			return &vmResult{Target: t, Action: action, SkipReason: reason, SkipCategory: skipProtected}, nil
+		}
+	}
+	if t.Arc {
+		if reason := t.OOB.supports(action); reason != "" {
+			return &vmResult{Target: t, Action: action, SkipReason: reason, SkipCategory: skipUnsupported}, nil
+		}
+	}
+	var annotations map[string]string
+	if p.policy != nil {
+		decision, err := p.policy.decide(ctx, p.policyInput(t, action))
+		if err != nil {
+			return &vmResult{Target: t, Action: action, Err: fmt.Errorf("not attempted, policy evaluation failed: %w", err)}, nil
+		}
+		if !decision.Allow {
+			reason := "vetoed by policy"
+			if decision.Reason != "" {
+				reason += ": " + decision.Reason
+			}
+			return &vmResult{Target: t, Action: action, SkipReason: reason, SkipCategory: skipPolicy}, nil
+		}
+		if len(decision.Annotations) > 0 {
+			slog.Info("Policy annotations", vmAttrs(t), "annotations", strings.Join(labelPairs(decision.Annotations, "="), ","))
+			annotations = decision.Annotations
+		}
+	}
+	if reason := p.access.lostFor(t); reason != "" {
+		return &vmResult{Target: t, Action: action, AccessLost: true, Err: fmt.Errorf("not attempted, access lost earlier in the run: %s", reason)}, annotations
+	}
+	if p.dryRun {
+		return &vmResult{Target: t, Action: action, DryRun: true}, annotations
+	}
+	if !p.force {
+		if reason := p.dedupe.claim(t, action); reason != "" {
+			return &vmResult{Target: t, Action: action, SkipReason: reason, SkipCategory: skipDuplicate}, annotations
+		}
+	}
+	return nil, annotations
+}
+
+// perform sends a single action request and records it in the journal
+func (p *pipeline) perform(ctx context.Context, t *vmTarget, action vmAction) *vmResult {
+	if t.Arc {
+		return p.performOutOfBand(ctx, t, action)
+	}
+	actionURL := fmt.Sprintf(
+		"%s/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/virtualMachines/%s/%s?api-version=%s",
+		armEndpoint, t.SubscriptionID, t.ResourceGroup, t.Name, action, vmAPI)
+
+	slog.Debug("Sending action request", vmAttrs(t), "action", action, "method", http.MethodPost, "url", actionURL)
+
+	res := &vmResult{Target: t, Action: action}
+	token, err := p.access.current(ctx)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	began := time.Now()
+	if !p.queuedAt.IsZero() {
+		res.Delay = began.Sub(p.queuedAt)
+	}
+	seq, err := p.journal.intent(p.runID, string(action), t.ID, t.Team)
+	if err != nil {
+		res.Err = fmt.Errorf("not attempted: %w", err)
+		return res
+	}
+	var throttled atomic.Int32
+	defer func() { res.Throttled = int(throttled.Load()) }()
+	ctx = withThrottleCount(ctx, &throttled)
+	resp, err := sendRequest(ctx, http.MethodPost, actionURL, token, nil)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized {
+		if renewed, ok := p.access.renew(ctx, token); ok {
+			resp.Body.Close()
+			resp, err = sendRequest(ctx, http.MethodPost, actionURL, renewed, nil)
+		}
+	}
+	res.Duration = time.Since(began)
+	if err != nil {
+		res.Err = err
+	} else {
+		armErr := readARMError(resp)
+		resp.Body.Close()
+		res.StatusCode = resp.StatusCode
+		if res.Operation = resp.Header.Get("Azure-AsyncOperation"); res.Operation == "" {
+			res.Operation = resp.Header.Get("Location")
+		}
+		res.ARMError = armErr
+		if reason := p.access.revoked(t, resp.StatusCode, armErr.code()); reason != "" {
+			res.Err = fmt.Errorf("access lost: %s", reason)
+			res.AccessLost = true
+		} else if !action.accepts(resp.StatusCode) && armErr.code() != "" {
+			res.Err = fmt.Errorf("unexpected status %d (%s)", resp.StatusCode, armErr.Code)
+		} else if !action.accepts(resp.StatusCode) {
+			res.Err = fmt.Errorf("unexpected status %d", resp.StatusCode)
+		}
+	}
+	p.journal.complete(seq, string(action), t.ID, t.Team, res.StatusCode, res.Err)
+
+	if res.Err == nil && action == actionStart && p.tagStarted {
+		tags := mergeLabels(startedTags(p.runID, began), labelTags(p.labels))
+		token, _ := p.access.current(ctx)
+		if err := mergeTags(ctx, token, t.ID, tags); err != nil {
+			slog.Error("Failed to tag VM", vmAttrs(t), "error", err)
+		}
+	}
+	return res
+}
+
+// report logs every result and aggregates them into a summary
+func (p *pipeline) report(in <-chan *vmResult) *runSummary {
+	summary := &runSummary{ByAction: map[vmAction]int{}, SkippedBy: map[string]int{}, ByTeam: map[string]*teamSummary{}}
+	for res := range in {
+		t := res.Target
+		if state := res.finalState(); state != "" {
+			t.transition(state)
+		}
+		team := &teamSummary{}
+		if t.Team != "" {
+			if summary.ByTeam[t.Team] == nil {
+				summary.ByTeam[t.Team] = team
+			}
+			team = summary.ByTeam[t.Team]
+		}
+		switch {
+		case res.SkipReason != "":
+			summary.Skipped++
+			summary.SkippedBy[res.SkipCategory]++
+			team.Skipped++
+			slog.Info("Skipping VM", vmAttrs(t), "category", res.SkipCategory, "reason", res.SkipReason)
+		case res.AccessLost:
+			summary.Failed++
+			summary.AccessLost++
+			team.Failed++
+			summary.Failures = append(summary.Failures, res)
+			slog.Error("Action failed", vmAttrs(t), "action", res.Action, "error", res.Err, hintAttr(res))
+		case res.Err != nil && (res.StatusCode == 0 || res.Action.accepts(res.StatusCode) || res.TimedOut):
+			summary.Failed++
+			team.Failed++
+			if res.TimedOut {
+				summary.TimedOut++
+			}
+			summary.Failures = append(summary.Failures, res)
+			slog.Error("Action failed", vmAttrs(t), "action", res.Action, "statusCode", res.StatusCode, "error", res.Err, hintAttr(res))
+		case res.Err != nil:
+			summary.Failed++
+			team.Failed++
+			summary.Failures = append(summary.Failures, res)
+			var armErr slog.Attr
+			if res.ARMError != nil {
+				armErr = slog.Group("armError", "code", res.ARMError.Code, "message", res.ARMError.Message)
+			}
+			slog.Error("Unexpected status", vmAttrs(t), "action", res.Action, "statusCode", res.StatusCode, armErr, hintAttr(res))
+		case res.DryRun:
+			summary.Planned++
+			summary.Plan = append(summary.Plan, res)
+			slog.Info("Would act on VM", vmAttrs(t), "action", res.Action)
+		default:
+			summary.Accepted++
+			team.Accepted++
+			summary.ByAction[res.Action]++
+			if res.Degraded != "" {
+				summary.Degraded++
+				slog.Warn("Request accepted, but the VM is degraded", vmAttrs(t), "action", res.Action, "statusCode", res.StatusCode, "reason", res.Degraded)
+			} else if res.Delay > 0 {
+				slog.Info("Request accepted", vmAttrs(t), "action", res.Action, "statusCode", res.StatusCode, "queuedFor", res.Delay.Round(time.Second))
+			} else {
+				slog.Info("Request accepted", vmAttrs(t), "action", res.Action, "statusCode", res.StatusCode)
+			}
+		}
+		if res.Throttled > 0 {
+			summary.Throttled++
+		}
+		summary.Results = append(summary.Results, res)
+		p.progress.observe(res)
+		p.bar.observe(res)
+		for _, sink := range p.sinks {
+			sink.publish(res)
+		}
+	}
+	return summary
+}
+
+// armDiscoverer enumerates every VM in every subscription visible to the token
+type armDiscoverer struct {
+	token    string
+	filter   string // OData $filter evaluated server-side, empty for none
+	reporter *errorReporter
+	meta     *metadataCache
+	scope    *subscriptionScope
+	arc      bool   // also discover Arc-enabled servers
+	group    string // only list this resource group, empty for the whole subscription
+}
+
+// scopeURL returns the URL of the scope listed in a subscription: the
+// subscription itself, or the resource group
+func (d *armDiscoverer) scopeURL(subscriptionID string) string {
+	if d.group == "" {
+		return fmt.Sprintf("%s/subscriptions/%s", armEndpoint, subscriptionID)
+	}
+	return fmt.Sprintf("%s/subscriptions/%s/resourceGroups/%s", armEndpoint, subscriptionID, d.group)
+}
+
+// vmListURL returns the list URL for a subscription. With a server-side filter the
+// generic resources endpoint is used, since the Compute list API only filters by scale set.
+func (d *armDiscoverer) vmListURL(subscriptionID string) string {
+	if d.filter == "" {
+		return fmt.Sprintf("%s/providers/Microsoft.Compute/virtualMachines?api-version=%s", d.scopeURL(subscriptionID), vmAPI)
+	}
+	filter := fmt.Sprintf("resourceType eq 'Microsoft.Compute/virtualMachines' and (%s)", d.filter)
+	return fmt.Sprintf("%s/resources?api-version=%s&$filter=%s",
+		d.scopeURL(subscriptionID), resourcesAPI, strings.ReplaceAll(url.QueryEscape(filter), "+", "%20"))
+}
+
+func (d *armDiscoverer) discover(ctx context.Context, out chan<- *vmTarget) error {
+	subsResp, err := d.meta.subscriptions(ctx, d.token)
+	if err != nil {
+		return fmt.Errorf("failed to fetch subscriptions: %w", err)
+	}
+	if subsResp, err = d.scope.apply(subsResp); err != nil {
+		return err
+	}
+
+	foundGroup := false
+	for _, sub := range subsResp.Value {
+		subscriptionID := sub.SubscriptionID
+		if d.group != "" {
+			exists, err := resourceGroupExists(ctx, d.token, subscriptionID, d.group)
+			if err != nil {
+				slog.Error("Failed to look up resource group", "subscription", subscriptionID, "resourceGroup", d.group, "error", err)
+				continue
+			}
+			if !exists {
+				slog.Debug("Subscription has no such resource group", "subscription", subscriptionID, "resourceGroup", d.group)
+				continue
+			}
+			foundGroup = true
+		}
+		slog.Info("Processing subscription", "subscription", subscriptionID, "displayName", sub.DisplayName)
+		d.reporter.setContext("subscription", subscriptionID)
+
+		// Pages are sent on as they arrive; a failed page keeps the VMs already sent
+		for next := d.vmListURL(subscriptionID); next != ""; {
+			var vms VirtualMachineListResponse
+			if err := getJSON(ctx, next, d.token, &vms); err != nil {
+				slog.Error("Failed to fetch VMs", "subscription", subscriptionID, "error", err)
+				break
+			}
+			for _, vm := range vms.Value {
+				t := &vmTarget{SubscriptionID: subscriptionID, Name: vm.Name, ID: vm.ID, Tags: vm.Tags,
+					Location: vm.Location, Size: vm.Properties.HardwareProfile.VMSize}
+				if ppg := vm.Properties.ProximityPlacementGroup; ppg != nil {
+					t.PPG = ppg.ID
+				}
+				out <- t
+			}
+			next = vms.NextLink
+		}
+		if d.arc {
+			if err := d.listArcMachines(ctx, subscriptionID, out); err != nil {
+				slog.Error("Failed to fetch Arc machines", "subscription", subscriptionID, "error", err)
+			}
+		}
+	}
+	if d.group != "" && !foundGroup {
+		return fmt.Errorf("resource group %s was not found in any subscription", d.group)
+	}
+	return nil
+}
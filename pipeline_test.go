@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testTarget returns a discovered VM with only its resource ID, name and
+// subscription set, like discovery leaves it
+func testTarget(sub, group, name string, tags map[string]string) *vmTarget {
+	return &vmTarget{
+		ID:             fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/virtualMachines/%s", sub, group, name),
+		SubscriptionID: sub,
+		Name:           name,
+		Tags:           tags,
+	}
+}
+
+// sliceDiscoverer discovers a fixed list of targets, or fails with err
+type sliceDiscoverer struct {
+	targets []*vmTarget
+	err     error
+}
+
+func (d sliceDiscoverer) discover(ctx context.Context, out chan<- *vmTarget) error {
+	for _, t := range d.targets {
+		out <- t
+	}
+	return d.err
+}
+
+// feed returns a closed channel holding targets
+func feed(targets ...*vmTarget) <-chan *vmTarget {
+	in := make(chan *vmTarget, len(targets))
+	for _, t := range targets {
+		in <- t
+	}
+	close(in)
+	return in
+}
+
+func targetNames(targets []*vmTarget) []string {
+	var out []string
+	for _, t := range targets {
+		out = append(out, t.Name)
+	}
+	return out
+}
+
+func TestEnrich(t *testing.T) {
+	p := &pipeline{teamTag: "team", viewWorkers: 4}
+	in := feed(
+		testTarget("sub1", "rg-a", "web-1", map[string]string{"team": "web"}),
+		testTarget("sub1", "RG-B", "db-1", nil),
+		testTarget("sub2", "rg-c", "api-1", map[string]string{"team": "api"}),
+	)
+	var got []*vmTarget
+	for target := range p.enrich(context.Background(), in) {
+		got = append(got, target)
+	}
+	want := []struct{ name, group, team string }{
+		{"web-1", "rg-a", "web"},
+		{"db-1", "RG-B", unassignedTeam},
+		{"api-1", "rg-c", "api"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("enrich returned %q, want %d targets", targetNames(got), len(want))
+	}
+	for i, w := range want {
+		g := got[i]
+		if g.Name != w.name || g.ResourceGroup != w.group || g.Team != w.team || g.state() != vmStateDiscovered {
+			t.Errorf("target %d = %s in %s of team %s, %s; want %s in %s of team %s, %s",
+				i, g.Name, g.ResourceGroup, g.Team, g.state(), w.name, w.group, w.team, vmStateDiscovered)
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	patterns, _ := parseNamePatterns([]string{"web-*", "db-*"})
+	p := &pipeline{filters: append(
+		categorize(skipFiltered, nameFilter(patterns, []string{"web-*", "db-*"})),
+		categorize(skipPolicy, func(t *vmTarget) (bool, string) {
+			if t.Tags["locked"] == "true" {
+				return false, "locked"
+			}
+			return true, ""
+		})...,
+	)}
+	in := feed(
+		testTarget("sub1", "rg-a", "web-1", nil),
+		testTarget("sub1", "rg-a", "api-1", nil),
+		testTarget("sub1", "rg-a", "db-1", map[string]string{"locked": "true"}),
+		testTarget("sub1", "rg-a", "web-2", map[string]string{"locked": "false"}),
+	)
+	skipped := make(chan *vmResult, 4)
+	var kept []*vmTarget
+	for target := range p.filter(context.Background(), in, skipped) {
+		kept = append(kept, target)
+	}
+	if got, want := targetNames(kept), []string{"web-1", "web-2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("kept %q, want %q", got, want)
+	}
+	var got []string
+	for res := range skipped {
+		got = append(got, res.Target.Name+" "+res.SkipCategory)
+	}
+	if want := []string{"api-1 " + skipFiltered, "db-1 " + skipPolicy}; !reflect.DeepEqual(got, want) {
+		t.Errorf("skipped %q, want %q", got, want)
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	errDenied := errors.New("denied")
+	batchByGroup := func(ctx context.Context, targets []*vmTarget) []targetBatch {
+		var batches []targetBatch
+		byGroup := map[string]int{}
+		for _, t := range targets {
+			i, ok := byGroup[t.ResourceGroup]
+			if !ok {
+				i = len(batches)
+				byGroup[t.ResourceGroup] = i
+				batches = append(batches, targetBatch{label: t.ResourceGroup})
+			}
+			batches[i].targets = append(batches[i].targets, t)
+		}
+		return batches
+	}
+	tests := []struct {
+		name     string
+		pipeline pipeline
+		batches  []string // the names of each batch, comma separated
+		skipped  []string // name and category
+		abortErr error
+	}{
+		{
+			name:     "targets stream through",
+			pipeline: pipeline{},
+			batches:  []string{"web-1", "web-2", "db-1"},
+		},
+		{
+			name:     "a passing gate releases every target",
+			pipeline: pipeline{gates: []planGate{func(context.Context, []*vmTarget) error { return nil }}},
+			batches:  []string{"web-1", "web-2", "db-1"},
+		},
+		{
+			name:     "a rejecting gate skips every target and aborts the run",
+			pipeline: pipeline{gates: []planGate{func(context.Context, []*vmTarget) error { return errDenied }}},
+			skipped:  []string{"web-1 " + skipRejected, "web-2 " + skipRejected, "db-1 " + skipRejected},
+			abortErr: errDenied,
+		},
+		{
+			name: "the picker leaves targets out",
+			pipeline: pipeline{pick: func(ctx context.Context, targets []*vmTarget) ([]*vmTarget, error) {
+				return targets[1:2], nil
+			}},
+			batches: []string{"web-2"},
+			skipped: []string{"web-1 " + skipFiltered, "db-1 " + skipFiltered},
+		},
+		{
+			name:     "more targets than --max-vms",
+			pipeline: pipeline{maxTargets: 2},
+			skipped:  []string{"web-1 " + skipCap, "web-2 " + skipCap, "db-1 " + skipCap},
+			abortErr: errors.New("3 VM(s) selected"),
+		},
+		{
+			name:     "a dry run over --max-vms is only warned about",
+			pipeline: pipeline{maxTargets: 2, dryRun: true},
+			batches:  []string{"web-1", "web-2", "db-1"},
+		},
+		{
+			name:     "batches",
+			pipeline: pipeline{batcher: batchByGroup},
+			batches:  []string{"web-1,web-2", "db-1"},
+		},
+	}
+	for _, tt := range tests {
+		p := tt.pipeline
+		targets := []*vmTarget{
+			testTarget("sub1", "rg-a", "web-1", nil),
+			testTarget("sub1", "rg-a", "web-2", nil),
+			testTarget("sub1", "rg-b", "db-1", nil),
+		}
+		for _, target := range targets {
+			target.ResourceGroup = parseResourceGroup(target.ID)
+		}
+		skipped := make(chan *vmResult, len(targets))
+		var batches []string
+		for batch := range p.schedule(context.Background(), feed(targets...), skipped) {
+			batches = append(batches, strings.Join(targetNames(batch.targets), ","))
+		}
+		var gotSkipped []string
+		for res := range skipped {
+			gotSkipped = append(gotSkipped, res.Target.Name+" "+res.SkipCategory)
+		}
+		if !reflect.DeepEqual(batches, tt.batches) {
+			t.Errorf("%s: batches %q, want %q", tt.name, batches, tt.batches)
+		}
+		if !reflect.DeepEqual(gotSkipped, tt.skipped) {
+			t.Errorf("%s: skipped %q, want %q", tt.name, gotSkipped, tt.skipped)
+		}
+		switch {
+		case tt.abortErr == nil && p.abortErr != nil:
+			t.Errorf("%s: run aborted: %v", tt.name, p.abortErr)
+		case tt.abortErr != nil && (p.abortErr == nil || !strings.Contains(p.abortErr.Error(), tt.abortErr.Error())):
+			t.Errorf("%s: abort error %v, want %v", tt.name, p.abortErr, tt.abortErr)
+		}
+	}
+}
+
+func TestExecuteDryRun(t *testing.T) {
+	protected, err := parseProtectionList([]string{"tag:critical"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &pipeline{dryRun: true, action: actionDeallocate, access: newAccessGuard("token"), protected: protected, concurrency: 2}
+	web := testTarget("sub1", "rg-a", "web-1", nil)
+	db := testTarget("sub1", "rg-a", "db-1", map[string]string{"critical": "yes"})
+	api := testTarget("sub2", "rg-b", "api-1", map[string]string{"critical": "yes"})
+	api.Action = actionStart
+	in := make(chan targetBatch, 2)
+	in <- targetBatch{targets: []*vmTarget{web}}
+	in <- targetBatch{label: "group", targets: []*vmTarget{db, api}}
+	close(in)
+
+	got := map[string]string{}
+	for res := range p.execute(context.Background(), in) {
+		switch {
+		case res.SkipReason != "":
+			got[res.Target.Name] = string(res.Action) + " skipped " + res.SkipCategory
+		case res.DryRun:
+			got[res.Target.Name] = string(res.Action) + " planned"
+		default:
+			got[res.Target.Name] = fmt.Sprintf("%s sent: %v", res.Action, res.Err)
+		}
+	}
+	want := map[string]string{
+		"web-1": "deallocate planned",
+		"db-1":  "deallocate skipped " + skipProtected,
+		"api-1": "start planned", // protection only guards against powering down
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("results %v, want %v", got, want)
+	}
+}
+
+func TestReport(t *testing.T) {
+	web := testTarget("sub1", "rg-a", "web-1", nil)
+	web.Team = "web"
+	db := testTarget("sub1", "rg-a", "db-1", nil)
+	db.Team = "data"
+	api := testTarget("sub1", "rg-a", "api-1", nil)
+	api.Team = "web"
+	batch := testTarget("sub1", "rg-a", "batch-1", nil)
+	results := []*vmResult{
+		{Target: web, Action: actionStart, StatusCode: 202},
+		{Target: db, Action: actionStart, StatusCode: 409, Err: errors.New("unexpected status 409")},
+		{Target: api, SkipReason: "already running", SkipCategory: skipAlreadyInState},
+		{Target: batch, Action: actionStart, DryRun: true, Throttled: 2},
+	}
+	in := make(chan *vmResult, len(results))
+	for _, res := range results {
+		in <- res
+	}
+	close(in)
+
+	s := (&pipeline{}).report(in)
+	if s.Accepted != 1 || s.Failed != 1 || s.Skipped != 1 || s.Planned != 1 || s.Throttled != 1 {
+		t.Errorf("accepted %d, failed %d, skipped %d, planned %d, throttled %d; want 1 each",
+			s.Accepted, s.Failed, s.Skipped, s.Planned, s.Throttled)
+	}
+	if s.ByAction[actionStart] != 1 || s.SkippedBy[skipAlreadyInState] != 1 {
+		t.Errorf("by action %v, skipped by %v", s.ByAction, s.SkippedBy)
+	}
+	if got := *s.ByTeam["web"]; got != (teamSummary{Accepted: 1, Skipped: 1}) {
+		t.Errorf("team web: %+v", got)
+	}
+	if got := *s.ByTeam["data"]; got != (teamSummary{Failed: 1}) {
+		t.Errorf("team data: %+v", got)
+	}
+	if len(s.Results) != len(results) || len(s.Failures) != 1 || s.Failures[0].Target != db || len(s.Plan) != 1 {
+		t.Errorf("%d results, %d failures, %d planned", len(s.Results), len(s.Failures), len(s.Plan))
+	}
+}
+
+func TestRun(t *testing.T) {
+	errDenied := errors.New("denied")
+	tests := []struct {
+		name     string
+		gates    []planGate
+		discover error
+		planned  int
+		skipped  int
+		err      error
+	}{
+		{name: "dry run", planned: 2, skipped: 1},
+		{name: "rejected", gates: []planGate{func(context.Context, []*vmTarget) error { return errDenied }}, skipped: 3, err: errDenied},
+		{name: "discovery failed", discover: errors.New("no subscriptions"), planned: 2, skipped: 1, err: errors.New("no subscriptions")},
+	}
+	for _, tt := range tests {
+		patterns, _ := parseNamePatterns([]string{"web-*"})
+		p := &pipeline{
+			runID: "test",
+			discoverer: sliceDiscoverer{err: tt.discover, targets: []*vmTarget{
+				testTarget("sub1", "rg-a", "web-1", nil),
+				testTarget("sub1", "rg-a", "db-1", nil),
+				testTarget("sub2", "rg-b", "web-2", nil),
+			}},
+			filters: categorize(skipFiltered, nameFilter(patterns, []string{"web-*"})),
+			gates:   tt.gates,
+			action:  actionStart,
+			access:  newAccessGuard("token"),
+			dryRun:  true,
+		}
+		summary, err := p.run(context.Background())
+		if (err == nil) != (tt.err == nil) || (err != nil && err.Error() != tt.err.Error()) {
+			t.Errorf("%s: run error %v, want %v", tt.name, err, tt.err)
+		}
+		if summary.Planned != tt.planned || summary.Skipped != tt.skipped || len(summary.Results) != 3 {
+			t.Errorf("%s: %d planned, %d skipped, %d results; want %d, %d, 3",
+				tt.name, summary.Planned, summary.Skipped, len(summary.Results), tt.planned, tt.skipped)
+		}
+	}
+}
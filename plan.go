@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Desired VM states in a plan
+const (
+	stateRunning     = "running"
+	stateDeallocated = "deallocated"
+)
+
+// selector matches VMs by name glob, resource group, subscription and tags.
+// Every populated field must match (AND); a list field matches if any entry does.
+type selector struct {
+	Names          []string          `json:"names,omitempty"`
+	ResourceGroups []string          `json:"resourceGroups,omitempty"`
+	Subscriptions  []string          `json:"subscriptions,omitempty"`
+	Tags           map[string]string `json:"tags,omitempty"`
+}
+
+// matches reports whether t satisfies the selector
+func (s *selector) matches(t *vmTarget) bool {
+	return s.mismatch(t) == ""
+}
+
+// mismatch explains which field of the selector t fails, or returns "" when it matches
+func (s *selector) mismatch(t *vmTarget) string {
+	if len(s.Names) > 0 && !matchAny(s.Names, t.Name, true) {
+		return fmt.Sprintf("name %q matches none of %q", t.Name, s.Names)
+	}
+	if len(s.ResourceGroups) > 0 && !matchAny(s.ResourceGroups, t.ResourceGroup, false) {
+		return fmt.Sprintf("resource group %q is not one of %q", t.ResourceGroup, s.ResourceGroups)
+	}
+	if len(s.Subscriptions) > 0 && !matchAny(s.Subscriptions, t.SubscriptionID, false) {
+		return fmt.Sprintf("subscription %q is not one of %q", t.SubscriptionID, s.Subscriptions)
+	}
+	keys := make([]string, 0, len(s.Tags))
+	for key := range s.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		want := s.Tags[key]
+		got, ok := t.Tags[key]
+		if !ok {
+			return fmt.Sprintf("tag %q is missing", key)
+		}
+		if got != want {
+			return fmt.Sprintf("tag %s is %q, not %q", key, got, want)
+		}
+	}
+	return ""
+}
+
+// matchAny compares value against patterns case-insensitively, optionally as globs
+func matchAny(patterns []string, value string, glob bool) bool {
+	value = strings.ToLower(value)
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		if p == value {
+			return true
+		}
+		if glob {
+			if ok, _ := path.Match(p, value); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// planRule declares the desired state of the VMs matched by its selector
+type planRule struct {
+	Name     string   `json:"name"`
+	Selector selector `json:"selector"`
+	State    string   `json:"state"`
+}
+
+// runPlan is a desired-state plan; the first rule matching a VM decides its action
+type runPlan struct {
+	Rules []planRule `json:"rules"`
+}
+
+// loadPlan reads and validates a plan file
+func loadPlan(planPath string) (*runPlan, error) {
+	data, err := readConfigFile(planPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read plan: %w", err)
+	}
+	var plan runPlan
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&plan); err != nil {
+		return nil, fmt.Errorf("failed to parse plan: %w", err)
+	}
+	if len(plan.Rules) == 0 {
+		return nil, fmt.Errorf("plan has no rules")
+	}
+	for i, rule := range plan.Rules {
+		if rule.State != stateRunning && rule.State != stateDeallocated {
+			return nil, fmt.Errorf("plan rule %d: unknown state %q", i+1, rule.State)
+		}
+		for _, name := range rule.Selector.Names {
+			if _, err := path.Match(name, ""); err != nil {
+				return nil, fmt.Errorf("plan rule %d: invalid name pattern %q", i+1, name)
+			}
+		}
+	}
+	return &plan, nil
+}
+
+// assign is a vmFilter that sets the action of t from the first matching rule
+// and skips VMs that no rule covers
+func (plan *runPlan) assign(t *vmTarget) (bool, string) {
+	for i, rule := range plan.Rules {
+		if !rule.Selector.matches(t) {
+			continue
+		}
+		t.Action = actionStart
+		if rule.State == stateDeallocated {
+			t.Action = actionDeallocate
+		}
+		t.Rule = rule.Name
+		if t.Rule == "" {
+			t.Rule = fmt.Sprintf("rule %d", i+1)
+		}
+		return true, ""
+	}
+	return false, "not matched by any plan rule"
+}
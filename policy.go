@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Policy Insights API version
+const policyInsightsAPI = "2019-10-01"
+
+// policyCheck flags VMs that are non-compliant with a deny policy assignment,
+// whose start-related writes Azure would refuse. Policy states are queried once
+// per subscription, on first use.
+type policyCheck struct {
+	ctx   context.Context
+	token string
+
+	// denied maps subscription ID → lower-cased VM resource ID → denying assignments
+	denied map[string]map[string][]string
+}
+
+func newPolicyCheck(ctx context.Context, token string) *policyCheck {
+	return &policyCheck{ctx: ctx, token: token, denied: map[string]map[string][]string{}}
+}
+
+// filter is a vmFilter rejecting VMs blocked by policy
+func (c *policyCheck) filter(t *vmTarget) (bool, string) {
+	denied, ok := c.denied[t.SubscriptionID]
+	if !ok {
+		var err error
+		if denied, err = c.query(t.SubscriptionID); err != nil {
+			// Missing Policy Insights access must not stop runs: check nothing for this subscription
+			slog.Error("Policy pre-check unavailable", "subscription", t.SubscriptionID, "error", err)
+		}
+		c.denied[t.SubscriptionID] = denied
+	}
+	if assignments := denied[strings.ToLower(t.ID)]; len(assignments) > 0 {
+		return false, "blocked by policy: non-compliant with deny assignment " + strings.Join(assignments, ", ")
+	}
+	return true, ""
+}
+
+// query returns the VMs of a subscription that are non-compliant with deny policies
+func (c *policyCheck) query(subscriptionID string) (map[string][]string, error) {
+	filter := "complianceState eq 'NonCompliant' and policyDefinitionAction eq 'deny' and " +
+		"resourceType eq 'Microsoft.Compute/virtualMachines'"
+	next := fmt.Sprintf("%s/subscriptions/%s/providers/Microsoft.PolicyInsights/policyStates/latest/queryResults?api-version=%s&$filter=%s&$select=%s",
+		armEndpoint, subscriptionID, policyInsightsAPI,
+		strings.ReplaceAll(url.QueryEscape(filter), "+", "%20"), "resourceId,policyAssignmentName")
+
+	denied := map[string][]string{}
+	for next != "" {
+		resp, err := sendRequest(asQuery(c.ctx), http.MethodPost, next, c.token, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Value []struct {
+				ResourceID           string `json:"resourceId"`
+				PolicyAssignmentName string `json:"policyAssignmentName"`
+			} `json:"value"`
+			NextLink string `json:"@odata.nextLink"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected status: %d", resp.StatusCode)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse JSON: %w", err)
+		}
+		for _, state := range page.Value {
+			id := strings.ToLower(state.ResourceID)
+			if !containsFold(denied[id], state.PolicyAssignmentName) {
+				denied[id] = append(denied[id], state.PolicyAssignmentName)
+				sort.Strings(denied[id])
+			}
+		}
+		next = page.NextLink
+	}
+	return denied, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"sync"
+	"time"
+)
+
+// Run states reported by runProgress
+const (
+	runQueued      = "queued"
+	runDiscovering = "discovering"
+	runExecuting   = "executing"
+	runFinished    = "finished"
+	runFailed      = "failed"
+)
+
+// runStatus is a point-in-time view of a run's progress
+type runStatus struct {
+	RunID      string         `json:"runId"`
+	Fleet      string         `json:"fleet,omitempty"`
+	State      string         `json:"state"`
+	Progress   string         `json:"progress"` // "<done>/<discovered>"
+	Discovered int            `json:"discovered"`
+	Done       int            `json:"done"`
+	Accepted   int            `json:"accepted"`
+	Failed     int            `json:"failed"`
+	Skipped    int            `json:"skipped"`
+	SkippedBy  map[string]int `json:"skippedBy,omitempty"`
+	Error      string         `json:"error,omitempty"`
+	CreatedAt  time.Time      `json:"createdAt"`
+	StartedAt  *time.Time     `json:"startedAt,omitempty"`
+	FinishedAt *time.Time     `json:"finishedAt,omitempty"`
+	Results    []resultRecord `json:"results,omitempty"`
+}
+
+// runProgress tracks the state and counts of a run while it executes.
+// It is safe for concurrent use; a nil *runProgress tracks nothing.
+type runProgress struct {
+	mu     sync.Mutex
+	status runStatus
+}
+
+func newRunProgress(runID, fleet string) *runProgress {
+	return &runProgress{status: runStatus{RunID: runID, Fleet: fleet, State: runQueued, CreatedAt: time.Now().UTC()}}
+}
+
+// setState moves the run to state, recording when it started
+func (p *runProgress) setState(state string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.status.StartedAt == nil && state != runQueued {
+		now := time.Now().UTC()
+		p.status.StartedAt = &now
+	}
+	p.status.State = state
+}
+
+// discovered counts a target entering the pipeline
+func (p *runProgress) discovered() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.status.Discovered++
+}
+
+// observe counts a result leaving the pipeline
+func (p *runProgress) observe(res *vmResult) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.status.Done++
+	switch res.outcome() {
+	case outcomeAccepted:
+		p.status.Accepted++
+	case outcomeFailed, outcomeAccessLost:
+		p.status.Failed++
+	case outcomeSkipped:
+		p.status.Skipped++
+		if p.status.SkippedBy == nil {
+			p.status.SkippedBy = map[string]int{}
+		}
+		p.status.SkippedBy[res.SkipCategory]++
+	}
+}
+
+// finish marks the run finished, or failed when err is non-nil
+func (p *runProgress) finish(err error) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now().UTC()
+	p.status.FinishedAt = &now
+	p.status.State = runFinished
+	if err != nil {
+		p.status.State = runFailed
+		p.status.Error = err.Error()
+	}
+}
+
+// snapshot returns a copy of the current status
+func (p *runProgress) snapshot() runStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.status
+	s.SkippedBy = maps.Clone(s.SkippedBy)
+	s.Progress = fmt.Sprintf("%d/%d", s.Done, s.Discovered)
+	return s
+}
+
+// terminal reports whether the run has finished or failed
+func (p *runProgress) terminal() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.status.State == runFinished || p.status.State == runFailed
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	progressBarWidth   = 30
+	progressBarRows    = 8 // subscriptions shown at most
+	progressBarRefresh = 100 * time.Millisecond
+)
+
+// progressBar draws the progress of a run below the log lines of a terminal:
+// one bar per subscription with VMs processed out of VMs discovered, then a
+// total. While it is shown, informational log lines are not written to the
+// terminal (--log-file still gets them), and warnings and errors are written
+// above it. A nil *progressBar draws nothing.
+type progressBar struct {
+	out io.Writer
+
+	mu            sync.Mutex
+	subscriptions []*subscriptionProgress // in discovery order
+	bySub         map[string]*subscriptionProgress
+	total         subscriptionProgress
+	discovering   bool
+	drawn         int // lines currently drawn
+	drawnAt       time.Time
+}
+
+// subscriptionProgress counts the VMs of a subscription
+type subscriptionProgress struct {
+	id         string
+	discovered int
+	done       int
+	accepted   int
+	planned    int
+	skipped    int
+	failed     int
+}
+
+// showProgressBar reports whether a run configured by opts draws a progress
+// bar: only on a terminal, for text output at the info or warn level, and
+// when no confirmation is asked, since the prompt shares the terminal
+func showProgressBar(opts *options) bool {
+	if !opts.progress || opts.output != outputText || opts.logFormat != logFormatText {
+		return false
+	}
+	if opts.level < slog.LevelInfo || opts.level > slog.LevelWarn {
+		return false
+	}
+	if !opts.yes && !opts.force && !opts.dryRun && !opts.interactive {
+		return false
+	}
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// newProgressBar starts drawing on out, which must be the terminal the logs are written to
+func newProgressBar(out io.Writer) *progressBar {
+	b := &progressBar{out: out, bySub: map[string]*subscriptionProgress{}, discovering: true}
+	console.mu.Lock()
+	console.bar = b
+	console.mu.Unlock()
+	return b
+}
+
+// discovered counts a VM entering the run
+func (b *progressBar) discovered(t *vmTarget) {
+	if b == nil {
+		return
+	}
+	b.update(func() {
+		sub := b.bySub[t.SubscriptionID]
+		if sub == nil {
+			sub = &subscriptionProgress{id: t.SubscriptionID}
+			b.bySub[t.SubscriptionID] = sub
+			b.subscriptions = append(b.subscriptions, sub)
+		}
+		sub.discovered++
+		b.total.discovered++
+	})
+}
+
+// discoveryOver marks the totals final
+func (b *progressBar) discoveryOver() {
+	if b == nil {
+		return
+	}
+	b.update(func() { b.discovering = false })
+}
+
+// observe counts a result leaving the run
+func (b *progressBar) observe(res *vmResult) {
+	if b == nil {
+		return
+	}
+	b.update(func() {
+		sub := b.bySub[res.Target.SubscriptionID]
+		if sub == nil {
+			// Results of VMs the bar was not told about still count in the total
+			sub = &subscriptionProgress{}
+		}
+		for _, c := range []*subscriptionProgress{sub, &b.total} {
+			c.done++
+			switch res.outcome() {
+			case outcomeAccepted:
+				c.accepted++
+			case outcomePlanned:
+				c.planned++
+			case outcomeSkipped:
+				c.skipped++
+			default:
+				c.failed++
+			}
+		}
+	})
+}
+
+// finish draws the final state and leaves it on the terminal
+func (b *progressBar) finish() {
+	if b == nil {
+		return
+	}
+	console.mu.Lock()
+	defer console.mu.Unlock()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.discovering = false
+	b.clear()
+	b.draw()
+	b.drawn = 0
+	console.bar = nil
+}
+
+// update applies change and redraws, at most every progressBarRefresh
+func (b *progressBar) update(change func()) {
+	console.mu.Lock()
+	defer console.mu.Unlock()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	change()
+	if time.Since(b.drawnAt) < progressBarRefresh {
+		return
+	}
+	b.clear()
+	b.draw()
+}
+
+// clear erases the lines drawn last; the caller holds console.mu and b.mu
+func (b *progressBar) clear() {
+	if b.drawn > 0 {
+		fmt.Fprintf(b.out, "\x1b[%dF\x1b[J", b.drawn)
+		b.drawn = 0
+	}
+}
+
+// draw writes the bars; the caller holds console.mu and b.mu
+func (b *progressBar) draw() {
+	var s strings.Builder
+	rows := b.subscriptions
+	hidden := 0
+	if len(rows) > progressBarRows {
+		// Subscriptions still in progress first
+		var busy, over []*subscriptionProgress
+		for _, sub := range rows {
+			if b.discovering || sub.done < sub.discovered {
+				busy = append(busy, sub)
+			} else {
+				over = append(over, sub)
+			}
+		}
+		rows = append(busy, over...)[:progressBarRows]
+		hidden = len(b.subscriptions) - progressBarRows
+	}
+	lines := 0
+	if len(b.subscriptions) > 1 {
+		for _, sub := range rows {
+			b.row(&s, sub.id, sub)
+			lines++
+		}
+		if hidden > 0 {
+			fmt.Fprintf(&s, "  … %d more subscription(s)\n", hidden)
+			lines++
+		}
+	}
+	b.row(&s, "total", &b.total)
+	lines++
+	io.WriteString(b.out, s.String())
+	b.drawn, b.drawnAt = lines, time.Now()
+}
+
+// row writes the bar of a subscription, or of the total
+func (b *progressBar) row(s *strings.Builder, name string, c *subscriptionProgress) {
+	filled := 0
+	if c.discovered > 0 {
+		filled = progressBarWidth * c.done / c.discovered
+	}
+	of := fmt.Sprint(c.discovered)
+	if b.discovering {
+		of += "+"
+	}
+	fmt.Fprintf(s, "%-36.36s [%s%s] %d/%s", name, strings.Repeat("█", filled), strings.Repeat("░", progressBarWidth-filled), c.done, of)
+	if c.planned > 0 {
+		fmt.Fprintf(s, "  planned %d", c.planned)
+	} else {
+		fmt.Fprintf(s, "  accepted %d", c.accepted)
+	}
+	fmt.Fprintf(s, "  skipped %d  failed %d\n", c.skipped, c.failed)
+}
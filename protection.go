@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// protectionList holds VMs that must never be powered down by this tool.
+// It is enforced by the execute stage for every action, regardless of --force.
+type protectionList struct {
+	tags  map[string]string // tag key → value, "" matches any value
+	names map[string]bool
+	ids   map[string]bool
+}
+
+// parseProtectionList parses entries of the form tag:key[=value], name:<vm name> or id:<resource id>
+func parseProtectionList(entries []string) (*protectionList, error) {
+	pl := &protectionList{tags: map[string]string{}, names: map[string]bool{}, ids: map[string]bool{}}
+	for _, entry := range entries {
+		kind, value, ok := strings.Cut(entry, ":")
+		if !ok || value == "" {
+			return nil, fmt.Errorf("invalid protection entry %q: expected tag:, name: or id: prefix", entry)
+		}
+		switch kind {
+		case "tag":
+			key, tagValue, _ := strings.Cut(value, "=")
+			pl.tags[strings.ToLower(key)] = tagValue
+		case "name":
+			pl.names[strings.ToLower(value)] = true
+		case "id":
+			pl.ids[strings.ToLower(value)] = true
+		default:
+			return nil, fmt.Errorf("invalid protection entry %q: unknown kind %q", entry, kind)
+		}
+	}
+	return pl, nil
+}
+
+// protects returns why t is protected, or "" when it is not.
+// Names, IDs and tag keys are compared case-insensitively, like ARM does.
+func (pl *protectionList) protects(t *vmTarget) string {
+	if pl == nil {
+		return ""
+	}
+	if pl.ids[strings.ToLower(t.ID)] {
+		return "protected by resource ID"
+	}
+	if pl.names[strings.ToLower(t.Name)] {
+		return "protected by name"
+	}
+	for key, value := range t.Tags {
+		want, ok := pl.tags[strings.ToLower(key)]
+		if ok && (want == "" || want == value) {
+			return fmt.Sprintf("protected by tag %s=%s", key, value)
+		}
+	}
+	return ""
+}
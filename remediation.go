@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// armError is the error object of an ARM error response
+type armError struct {
+	Code           string `json:"code"`
+	Message        string `json:"message"`
+	AdditionalInfo []struct {
+		Type string          `json:"type"`
+		Info json.RawMessage `json:"info"`
+	} `json:"additionalInfo"`
+}
+
+// readARMError reads the error of an ARM error response, or nil for
+// successful responses and bodies without one
+func readARMError(resp *http.Response) *armError {
+	if resp.StatusCode < http.StatusBadRequest {
+		return nil
+	}
+	var body struct {
+		Error *armError `json:"error"`
+	}
+	_ = json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&body)
+	if body.Error == nil || body.Error.Code == "" {
+		return nil
+	}
+	return body.Error
+}
+
+// code returns the error code, or "" for no error
+func (e *armError) code() string {
+	if e == nil {
+		return ""
+	}
+	return e.Code
+}
+
+// quotaFamilyPattern finds the VM family in quota error messages
+var quotaFamilyPattern = regexp.MustCompile(`(?i)\bstandard\w*family\b`)
+
+// quotaHint asks for a quota increase, for the VM family the message names if it does
+func quotaHint(e *armError, t *vmTarget) string {
+	if family := quotaFamilyPattern.FindString(e.Message); family != "" {
+		return fmt.Sprintf("request a quota increase for %s in %s", family, t.Location)
+	}
+	return fmt.Sprintf("request a quota increase for the VM family of %s in %s", t.Size, t.Location)
+}
+
+// policyAssignmentPattern finds policy assignment IDs in error messages
+var policyAssignmentPattern = regexp.MustCompile(`(?i)/providers/Microsoft\.Authorization/policyAssignments/[^"'\s\\,\]}]+`)
+
+// policyAssignment returns the ID of the policy assignment that denied the
+// request, from the PolicyViolation details or else the message, or ""
+func (e *armError) policyAssignment() string {
+	for _, info := range e.AdditionalInfo {
+		if info.Type != "PolicyViolation" {
+			continue
+		}
+		var violation struct {
+			PolicyAssignmentID string `json:"policyAssignmentId"`
+		}
+		if json.Unmarshal(info.Info, &violation) == nil && violation.PolicyAssignmentID != "" {
+			return violation.PolicyAssignmentID
+		}
+	}
+	return policyAssignmentPattern.FindString(e.Message)
+}
+
+// remediationHint tells what to do about a failed result, or "" when nothing
+// more specific than the error can be said
+func remediationHint(res *vmResult) string {
+	t := res.Target
+	e := res.ARMError
+	if e == nil {
+		if errors.Is(res.Err, errMissedDeadline) {
+			return "the start was accepted but the VM is not running: check its boot diagnostics and the activity log"
+		}
+		if errors.Is(res.Err, errRunTimeout) {
+			return "the run was cut short by --run-timeout: check the VM's state, then run again or raise the timeout"
+		}
+		if res.TimedOut {
+			return "the VM did not finish within --vm-timeout: check its activity log, or raise the timeout if its operations are slow"
+		}
+		if errors.Is(res.Err, errOperationFailed) {
+			return "the action was accepted but its operation did not succeed: check the activity log of the VM"
+		}
+		if res.StatusCode == http.StatusTooManyRequests {
+			return "ARM throttled the request: lower the parallelism or run again later"
+		}
+		return ""
+	}
+	switch e.Code {
+	case "QuotaExceeded":
+		return quotaHint(e, t)
+	case "OperationNotAllowed":
+		if strings.Contains(strings.ToLower(e.Message), "quota") {
+			return quotaHint(e, t)
+		}
+		return ""
+	case "AllocationFailed", "ZonalAllocationFailed", "OverconstrainedAllocationRequest", "OverconstrainedZonalAllocationRequest", "SkuNotAvailable":
+		return fmt.Sprintf("Azure has no capacity for %s in %s right now: retry later, or resize the VM to another size", t.Size, t.Location)
+	case "RequestDisallowedByPolicy", "DisallowedByPolicy":
+		if assignment := e.policyAssignment(); assignment != "" {
+			return fmt.Sprintf("denied by policy assignment %s: ask its owner for an exemption", assignment)
+		}
+		return "denied by an Azure Policy assignment: its ID is in the error message"
+	case "AuthorizationFailed", "LinkedAuthorizationFailed":
+		return fmt.Sprintf("grant the identity Microsoft.Compute/virtualMachines/%s/action, e.g. with Virtual Machine Contributor, on /subscriptions/%s/resourceGroups/%s",
+			res.Action, t.SubscriptionID, t.ResourceGroup)
+	case "ScopeLocked":
+		return "a read-only lock covers the VM: remove the lock on the VM, its resource group or subscription"
+	case "Conflict", "OperationPreempted", "ConflictingUserInput":
+		return "another operation is in progress on the VM: run again once it completed"
+	case "ResourceNotFound", "NotFound":
+		return "the VM was deleted or moved after it was discovered"
+	case "MissingSubscriptionRegistration", "SubscriptionNotRegistered":
+		return fmt.Sprintf("register the Microsoft.Compute resource provider in subscription %s", t.SubscriptionID)
+	case "ReadOnlyDisabledSubscription", "SubscriptionNotFound":
+		return fmt.Sprintf("subscription %s is disabled: re-enable it or exclude it with --exclude-subscription", t.SubscriptionID)
+	case "TooManyRequests":
+		return "ARM throttled the request: lower the parallelism or run again later"
+	}
+	return ""
+}
+
+// hintAttr is the remediation hint of a failed result as a log field, or an
+// empty attribute, which handlers drop, if there is none
+func hintAttr(res *vmResult) slog.Attr {
+	if hint := remediationHint(res); hint != "" {
+		return slog.String("hint", hint)
+	}
+	return slog.Attr{}
+}
+
+// failureGroup is a set of failures with the same cause
+type failureGroup struct {
+	Cause   string
+	Count   int
+	Example *vmResult // the first failure of the group
+}
+
+// failureCause classifies a failure by its ARM error code, or else by how it failed
+func failureCause(res *vmResult) string {
+	switch {
+	case errors.Is(res.Err, errMissedDeadline):
+		return "missed --vm-deadline"
+	case res.TimedOut:
+		return "exceeded --vm-timeout"
+	case errors.Is(res.Err, errRunTimeout):
+		return "cut short by --run-timeout"
+	case res.ARMError != nil:
+		return res.ARMError.Code
+	case errors.Is(res.Err, errOperationFailed):
+		return "operation did not succeed"
+	case res.AccessLost:
+		return "access lost"
+	case res.StatusCode != 0:
+		return fmt.Sprintf("HTTP %d", res.StatusCode)
+	case res.Duration == 0:
+		return fmt.Sprintf("not sent (%v)", res.Err)
+	}
+	return "no response"
+}
+
+// rollupFailures groups failures by cause, the most frequent first
+func rollupFailures(failures []*vmResult) []*failureGroup {
+	byCause := map[string]*failureGroup{}
+	var groups []*failureGroup
+	for _, res := range failures {
+		cause := failureCause(res)
+		g, ok := byCause[cause]
+		if !ok {
+			g = &failureGroup{Cause: cause, Example: res}
+			byCause[cause] = g
+			groups = append(groups, g)
+		}
+		g.Count++
+	}
+	sort.SliceStable(groups, func(i, j int) bool { return groups[i].Count > groups[j].Count })
+	return groups
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// Resource Graph API version
+const resourceGraphAPI = "2022-10-01"
+
+// resourceGraphBaseQuery selects every VM, and resourceGraphArcQuery every VM
+// and Arc-enabled server; user clauses are appended to them
+const (
+	resourceGraphBaseQuery = "Resources | where type =~ 'microsoft.compute/virtualmachines'"
+	resourceGraphArcQuery  = "Resources | where type in~ ('microsoft.compute/virtualmachines', 'microsoft.hybridcompute/machines')"
+)
+
+// resourceGraphRequest is the body of a Resource Graph query
+type resourceGraphRequest struct {
+	Subscriptions []string                    `json:"subscriptions,omitempty"`
+	Query         string                      `json:"query"`
+	Options       resourceGraphRequestOptions `json:"options"`
+}
+
+type resourceGraphRequestOptions struct {
+	Top          int    `json:"$top"`
+	SkipToken    string `json:"$skipToken,omitempty"`
+	ResultFormat string `json:"resultFormat"`
+}
+
+// resourceGraphResponse represents the Resource Graph query response
+type resourceGraphResponse struct {
+	Data []struct {
+		ID             string            `json:"id"`
+		Name           string            `json:"name"`
+		SubscriptionID string            `json:"subscriptionId"`
+		ResourceGroup  string            `json:"resourceGroup"`
+		Tags           map[string]string `json:"tags"`
+		PPG            string            `json:"ppg"`
+		Location       string            `json:"location"`
+		Size           string            `json:"size"`
+		Type           string            `json:"type"`
+		Status         string            `json:"status"` // of Arc machines
+	} `json:"data"`
+	SkipToken string `json:"$skipToken"`
+}
+
+// resourceGraphDiscoverer enumerates VMs across the tenant with a single paged Resource Graph query
+type resourceGraphDiscoverer struct {
+	token     string
+	where     []string
+	pageSize  int
+	skipToken string
+	maxPages  int
+
+	// arc also selects Arc-enabled servers
+	arc bool
+
+	// scope, when not empty, is resolved into the subscriptions the query runs in
+	scope *subscriptionScope
+	meta  *metadataCache
+
+	// group, when set, restricts the query to one resource group
+	group string
+	// locations, when set, restrict the query to these regions
+	locations []string
+}
+
+// query builds the KQL query, ANDing every user clause onto the base query
+func (d *resourceGraphDiscoverer) query() string {
+	var b strings.Builder
+	if d.arc {
+		b.WriteString(resourceGraphArcQuery)
+	} else {
+		b.WriteString(resourceGraphBaseQuery)
+	}
+	if d.group != "" {
+		fmt.Fprintf(&b, " | where resourceGroup =~ '%s'", d.group)
+	}
+	if len(d.locations) > 0 {
+		fmt.Fprintf(&b, " | where location in~ ('%s')", strings.Join(d.locations, "', '"))
+	}
+	for _, clause := range d.where {
+		fmt.Fprintf(&b, " | where (%s)", clause)
+	}
+	b.WriteString(" | project id, name, subscriptionId, resourceGroup, tags, location, " +
+		"ppg = tostring(properties.proximityPlacementGroup.id), size = tostring(properties.hardwareProfile.vmSize)")
+	if d.arc {
+		b.WriteString(", type, status = tostring(properties.status)")
+	}
+	return b.String()
+}
+
+func (d *resourceGraphDiscoverer) discover(ctx context.Context, out chan<- *vmTarget) error {
+	queryURL := fmt.Sprintf("%s/providers/Microsoft.ResourceGraph/resources?api-version=%s", armEndpoint, resourceGraphAPI)
+	query := d.query()
+	slog.Debug("Resource Graph query", "query", query)
+	var subscriptions []string
+	if !d.scope.empty() {
+		subs, err := d.meta.subscriptions(ctx, d.token)
+		if err != nil {
+			return fmt.Errorf("failed to fetch subscriptions: %w", err)
+		}
+		if subs, err = d.scope.apply(subs); err != nil {
+			return err
+		}
+		if len(subs.Value) == 0 {
+			return fmt.Errorf("no subscription is left to query after --exclude-subscription")
+		}
+		for _, sub := range subs.Value {
+			subscriptions = append(subscriptions, sub.SubscriptionID)
+		}
+		slog.Debug("Resource Graph subscriptions", "subscriptions", strings.Join(subscriptions, ","))
+	}
+
+	skipToken := d.skipToken
+	for page := 1; ; page++ {
+		body, err := json.Marshal(resourceGraphRequest{
+			Subscriptions: subscriptions,
+			Query:         query,
+			Options: resourceGraphRequestOptions{
+				Top:          d.pageSize,
+				SkipToken:    skipToken,
+				ResultFormat: "objectArray",
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to build Resource Graph request: %w", err)
+		}
+		resp, err := sendRequest(asQuery(ctx), http.MethodPost, queryURL, d.token, body)
+		if err != nil {
+			return fmt.Errorf("failed to query Resource Graph: %w", err)
+		}
+		var result resourceGraphResponse
+		if resp.StatusCode != http.StatusOK {
+			var errBody bytes.Buffer
+			_, _ = errBody.ReadFrom(resp.Body)
+			resp.Body.Close()
+			return fmt.Errorf("unexpected status for Resource Graph query: %d: %s", resp.StatusCode, errBody.String())
+		}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("failed to parse Resource Graph JSON: %w", err)
+		}
+
+		for _, vm := range result.Data {
+			t := &vmTarget{
+				SubscriptionID: vm.SubscriptionID,
+				ResourceGroup:  vm.ResourceGroup,
+				Name:           vm.Name,
+				ID:             vm.ID,
+				Tags:           vm.Tags,
+				PPG:            vm.PPG,
+				Location:       vm.Location,
+				Size:           vm.Size,
+				Arc:            strings.EqualFold(vm.Type, "microsoft.hybridcompute/machines"),
+			}
+			if t.Arc && vm.Status == arcStatusConnected {
+				t.Statuses = []string{"PowerState/running"}
+			}
+			out <- t
+		}
+
+		skipToken = result.SkipToken
+		if skipToken == "" {
+			return nil
+		}
+		if d.maxPages > 0 && page >= d.maxPages {
+			slog.Info("Resource Graph paging stopped; resume with --rg-skip-token", "pages", page, "skipToken", skipToken)
+			return nil
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// Result outcomes
+const (
+	outcomeAccepted = "accepted"
+	outcomeFailed   = "failed"
+	outcomeSkipped  = "skipped"
+
+	// outcomeAccessLost is a failure caused by the identity losing access mid-run
+	outcomeAccessLost = "access-lost"
+
+	// outcomePlanned is an action a dry run would have performed
+	outcomePlanned = "planned"
+)
+
+// outcome classifies the result
+func (r *vmResult) outcome() string {
+	switch {
+	case r.SkipReason != "":
+		return outcomeSkipped
+	case r.AccessLost:
+		return outcomeAccessLost
+	case r.Err != nil:
+		return outcomeFailed
+	case r.DryRun:
+		return outcomePlanned
+	}
+	return outcomeAccepted
+}
+
+// resultRecord is the serialized form of a vmResult shared by every result sink
+type resultRecord struct {
+	RunID          string            `json:"runId"`
+	Time           string            `json:"time"`
+	SubscriptionID string            `json:"subscriptionId"`
+	ResourceGroup  string            `json:"resourceGroup"`
+	Name           string            `json:"name"`
+	ID             string            `json:"id"`
+	Team           string            `json:"team,omitempty"`
+	Labels         map[string]string `json:"labels,omitempty"`
+	Annotations    map[string]string `json:"annotations,omitempty"`
+	Action         string            `json:"action,omitempty"`
+	Outcome        string            `json:"outcome"`
+	StatusCode     int               `json:"statusCode,omitempty"`
+	Error          string            `json:"error,omitempty"`
+	ErrorCode      string            `json:"errorCode,omitempty"`
+	Hint           string            `json:"hint,omitempty"`
+	SkipReason     string            `json:"skipReason,omitempty"`
+	SkipCategory   string            `json:"skipCategory,omitempty"`
+	DurationMs     int64             `json:"durationMs"`
+	DelayMs        int64             `json:"delayMs,omitempty"`
+	Degraded       string            `json:"degraded,omitempty"`
+	Operation      string            `json:"operation,omitempty"`
+	TimedOut       bool              `json:"timedOut,omitempty"`
+	Throttled      int               `json:"throttled,omitempty"`
+	History        []stateTransition `json:"history,omitempty"`
+}
+
+// record converts the result into its serialized form
+func (r *vmResult) record(runID string) resultRecord {
+	rec := resultRecord{
+		RunID:          runID,
+		Time:           time.Now().UTC().Format(time.RFC3339),
+		SubscriptionID: r.Target.SubscriptionID,
+		ResourceGroup:  r.Target.ResourceGroup,
+		Name:           r.Target.Name,
+		ID:             r.Target.ID,
+		Team:           r.Target.Team,
+		Action:         string(r.Action),
+		Outcome:        r.outcome(),
+		StatusCode:     r.StatusCode,
+		SkipReason:     r.SkipReason,
+		SkipCategory:   r.SkipCategory,
+		DurationMs:     r.Duration.Milliseconds(),
+		Annotations:    r.Annotations,
+		DelayMs:        r.Delay.Milliseconds(),
+		Degraded:       r.Degraded,
+		Operation:      r.OperationStatus,
+		TimedOut:       r.TimedOut,
+		Throttled:      r.Throttled,
+		History:        r.Target.History,
+	}
+	if r.Err != nil {
+		rec.Error = r.Err.Error()
+		rec.ErrorCode = r.ARMError.code()
+		rec.Hint = remediationHint(r)
+	}
+	return rec
+}
+
+// resultSink receives every result as the report stage sees it.
+// publish must not block the pipeline for long; close flushes pending deliveries.
+type resultSink interface {
+	publish(res *vmResult)
+	close()
+}
+
+// runInfo describes a run for run-level observers
+type runInfo struct {
+	ID         string
+	StartedAt  time.Time
+	FinishedAt time.Time
+	Args       []string
+	Labels     map[string]string
+	Err        error // why discovery failed, once the run finished
+}
+
+// runObserver is notified when a run starts and when it finishes
+type runObserver interface {
+	runStarted(ctx context.Context, run *runInfo)
+	runFinished(ctx context.Context, run *runInfo, summary *runSummary)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// defaultRequestRetries is how often a request is retried when ctx does not say
+const defaultRequestRetries = 4
+
+// maxRetryAfter is the longest Retry-After that is waited for; a response asking
+// for a longer wait is returned to the caller instead
+const maxRetryAfter = 5 * time.Minute
+
+// retryBackoff is the wait before the first retry of a response without
+// Retry-After, doubled on each further retry
+var retryBackoff = time.Second
+
+type retriesKey struct{}
+
+type queryKey struct{}
+
+type throttledKey struct{}
+
+// withThrottleCount counts in n every 429 response to the requests sent with ctx
+func withThrottleCount(ctx context.Context, n *atomic.Int32) context.Context {
+	return context.WithValue(ctx, throttledKey{}, n)
+}
+
+// withRetries makes the requests sent with ctx be retried up to retries times
+// when they are throttled or fail transiently
+func withRetries(ctx context.Context, retries int) context.Context {
+	return context.WithValue(ctx, retriesKey{}, retries)
+}
+
+// requestRetries returns how often requests sent with ctx are retried
+func requestRetries(ctx context.Context) int {
+	if n, ok := ctx.Value(retriesKey{}).(int); ok {
+		return n
+	}
+	return defaultRequestRetries
+}
+
+// asQuery marks the requests sent with ctx as read-only queries, such as
+// Resource Graph POSTs, which are retried like GETs whatever their method
+func asQuery(ctx context.Context) context.Context {
+	return context.WithValue(ctx, queryKey{}, true)
+}
+
+// idempotent reports whether a request sent with method and ctx may be sent twice
+func idempotent(ctx context.Context, method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	query, _ := ctx.Value(queryKey{}).(bool)
+	return query
+}
+
+// retryableAttempt reports whether an attempt that got resp or err is worth
+// retrying. A request that is not idempotent, such as an action POST, may have
+// been acted on when it timed out or failed with a server error, so it is only
+// retried when throttled or when it never left.
+func retryableAttempt(ctx context.Context, method string, resp *http.Response, err error) bool {
+	switch {
+	case idempotent(ctx, method) && err != nil:
+		return true
+	case idempotent(ctx, method):
+		return retryable(resp.StatusCode)
+	case err != nil:
+		return notSent(err)
+	}
+	return resp.StatusCode == http.StatusTooManyRequests
+}
+
+// notSent reports whether a request failed before it was written: its host
+// could not be resolved or connected to
+func notSent(err error) bool {
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	return errors.As(err, &dnsErr) || (errors.As(err, &opErr) && opErr.Op == "dial")
+}
+
+// retryable reports whether a response status is worth retrying: throttling
+// and server errors other than 501 Not Implemented
+func retryable(status int) bool {
+	return status == http.StatusTooManyRequests || (status >= 500 && status != http.StatusNotImplemented)
+}
+
+// retryDelay returns how long to wait before retry attempt (1, 2, …): the
+// Retry-After of resp when it has one, and otherwise 1s, 2s, 4s, … capped at
+// 30s, with up to 50% jitter
+func retryDelay(attempt int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if after, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+			return after
+		}
+	}
+	backoff := retryBackoff << (attempt - 1)
+	if backoff > 30*time.Second || backoff <= 0 {
+		backoff = 30 * time.Second
+	}
+	return backoff + time.Duration(rand.Int63n(int64(backoff/2)))
+}
+
+// parseRetryAfter parses a Retry-After header, given in seconds or as an HTTP date
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(at.Sub(now), 0), true
+	}
+	return 0, false
+}
+
+// sendWithRetries sends a request with send, retrying network errors, 429 and
+// 5xx responses up to the retries of ctx; requests that are not idempotent are
+// only retried as retryableAttempt allows. The last response or error is
+// returned when no attempt succeeds.
+func sendWithRetries(ctx context.Context, method, rawURL string, send func() (*http.Response, error)) (*http.Response, error) {
+	retries := requestRetries(ctx)
+	for attempt := 0; ; attempt++ {
+		resp, err := send()
+		if err == nil && resp.StatusCode == http.StatusTooManyRequests {
+			if n, ok := ctx.Value(throttledKey{}).(*atomic.Int32); ok {
+				n.Add(1)
+			}
+		}
+		if attempt == retries || ctx.Err() != nil || !retryableAttempt(ctx, method, resp, err) {
+			if err != nil && attempt > 0 {
+				err = fmt.Errorf("giving up after %d attempts: %w", attempt+1, err)
+			}
+			return resp, err
+		}
+		delay := retryDelay(attempt+1, resp)
+		reason := ""
+		if err != nil {
+			reason = err.Error()
+		} else {
+			reason = fmt.Sprintf("status %d", resp.StatusCode)
+			if delay > maxRetryAfter {
+				return resp, nil
+			}
+			resp.Body.Close()
+		}
+		slog.Warn("Request failed, retrying", "method", method, "url", withoutQuery(rawURL), "reason", reason,
+			"delay", delay.Round(time.Millisecond), "attempt", attempt+1, "retries", retries)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// withoutQuery drops the query of a URL, keeping logs short
+func withoutQuery(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	u.RawQuery = ""
+	return u.String()
+}
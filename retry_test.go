@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2025, 1, 6, 7, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"", 0, false},
+		{"0", 0, true},
+		{"30", 30 * time.Second, true},
+		{"-5", 0, false},
+		{"soon", 0, false},
+		{"1.5", 0, false},
+		{"Mon, 06 Jan 2025 07:00:45 GMT", 45 * time.Second, true},
+		{"Mon, 06 Jan 2025 06:59:00 GMT", 0, true},
+	}
+	for _, tt := range tests {
+		got, ok := parseRetryAfter(tt.value, now)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseRetryAfter(%q) = %v, %v, want %v, %v", tt.value, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestSendWithRetries(t *testing.T) {
+	defer func(backoff time.Duration) { retryBackoff = backoff }(retryBackoff)
+	retryBackoff = time.Millisecond
+
+	status := func(code int) func() (*http.Response, error) {
+		return func() (*http.Response, error) {
+			return &http.Response{StatusCode: code, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(""))}, nil
+		}
+	}
+	fail := func(err error) func() (*http.Response, error) {
+		return func() (*http.Response, error) { return nil, err }
+	}
+	dialErr := &url.Error{Op: "Post", URL: "https://management.azure.com", Err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}}
+	readErr := &url.Error{Op: "Post", URL: "https://management.azure.com", Err: &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}}
+	timeoutErr := &url.Error{Op: "Post", URL: "https://management.azure.com", Err: context.DeadlineExceeded}
+
+	tests := []struct {
+		name     string
+		method   string
+		query    bool
+		send     func() (*http.Response, error)
+		attempts int
+	}{
+		{"GET 5xx", http.MethodGet, false, status(http.StatusServiceUnavailable), 3},
+		{"GET 429", http.MethodGet, false, status(http.StatusTooManyRequests), 3},
+		{"GET network error", http.MethodGet, false, fail(readErr), 3},
+		{"GET 404", http.MethodGet, false, status(http.StatusNotFound), 1},
+		{"POST 5xx", http.MethodPost, false, status(http.StatusInternalServerError), 1},
+		{"POST read error", http.MethodPost, false, fail(readErr), 1},
+		{"POST timeout", http.MethodPost, false, fail(timeoutErr), 1},
+		{"POST 429", http.MethodPost, false, status(http.StatusTooManyRequests), 3},
+		{"POST dial error", http.MethodPost, false, fail(dialErr), 3},
+		{"POST DNS error", http.MethodPost, false, fail(&net.DNSError{Err: "no such host", Name: "management.azure.com"}), 3},
+		{"query POST 5xx", http.MethodPost, true, status(http.StatusServiceUnavailable), 3},
+		{"query POST read error", http.MethodPost, true, fail(readErr), 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := withRetries(context.Background(), 2)
+			if tt.query {
+				ctx = asQuery(ctx)
+			}
+			attempts := 0
+			resp, err := sendWithRetries(ctx, tt.method, "https://management.azure.com/resource", func() (*http.Response, error) {
+				attempts++
+				return tt.send()
+			})
+			if resp != nil {
+				resp.Body.Close()
+			}
+			if resp == nil && err == nil {
+				t.Fatal("got neither a response nor an error")
+			}
+			if attempts != tt.attempts {
+				t.Errorf("sent %d times, want %d", attempts, tt.attempts)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Catch-up policies for schedule fire times missed while the host was
+// suspended or its clock jumped
+const (
+	catchUpOnce = "once" // fire once as soon as the miss is noticed
+	catchUpSkip = "skip" // wait for the next regular fire time
+)
+
+// scheduleTick is how often schedules compare the wall clock to their next
+// fire time, and scheduleGrace how late a fire may be before it counts as missed
+const (
+	scheduleTick  = 30 * time.Second
+	scheduleGrace = 5 * time.Minute
+)
+
+// runSchedule calls fire at every time returned by next(now) until ctx is done.
+// Rather than sleeping until the fire time, which stalls while the host is
+// suspended, it checks the wall clock every tick, so that suspensions and clock
+// jumps are detected: missed fire times are coalesced and handled by policy.
+func runSchedule(ctx context.Context, name, policy string, next func(now time.Time) time.Time, fire func(now time.Time)) {
+	now := time.Now().Round(0) // strip the monotonic reading: compare wall clock only
+	due := next(now)
+	slog.Info("Next fire time", "schedule", name, "at", due.Format(time.RFC3339))
+	ticker := time.NewTicker(scheduleTick)
+	defer ticker.Stop()
+	last := now
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now = time.Now().Round(0)
+		if now.Before(last.Add(-scheduleTick)) {
+			// The clock was set back: the pending fire time may now be far away
+			due = next(now)
+			slog.Warn("Clock moved back", "by", last.Sub(now).Round(time.Second), "schedule", name, "next", due.Format(time.RFC3339))
+		}
+		last = now
+		if now.Before(due) {
+			continue
+		}
+		if late := now.Sub(due); late > scheduleGrace {
+			missed := 0
+			for at := due; !at.After(now); at = next(at) {
+				missed++
+			}
+			if policy == catchUpSkip {
+				due = next(now)
+				slog.Warn("Missed fire times (host suspended or clock changed); skipping", "schedule", name, "missed", missed,
+					"late", late.Round(time.Second), "next", due.Format(time.RFC3339))
+				continue
+			}
+			slog.Warn("Missed fire times (host suspended or clock changed); catching up once now", "schedule", name, "missed", missed,
+				"late", late.Round(time.Second))
+		}
+		fire(now)
+		due = next(now)
+		slog.Info("Next fire time", "schedule", name, "at", due.Format(time.RFC3339))
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sentryClient identifies this tool in the X-Sentry-Auth header
+const sentryClient = "vmstarter/1.0"
+
+// errorReporter sends fatal errors and panics to a Sentry (or compatible) DSN.
+// A nil *errorReporter is valid and reports nothing.
+type errorReporter struct {
+	storeURL    string
+	publicKey   string
+	environment string
+	release     string
+
+	mu    sync.Mutex
+	extra map[string]string
+}
+
+// newErrorReporter builds a reporter from SENTRY_DSN, returning nil when it is unset
+// DSN format: https://<public_key>@<host>/<project_id>
+func newErrorReporter() (*errorReporter, error) {
+	dsn := os.Getenv("SENTRY_DSN")
+	if dsn == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SENTRY_DSN: %w", err)
+	}
+	if u.User == nil || u.User.Username() == "" {
+		return nil, fmt.Errorf("invalid SENTRY_DSN: missing public key")
+	}
+	path := strings.Trim(u.Path, "/")
+	lastSlash := strings.LastIndex(path, "/")
+	projectID := path[lastSlash+1:]
+	if projectID == "" {
+		return nil, fmt.Errorf("invalid SENTRY_DSN: missing project ID")
+	}
+	prefix := ""
+	if lastSlash != -1 {
+		prefix = "/" + path[:lastSlash]
+	}
+	return &errorReporter{
+		storeURL:    fmt.Sprintf("%s://%s%s/api/%s/store/", u.Scheme, u.Host, prefix, projectID),
+		publicKey:   u.User.Username(),
+		environment: os.Getenv("SENTRY_ENVIRONMENT"),
+		release:     os.Getenv("SENTRY_RELEASE"),
+		extra:       map[string]string{},
+	}, nil
+}
+
+// setContext attaches a key/value pair to every event sent afterwards
+func (r *errorReporter) setContext(key, value string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.extra[key] = value
+}
+
+// capture sends a single event with the given level and message
+func (r *errorReporter) capture(level, message string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	extra := make(map[string]string, len(r.extra))
+	for k, v := range r.extra {
+		extra[k] = v
+	}
+	r.mu.Unlock()
+
+	eventID := make([]byte, 16)
+	_, _ = rand.Read(eventID)
+	hostname, _ := os.Hostname()
+	event := map[string]interface{}{
+		"event_id":    hex.EncodeToString(eventID),
+		"timestamp":   time.Now().UTC().Format(time.RFC3339),
+		"level":       level,
+		"platform":    "go",
+		"logger":      "vmstarter",
+		"server_name": hostname,
+		"message":     map[string]string{"formatted": message},
+		"extra":       extra,
+	}
+	if r.environment != "" {
+		event["environment"] = r.environment
+	}
+	if r.release != "" {
+		event["release"] = r.release
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	// Reporting happens on the way out, so it gets its own short deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.storeURL, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", fmt.Sprintf(
+		"Sentry sentry_version=7, sentry_client=%s, sentry_key=%s", sentryClient, r.publicKey))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		slog.Error("Failed to report error to Sentry", "error", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		slog.Error("Unexpected status from Sentry", "statusCode", resp.StatusCode)
+	}
+}
+
+// recoverPanic reports a panic with its stack trace and exits; use it with defer
+func (r *errorReporter) recoverPanic() {
+	rec := recover()
+	if rec == nil {
+		return
+	}
+	stack := string(debug.Stack())
+	slog.Error(fmt.Sprintf("Panic: %v", rec), "stack", stack)
+	r.capture("fatal", fmt.Sprintf("panic: %v\n\n%s", rec, stack))
+	os.Exit(2)
+}
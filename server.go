@@ -0,0 +1,734 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// server exposes runs over a REST API
+type server struct {
+	app       *app
+	fleets    map[string]*app // named fleets of --fleets, "" being app
+	schedules map[string]*fleetSchedule
+	auth      authenticator
+	limiter   *rateLimiter
+	runs      *runLimiter
+	maxQueued int
+	digest    *digest
+	owners    *ownerNotifier
+	secret    []byte // signs snooze links
+
+	mu      sync.Mutex
+	history map[string]*apiRun
+	order   []string // run IDs, oldest first
+}
+
+// maxRetainedRuns bounds how many finished runs are kept for status queries
+const maxRetainedRuns = 500
+
+// newServer builds the API server from the app options
+func newServer(a *app) (*server, error) {
+	opts := a.opts
+	auth := &chainAuthenticator{}
+	if opts.apiTenant != "" {
+		roles, err := loadRoleGrants(opts.apiRolesPath)
+		if err != nil {
+			return nil, err
+		}
+		auth.aad = newAADAuthenticator(opts.apiTenant, opts.apiAudience, roles)
+	}
+	if opts.apiKeysPath != "" {
+		keys, err := loadAPIKeys(opts.apiKeysPath)
+		if err != nil {
+			return nil, err
+		}
+		auth.keys = keys
+	}
+	var d *digest
+	if opts.digest != "" {
+		var err error
+		if d, err = newDigest(opts.digest, opts.digestTime, opts.digestSlackChannel, opts.digestEmails, a.messages); err != nil {
+			return nil, err
+		}
+	}
+	s := &server{
+		app:       a,
+		fleets:    map[string]*app{"": a},
+		schedules: map[string]*fleetSchedule{},
+		digest:    d,
+		auth:      auth,
+		limiter:   newRateLimiter(opts.apiRate, opts.apiBurst),
+		runs:      newRunLimiter(opts.apiMaxRuns),
+		maxQueued: opts.apiMaxQueued,
+		history:   map[string]*apiRun{},
+	}
+	if opts.fleetsPath != "" {
+		fleets, err := loadFleets(opts.fleetsPath)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range fleets {
+			if f.opts.journalPath != "" && f.opts.journalPath == opts.journalPath {
+				s.close()
+				return nil, fmt.Errorf("fleet %s shares the journal %s with the default fleet", f.name, opts.journalPath)
+			}
+			fa, err := newApp(f.opts, a.reporter)
+			if err != nil {
+				s.close()
+				return nil, fmt.Errorf("fleet %s: %w", f.name, err)
+			}
+			fa.fleet = f.name
+			s.fleets[f.name] = fa
+			if f.schedule != nil {
+				s.schedules[f.name] = f.schedule
+			}
+		}
+	}
+	if opts.stopNotice > 0 {
+		s.close()
+		return nil, fmt.Errorf("--stop-notice applies to the scheduled fleets of --fleets")
+	}
+	for _, fa := range s.fleets {
+		if fa.opts.stopNotice == 0 {
+			continue
+		}
+		if opts.publicURL == "" {
+			s.close()
+			return nil, fmt.Errorf("fleet %s: --stop-notice requires --public-url for its snooze links", fa.fleet)
+		}
+		secret := os.Getenv("VMSTARTER_SNOOZE_SECRET")
+		if secret == "" {
+			s.close()
+			return nil, fmt.Errorf("fleet %s: --stop-notice requires VMSTARTER_SNOOZE_SECRET to sign its snooze links", fa.fleet)
+		}
+		s.owners, s.secret = newOwnerNotifier(), []byte(secret)
+	}
+	return s, nil
+}
+
+// close releases the shared resources of the named fleets; the default
+// fleet's app is owned by the caller
+func (s *server) close() {
+	for name, fa := range s.fleets {
+		if name != "" {
+			fa.close()
+		}
+	}
+}
+
+// fleetApp returns the app of the named fleet, or nil when there is none
+func (s *server) fleetApp(name string) *app {
+	return s.fleets[name]
+}
+
+// listenAndServe serves the API on addr until it fails
+func (s *server) listenAndServe(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.Handle("GET /", uiHandler())
+	mux.HandleFunc("GET /openapi.json", handleOpenAPI)
+	mux.HandleFunc("POST /v1/start", s.handleAction(actionStart))
+	mux.HandleFunc("GET /v1/vms", s.handleVMs)
+	mux.HandleFunc("GET /v1/runs", s.handleRuns)
+	mux.HandleFunc("GET /v1/runs/{id}", s.handleRun)
+	mux.HandleFunc("GET /v1/runs/{id}/events", s.handleRunEvents)
+	mux.HandleFunc("POST /v1/snooze", s.handleSnooze)
+	mux.HandleFunc("GET /v1/snooze/{token}", s.handleSnoozeLink)
+	mux.HandleFunc("POST /v1/snooze/{token}", s.handleSnoozeLink)
+
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	if s.digest != nil {
+		go s.digest.loop(context.Background(), s.app.opts.catchUp)
+	}
+	for name, schedule := range s.schedules {
+		fa := s.fleets[name]
+		slog.Info("Fleet scheduled", "fleet", name, "action", fa.opts.action, "schedule", schedule)
+		go runSchedule(context.Background(), string(fa.opts.action)+" of fleet "+name, fa.opts.catchUp, schedule.next, func(time.Time) {
+			s.startScheduled(fa, nil)
+		})
+		if fa.opts.stopNotice > 0 {
+			go s.noticeSchedule(fa, schedule)
+		}
+	}
+	slog.Info("Listening", "addr", addr)
+	return srv.ListenAndServe()
+}
+
+// apiError is the body of every non-2xx API response
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// apiRun is a run submitted through the API
+type apiRun struct {
+	owner     string // client key of the principal that submitted it
+	app       *app   // of the fleet the run belongs to
+	action    vmAction
+	sel       selector
+	labels    map[string]string
+	progress  *runProgress
+	collected *collectSink
+
+	// snoozable runs skip the VMs whose scheduled stop their owner snoozed
+	snoozable bool
+
+	// after lists the earlier unfinished runs whose VMs may overlap with this
+	// run's; it executes once all of them are over. done is closed when it is.
+	after []*apiRun
+	done  chan struct{}
+}
+
+// coalesces reports whether other is a request identical to run, which has not
+// started yet, so that it can be answered with run instead
+func (run *apiRun) coalesces(other *apiRun) bool {
+	if run.owner != other.owner || run.app != other.app || run.action != other.action || run.progress.snapshot().State != runQueued {
+		return false
+	}
+	a, _ := json.Marshal(runRequest{selector: run.sel, Labels: run.labels})
+	b, _ := json.Marshal(runRequest{selector: other.sel, Labels: other.labels})
+	return string(a) == string(b)
+}
+
+// runRequest is the body of an action request: a selector, optional labels
+// attached to the run on top of the fleet's --label ones, and the fleet
+type runRequest struct {
+	selector
+	Labels map[string]string `json:"labels,omitempty"`
+	Fleet  string            `json:"fleet,omitempty"`
+}
+
+// newAPIRun builds a queued run of the fleet app
+func newAPIRun(runID, owner string, fa *app, action vmAction, sel selector, labels map[string]string) *apiRun {
+	return &apiRun{
+		owner:     owner,
+		app:       fa,
+		action:    action,
+		sel:       sel,
+		labels:    mergeLabels(fa.opts.labels, labels),
+		progress:  newRunProgress(runID, fa.fleet),
+		collected: newCollectSink(runID),
+		done:      make(chan struct{}),
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// authenticate identifies and rate limits the caller, writing the error response
+// itself and returning nil when the request must not proceed
+func (s *server) authenticate(w http.ResponseWriter, r *http.Request) *principal {
+	caller, err := s.auth.authenticate(r)
+	client := "ip:" + remoteHost(r)
+	if err == nil {
+		client = caller.key()
+	}
+	if ok, wait := s.limiter.allow(client); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		writeJSON(w, http.StatusTooManyRequests, apiError{Error: "rate limit exceeded"})
+		return nil
+	}
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeJSON(w, http.StatusUnauthorized, apiError{Error: err.Error()})
+		return nil
+	}
+	return caller
+}
+
+// handleAction queues a run of action against the VMs selected by the request
+// body, restricted to the scopes the caller was granted, and returns its ID at once
+func (s *server) handleAction(action vmAction) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller := s.authenticate(w, r)
+		if caller == nil {
+			return
+		}
+		if !caller.mayPerform(action) {
+			writeJSON(w, http.StatusForbidden, apiError{Error: fmt.Sprintf("not allowed to %s VMs", action)})
+			return
+		}
+
+		var body runRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+			writeJSON(w, http.StatusBadRequest, apiError{Error: fmt.Sprintf("invalid selector: %v", err)})
+			return
+		}
+		for key, value := range body.Labels {
+			if err := validLabel(key, value); err != nil {
+				writeJSON(w, http.StatusBadRequest, apiError{Error: err.Error()})
+				return
+			}
+			if key == requestedByLabel || key == requestedByIDLabel {
+				writeJSON(w, http.StatusBadRequest, apiError{Error: fmt.Sprintf("label %q is reserved for the caller's identity", key)})
+				return
+			}
+		}
+		sel := body.selector
+		fa := s.fleetApp(body.Fleet)
+		if fa == nil {
+			writeJSON(w, http.StatusNotFound, apiError{Error: fmt.Sprintf("unknown fleet %q", body.Fleet)})
+			return
+		}
+
+		runID := uuid.NewString()
+		run := newAPIRun(runID, caller.key(), fa, action, sel, mergeLabels(body.Labels, caller.attribution()))
+		queued, ok := s.enqueue(runID, run)
+		if !ok {
+			w.Header().Set("Retry-After", "60")
+			writeJSON(w, http.StatusTooManyRequests, apiError{Error: "too many queued runs"})
+			return
+		}
+		if queued != run {
+			status := queued.progress.snapshot()
+			fa.journal.audit("api", fmt.Sprintf("principal=%s name=%s auth=%s action=%s run=%s coalesced=true",
+				caller.ID, caller.Name, caller.Method, action, status.RunID))
+			slog.Info("Request coalesced into queued run", "caller", caller.Name, "runId", status.RunID)
+			w.Header().Set("Location", "/v1/runs/"+status.RunID)
+			writeJSON(w, http.StatusAccepted, status)
+			return
+		}
+		fa.journal.audit("api", fmt.Sprintf("principal=%s name=%s auth=%s action=%s run=%s",
+			caller.ID, caller.Name, caller.Method, action, runID))
+		slog.Info("Run requested", "runId", runID, fleetAttr(fa), "caller", caller.Name, "callerId", caller.ID)
+
+		authorized := func(t *vmTarget) (bool, string) {
+			targetAction := t.Action
+			if targetAction == "" {
+				targetAction = action
+			}
+			if !caller.allows(targetAction, t) {
+				return false, "outside the caller's granted scopes"
+			}
+			return true, ""
+		}
+		selected := func(t *vmTarget) (bool, string) {
+			return sel.matches(t), "not matched by the request selector"
+		}
+		go s.execute(runID, run, action, selected, authorized)
+
+		w.Header().Set("Location", "/v1/runs/"+runID)
+		writeJSON(w, http.StatusAccepted, run.progress.snapshot())
+	}
+}
+
+// startScheduled queues a scheduled run of the fleet app's --action on every
+// VM it selects, or only on the VMs of ids (lower-cased resource IDs) when set
+func (s *server) startScheduled(fa *app, ids map[string]bool) {
+	runID := uuid.NewString()
+	action := fa.opts.action
+	var filters []vmFilter
+	var sel selector
+	if ids != nil {
+		// Name the VMs in the selector too, so that the run does not coalesce
+		// with, or wait for, runs of other VMs
+		for id := range ids {
+			sel.Names = append(sel.Names, id[strings.LastIndex(id, "/")+1:])
+		}
+		sort.Strings(sel.Names)
+		filters = append(filters, func(t *vmTarget) (bool, string) {
+			return ids[strings.ToLower(t.ID)], "not among the VMs whose snooze is over"
+		})
+	}
+	run := newAPIRun(runID, "schedule:"+fa.fleet, fa, action, sel, nil)
+	run.snoozable = action.powersDown() && fa.opts.journalPath != ""
+	if queued, ok := s.enqueue(runID, run); !ok {
+		slog.Error("Scheduled run dropped: too many queued runs", "action", action, "fleet", fa.fleet)
+		return
+	} else if queued != run {
+		slog.Info("Scheduled run coalesced into queued run", "action", action, "fleet", fa.fleet, "runId", queued.progress.snapshot().RunID)
+		return
+	}
+	fa.journal.audit("schedule", fmt.Sprintf("fleet=%s action=%s run=%s", fa.fleet, action, runID))
+	slog.Info("Run started by its schedule", "runId", runID, fleetAttr(fa))
+	go s.execute(runID, run, action, filters...)
+}
+
+// fleetAttr names the fleet of fa in log records, or is empty for the default fleet
+func fleetAttr(fa *app) slog.Attr {
+	if fa.fleet == "" {
+		return slog.Attr{}
+	}
+	return slog.String("fleet", fa.fleet)
+}
+
+// enqueue registers a run unless too many runs are already waiting, and
+// returns it, or the queued run it is identical to and coalesced into. A new
+// run is serialized after every unfinished run whose selector may match the same VMs.
+func (s *server) enqueue(runID string, run *apiRun) (*apiRun, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	queued := 0
+	for _, id := range s.order {
+		other := s.history[id]
+		if other.progress.terminal() {
+			continue
+		}
+		if other.coalesces(run) {
+			return other, true
+		}
+		queued++
+		if other.app == run.app && !run.sel.disjoint(&other.sel) {
+			run.after = append(run.after, other)
+		}
+	}
+	if queued >= s.maxQueued {
+		return nil, false
+	}
+	s.history[runID] = run
+	s.order = append(s.order, runID)
+	// Forget the oldest finished runs beyond the retention limit
+	for len(s.order) > maxRetainedRuns {
+		oldest := s.order[0]
+		if !s.history[oldest].progress.terminal() {
+			break
+		}
+		delete(s.history, oldest)
+		s.order = s.order[1:]
+	}
+	return run, true
+}
+
+// execute waits for the overlapping runs queued before it and for a free run
+// slot, then runs the pipeline in the background
+func (s *server) execute(runID string, run *apiRun, action vmAction, filters ...vmFilter) {
+	defer close(run.done)
+	s.persist(run)
+	defer s.persist(run)
+	for _, other := range run.after {
+		if !other.progress.terminal() {
+			slog.Info("Run waits for overlapping run", "runId", runID, "overlapping", other.progress.snapshot().RunID)
+		}
+		<-other.done
+	}
+	s.runs.acquire()
+	defer s.runs.release()
+
+	ctx := context.Background()
+	var snoozed snoozes
+	if run.snoozable {
+		// Read when the run starts, so that snoozes made while it waited count
+		var err error
+		if snoozed, err = readSnoozes(run.app.opts.journalPath, time.Now()); err != nil {
+			slog.Error("Run failed", "runId", runID, "error", err)
+			run.progress.finish(err)
+			run.collected.close()
+			return
+		}
+	}
+	p, err := run.app.newPipeline(ctx, runID, run.labels, filters...)
+	if err != nil {
+		slog.Error("Run failed", "runId", runID, "error", err)
+		run.progress.finish(err)
+		run.collected.close()
+		return
+	}
+	if len(snoozed) > 0 {
+		p.filters = append(p.filters, categorize(skipSnoozed, snoozed.filter)...)
+		defer s.deferSnoozed(run, snoozed)
+	}
+	p.action = action
+	p.requester = run.owner
+	p.progress = run.progress
+	p.sinks = append(p.sinks, run.collected)
+	if s.digest != nil {
+		p.sinks = append(p.sinks, s.digest)
+	}
+
+	if _, err := p.run(ctx); err != nil {
+		slog.Error("Run failed", "runId", runID, "error", err)
+	}
+}
+
+// persist saves the status of run, with its results once it is over, to the
+// run store of its fleet, when the fleet's journal has one
+func (s *server) persist(run *apiRun) {
+	rs := run.app.journal.runs()
+	if rs == nil {
+		return
+	}
+	status := run.progress.snapshot()
+	if run.progress.terminal() {
+		status.Results = run.collected.records()
+	}
+	if err := rs.saveRun(run.owner, status); err != nil {
+		slog.Error("Failed to save run", "runId", status.RunID, fleetAttr(run.app), "error", err)
+	}
+}
+
+// loadRun looks a run submitted to another replica up in the run stores of
+// the fleets, returning nil when none of them knows it
+func (s *server) loadRun(runID string) *apiRun {
+	for _, fa := range s.fleets {
+		rs := fa.journal.runs()
+		if rs == nil {
+			continue
+		}
+		owner, status, err := rs.loadRun(runID)
+		if err != nil {
+			slog.Error("Failed to load run", "runId", runID, fleetAttr(fa), "error", err)
+			continue
+		}
+		if status != nil {
+			return storedRun(fa, owner, status)
+		}
+	}
+	return nil
+}
+
+// storedRun rebuilds a run from the status kept in a run store. Only the
+// replica executing a run follows its progress, so the run is complete as is.
+func storedRun(fa *app, owner string, status *runStatus) *apiRun {
+	results := status.Results
+	status.Results = nil
+	collected := newCollectSink(status.RunID)
+	collected.recs = results
+	collected.close()
+	done := make(chan struct{})
+	close(done)
+	return &apiRun{owner: owner, app: fa, progress: &runProgress{status: *status}, collected: collected, done: done}
+}
+
+// lookupRun authenticates the caller and finds the run named in the path,
+// writing the error response itself and returning nil on failure.
+// Callers only see their own runs.
+func (s *server) lookupRun(w http.ResponseWriter, r *http.Request) *apiRun {
+	caller := s.authenticate(w, r)
+	if caller == nil {
+		return nil
+	}
+	s.mu.Lock()
+	run, ok := s.history[r.PathValue("id")]
+	s.mu.Unlock()
+	if !ok {
+		run = s.loadRun(r.PathValue("id"))
+	}
+	if run == nil || run.owner != caller.key() {
+		writeJSON(w, http.StatusNotFound, apiError{Error: "run not found"})
+		return nil
+	}
+	return run
+}
+
+// vmRecord is a discovered VM as returned by the inventory endpoint
+type vmRecord struct {
+	SubscriptionID string            `json:"subscriptionId"`
+	ResourceGroup  string            `json:"resourceGroup"`
+	Name           string            `json:"name"`
+	ID             string            `json:"id"`
+	Tags           map[string]string `json:"tags,omitempty"`
+}
+
+func newVMRecord(t *vmTarget) vmRecord {
+	return vmRecord{SubscriptionID: t.SubscriptionID, ResourceGroup: t.ResourceGroup, Name: t.Name, ID: t.ID, Tags: t.Tags}
+}
+
+// handleVMs lists the VMs within the caller's granted scopes
+func (s *server) handleVMs(w http.ResponseWriter, r *http.Request) {
+	caller := s.authenticate(w, r)
+	if caller == nil {
+		return
+	}
+	fa := s.fleetApp(r.URL.Query().Get("fleet"))
+	if fa == nil {
+		writeJSON(w, http.StatusNotFound, apiError{Error: fmt.Sprintf("unknown fleet %q", r.URL.Query().Get("fleet"))})
+		return
+	}
+	targets, err := fa.inventory(r.Context())
+	if err != nil {
+		writeJSON(w, http.StatusBadGateway, apiError{Error: err.Error()})
+		return
+	}
+	vms := []vmRecord{}
+	for _, t := range targets {
+		if caller.canSee(t) {
+			vms = append(vms, newVMRecord(t))
+		}
+	}
+	writeJSON(w, http.StatusOK, vms)
+}
+
+// handleRuns lists the caller's runs, newest first, without per-VM results,
+// including those of other replicas sharing a run store
+func (s *server) handleRuns(w http.ResponseWriter, r *http.Request) {
+	caller := s.authenticate(w, r)
+	if caller == nil {
+		return
+	}
+	runs := []runStatus{}
+	seen := map[string]bool{}
+	s.mu.Lock()
+	for i := len(s.order) - 1; i >= 0; i-- {
+		if run := s.history[s.order[i]]; run.owner == caller.key() {
+			runs = append(runs, run.progress.snapshot())
+			seen[s.order[i]] = true
+		}
+	}
+	s.mu.Unlock()
+	stored := false
+	for _, fa := range s.fleets {
+		rs := fa.journal.runs()
+		if rs == nil {
+			continue
+		}
+		others, err := rs.listRuns(caller.key(), maxRetainedRuns)
+		if err != nil {
+			slog.Error("Failed to list runs", fleetAttr(fa), "error", err)
+			continue
+		}
+		for _, status := range others {
+			if !seen[status.RunID] {
+				runs = append(runs, status)
+				seen[status.RunID] = true
+				stored = true
+			}
+		}
+	}
+	if stored {
+		sort.SliceStable(runs, func(i, j int) bool { return runs[i].CreatedAt.After(runs[j].CreatedAt) })
+	}
+	writeJSON(w, http.StatusOK, runs)
+}
+
+// handleRun returns the status of a run
+func (s *server) handleRun(w http.ResponseWriter, r *http.Request) {
+	run := s.lookupRun(w, r)
+	if run == nil {
+		return
+	}
+	status := run.progress.snapshot()
+	if status.State == runFinished || status.State == runFailed {
+		status.Results = run.collected.records()
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// handleRunEvents streams a run as Server-Sent Events: a "status" event first,
+// one "result" event per VM (replaying those already known), and a final
+// "status" event once the run is over
+func (s *server) handleRunEvents(w http.ResponseWriter, r *http.Request) {
+	run := s.lookupRun(w, r)
+	if run == nil {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: "streaming not supported"})
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(event string, body interface{}) {
+		data, _ := json.Marshal(body)
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+		flusher.Flush()
+	}
+	send("status", run.progress.snapshot())
+
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+	sent := 0
+	for {
+		recs, changed, done := run.collected.since(sent)
+		for _, rec := range recs {
+			send("result", rec)
+		}
+		sent += len(recs)
+		if done {
+			send("status", run.progress.snapshot())
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		case <-changed:
+		}
+	}
+}
+
+// remoteHost returns the client address of r without its port
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// collectSink keeps every result of a run in memory and wakes up readers
+// waiting for new results
+type collectSink struct {
+	runID   string
+	mu      sync.Mutex
+	recs    []resultRecord
+	changed chan struct{} // closed and replaced whenever recs grow or the sink closes
+	closed  bool
+}
+
+func newCollectSink(runID string) *collectSink {
+	return &collectSink{runID: runID, changed: make(chan struct{})}
+}
+
+func (c *collectSink) publish(res *vmResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.recs = append(c.recs, res.record(c.runID))
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (c *collectSink) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.changed)
+	}
+}
+
+// records returns a copy of the collected results
+func (c *collectSink) records() []resultRecord {
+	recs, _, _ := c.since(0)
+	return recs
+}
+
+// since returns the results after the first n, a channel closed on the next
+// change, and whether no more results will arrive
+func (c *collectSink) since(n int) ([]resultRecord, <-chan struct{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var recs []resultRecord
+	if n < len(c.recs) {
+		recs = append(recs, c.recs[n:]...)
+	}
+	return recs, c.changed, c.closed
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// defaultServiceNowTemplate maps run context onto the fields of a new record
+const defaultServiceNowTemplate = `{
+  "short_description": {{json (msg "servicenow.short_description" .Run.ID)}},
+  "description": {{json (msg "servicenow.description" (.Run.StartedAt.Format "2006-01-02T15:04:05Z07:00"))}},
+  "category": "Software"
+}`
+
+// serviceNowTemplateData is the data available to the mapping template
+type serviceNowTemplateData struct {
+	Run *runInfo
+}
+
+// serviceNowObserver creates (or attaches to) a ServiceNow record per run and
+// appends the outcome as work notes when the run finishes
+type serviceNowObserver struct {
+	instance string // e.g. mycompany.service-now.com
+	table    string
+	user     string
+	password string
+	tmpl     *template.Template
+	messages messageCatalog
+
+	sysID  string
+	number string
+}
+
+// newServiceNowObserver builds the observer; sysID attaches to an existing record instead of creating one
+func newServiceNowObserver(instance, table, templatePath, sysID string, messages messageCatalog) (*serviceNowObserver, error) {
+	text := defaultServiceNowTemplate
+	if templatePath != "" {
+		data, err := os.ReadFile(templatePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ServiceNow template: %w", err)
+		}
+		text = string(data)
+	}
+	tmpl, err := template.New("servicenow").Funcs(messages.funcs()).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ServiceNow template: %w", err)
+	}
+	user, password := os.Getenv("SERVICENOW_USER"), os.Getenv("SERVICENOW_PASSWORD")
+	if user == "" || password == "" {
+		return nil, fmt.Errorf("SERVICENOW_USER and SERVICENOW_PASSWORD must be set")
+	}
+	instance = strings.TrimSuffix(strings.TrimPrefix(instance, "https://"), "/")
+	return &serviceNowObserver{
+		instance: instance,
+		table:    table,
+		user:     user,
+		password: password,
+		tmpl:     tmpl,
+		sysID:    sysID,
+		number:   sysID,
+		messages: messages,
+	}, nil
+}
+
+// call sends a Table API request and decodes the returned record
+func (s *serviceNowObserver) call(ctx context.Context, method, url string, fields map[string]interface{}) (map[string]interface{}, error) {
+	body, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(s.user, s.password)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+	var out struct {
+		Result map[string]interface{} `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("failed to parse ServiceNow JSON: %w", err)
+	}
+	return out.Result, nil
+}
+
+// templateJSON lets templates embed arbitrary values as properly escaped JSON
+func templateJSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+func (s *serviceNowObserver) tableURL() string {
+	return fmt.Sprintf("https://%s/api/now/table/%s", s.instance, s.table)
+}
+
+func (s *serviceNowObserver) runStarted(ctx context.Context, run *runInfo) {
+	if s.sysID != "" {
+		s.addWorkNotes(ctx, s.messages.format("servicenow.started", run.ID))
+		return
+	}
+	var rendered bytes.Buffer
+	if err := s.tmpl.Execute(&rendered, serviceNowTemplateData{Run: run}); err != nil {
+		slog.Error("Failed to render ServiceNow template", "error", err)
+		return
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(rendered.Bytes(), &fields); err != nil {
+		slog.Error("ServiceNow template did not render a JSON object", "error", err)
+		return
+	}
+	record, err := s.call(ctx, http.MethodPost, s.tableURL(), fields)
+	if err != nil {
+		slog.Error("Failed to create ServiceNow record", "error", err)
+		return
+	}
+	s.sysID, _ = record["sys_id"].(string)
+	s.number, _ = record["number"].(string)
+	slog.Info("Created ServiceNow record", "table", s.table, "number", s.number)
+}
+
+func (s *serviceNowObserver) runFinished(ctx context.Context, run *runInfo, summary *runSummary) {
+	s.addWorkNotes(ctx, s.messages.format("servicenow.finished", run.ID, run.FinishedAt.Sub(run.StartedAt).Round(time.Second), summary.Accepted, summary.Failed, summary.Skipped))
+}
+
+// addWorkNotes appends a work note to the run's record
+func (s *serviceNowObserver) addWorkNotes(ctx context.Context, notes string) {
+	if s.sysID == "" {
+		return
+	}
+	if _, err := s.call(ctx, http.MethodPatch, s.tableURL()+"/"+s.sysID, map[string]interface{}{"work_notes": notes}); err != nil {
+		slog.Error("Failed to update ServiceNow record", "number", s.number, "error", err)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import "log/slog"
+
+// Categories of skipped results, so that dashboards can tell why VMs were not
+// acted on without parsing the free-form skip reasons
+const (
+	skipAlreadyInState = "already-in-state" // e.g. already running for a start
+	skipFiltered       = "filtered"         // excluded by names, locations, tags, the plan or a selector
+	skipUnsupported    = "unsupported"      // generalized VMs and uncovered Arc machines
+	skipProtected      = "protected"        // on the protection list
+	skipPolicy         = "policy"           // denied by Azure Policy or vetoed by the OPA policy
+	skipDuplicate      = "duplicate"        // already requested within the duplicate window
+	skipCap            = "cap"              // more VMs selected than --max-vms
+	skipRejected       = "rejected"         // the plan was rejected: approval, confirmation, hooks or PIM
+	skipRunTimeout     = "run-timeout"      // not attempted before --run-timeout
+	skipSnoozed        = "snoozed"          // scheduled stop postponed by the VM's owner
+)
+
+var knownSkipCategories = []string{
+	skipAlreadyInState, skipFiltered, skipUnsupported, skipProtected, skipPolicy, skipDuplicate, skipCap, skipRejected, skipRunTimeout, skipSnoozed,
+}
+
+// skipCounts returns the counts of skipped results per category as log
+// attributes, in the order of knownSkipCategories
+func skipCounts(byCategory map[string]int) []any {
+	var counts []any
+	for _, category := range knownSkipCategories {
+		if n := byCategory[category]; n > 0 {
+			counts = append(counts, slog.Int(category, n))
+		}
+	}
+	return counts
+}
+
+// categorizedFilter is a filter whose rejections are skipped with category
+type categorizedFilter struct {
+	category string
+	keep     vmFilter
+}
+
+// categorize tags every filter of filters with category
+func categorize(category string, filters ...vmFilter) []categorizedFilter {
+	out := make([]categorizedFilter, len(filters))
+	for i, f := range filters {
+		out[i] = categorizedFilter{category: category, keep: f}
+	}
+	return out
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// snapshotVersion is the format version of inventory snapshots
+const snapshotVersion = 1
+
+// inventorySnapshot is the discovered inventory written by snapshot export.
+// Runs with --snapshot act on it instead of discovering, so that discovery and
+// execution can be separated by a review of the file.
+type inventorySnapshot struct {
+	Version   int          `json:"version"`
+	CreatedAt time.Time    `json:"createdAt"`
+	Tenant    string       `json:"tenant,omitempty"`
+	VMs       []snapshotVM `json:"vms"`
+}
+
+// snapshotVM is one VM of a snapshot
+type snapshotVM struct {
+	SubscriptionID string            `json:"subscriptionId"`
+	ResourceGroup  string            `json:"resourceGroup"`
+	Name           string            `json:"name"`
+	ID             string            `json:"id"`
+	Tags           map[string]string `json:"tags,omitempty"`
+	Location       string            `json:"location,omitempty"`
+	Size           string            `json:"size,omitempty"`
+	PPG            string            `json:"proximityPlacementGroup,omitempty"`
+}
+
+// runSnapshot implements the snapshot command
+func runSnapshot(ctx context.Context, reporter *errorReporter, args []string) error {
+	if len(args) == 0 || args[0] != "export" {
+		return fmt.Errorf("usage: snapshot export [flags] <file>")
+	}
+	opts := &options{}
+	fs := newFlagSet("snapshot export", opts)
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: snapshot export [flags] <file>, with - for stdout")
+	}
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	if err := setupLogging(opts); err != nil {
+		return err
+	}
+	if opts.snapshotPath != "" {
+		return fmt.Errorf("--snapshot cannot be exported again: discover the inventory instead")
+	}
+	a := &app{opts: opts, reporter: reporter}
+	targets, err := a.quietInventory(ctx)
+	if err != nil {
+		return err
+	}
+	s := newSnapshot(targets, opts.tenant, time.Now())
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	path := fs.Arg(0)
+	if path == "-" {
+		_, err = os.Stdout.Write(data)
+	} else {
+		err = os.WriteFile(path, data, 0o644)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	slog.Info("Exported snapshot", "path", path, "vms", len(s.VMs), "subscriptions", s.subscriptionCount(), "sha256", sha256Hex(data))
+	return nil
+}
+
+// newSnapshot captures targets as discovered at now, ordered by ID
+func newSnapshot(targets []*vmTarget, tenant string, now time.Time) *inventorySnapshot {
+	s := &inventorySnapshot{Version: snapshotVersion, CreatedAt: now.UTC().Truncate(time.Second), Tenant: tenant, VMs: []snapshotVM{}}
+	for _, t := range targets {
+		if t.Arc {
+			continue
+		}
+		s.VMs = append(s.VMs, snapshotVM{
+			SubscriptionID: t.SubscriptionID, ResourceGroup: t.ResourceGroup, Name: t.Name, ID: t.ID,
+			Tags: t.Tags, Location: t.Location, Size: t.Size, PPG: t.PPG,
+		})
+	}
+	sort.Slice(s.VMs, func(i, j int) bool { return strings.ToLower(s.VMs[i].ID) < strings.ToLower(s.VMs[j].ID) })
+	return s
+}
+
+// loadSnapshot reads and validates a --snapshot file: its version, that every
+// VM ID matches its subscription, resource group and name, and that it was
+// taken for tenant when both name one
+func loadSnapshot(path, tenant string) (*inventorySnapshot, error) {
+	data, err := readConfigFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	var s inventorySnapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("invalid snapshot %s: %w", path, err)
+	}
+	if s.Version != snapshotVersion {
+		return nil, fmt.Errorf("snapshot %s: unsupported version %d, expected %d", path, s.Version, snapshotVersion)
+	}
+	if s.CreatedAt.IsZero() {
+		return nil, fmt.Errorf("snapshot %s: createdAt is missing", path)
+	}
+	if tenant != "" && s.Tenant != "" && !strings.EqualFold(tenant, s.Tenant) {
+		return nil, fmt.Errorf("snapshot %s was taken in tenant %s, not --tenant %s", path, s.Tenant, tenant)
+	}
+	for i, vm := range s.VMs {
+		want := fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/virtualMachines/%s", vm.SubscriptionID, vm.ResourceGroup, vm.Name)
+		if vm.SubscriptionID == "" || vm.ResourceGroup == "" || vm.Name == "" || !strings.EqualFold(vm.ID, want) {
+			return nil, fmt.Errorf("snapshot %s: VM %d (%q) does not match its subscription, resource group and name", path, i+1, vm.ID)
+		}
+	}
+	slog.Info("Using snapshot", "path", path, "takenAt", s.CreatedAt.Format(time.RFC3339), "vms", len(s.VMs), "sha256", sha256Hex(data))
+	return &s, nil
+}
+
+// fresh returns an error when the snapshot is older than maxAge at now
+func (s *inventorySnapshot) fresh(maxAge time.Duration, now time.Time) error {
+	if age := now.Sub(s.CreatedAt); maxAge > 0 && age > maxAge {
+		return fmt.Errorf("snapshot taken at %s is %s old, more than --snapshot-max-age %s: export a new one",
+			s.CreatedAt.Format(time.RFC3339), age.Round(time.Minute), maxAge)
+	}
+	return nil
+}
+
+// subscriptionCount returns how many subscriptions the VMs of s are in
+func (s *inventorySnapshot) subscriptionCount() int {
+	subs := map[string]bool{}
+	for _, vm := range s.VMs {
+		subs[strings.ToLower(vm.SubscriptionID)] = true
+	}
+	return len(subs)
+}
+
+// snapshotDiscoverer discovers the VMs of a snapshot, as long as it is fresh
+type snapshotDiscoverer struct {
+	snapshot *inventorySnapshot
+	maxAge   time.Duration
+}
+
+func (d *snapshotDiscoverer) discover(ctx context.Context, out chan<- *vmTarget) error {
+	if err := d.snapshot.fresh(d.maxAge, time.Now()); err != nil {
+		return err
+	}
+	for _, vm := range d.snapshot.VMs {
+		t := &vmTarget{
+			SubscriptionID: vm.SubscriptionID, ResourceGroup: vm.ResourceGroup, Name: vm.Name, ID: vm.ID,
+			Tags: maps.Clone(vm.Tags), Location: vm.Location, Size: vm.Size, PPG: vm.PPG,
+		}
+		select {
+		case out <- t:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// sha256Hex returns the hex SHA-256 of data, so that a reviewed snapshot can be
+// recognized when it is used
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// runSnooze implements the snooze command: it postpones the scheduled stops
+// of a VM, recording the snooze with who asked for it and why in the journal
+// of the fleet that stops it, which the server reads before every stop
+func runSnooze(ctx context.Context, reporter *errorReporter, args []string) error {
+	opts := &options{}
+	flags := newFlagSet("snooze", opts)
+	duration := flags.Duration("for", 0, "how long from now the VM stays up, e.g. 2h (required)")
+	reason := flags.String("reason", "", "why the VM must stay up, recorded in the journal")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	// Flags may follow the VM, as in `snooze <vm> --for 2h`
+	vm := flags.Arg(0)
+	if flags.NArg() > 1 {
+		if err := flags.Parse(flags.Args()[1:]); err != nil {
+			return err
+		}
+		if flags.NArg() > 0 {
+			vm = ""
+		}
+	}
+	if vm == "" {
+		return fmt.Errorf("usage: snooze [flags] <vm name or resource ID> --for <duration> [--reason <text>]")
+	}
+	if *duration <= 0 {
+		return fmt.Errorf("--for must be positive")
+	}
+	if opts.journalPath == "" {
+		return fmt.Errorf("--journal is required: the journal of the fleet that stops the VM")
+	}
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	if err := setupLogging(opts); err != nil {
+		return err
+	}
+
+	a, err := newApp(opts, reporter)
+	if err != nil {
+		return err
+	}
+	defer a.close()
+	targets, err := a.quietInventory(ctx)
+	if err != nil {
+		return err
+	}
+	t, err := oneVM(targets, vm)
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		return fmt.Errorf("VM %q was not discovered: check the spelling, the discovery flags and that the identity can read it", vm)
+	}
+	hostname, _ := os.Hostname()
+	until := time.Now().Add(*duration)
+	if err := a.journal.snooze(t.ID, until, snoozeDetail(os.Getenv("USER"), "cli host="+hostname, *reason)); err != nil {
+		return err
+	}
+	slog.Info("Scheduled stops snoozed", "vm", t.Name, "resourceGroup", t.ResourceGroup, "until", until.Format(time.RFC3339))
+	return nil
+}
+
+// oneVM returns the VM of targets named vm, by name or resource ID, or nil
+// when there is none
+func oneVM(targets []*vmTarget, vm string) (*vmTarget, error) {
+	var found []*vmTarget
+	for _, t := range targets {
+		if strings.EqualFold(t.Name, vm) || strings.EqualFold(t.ID, vm) {
+			found = append(found, t)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return nil, nil
+	case 1:
+		return found[0], nil
+	}
+	return nil, fmt.Errorf("%d VMs are named %q: give the resource ID of the one to snooze", len(found), vm)
+}
+
+// snoozeDetail is the journal detail of a snooze requested by by, through via
+func snoozeDetail(by, via, reason string) string {
+	detail := fmt.Sprintf("by=%s via=%s", by, via)
+	if reason != "" {
+		detail += fmt.Sprintf(" reason=%q", reason)
+	}
+	return detail
+}
+
+// snoozes maps the lower-cased IDs of the VMs whose scheduled stops are
+// postponed to the end of their snooze
+type snoozes map[string]time.Time
+
+// readSnoozes collects the snoozes of the journal at location that are still
+// in effect at now. A later snooze of a VM replaces an earlier one.
+func readSnoozes(location string, now time.Time) (snoozes, error) {
+	s := snoozes{}
+	if location == "" {
+		return s, nil
+	}
+	err := readJournal(location, func(rec *journalRecord) {
+		if rec.Phase == journalSnooze && rec.ResourceID != "" {
+			s[strings.ToLower(rec.ResourceID)] = rec.Until
+		}
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	for id, until := range s {
+		if !until.After(now) {
+			delete(s, id)
+		}
+	}
+	return s, nil
+}
+
+// until returns when the snooze of t ends, if t is snoozed
+func (s snoozes) until(t *vmTarget) (time.Time, bool) {
+	until, ok := s[strings.ToLower(t.ID)]
+	return until, ok
+}
+
+// filter skips the snoozed VMs
+func (s snoozes) filter(t *vmTarget) (bool, string) {
+	if until, ok := s.until(t); ok {
+		return false, fmt.Sprintf("scheduled stop snoozed until %s", until.Format(time.RFC3339))
+	}
+	return true, ""
+}
+
+// snoozeGrant is what a snooze link allows: postponing the stop of a VM of a
+// fleet due at Stop, on behalf of Owner
+type snoozeGrant struct {
+	Fleet string    `json:"f,omitempty"`
+	VM    string    `json:"vm"`
+	Stop  time.Time `json:"stop"`
+	Owner string    `json:"owner"`
+}
+
+// signSnooze encodes g as a token authenticated with secret
+func signSnooze(secret []byte, g snoozeGrant) string {
+	payload, _ := json.Marshal(g)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifySnooze decodes a token made by signSnooze with secret
+func verifySnooze(secret []byte, token string) (*snoozeGrant, error) {
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, fmt.Errorf("malformed snooze link")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("malformed snooze link")
+	}
+	got, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return nil, fmt.Errorf("malformed snooze link")
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return nil, fmt.Errorf("invalid snooze link")
+	}
+	var g snoozeGrant
+	if err := json.Unmarshal(payload, &g); err != nil {
+		return nil, fmt.Errorf("malformed snooze link")
+	}
+	return &g, nil
+}
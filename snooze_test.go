@@ -0,0 +1,126 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSnoozeTokenRoundTrip(t *testing.T) {
+	secret := []byte("secret")
+	grant := snoozeGrant{
+		Fleet: "nightly",
+		VM:    "/subscriptions/sub1/resourceGroups/rg-a/providers/Microsoft.Compute/virtualMachines/web-1",
+		Stop:  time.Date(2025, 1, 6, 19, 0, 0, 0, time.UTC),
+		Owner: "alice@contoso.com",
+	}
+	token := signSnooze(secret, grant)
+	encoded, signature, _ := strings.Cut(token, ".")
+	forged := signSnooze(secret, snoozeGrant{VM: grant.VM, Stop: grant.Stop.Add(24 * time.Hour), Owner: grant.Owner})
+	forgedPayload, _, _ := strings.Cut(forged, ".")
+
+	tests := []struct {
+		name   string
+		secret []byte
+		token  string
+		ok     bool
+	}{
+		{"signed", secret, token, true},
+		{"other secret", []byte("other"), token, false},
+		{"payload swapped", secret, forgedPayload + "." + signature, false},
+		{"signature truncated", secret, encoded + "." + signature[:len(signature)-2], false},
+		{"no signature", secret, encoded, false},
+		{"not base64", secret, "!!." + signature, false},
+		{"empty", secret, "", false},
+	}
+	for _, tt := range tests {
+		got, err := verifySnooze(tt.secret, tt.token)
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("%s: verifySnooze succeeded, want an error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: verifySnooze: %v", tt.name, err)
+			continue
+		}
+		if got.Fleet != grant.Fleet || got.VM != grant.VM || !got.Stop.Equal(grant.Stop) || got.Owner != grant.Owner {
+			t.Errorf("%s: verifySnooze = %+v, want %+v", tt.name, *got, grant)
+		}
+	}
+}
+
+func TestReadSnoozesExpiry(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "journal.jsonl")
+	j, err := openJournal(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2025, 1, 6, 19, 0, 0, 0, time.UTC)
+	vm := func(name string) string {
+		return "/subscriptions/sub1/resourceGroups/rg-a/providers/Microsoft.Compute/virtualMachines/" + name
+	}
+	for _, snooze := range []struct {
+		name  string
+		until time.Time
+	}{
+		{"active", now.Add(2 * time.Hour)},
+		{"expired", now.Add(-time.Minute)},
+		{"ends-now", now},
+		{"extended", now.Add(-time.Hour)},
+		{"extended", now.Add(time.Hour)},
+		{"shortened", now.Add(time.Hour)},
+		{"shortened", now.Add(-time.Hour)},
+	} {
+		if err := j.snooze(vm(snooze.name), snooze.until, "by=test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := j.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := readSnoozes(location, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		snoozed bool
+		until   time.Time
+	}{
+		{"active", true, now.Add(2 * time.Hour)},
+		{"ACTIVE", true, now.Add(2 * time.Hour)},
+		{"expired", false, time.Time{}},
+		{"ends-now", false, time.Time{}},
+		{"extended", true, now.Add(time.Hour)},
+		{"shortened", false, time.Time{}},
+		{"never-snoozed", false, time.Time{}},
+	}
+	for _, tt := range tests {
+		target := &vmTarget{ID: vm(tt.name), Name: tt.name}
+		until, ok := s.until(target)
+		if ok != tt.snoozed || !until.Equal(tt.until) {
+			t.Errorf("%s: until = %v, %v, want %v, %v", tt.name, until, ok, tt.until, tt.snoozed)
+		}
+		if keep, _ := s.filter(target); keep == tt.snoozed {
+			t.Errorf("%s: filter keeps = %v, want %v", tt.name, keep, !tt.snoozed)
+		}
+	}
+}
+
+func TestSnoozeWithoutJournal(t *testing.T) {
+	var j *journal
+	if err := j.snooze("/subscriptions/sub1/resourceGroups/rg-a/providers/Microsoft.Compute/virtualMachines/web-1", time.Now().Add(time.Hour), "by=test"); err == nil {
+		t.Error("snooze without a journal succeeded, want an error")
+	}
+}
+
+func TestReadSnoozesWithoutJournal(t *testing.T) {
+	s, err := readSnoozes(filepath.Join(t.TempDir(), "missing.jsonl"), time.Now())
+	if err != nil || len(s) != 0 {
+		t.Errorf("readSnoozes of a missing journal = %v, %v, want none", s, err)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+// database/sql drivers of the SQL stores
+const (
+	driverSQLite   = "sqlite"
+	driverPostgres = "postgres"
+)
+
+// sqlStore keeps the journal and the server runs in a SQLite or Postgres
+// database. Each record is kept as its JSON document, next to the columns it
+// is most often queried by.
+type sqlStore struct {
+	db *sql.DB
+}
+
+// sqliteDefaultPragmas are added to SQLite DSNs that do not set them: processes
+// sharing the database wait for each other's writes rather than failing
+var sqliteDefaultPragmas = []string{"busy_timeout(10000)", "journal_mode(WAL)"}
+
+// sqliteDSN adds to dsn each of the sqliteDefaultPragmas its query does not set
+func sqliteDSN(dsn string) string {
+	path, rawQuery, _ := strings.Cut(dsn, "?")
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		// Left for the driver to report
+		return dsn
+	}
+	set := map[string]bool{}
+	for _, pragma := range query["_pragma"] {
+		name, _, _ := strings.Cut(pragma, "(")
+		set[strings.ToLower(strings.TrimSpace(name))] = true
+	}
+	for _, pragma := range sqliteDefaultPragmas {
+		name, _, _ := strings.Cut(pragma, "(")
+		if set[name] {
+			continue
+		}
+		if rawQuery != "" {
+			rawQuery += "&"
+		}
+		rawQuery += "_pragma=" + url.QueryEscape(pragma)
+	}
+	if rawQuery == "" {
+		return path
+	}
+	return path + "?" + rawQuery
+}
+
+func openSQLStore(driver, dsn string) (*sqlStore, error) {
+	id := "BIGSERIAL PRIMARY KEY"
+	if driver == driverSQLite {
+		dsn = sqliteDSN(dsn)
+		id = "INTEGER PRIMARY KEY AUTOINCREMENT"
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open journal: %w", err)
+	}
+	if driver == driverSQLite {
+		db.SetMaxOpenConns(1)
+	}
+	for _, stmt := range []string{
+		`CREATE TABLE IF NOT EXISTS journal (
+			id ` + id + `,
+			time TEXT NOT NULL,
+			phase TEXT NOT NULL,
+			resource_id TEXT NOT NULL,
+			run_id TEXT NOT NULL,
+			record TEXT NOT NULL)`,
+		`CREATE TABLE IF NOT EXISTS runs (
+			id TEXT PRIMARY KEY,
+			owner TEXT NOT NULL,
+			created BIGINT NOT NULL,
+			status TEXT NOT NULL)`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to open journal: %w", err)
+		}
+	}
+	return &sqlStore{db: db}, nil
+}
+
+func (s *sqlStore) append(recs []journalRecord) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, rec := range recs {
+		doc, err := json.Marshal(rec)
+		if err != nil {
+			continue
+		}
+		_, err = tx.Exec(`INSERT INTO journal (time, phase, resource_id, run_id, record) VALUES ($1, $2, $3, $4, $5)`,
+			rec.Time.Format(time.RFC3339Nano), rec.Phase, rec.ResourceID, rec.RunID, string(doc))
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) read(fn func(rec *journalRecord)) error {
+	rows, err := s.db.Query(`SELECT id, record FROM journal ORDER BY id`)
+	if err != nil {
+		return fmt.Errorf("failed to read journal: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var doc string
+		if err := rows.Scan(&id, &doc); err != nil {
+			return fmt.Errorf("failed to read journal: %w", err)
+		}
+		var rec journalRecord
+		if err := json.Unmarshal([]byte(doc), &rec); err != nil {
+			return fmt.Errorf("journal record %d: %w", id, err)
+		}
+		fn(&rec)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read journal: %w", err)
+	}
+	return nil
+}
+
+func (s *sqlStore) saveRun(owner string, status runStatus) error {
+	doc, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO runs (id, owner, created, status) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (id) DO UPDATE SET status = excluded.status`,
+		status.RunID, owner, status.CreatedAt.UnixNano(), string(doc))
+	return err
+}
+
+func (s *sqlStore) loadRun(runID string) (string, *runStatus, error) {
+	var owner, doc string
+	err := s.db.QueryRow(`SELECT owner, status FROM runs WHERE id = $1`, runID).Scan(&owner, &doc)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	var status runStatus
+	if err := json.Unmarshal([]byte(doc), &status); err != nil {
+		return "", nil, fmt.Errorf("run %s: %w", runID, err)
+	}
+	return owner, &status, nil
+}
+
+func (s *sqlStore) listRuns(owner string, limit int) ([]runStatus, error) {
+	rows, err := s.db.Query(`SELECT status FROM runs WHERE owner = $1 ORDER BY created DESC LIMIT $2`, owner, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var runs []runStatus
+	for rows.Next() {
+		var doc string
+		if err := rows.Scan(&doc); err != nil {
+			return nil, err
+		}
+		var status runStatus
+		if err := json.Unmarshal([]byte(doc), &status); err != nil {
+			return nil, err
+		}
+		status.Results = nil
+		runs = append(runs, status)
+	}
+	return runs, rows.Err()
+}
+
+func (s *sqlStore) close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestSQLiteDSN(t *testing.T) {
+	tests := []struct {
+		dsn  string
+		want string
+	}{
+		{"state.db", "state.db?_pragma=busy_timeout%2810000%29&_pragma=journal_mode%28WAL%29"},
+		{"state.db?mode=rwc", "state.db?mode=rwc&_pragma=busy_timeout%2810000%29&_pragma=journal_mode%28WAL%29"},
+		{"state.db?_pragma=busy_timeout(500)", "state.db?_pragma=busy_timeout(500)&_pragma=journal_mode%28WAL%29"},
+		{"state.db?_pragma=JOURNAL_MODE(DELETE)&_pragma=busy_timeout%281%29", "state.db?_pragma=JOURNAL_MODE(DELETE)&_pragma=busy_timeout%281%29"},
+		{"file:/var/lib/state.db?_pragma=foreign_keys(1)", "file:/var/lib/state.db?_pragma=foreign_keys(1)&_pragma=busy_timeout%2810000%29&_pragma=journal_mode%28WAL%29"},
+	}
+	for _, tt := range tests {
+		if got := sqliteDSN(tt.dsn); got != tt.want {
+			t.Errorf("sqliteDSN(%q) = %q, want %q", tt.dsn, got, tt.want)
+		}
+	}
+}
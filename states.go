@@ -0,0 +1,57 @@
+package main
+
+import "time"
+
+// VM states within a run. A target moves from discovered through filtered,
+// queued, requested and accepted; running, completed, failed, skipped and
+// planned end it.
+const (
+	vmStateDiscovered = "discovered"
+	vmStateFiltered   = "filtered" // passed every filter
+	vmStateQueued     = "queued"   // waiting for a worker or its batch
+	vmStateRequested  = "requested"
+	vmStateAccepted   = "accepted"
+	vmStateRunning    = "running"   // confirmed running, by --wait or --vm-deadline
+	vmStateCompleted  = "completed" // the operation of an action other than start succeeded, with --wait
+	vmStateFailed     = "failed"
+	vmStateSkipped    = "skipped"
+	vmStatePlanned    = "planned" // a dry run would have sent the action
+)
+
+// stateTransition is a state a target entered, and when
+type stateTransition struct {
+	State string    `json:"state"`
+	At    time.Time `json:"at"`
+}
+
+// transition records that t entered state. Only the stage currently holding
+// t calls it, so no locking is needed.
+func (t *vmTarget) transition(state string) {
+	t.History = append(t.History, stateTransition{State: state, At: time.Now().UTC()})
+}
+
+// state returns the state t is in, or "" before discovery
+func (t *vmTarget) state() string {
+	if len(t.History) == 0 {
+		return ""
+	}
+	return t.History[len(t.History)-1].State
+}
+
+// finalState returns the state res ends its target in, or "" when the target
+// is already in it: accepted and running results end where execution left them
+func (res *vmResult) finalState() string {
+	state := ""
+	switch res.outcome() {
+	case outcomeSkipped:
+		state = vmStateSkipped
+	case outcomeFailed, outcomeAccessLost:
+		state = vmStateFailed
+	case outcomePlanned:
+		state = vmStatePlanned
+	}
+	if state == res.Target.state() {
+		return ""
+	}
+	return state
+}
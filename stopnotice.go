@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// noticeSchedule notifies the owners of the VMs of the scheduled fleet fa
+// --stop-notice before each of its stops
+func (s *server) noticeSchedule(fa *app, schedule *fleetSchedule) {
+	notice := fa.opts.stopNotice
+	next := func(now time.Time) time.Time {
+		return schedule.next(now.Add(notice)).Add(-notice)
+	}
+	runSchedule(context.Background(), "stop notice of fleet "+fa.fleet, fa.opts.catchUp, next, func(now time.Time) {
+		s.noticeStop(fa, schedule.next(now), nil)
+	})
+}
+
+// noticeStop tells the owners of the VMs that the fleet fa will power down at
+// stop, or of the VMs of ids only when set, with a link per VM to snooze the
+// stop. The VMs are those a dry run selects now; VMs already snoozed past stop
+// are left out.
+func (s *server) noticeStop(fa *app, stop time.Time, ids map[string]bool) {
+	ctx := withTenant(context.Background(), fa.opts.tenant)
+	runID := uuid.NewString()
+	snoozed, err := readSnoozes(fa.opts.journalPath, stop)
+	if err != nil {
+		slog.Error("Stop notice failed", fleetAttr(fa), "error", err)
+		return
+	}
+	filters := []vmFilter{snoozed.filter}
+	if ids != nil {
+		filters = append(filters, func(t *vmTarget) (bool, string) {
+			return ids[strings.ToLower(t.ID)], "not among the VMs whose snooze is over"
+		})
+	}
+	// The notice previews the stop with a dry run, which must leave the
+	// fleet's --report-csv and --compare-last alone
+	opts := *fa.opts
+	opts.dryRun, opts.reportCSV, opts.compareLast = true, "", false
+	preview := *fa
+	preview.opts = &opts
+	p, err := preview.newPipeline(ctx, runID, nil, filters...)
+	if err != nil {
+		slog.Error("Stop notice failed", fleetAttr(fa), "error", err)
+		return
+	}
+	summary, err := p.run(ctx)
+	if err != nil {
+		slog.Error("Stop notice failed", fleetAttr(fa), "error", err)
+		return
+	}
+
+	byOwner := map[string][]*vmTarget{}
+	unowned := 0
+	for _, res := range summary.Plan {
+		value, _ := lookupTag(res.Target.Tags, fa.opts.ownerTag)
+		owners := parseOwners(value)
+		if fa.opts.resolveOwners {
+			owners = s.owners.resolve(ctx, owners)
+		}
+		if len(owners) == 0 {
+			unowned++
+		}
+		for _, owner := range owners {
+			byOwner[owner] = append(byOwner[owner], res.Target)
+		}
+	}
+	owners := make([]string, 0, len(byOwner))
+	for owner := range byOwner {
+		owners = append(owners, owner)
+	}
+	sort.Strings(owners)
+
+	m := fa.messages
+	base := strings.TrimSuffix(s.app.opts.publicURL, "/")
+	notified := 0
+	for _, owner := range owners {
+		vms := byOwner[owner]
+		subject := m.format("notice.subject", fa.opts.action, len(vms), stop.UTC().Format("2006-01-02 15:04"))
+		var text strings.Builder
+		for _, t := range vms {
+			token := signSnooze(s.secret, snoozeGrant{Fleet: fa.fleet, VM: t.ID, Stop: stop, Owner: owner})
+			text.WriteString(m.format("notice.vm", t.Name, t.ResourceGroup, t.SubscriptionID) + "\n")
+			text.WriteString("    " + m.format("notice.snooze", fa.opts.snoozeExtension, base+"/v1/snooze/"+token) + "\n")
+		}
+		if err := s.owners.send(ctx, owner, subject, text.String()); err != nil {
+			slog.Warn("Stop notice not delivered", fleetAttr(fa), "owner", ownerAttr(owner), "error", err)
+			continue
+		}
+		notified++
+	}
+	fa.journal.audit("stop-notice", fmt.Sprintf("fleet=%s stop=%s vms=%d owners=%d notified=%d unowned=%d",
+		fa.fleet, stop.Format(time.RFC3339), len(summary.Plan), len(owners), notified, unowned))
+	slog.Info("Stop notice sent", fleetAttr(fa), "stop", stop.Format(time.RFC3339), "vms", len(summary.Plan),
+		"owners", notified, "unowned", unowned)
+}
+
+// ownerAttr is owner as logged: webhook URLs are secrets
+func ownerAttr(owner string) string {
+	if strings.HasPrefix(owner, "https://") {
+		return scrubURL(owner)
+	}
+	return owner
+}
+
+// deferSnoozed schedules, for the VMs the scheduled stop run skipped as
+// snoozed, a stop at the end of their snooze, preceded by a notice. The timers
+// live in memory only: a restart forgets them, and the VMs then stay up until
+// the fleet's next scheduled stop.
+func (s *server) deferSnoozed(run *apiRun, snoozed snoozes) {
+	byUntil := map[time.Time]map[string]bool{}
+	for _, rec := range run.collected.records() {
+		if rec.SkipCategory != skipSnoozed {
+			continue
+		}
+		id := strings.ToLower(rec.ID)
+		until, ok := snoozed[id]
+		if !ok {
+			continue
+		}
+		if byUntil[until] == nil {
+			byUntil[until] = map[string]bool{}
+		}
+		byUntil[until][id] = true
+	}
+	fa := run.app
+	for until, ids := range byUntil {
+		until, ids := until, ids
+		if notice := fa.opts.stopNotice; notice > 0 && s.owners != nil {
+			time.AfterFunc(time.Until(until.Add(-notice)), func() { s.noticeStop(fa, until, ids) })
+		}
+		time.AfterFunc(time.Until(until), func() { s.startScheduled(fa, ids) })
+		slog.Info("Snoozed stop deferred", fleetAttr(fa), "vms", len(ids), "until", until.Format(time.RFC3339))
+	}
+}
+
+// snoozeRequest is the body of a snooze request
+type snoozeRequest struct {
+	VM     string `json:"vm"` // name or resource ID
+	Fleet  string `json:"fleet,omitempty"`
+	For    string `json:"for"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// snoozeStatus is the snooze recorded for a request
+type snoozeStatus struct {
+	VM     string    `json:"vm"`
+	Fleet  string    `json:"fleet,omitempty"`
+	Until  time.Time `json:"until"`
+	By     string    `json:"by"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// handleSnooze postpones the scheduled stops of a VM of a fleet, like the
+// snooze command. Keeping a VM up is like starting it: the caller needs a
+// start grant covering it.
+func (s *server) handleSnooze(w http.ResponseWriter, r *http.Request) {
+	caller := s.authenticate(w, r)
+	if caller == nil {
+		return
+	}
+	if !caller.mayPerform(actionStart) {
+		writeJSON(w, http.StatusForbidden, apiError{Error: "not allowed to start VMs, nor to keep them up"})
+		return
+	}
+	var body snoozeRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: fmt.Sprintf("invalid snooze request: %v", err)})
+		return
+	}
+	d, err := time.ParseDuration(body.For)
+	if err != nil || d <= 0 {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: fmt.Sprintf("invalid \"for\" %q: expected a positive duration such as 2h", body.For)})
+		return
+	}
+	fa := s.fleetApp(body.Fleet)
+	if fa == nil {
+		writeJSON(w, http.StatusNotFound, apiError{Error: fmt.Sprintf("unknown fleet %q", body.Fleet)})
+		return
+	}
+	if s.schedules[body.Fleet] == nil || !fa.opts.action.powersDown() || fa.opts.journalPath == "" {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: fmt.Sprintf("fleet %q does not stop VMs on a schedule with a --journal", body.Fleet)})
+		return
+	}
+	targets, err := fa.inventory(r.Context())
+	if err != nil {
+		writeJSON(w, http.StatusBadGateway, apiError{Error: err.Error()})
+		return
+	}
+	var visible []*vmTarget
+	for _, t := range targets {
+		if caller.canSee(t) {
+			visible = append(visible, t)
+		}
+	}
+	t, err := oneVM(visible, body.VM)
+	if err != nil {
+		writeJSON(w, http.StatusConflict, apiError{Error: err.Error()})
+		return
+	}
+	if t == nil {
+		writeJSON(w, http.StatusNotFound, apiError{Error: fmt.Sprintf("unknown VM %q", body.VM)})
+		return
+	}
+	if !caller.allows(actionStart, t) {
+		writeJSON(w, http.StatusForbidden, apiError{Error: fmt.Sprintf("not allowed to keep %s up", t.Name)})
+		return
+	}
+	by := caller.Name
+	if by == "" {
+		by = caller.ID
+	}
+	until := time.Now().Add(d).UTC()
+	if err := fa.journal.snooze(t.ID, until, snoozeDetail(by, "api principal="+caller.ID, body.Reason)); err != nil {
+		slog.Error("Snooze not recorded", fleetAttr(fa), "vm", t.Name, "error", err)
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: err.Error()})
+		return
+	}
+	slog.Info("Scheduled stops snoozed", fleetAttr(fa), "vm", t.Name, "until", until.Format(time.RFC3339), "caller", by, "callerId", caller.ID)
+	writeJSON(w, http.StatusOK, snoozeStatus{VM: t.ID, Fleet: fa.fleet, Until: until, By: by, Reason: body.Reason})
+}
+
+var snoozePage = template.Must(template.New("snooze").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>VMStarter</title></head>
+<body style="font-family: sans-serif; max-width: 40em; margin: 3em auto">
+<p>{{.Message}}</p>
+{{if .Confirm}}<form method="post"><button type="submit">Keep it running until {{.Until}} UTC</button></form>{{end}}
+</body></html>
+`))
+
+// handleSnoozeLink serves the links of stop notices. GET asks to confirm, so
+// that mail scanners following links do not snooze; POST records the snooze.
+// The signed token is the credential: it names the VM, the stop and the owner
+// it was sent to.
+func (s *server) handleSnoozeLink(w http.ResponseWriter, r *http.Request) {
+	if ok, wait := s.limiter.allow("ip:" + remoteHost(r)); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		writeSnoozePage(w, http.StatusTooManyRequests, "Too many requests, try again in a minute.", false, "")
+		return
+	}
+	if s.secret == nil {
+		writeSnoozePage(w, http.StatusNotFound, "No fleet sends stop notices.", false, "")
+		return
+	}
+	g, err := verifySnooze(s.secret, r.PathValue("token"))
+	if err != nil {
+		writeSnoozePage(w, http.StatusBadRequest, "This link is "+strings.TrimSuffix(err.Error(), " snooze link")+".", false, "")
+		return
+	}
+	fa := s.fleetApp(g.Fleet)
+	if fa == nil || fa.opts.stopNotice == 0 {
+		writeSnoozePage(w, http.StatusNotFound, fmt.Sprintf("Fleet %q no longer sends stop notices.", g.Fleet), false, "")
+		return
+	}
+	name := g.VM[strings.LastIndex(g.VM, "/")+1:]
+	until := g.Stop.Add(fa.opts.snoozeExtension)
+	if !time.Now().Before(g.Stop) {
+		writeSnoozePage(w, http.StatusGone, fmt.Sprintf("The stop of %s at %s UTC is over; this link cannot snooze it anymore.",
+			name, g.Stop.UTC().Format("2006-01-02 15:04")), false, "")
+		return
+	}
+	untilText := until.UTC().Format("2006-01-02 15:04")
+	if r.Method == http.MethodGet {
+		writeSnoozePage(w, http.StatusOK, fmt.Sprintf("%s is scheduled to %s at %s UTC.", name, fa.opts.action,
+			g.Stop.UTC().Format("2006-01-02 15:04")), true, untilText)
+		return
+	}
+	if err := fa.journal.snooze(g.VM, until, fmt.Sprintf("by=%s via=link stop=%s", ownerAttr(g.Owner), g.Stop.Format(time.RFC3339))); err != nil {
+		slog.Error("Snooze not recorded", fleetAttr(fa), "vm", name, "error", err)
+		writeSnoozePage(w, http.StatusInternalServerError, fmt.Sprintf("The snooze of %s could not be recorded and %s will be stopped as scheduled. Try again in a moment.", name, name), true, untilText)
+		return
+	}
+	slog.Info("Stop snoozed", fleetAttr(fa), "vm", name, "until", until.Format(time.RFC3339), "by", ownerAttr(g.Owner))
+	writeSnoozePage(w, http.StatusOK, fmt.Sprintf("%s keeps running until %s UTC.", name, untilText), false, "")
+}
+
+func writeSnoozePage(w http.ResponseWriter, status int, message string, confirm bool, until string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	_ = snoozePage.Execute(w, struct {
+		Message string
+		Confirm bool
+		Until   string
+	}{message, confirm, until})
+}
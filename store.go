@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// journalStore persists journal records. The --journal location picks the
+// implementation: a JSON lines file, SQLite, Postgres or an Azure table.
+type journalStore interface {
+	// append durably writes recs, in order
+	append(recs []journalRecord) error
+	// read calls fn with every record, in the order they were appended
+	read(fn func(rec *journalRecord)) error
+	close() error
+}
+
+// runStore is implemented by the stores that also keep the status of the
+// runs submitted to the server, so that every replica sharing the store can
+// answer for the runs of the others
+type runStore interface {
+	// saveRun records the status of a run, with its results, submitted by owner
+	saveRun(owner string, status runStatus) error
+	// loadRun returns the status of a run with its results, or a nil status when it is unknown
+	loadRun(runID string) (owner string, status *runStatus, err error)
+	// listRuns returns the runs of owner without their results, newest first, at most limit of them
+	listRuns(owner string, limit int) ([]runStatus, error)
+}
+
+// openStore opens the journal at location: "postgres://..." and
+// "postgresql://..." name a Postgres database, "azuretable://<account>/<table>"
+// an Azure Storage table and "sqlite:<path>" a SQLite database, as does a path
+// ending in .db, .sqlite or .sqlite3. Any other path is a JSON lines file.
+// Unless create is set, a journal that does not exist yet is an error.
+func openStore(location string, create bool) (journalStore, error) {
+	switch {
+	case strings.HasPrefix(location, "postgres://"), strings.HasPrefix(location, "postgresql://"):
+		return openSQLStore(driverPostgres, location)
+	case strings.HasPrefix(location, "azuretable://"):
+		return openTableStore(location)
+	}
+	if path := sqlitePath(location); path != "" {
+		if !create {
+			if _, err := os.Stat(path); err != nil {
+				return nil, fmt.Errorf("failed to open journal: %w", err)
+			}
+		}
+		return openSQLStore(driverSQLite, path)
+	}
+	return openFileStore(location, create)
+}
+
+// sqlitePath returns the path of the SQLite database at location, or "" when
+// location is not one
+func sqlitePath(location string) string {
+	if path, ok := strings.CutPrefix(location, "sqlite:"); ok {
+		return strings.TrimPrefix(path, "//")
+	}
+	switch strings.ToLower(filepath.Ext(location)) {
+	case ".db", ".sqlite", ".sqlite3":
+		return location
+	}
+	return ""
+}
+
+// fileStore keeps the journal as a JSON lines file, fsync'ed after every append
+type fileStore struct {
+	path string
+	f    *os.File // nil when opened for reading only
+}
+
+func openFileStore(path string, create bool) (*fileStore, error) {
+	if !create {
+		if _, err := os.Stat(path); err != nil {
+			return nil, fmt.Errorf("failed to open journal: %w", err)
+		}
+		return &fileStore{path: path}, nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open journal: %w", err)
+	}
+	return &fileStore{path: path, f: f}, nil
+}
+
+func (s *fileStore) append(recs []journalRecord) error {
+	var lines []byte
+	for _, rec := range recs {
+		line, err := json.Marshal(rec)
+		if err != nil {
+			continue
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+	if _, err := s.f.Write(lines); err != nil {
+		return err
+	}
+	return s.f.Sync()
+}
+
+func (s *fileStore) read(fn func(rec *journalRecord)) error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to open journal: %w", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var rec journalRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return fmt.Errorf("journal line %d: %w", line, err)
+		}
+		fn(&rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read journal: %w", err)
+	}
+	return nil
+}
+
+func (s *fileStore) close() error {
+	if s.f == nil {
+		return nil
+	}
+	return s.f.Close()
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// subscriptionScope limits discovery to some of the subscriptions the identity
+// can see. Entries are subscription IDs or display names, compared case-insensitively;
+// exclusions win over inclusions.
+type subscriptionScope struct {
+	include []string
+	exclude []string
+}
+
+// empty reports whether the scope covers every visible subscription
+func (s *subscriptionScope) empty() bool {
+	return s == nil || (len(s.include) == 0 && len(s.exclude) == 0)
+}
+
+// apply returns the subscriptions of subs within the scope, without modifying
+// subs. An included entry matching no visible subscription is an error, so that
+// a typo cannot silently shrink the run to nothing.
+func (s *subscriptionScope) apply(subs *SubscriptionListResponse) (*SubscriptionListResponse, error) {
+	if s.empty() {
+		return subs, nil
+	}
+	matches := func(sub *subscriptionEntry, entry string) bool {
+		return strings.EqualFold(sub.SubscriptionID, entry) || strings.EqualFold(sub.DisplayName, entry)
+	}
+	for _, list := range []struct {
+		flag    string
+		entries []string
+	}{{"--subscription", s.include}, {"--exclude-subscription", s.exclude}} {
+		for _, entry := range list.entries {
+			found := false
+			for i := range subs.Value {
+				found = found || matches(&subs.Value[i], entry)
+			}
+			if found {
+				continue
+			}
+			if list.flag == "--subscription" {
+				return nil, fmt.Errorf("%s %q matches no subscription visible to the identity", list.flag, entry)
+			}
+			slog.Warn("Entry matches no subscription visible to the identity", "flag", list.flag, "entry", entry)
+		}
+	}
+
+	scoped := &SubscriptionListResponse{}
+	for _, sub := range subs.Value {
+		included := len(s.include) == 0
+		for _, entry := range s.include {
+			included = included || matches(&sub, entry)
+		}
+		for _, entry := range s.exclude {
+			included = included && !matches(&sub, entry)
+		}
+		if included {
+			scoped.Value = append(scoped.Value, sub)
+		}
+	}
+	return scoped, nil
+}
+
+// subscriptionScope returns the scope set by --subscription and --exclude-subscription
+func (opts *options) subscriptionScope() *subscriptionScope {
+	return &subscriptionScope{include: opts.subscriptions, exclude: opts.excludeSubscriptions}
+}
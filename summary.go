@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// Exit codes of a run, so that CI pipelines can tell what happened
+const (
+	exitSuccess        = 0 // every VM was acted on or skipped
+	exitFailure        = 1 // the run could not run, or every VM it attempted failed
+	exitUsage          = 2 // invalid flags
+	exitRunTimeout     = 3 // --run-timeout was exceeded; the summary is partial
+	exitPartialFailure = 4 // some VMs failed while others were acted on
+)
+
+// exitCode returns the exit code the results of a run call for
+func (s *runSummary) exitCode() int {
+	switch {
+	case s.Failed == 0:
+		return exitSuccess
+	case s.Accepted+s.Planned > 0:
+		return exitPartialFailure
+	}
+	return exitFailure
+}
+
+// resultLabel names the outcome of res in the result table
+func resultLabel(res *vmResult) string {
+	switch {
+	case res.outcome() == outcomeAccepted && res.Degraded != "":
+		return "degraded"
+	case res.outcome() == outcomeAccessLost:
+		return outcomeFailed
+	}
+	return res.outcome()
+}
+
+// resultDetail is the reason, error or remark of res in the result table
+func resultDetail(res *vmResult) string {
+	switch {
+	case res.SkipReason != "":
+		return res.SkipCategory + ": " + res.SkipReason
+	case res.Err != nil:
+		return res.Err.Error()
+	case res.Degraded != "":
+		return res.Degraded
+	}
+	return ""
+}
+
+// resultOrder sorts failures first, then accepted, planned and skipped results
+var resultOrder = map[string]int{outcomeFailed: 0, "degraded": 1, outcomeAccepted: 2, outcomePlanned: 3, outcomeSkipped: 4}
+
+// printResultTable prints one row per VM of the run: what was done to it, how
+// often it was throttled and why it failed or was skipped. VMs that the filters
+// excluded are only counted, since they can make up most of a tenant.
+func printResultTable(results []*vmResult) {
+	rows, filtered := resultRows(results)
+	if len(rows) == 0 && filtered == 0 {
+		return
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "RESULT\tACTION\tSUBSCRIPTION\tRESOURCE GROUP\tVM\tTHROTTLED\tDETAIL")
+	for _, res := range rows {
+		t := res.Target
+		throttled := ""
+		if res.Throttled > 0 {
+			throttled = fmt.Sprintf("%dx", res.Throttled)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			resultLabel(res), orDash(string(res.Action)), t.SubscriptionID, t.ResourceGroup, t.Name, throttled, resultDetail(res))
+	}
+	tw.Flush()
+	if filtered > 0 {
+		fmt.Printf("… and %d VM(s) excluded by filters\n", filtered)
+	}
+}
+
+// resultRows returns the results shown in result tables, in resultOrder and
+// by ID, and the number of filtered ones left out
+func resultRows(results []*vmResult) ([]*vmResult, int) {
+	var rows []*vmResult
+	filtered := 0
+	for _, res := range results {
+		if res.SkipCategory == skipFiltered {
+			filtered++
+			continue
+		}
+		rows = append(rows, res)
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		a, b := resultOrder[resultLabel(rows[i])], resultOrder[resultLabel(rows[j])]
+		if a != b {
+			return a < b
+		}
+		return strings.ToLower(rows[i].Target.ID) < strings.ToLower(rows[j].Target.ID)
+	})
+	return rows, filtered
+}
+
+// orDash returns s, or "-" when it is empty
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestRunSummaryExitCode(t *testing.T) {
+	tests := []struct {
+		name    string
+		summary runSummary
+		want    int
+	}{
+		{"nothing to do", runSummary{}, exitSuccess},
+		{"all accepted", runSummary{Accepted: 3}, exitSuccess},
+		{"only skipped", runSummary{Skipped: 2}, exitSuccess},
+		{"dry run", runSummary{Planned: 2}, exitSuccess},
+		{"some failed", runSummary{Accepted: 2, Failed: 1}, exitPartialFailure},
+		{"failed during a dry run", runSummary{Planned: 1, Failed: 1}, exitPartialFailure},
+		{"all failed", runSummary{Failed: 3}, exitFailure},
+		{"failed and skipped", runSummary{Failed: 1, Skipped: 4}, exitFailure},
+	}
+	for _, tt := range tests {
+		if got := tt.summary.exitCode(); got != tt.want {
+			t.Errorf("%s: exitCode() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
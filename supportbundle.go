@@ -0,0 +1,406 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Limits of what a support bundle includes
+const (
+	bundleJournalRecords = 500
+	bundleLogBytes       = 1 << 20
+	bundleDoctorTimeout  = 2 * time.Minute
+)
+
+// scrubbed replaces secrets in support bundles
+const scrubbed = "***"
+
+// bundleEnvPrefixes select the environment variables a support bundle
+// describes; the rest of the environment is none of VMStarter's business
+var bundleEnvPrefixes = []string{
+	"AZURE_", "VMSTARTER_", "SENTRY_", "SLACK_", "GRAFANA_", "JIRA_", "SERVICENOW_", "SMTP_", "SOPS_",
+	"IDENTITY_ENDPOINT", "MSI_ENDPOINT", "HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY", "GITHUB_ACTIONS", "TF_BUILD",
+}
+
+// bundleURLFlags hold URLs whose path or query may embed a secret
+var bundleURLFlags = map[string]bool{"webhook-url": true, "heartbeat-url": true, "opa-url": true, "grafana-url": true, "jira-url": true}
+
+// Patterns of secrets in free text: tokens, credentials in URLs and secret-named values
+var (
+	jwtPattern         = regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)
+	authPattern        = regexp.MustCompile(`(?i)\b(bearer|basic)\s+[A-Za-z0-9._~+/=-]+`)
+	urlUserPattern     = regexp.MustCompile(`(?i)\b([a-z][a-z0-9+.-]*://)[^/\s@]+@`)
+	queryPattern       = regexp.MustCompile(`(?i)([?&](?:sig|code|token|key|secret|password|api[-_]?key|access_token)=)[^&\s"']+`)
+	secretValuePattern = regexp.MustCompile(`(?i)\b([\w.-]*(?:secret|password|token|apikey|api_key)[\w.-]*)=("[^"]*"|[^\s,]+)`)
+)
+
+// runSupportBundle implements the support-bundle command: it collects what is
+// needed to diagnose a problem into a zip file that can be attached to an issue,
+// with secrets scrubbed from everything it includes
+func runSupportBundle(ctx context.Context, reporter *errorReporter, args []string) error {
+	opts := &options{}
+	fs := newFlagSet("support-bundle", opts)
+	out := fs.String("out", "", "zip file to write (default: vmstarter-support-<UTC time>.zip)")
+	var logs stringList
+	fs.Var(&logs, "logs", "log file of earlier runs to include the end of, besides --log-file (repeatable)")
+	doctor := fs.Bool("doctor", true, "run the doctor checks and include their results")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+	// Invalid flags are what bundles are for, so they are reported in it instead of failing
+	validation := checkConfig(opts)
+	// Not into --log-file: the bundle reads it
+	file := opts.logFile
+	opts.logFile = ""
+	if err := setupLogging(opts); err != nil {
+		return err
+	}
+
+	path := *out
+	if path == "" {
+		path = "vmstarter-support-" + time.Now().UTC().Format("20060102T150405Z") + ".zip"
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create support bundle: %w", err)
+	}
+	b := &supportBundle{zw: zip.NewWriter(f)}
+
+	b.add("version.txt", []byte(versionInfo()))
+	b.add("args.txt", []byte(bundleArgs(fs)))
+	var report bytes.Buffer
+	validation.print(&report)
+	if len(validation.errors) == 0 {
+		fmt.Fprintf(&report, "[INF]: Configuration is valid (%d warning(s))\n", len(validation.warnings))
+	}
+	b.add("config/validation.txt", report.Bytes())
+	b.addConfigFiles(opts)
+	b.add("environment.txt", []byte(bundleEnvironment()))
+	if opts.journalPath != "" {
+		b.addJournal(opts.journalPath)
+	}
+	if file != "" {
+		logs = append(logs, file)
+	}
+	for _, logPath := range logs {
+		b.addLog(logPath)
+	}
+	if *doctor {
+		ctx, cancel := context.WithTimeout(ctx, bundleDoctorTimeout)
+		var checks bytes.Buffer
+		(&diagnosis{out: &checks}).run(ctx, "", opts.operatorID)
+		cancel()
+		b.add("doctor.txt", []byte(scrubText(checks.String())))
+	}
+	if len(b.problems) > 0 {
+		b.add("errors.txt", []byte(strings.Join(b.problems, "\n")+"\n"))
+	}
+
+	if err := b.zw.Close(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write support bundle: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write support bundle: %w", err)
+	}
+	slog.Info("Wrote support bundle; review it before attaching it to an issue", "path", path, "files", b.files)
+	return nil
+}
+
+// supportBundle is a zip file being written. Parts that cannot be collected
+// are listed in errors.txt rather than failing the whole bundle.
+type supportBundle struct {
+	zw       *zip.Writer
+	files    int
+	problems []string
+}
+
+// add writes the file name with content to the bundle
+func (b *supportBundle) add(name string, content []byte) {
+	w, err := b.zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+	if err == nil {
+		_, err = w.Write(content)
+	}
+	if err != nil {
+		b.failf("%s: %v", name, err)
+		return
+	}
+	b.files++
+}
+
+func (b *supportBundle) failf(format string, args ...interface{}) {
+	b.problems = append(b.problems, fmt.Sprintf(format, args...))
+}
+
+// addConfigFiles adds the JSON configuration files named by opts, decrypted
+// and with the values of secret-named keys scrubbed
+func (b *supportBundle) addConfigFiles(opts *options) {
+	files := []struct{ flag, path string }{
+		{"plan", opts.planPath},
+		{"hooks", opts.hooksPath},
+		{"oob-starters", opts.oobStartersPath},
+		{"messages", opts.messagesPath},
+		{"guardrails", opts.guardrailsPath},
+		{"fleets", opts.fleetsPath},
+		{"api-roles", opts.apiRolesPath},
+		{"api-keys", opts.apiKeysPath},
+	}
+	for _, file := range files {
+		if file.path == "" {
+			continue
+		}
+		data, err := readConfigFile(file.path)
+		if err != nil {
+			b.failf("--%s: %v", file.flag, err)
+			continue
+		}
+		var doc interface{}
+		if err := json.Unmarshal(data, &doc); err != nil {
+			// Not included: what cannot be parsed cannot be scrubbed
+			b.failf("--%s: not included: %v", file.flag, err)
+			continue
+		}
+		out, err := json.MarshalIndent(scrubJSON("", doc), "", "  ")
+		if err != nil {
+			b.failf("--%s: %v", file.flag, err)
+			continue
+		}
+		b.add("config/"+file.flag+".json", append(out, '\n'))
+	}
+}
+
+// addJournal adds the most recent records of the journal at path and the
+// decisions of the last run recorded in it
+func (b *supportBundle) addJournal(path string) {
+	var recent []journalRecord
+	err := readJournal(path, func(rec *journalRecord) {
+		rec.Detail, rec.Error = scrubText(rec.Detail), scrubText(rec.Error)
+		recent = append(recent, *rec)
+		if len(recent) > bundleJournalRecords {
+			recent = recent[1:]
+		}
+	})
+	if err != nil {
+		b.failf("--journal: %v", err)
+	}
+	var tail bytes.Buffer
+	enc := json.NewEncoder(&tail)
+	for _, rec := range recent {
+		enc.Encode(rec)
+	}
+	b.add("journal-tail.jsonl", tail.Bytes())
+
+	runID, at, decisions, err := lastDecisions(path)
+	if err != nil || runID == "" {
+		return
+	}
+	type decision struct {
+		ResourceID string `json:"resourceId"`
+		Decision   string `json:"decision"`
+	}
+	lastRun := struct {
+		RunID     string     `json:"runId"`
+		At        time.Time  `json:"at"`
+		Decisions []decision `json:"decisions"`
+	}{RunID: runID, At: at}
+	for _, rec := range decisions {
+		lastRun.Decisions = append(lastRun.Decisions, decision{rec.ResourceID, decisionText(vmAction(rec.Action), scrubText(rec.Detail))})
+	}
+	sort.Slice(lastRun.Decisions, func(i, j int) bool { return lastRun.Decisions[i].ResourceID < lastRun.Decisions[j].ResourceID })
+	out, err := json.MarshalIndent(lastRun, "", "  ")
+	if err != nil {
+		b.failf("last run: %v", err)
+		return
+	}
+	b.add("last-run.json", append(out, '\n'))
+}
+
+// addLog adds the last bundleLogBytes of the log file at path, from the first
+// complete line on
+func (b *supportBundle) addLog(path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		b.failf("--logs: %v", err)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		b.failf("--logs: %v", err)
+		return
+	}
+	offset := info.Size() - bundleLogBytes
+	if offset > 0 {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			b.failf("--logs: %v", err)
+			return
+		}
+	}
+	data, err := io.ReadAll(io.LimitReader(f, bundleLogBytes))
+	if err != nil {
+		b.failf("--logs: %v", err)
+		return
+	}
+	if offset > 0 {
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			data = data[i+1:]
+		}
+	}
+	b.add("logs/"+filepath.Base(path), []byte(scrubText(string(data))))
+}
+
+// versionInfo describes the build of this binary and the platform it runs on
+func versionInfo() string {
+	var s strings.Builder
+	fmt.Fprintf(&s, "platform: %s/%s\n", runtime.GOOS, runtime.GOARCH)
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		s.WriteString("build information unavailable\n")
+		return s.String()
+	}
+	fmt.Fprintf(&s, "go: %s\nmodule: %s %s\n", info.GoVersion, info.Main.Path, info.Main.Version)
+	for _, setting := range info.Settings {
+		if strings.HasPrefix(setting.Key, "vcs.") {
+			fmt.Fprintf(&s, "%s: %s\n", setting.Key, setting.Value)
+		}
+	}
+	for _, dep := range info.Deps {
+		fmt.Fprintf(&s, "dependency: %s %s\n", dep.Path, dep.Version)
+	}
+	return s.String()
+}
+
+// bundleArgs lists the flags set on the command line, with secrets scrubbed
+func bundleArgs(fs *flag.FlagSet) string {
+	var s strings.Builder
+	fs.Visit(func(f *flag.Flag) {
+		value := f.Value.String()
+		if bundleURLFlags[f.Name] {
+			value = scrubURL(value)
+		}
+		fmt.Fprintf(&s, "--%s=%s\n", f.Name, scrubText(value))
+	})
+	return s.String()
+}
+
+// bundleEnvironment describes the host and the environment variables VMStarter
+// reads, with the values of secret ones replaced
+func bundleEnvironment() string {
+	var s strings.Builder
+	hostname, _ := os.Hostname()
+	fmt.Fprintf(&s, "host: %s\ntime: %s\ncredential: %s\n", hostname, time.Now().UTC().Format(time.RFC3339), credentialSource())
+	var vars []string
+	for _, entry := range os.Environ() {
+		name, value, _ := strings.Cut(entry, "=")
+		upper := strings.ToUpper(name)
+		for _, prefix := range bundleEnvPrefixes {
+			if strings.HasPrefix(upper, prefix) {
+				if secretName(name) {
+					value = scrubbed
+				}
+				vars = append(vars, name+"="+scrubText(value))
+				break
+			}
+		}
+	}
+	sort.Strings(vars)
+	for _, v := range vars {
+		fmt.Fprintf(&s, "env: %s\n", v)
+	}
+	return s.String()
+}
+
+// secretName reports whether a key or variable named name holds a secret
+func secretName(name string) bool {
+	n := strings.NewReplacer("-", "", "_", "", ".", "").Replace(strings.ToLower(name))
+	if n == "key" || strings.HasSuffix(n, "key") && !strings.HasSuffix(n, "tagkey") {
+		return true
+	}
+	for _, word := range []string{"secret", "token", "password", "authorization", "credential", "dsn", "cookie", "signature"} {
+		if strings.Contains(n, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// scrubJSON returns doc with the values of secret-named keys replaced and
+// secrets in strings scrubbed. References to environment variables (${NAME})
+// and Key Vault are kept: they name secrets without holding them.
+func scrubJSON(key string, doc interface{}) interface{} {
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		for k, value := range v {
+			v[k] = scrubJSON(k, value)
+		}
+		return v
+	case []interface{}:
+		for i, value := range v {
+			v[i] = scrubJSON(key, value)
+		}
+		return v
+	case string:
+		if isSecretReference(v) {
+			return v
+		}
+		if secretName(key) {
+			return scrubbed
+		}
+		return scrubText(v)
+	}
+	if secretName(key) && doc != nil {
+		return scrubbed
+	}
+	return doc
+}
+
+// isSecretReference reports whether s only references a secret kept elsewhere
+func isSecretReference(s string) bool {
+	return strings.HasPrefix(s, keyVaultRefPrefix) || (strings.HasPrefix(s, "${") && strings.HasSuffix(s, "}") && !strings.Contains(s[2:], "${"))
+}
+
+// scrubText replaces tokens, credentials in URLs and secret-named values in free text
+func scrubText(s string) string {
+	s = jwtPattern.ReplaceAllString(s, scrubbed)
+	s = authPattern.ReplaceAllString(s, "$1 "+scrubbed)
+	s = urlUserPattern.ReplaceAllString(s, "${1}"+scrubbed+"@")
+	s = queryPattern.ReplaceAllString(s, "${1}"+scrubbed)
+	return secretValuePattern.ReplaceAllString(s, "$1="+scrubbed)
+}
+
+// scrubURL keeps the scheme and host of a URL, whose path and query may be
+// the secret itself (webhook and heartbeat URLs)
+func scrubURL(s string) string {
+	if isSecretReference(s) {
+		return s
+	}
+	scheme, rest, ok := strings.Cut(s, "://")
+	if !ok {
+		return scrubbed
+	}
+	host, _, hasPath := strings.Cut(rest, "/")
+	if i := strings.LastIndex(host, "@"); i >= 0 {
+		host = host[i+1:]
+	}
+	if !hasPath {
+		return scheme + "://" + host
+	}
+	return scheme + "://" + host + "/" + scrubbed
+}
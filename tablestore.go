@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	storageScope      = "https://storage.azure.com/.default"
+	tableAPIVersion   = "2020-12-06"
+	tableHostSuffix   = ".table.core.windows.net"
+	tableTokenRefresh = 30 * time.Minute
+
+	// tableChunk bounds the bytes of a string property; the service allows 64 KiB of UTF-16
+	tableChunk = 30000
+	// tableMaxStatus bounds the size of a run status kept with its results in
+	// one entity, which may not exceed 1 MiB
+	tableMaxStatus = 900 * 1024
+
+	journalPartition = "journal"
+	runPartition     = "run"
+)
+
+var tableNamePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]{2,62}$`)
+
+// tableStore keeps the journal and the server runs in an Azure Storage table,
+// authenticating with the ambient Azure credential, which needs the "Storage
+// Table Data Contributor" role. Journal records are entities of the "journal"
+// partition keyed by time, runs entities of the "run" partition keyed by run ID.
+type tableStore struct {
+	endpoint string // of the table, such as https://account.table.core.windows.net/journal
+	client   *http.Client
+
+	mu      sync.Mutex
+	token   string
+	fetched time.Time
+}
+
+// openTableStore opens the table of an azuretable://<account>/<table>
+// location, creating it when needed. The account may be given as a host name
+// for clouds other than the public one.
+func openTableStore(location string) (*tableStore, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid journal %q: %w", location, err)
+	}
+	table := strings.Trim(u.Path, "/")
+	if u.Host == "" || !tableNamePattern.MatchString(table) {
+		return nil, fmt.Errorf("invalid journal %q: expected azuretable://<account>/<table>", location)
+	}
+	host := u.Host
+	if !strings.Contains(host, ".") {
+		host += tableHostSuffix
+	}
+	s := &tableStore{
+		endpoint: "https://" + host + "/" + table,
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+	body, _ := json.Marshal(map[string]string{"TableName": table})
+	resp, err := s.send(http.MethodPost, "https://"+host+"/Tables", body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open journal: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusConflict {
+		return nil, fmt.Errorf("failed to open journal: creating table %s: unexpected status: %d", table, resp.StatusCode)
+	}
+	return s, nil
+}
+
+// accessToken returns a storage token, fetching a new one once in a while
+func (s *tableStore) accessToken(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token == "" || time.Since(s.fetched) > tableTokenRefresh {
+		token, err := getAccessToken(ctx, storageScope)
+		if err != nil {
+			return "", err
+		}
+		s.token, s.fetched = token, time.Now()
+	}
+	return s.token, nil
+}
+
+// send sends a Table service request, retrying throttled and transiently failed ones
+func (s *tableStore) send(method, rawURL string, body []byte) (*http.Response, error) {
+	ctx := context.Background()
+	token, err := s.accessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return sendWithRetries(ctx, method, rawURL, func() (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, method, rawURL, bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("x-ms-version", tableAPIVersion)
+		req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+		req.Header.Set("Accept", "application/json;odata=nometadata")
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Prefer", "return-no-content")
+		return s.client.Do(req)
+	})
+}
+
+// entityURL is the address of the entity with the given keys
+func (s *tableStore) entityURL(partition, row string) string {
+	quote := func(v string) string { return url.PathEscape(strings.ReplaceAll(v, "'", "''")) }
+	return fmt.Sprintf("%s(PartitionKey='%s',RowKey='%s')", s.endpoint, quote(partition), quote(row))
+}
+
+// query calls fn with every entity matching filter, following continuations
+func (s *tableStore) query(filter string, fn func(entity map[string]interface{}) error) error {
+	next := url.Values{"$filter": {filter}}
+	for {
+		resp, err := s.send(http.MethodGet, s.endpoint+"()?"+next.Encode(), nil)
+		if err != nil {
+			return err
+		}
+		var page struct {
+			Value []map[string]interface{} `json:"value"`
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("unexpected status: %d", resp.StatusCode)
+		} else if decodeErr := json.NewDecoder(resp.Body).Decode(&page); decodeErr != nil {
+			err = fmt.Errorf("failed to parse JSON: %w", decodeErr)
+		}
+		partition := resp.Header.Get("x-ms-continuation-NextPartitionKey")
+		row := resp.Header.Get("x-ms-continuation-NextRowKey")
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		for _, entity := range page.Value {
+			if err := fn(entity); err != nil {
+				return err
+			}
+		}
+		if partition == "" {
+			return nil
+		}
+		next.Set("NextPartitionKey", partition)
+		next.Set("NextRowKey", row)
+	}
+}
+
+// put inserts or replaces an entity
+func (s *tableStore) put(partition, row string, props map[string]interface{}) error {
+	body, err := json.Marshal(props)
+	if err != nil {
+		return err
+	}
+	resp, err := s.send(http.MethodPut, s.entityURL(partition, row), body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (s *tableStore) append(recs []journalRecord) error {
+	for _, rec := range recs {
+		doc, err := json.Marshal(rec)
+		if err != nil {
+			continue
+		}
+		// Row keys sort in the order records were written
+		row := fmt.Sprintf("%019d-%019d", rec.Time.UnixNano(), rec.Seq)
+		props := map[string]interface{}{"Phase": rec.Phase, "ResourceId": rec.ResourceID, "RunId": rec.RunID, "Record": string(doc)}
+		if err := s.put(journalPartition, row, props); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *tableStore) read(fn func(rec *journalRecord)) error {
+	err := s.query("PartitionKey eq '"+journalPartition+"'", func(entity map[string]interface{}) error {
+		doc, _ := entity["Record"].(string)
+		var rec journalRecord
+		if err := json.Unmarshal([]byte(doc), &rec); err != nil {
+			return fmt.Errorf("journal record %v: %w", entity["RowKey"], err)
+		}
+		fn(&rec)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read journal: %w", err)
+	}
+	return nil
+}
+
+// saveRun keeps the status in Status0, Status1, ... properties, as it may not
+// fit in one. A status too large for an entity is kept without its results.
+func (s *tableStore) saveRun(owner string, status runStatus) error {
+	doc, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	if len(doc) > tableMaxStatus {
+		status.Results = nil
+		if doc, err = json.Marshal(status); err != nil {
+			return err
+		}
+	}
+	props := map[string]interface{}{"Owner": owner}
+	for i, chunk := range splitUTF8(string(doc), tableChunk) {
+		props["Status"+strconv.Itoa(i)] = chunk
+	}
+	return s.put(runPartition, status.RunID, props)
+}
+
+// splitUTF8 splits s into pieces of at most n bytes without splitting runes
+func splitUTF8(s string, n int) []string {
+	var pieces []string
+	for len(s) > n {
+		cut := n
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		pieces = append(pieces, s[:cut])
+		s = s[cut:]
+	}
+	return append(pieces, s)
+}
+
+// runEntity decodes the owner and status of a run entity
+func runEntity(entity map[string]interface{}) (string, *runStatus, error) {
+	var doc strings.Builder
+	for i := 0; ; i++ {
+		chunk, ok := entity["Status"+strconv.Itoa(i)].(string)
+		if !ok {
+			break
+		}
+		doc.WriteString(chunk)
+	}
+	var status runStatus
+	if err := json.Unmarshal([]byte(doc.String()), &status); err != nil {
+		return "", nil, fmt.Errorf("run %v: %w", entity["RowKey"], err)
+	}
+	owner, _ := entity["Owner"].(string)
+	return owner, &status, nil
+}
+
+func (s *tableStore) loadRun(runID string) (string, *runStatus, error) {
+	resp, err := s.send(http.MethodGet, s.entityURL(runPartition, runID), nil)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+	var entity map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&entity); err != nil {
+		return "", nil, fmt.Errorf("failed to parse JSON: %w", err)
+	}
+	return runEntity(entity)
+}
+
+func (s *tableStore) listRuns(owner string, limit int) ([]runStatus, error) {
+	var runs []runStatus
+	filter := fmt.Sprintf("PartitionKey eq '%s' and Owner eq '%s'", runPartition, strings.ReplaceAll(owner, "'", "''"))
+	err := s.query(filter, func(entity map[string]interface{}) error {
+		_, status, err := runEntity(entity)
+		if err != nil {
+			return err
+		}
+		status.Results = nil
+		runs = append(runs, *status)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].CreatedAt.After(runs[j].CreatedAt) })
+	if len(runs) > limit {
+		runs = runs[:limit]
+	}
+	return runs, nil
+}
+
+func (s *tableStore) close() error {
+	return nil
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Limits of Azure resource tags
+const (
+	maxTagNameLength  = 512
+	maxTagValueLength = 256
+	invalidTagChars   = `<>%&\?/`
+)
+
+// tagChange is the update the tag command makes to one VM: the tags to set and
+// the tags to remove, with their current values
+type tagChange struct {
+	target *vmTarget
+	set    map[string]string
+	unset  map[string]string
+}
+
+// runTag implements the tag command: it sets or removes tags on every VM the
+// selectors match, so that tag conventions can be adopted across a fleet
+func runTag(ctx context.Context, reporter *errorReporter, args []string) error {
+	opts := &options{}
+	fs := newFlagSet("tag", opts)
+	var selectorFlags, setFlags, unsetFlags stringList
+	fs.Var(&selectorFlags, "selector", "only tag VMs carrying this tag, as key=value (repeatable, ANDed with --tag)")
+	fs.Var(&setFlags, "set", "tag to set on the selected VMs, as key=value (repeatable)")
+	fs.Var(&unsetFlags, "unset", "tag to remove from the selected VMs (repeatable)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return fmt.Errorf("usage: tag [flags] --set key=value | --unset key")
+	}
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	if err := setupLogging(opts); err != nil {
+		return err
+	}
+	selectors, err := parseTagSelectors("--selector", selectorFlags)
+	if err != nil {
+		return err
+	}
+	set, unset, err := parseTagUpdates(setFlags, unsetFlags)
+	if err != nil {
+		return err
+	}
+
+	a, err := newApp(opts, reporter)
+	if err != nil {
+		return err
+	}
+	defer a.close()
+	targets, err := a.quietInventory(ctx)
+	if err != nil {
+		return err
+	}
+	changes, unchanged := planTagChanges(selectTagTargets(targets, opts, selectors), set, unset)
+	if len(changes) == 0 {
+		slog.Info("No VM to tag: the selected VMs are already up to date", "unchanged", unchanged)
+		return nil
+	}
+	printTagChanges(changes)
+	if opts.dryRun {
+		slog.Info("Dry run: VMs would be tagged", "tagged", len(changes), "unchanged", unchanged)
+		return nil
+	}
+	if !opts.yes {
+		if err := askConfirmation(os.Stdin, os.Stdout); err != nil {
+			return err
+		}
+	}
+
+	ctx = withRetries(withTenant(ctx, opts.tenant), opts.armRetries)
+	token, err := getAzureAccessToken(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get Azure token: %w", err)
+	}
+	failed := applyTagChanges(ctx, token, changes, opts.concurrency, a.journal)
+	slog.Info("Tagging finished", "tagged", len(changes)-failed, "unchanged", unchanged, "failed", failed)
+	if failed > 0 {
+		return fmt.Errorf("failed to tag %d VM(s)", failed)
+	}
+	return nil
+}
+
+// parseTagUpdates parses the values of --set and --unset and checks them
+// against the naming rules of Azure tags
+func parseTagUpdates(setFlags, unsetFlags []string) (map[string]string, []string, error) {
+	set := map[string]string{}
+	for _, entry := range setFlags {
+		key, value, ok := strings.Cut(entry, "=")
+		if !ok || key == "" {
+			return nil, nil, fmt.Errorf("invalid --set %q: expected key=value", entry)
+		}
+		if err := validTagName(key); err != nil {
+			return nil, nil, fmt.Errorf("invalid --set %q: %w", entry, err)
+		}
+		if len(value) > maxTagValueLength {
+			return nil, nil, fmt.Errorf("invalid --set %q: values are limited to %d characters", entry, maxTagValueLength)
+		}
+		if existing, ok := lookupTag(set, key); ok && existing != value {
+			return nil, nil, fmt.Errorf("--set %s is given twice, with values %q and %q", key, existing, value)
+		}
+		set[key] = value
+	}
+	var unset []string
+	for _, key := range unsetFlags {
+		if err := validTagName(key); err != nil {
+			return nil, nil, fmt.Errorf("invalid --unset %q: %w", key, err)
+		}
+		if _, ok := lookupTag(set, key); ok {
+			return nil, nil, fmt.Errorf("tag %s cannot be both set and unset", key)
+		}
+		unset = append(unset, key)
+	}
+	if len(set) == 0 && len(unset) == 0 {
+		return nil, nil, fmt.Errorf("nothing to do: pass --set key=value or --unset key")
+	}
+	return set, unset, nil
+}
+
+// validTagName checks a tag name against the rules of Azure Resource Manager
+func validTagName(key string) error {
+	switch {
+	case key == "":
+		return fmt.Errorf("tag names must not be empty")
+	case len(key) > maxTagNameLength:
+		return fmt.Errorf("tag names are limited to %d characters", maxTagNameLength)
+	case strings.ContainsAny(key, invalidTagChars):
+		return fmt.Errorf("tag names must not contain any of %s", invalidTagChars)
+	}
+	return nil
+}
+
+// selectTagTargets returns the targets that carry every selector tag and pass
+// the name, location and tag filters of opts. Arc machines are left out: their
+// tags are not managed here.
+func selectTagTargets(targets []*vmTarget, opts *options, selectors map[string]string) []*vmTarget {
+	var filters []vmFilter
+	if len(opts.names) > 0 {
+		filters = append(filters, nameFilter(opts.names, opts.nameFlags))
+	}
+	if len(opts.locations) > 0 {
+		filters = append(filters, locationFilter(opts.locations))
+	}
+	if len(opts.excludeTags) > 0 {
+		filters = append(filters, excludeTagFilter(opts.excludeTags))
+	}
+	if len(opts.tags) > 0 {
+		filters = append(filters, tagFilter(opts.tags))
+	}
+	if len(selectors) > 0 {
+		filters = append(filters, tagFilter(selectors))
+	}
+	var selected []*vmTarget
+next:
+	for _, t := range targets {
+		if t.Arc {
+			continue
+		}
+		for _, keep := range filters {
+			if ok, _ := keep(t); !ok {
+				continue next
+			}
+		}
+		selected = append(selected, t)
+	}
+	return selected
+}
+
+// planTagChanges computes the change each target needs, ordered by ID, and
+// counts the targets that already carry the tags as requested
+func planTagChanges(targets []*vmTarget, set map[string]string, unset []string) ([]tagChange, int) {
+	var changes []tagChange
+	unchanged := 0
+	for _, t := range targets {
+		c := tagChange{target: t, set: map[string]string{}, unset: map[string]string{}}
+		for key, value := range set {
+			if got, ok := lookupTag(t.Tags, key); !ok || got != value {
+				c.set[key] = value
+			}
+		}
+		for _, key := range unset {
+			for k, v := range t.Tags {
+				if strings.EqualFold(k, key) {
+					c.unset[k] = v
+				}
+			}
+		}
+		if len(c.set) == 0 && len(c.unset) == 0 {
+			unchanged++
+			continue
+		}
+		changes = append(changes, c)
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return strings.ToLower(changes[i].target.ID) < strings.ToLower(changes[j].target.ID)
+	})
+	return changes, unchanged
+}
+
+// printTagChanges logs the tags each VM gets and loses
+func printTagChanges(changes []tagChange) {
+	slog.Info("VMs to tag", "count", len(changes))
+	for _, c := range changes {
+		t := c.target
+		vm := t.SubscriptionID + "/" + t.ResourceGroup + "/" + t.Name
+		for _, key := range sortedKeys(c.set) {
+			if old, ok := lookupTag(t.Tags, key); ok {
+				slog.Info("Tag changed", "vm", vm, "tag", key, "value", c.set[key], "was", old)
+			} else {
+				slog.Info("Tag added", "vm", vm, "tag", key, "value", c.set[key])
+			}
+		}
+		for _, key := range sortedKeys(c.unset) {
+			slog.Info("Tag removed", "vm", vm, "tag", key)
+		}
+	}
+}
+
+// applyTagChanges sends the changes, at most concurrency at a time, records
+// each tagged VM in the journal and returns how many failed
+func applyTagChanges(ctx context.Context, token string, changes []tagChange, concurrency int, j *journal) int {
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed int
+	)
+	sem := make(chan struct{}, concurrency)
+	for _, c := range changes {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(c tagChange) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			t := c.target
+			err := applyTagChange(ctx, token, c)
+			if err != nil {
+				slog.Error("Failed to tag VM", vmAttrs(t), "error", err)
+				mu.Lock()
+				failed++
+				mu.Unlock()
+				return
+			}
+			slog.Info("Tagged VM", vmAttrs(t))
+			j.audit("tag", fmt.Sprintf("%s set=%s unset=%s", t.ID, formatTags(c.set), strings.Join(sortedKeys(c.unset), ",")))
+		}(c)
+	}
+	wg.Wait()
+	return failed
+}
+
+// applyTagChange merges the tags c sets, then deletes those it removes
+func applyTagChange(ctx context.Context, token string, c tagChange) error {
+	if len(c.set) > 0 {
+		if err := mergeTags(ctx, token, c.target.ID, c.set); err != nil {
+			return err
+		}
+	}
+	if len(c.unset) > 0 {
+		if err := deleteTags(ctx, token, c.target.ID, c.unset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// formatTags returns tags as comma separated key=value pairs, sorted by key
+func formatTags(tags map[string]string) string {
+	pairs := make([]string, 0, len(tags))
+	for _, key := range sortedKeys(tags) {
+		pairs = append(pairs, key+"="+tags[key])
+	}
+	return strings.Join(pairs, ",")
+}
+
+// sortedKeys returns the keys of m in order
+func sortedKeys(m map[string]string) []string {
+	return slices.Sorted(maps.Keys(m))
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Tags API version and the keys written onto started VMs
+const (
+	tagsAPI             = "2021-04-01"
+	tagLastStarted      = "vm-starter:last-started"
+	tagLastRunID        = "vm-starter:last-run-id"
+	tagsMergeOperation  = "Merge"
+	tagsDeleteOperation = "Delete"
+)
+
+// tagsPatchRequest is the body of a Tags - Update At Scope request
+type tagsPatchRequest struct {
+	Operation  string `json:"operation"`
+	Properties struct {
+		Tags map[string]string `json:"tags"`
+	} `json:"properties"`
+}
+
+// mergeTags merges tags into the existing tag set of resourceID, leaving other tags untouched
+func mergeTags(ctx context.Context, token, resourceID string, tags map[string]string) error {
+	return patchTags(ctx, token, resourceID, tagsMergeOperation, tags)
+}
+
+// deleteTags removes tags, given with their current values, from resourceID
+func deleteTags(ctx context.Context, token, resourceID string, tags map[string]string) error {
+	return patchTags(ctx, token, resourceID, tagsDeleteOperation, tags)
+}
+
+// patchTags applies a Tags - Update At Scope operation to resourceID
+func patchTags(ctx context.Context, token, resourceID, operation string, tags map[string]string) error {
+	tagsURL := fmt.Sprintf("%s%s/providers/Microsoft.Resources/tags/default?api-version=%s", armEndpoint, resourceID, tagsAPI)
+	patch := tagsPatchRequest{Operation: operation}
+	patch.Properties.Tags = tags
+	body, err := json.Marshal(patch)
+	if err != nil {
+		return fmt.Errorf("failed to build tags request: %w", err)
+	}
+	resp, err := sendRequest(ctx, http.MethodPatch, tagsURL, token, body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// startedTags returns the metadata tags written after a successful start
+func startedTags(runID string, at time.Time) map[string]string {
+	return map[string]string{
+		tagLastStarted: at.UTC().Format(time.RFC3339),
+		tagLastRunID:   runID,
+	}
+}
+
+// parseTagSelectors parses the repeated key=value values of a tag selection flag
+func parseTagSelectors(flagName string, list []string) (map[string]string, error) {
+	tags := map[string]string{}
+	for _, entry := range list {
+		key, value, ok := strings.Cut(entry, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid %s %q: expected key=value", flagName, entry)
+		}
+		if existing, ok := lookupTag(tags, key); ok && existing != value {
+			return nil, fmt.Errorf("%s %s is given twice, with values %q and %q; no VM can match both", flagName, key, existing, value)
+		}
+		tags[key] = value
+	}
+	return tags, nil
+}
+
+// lookupTag returns the value of a tag; tag names are case-insensitive in Azure, values are not
+func lookupTag(tags map[string]string, key string) (string, bool) {
+	if value, ok := tags[key]; ok {
+		return value, true
+	}
+	for k, v := range tags {
+		if strings.EqualFold(k, key) {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// parseTagExclusions parses the repeated key[=value] values of --exclude-tag;
+// a key without a value excludes the tag whatever its value
+func parseTagExclusions(list []string) (map[string][]string, error) {
+	excluded := map[string][]string{}
+	for _, entry := range list {
+		key, value, hasValue := strings.Cut(entry, "=")
+		if key == "" {
+			return nil, fmt.Errorf("invalid --exclude-tag %q: expected key or key=value", entry)
+		}
+		key = strings.ToLower(key)
+		if !hasValue {
+			excluded[key] = nil
+			continue
+		}
+		if values, ok := excluded[key]; !ok || values != nil {
+			excluded[key] = append(values, value)
+		}
+	}
+	return excluded, nil
+}
+
+// excludeTagFilter skips the VMs carrying any of the excluded tags
+func excludeTagFilter(excluded map[string][]string) vmFilter {
+	return func(t *vmTarget) (bool, string) {
+		for key, value := range t.Tags {
+			values, ok := excluded[strings.ToLower(key)]
+			if !ok {
+				continue
+			}
+			if values == nil {
+				return false, fmt.Sprintf("excluded by tag %s", key)
+			}
+			for _, v := range values {
+				if v == value {
+					return false, fmt.Sprintf("excluded by tag %s=%s", key, value)
+				}
+			}
+		}
+		return true, ""
+	}
+}
+
+// tagFilter keeps only the VMs that carry every one of tags (key=value, ANDed)
+func tagFilter(tags map[string]string) vmFilter {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return func(t *vmTarget) (bool, string) {
+		for _, key := range keys {
+			got, ok := lookupTag(t.Tags, key)
+			if !ok {
+				return false, fmt.Sprintf("not tagged %s=%s", key, tags[key])
+			}
+			if got != tags[key] {
+				return false, fmt.Sprintf("tag %s is %q, not %q", key, got, tags[key])
+			}
+		}
+		return true, ""
+	}
+}
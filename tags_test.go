@@ -0,0 +1,40 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTagSelectors(t *testing.T) {
+	tests := []struct {
+		list    []string
+		want    map[string]string
+		wantErr bool
+	}{
+		{list: nil, want: map[string]string{}},
+		{list: []string{"env=prod"}, want: map[string]string{"env": "prod"}},
+		{list: []string{"env=prod", "team=web"}, want: map[string]string{"env": "prod", "team": "web"}},
+		{list: []string{"env="}, want: map[string]string{"env": ""}},
+		{list: []string{"owner=a=b"}, want: map[string]string{"owner": "a=b"}},
+		{list: []string{"env=prod", "env=prod"}, want: map[string]string{"env": "prod"}},
+		{list: []string{"env=prod", "Env=test"}, wantErr: true},
+		{list: []string{"env"}, wantErr: true},
+		{list: []string{"=prod"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseTagSelectors("--tag", tt.list)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseTagSelectors(%q) = %v, want an error", tt.list, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseTagSelectors(%q): %v", tt.list, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseTagSelectors(%q) = %v, want %v", tt.list, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import "sort"
+
+// unassignedTeam is reported for VMs without the --team-tag tag
+const unassignedTeam = "(unassigned)"
+
+// teamOf returns the team owning t according to its tag key
+func teamOf(t *vmTarget, key string) string {
+	if team := t.Tags[key]; team != "" {
+		return team
+	}
+	return unassignedTeam
+}
+
+// sortedTeams returns the teams of a summary in alphabetical order
+func sortedTeams(byTeam map[string]*teamSummary) []string {
+	teams := make([]string, 0, len(byTeam))
+	for team := range byTeam {
+		teams = append(teams, team)
+	}
+	sort.Strings(teams)
+	return teams
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// errVMTimeout is wrapped by the error of targets that exceeded --vm-timeout
+var errVMTimeout = errors.New("exceeded the per-VM timeout")
+
+// errRunTimeout is the cause of the run context once --run-timeout is exceeded,
+// and wrapped by the errors of the targets it cut short
+var errRunTimeout = errors.New("exceeded the run timeout")
+
+// runTimedOut reports whether ctx ended because the run exceeded --run-timeout
+func runTimedOut(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errRunTimeout)
+}
+
+// targetContext returns the context one target is executed and awaited in:
+// ctx bounded by --vm-timeout, when set
+func (p *pipeline) targetContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if p.vmTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, p.vmTimeout)
+}
+
+// checkTimeout turns res into a timeout failure when its target context
+// expired, on --vm-timeout or --run-timeout, whatever the action or wait that
+// was in progress reported
+func (p *pipeline) checkTimeout(ctx, targetCtx context.Context, res *vmResult) {
+	if res.SkipReason != "" || res.DryRun {
+		return
+	}
+	step := "the request"
+	if res.StatusCode != 0 && res.Action.accepts(res.StatusCode) {
+		step = "waiting for the accepted " + string(res.Action)
+	}
+	switch {
+	case runTimedOut(ctx):
+		res.Err = fmt.Errorf("%w: %s was cancelled", errRunTimeout, step)
+	case ctx.Err() == nil && errors.Is(targetCtx.Err(), context.DeadlineExceeded):
+		res.TimedOut = true
+		res.Err = fmt.Errorf("%w: %s did not finish within --vm-timeout %s", errVMTimeout, step, p.vmTimeout.Round(time.Second))
+	}
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Output formats of schedule import
+const (
+	uptimeFleets = "fleets" // a --fleets file starting and deallocating the VMs on schedule
+	uptimeTags   = "tags"   // tag commands recording the windows on the VMs
+)
+
+// tagSchedule is the tag that schedule import --format tags records the uptime windows of VMs in
+const tagSchedule = "vm-starter:schedule"
+
+// uptimeTargetTagPrefix marks matrix rows that select VMs by tag instead of by name
+const uptimeTargetTagPrefix = "tag:"
+
+// uptimeCell is an uptime window of a matrix cell: HH[:MM]-HH[:MM], in UTC
+var uptimeCell = regexp.MustCompile(`^(\d{1,2})(?::(\d{2}))?\s*-\s*(\d{1,2})(?::(\d{2}))?$`)
+
+// uptimeWindow is the time of day a target is up, on days
+type uptimeWindow struct {
+	target string // VM name pattern, or tag:key=value
+	start  time.Duration
+	end    time.Duration // up to 24h; at or before start when the window spans midnight
+	days   []time.Weekday
+}
+
+// runScheduleImport implements the schedule command: it turns an uptime
+// matrix maintained in a spreadsheet into fleet schedules or tag commands
+func runScheduleImport(ctx context.Context, reporter *errorReporter, args []string) error {
+	usage := fmt.Errorf("usage: schedule import [--format fleets|tags] [--fleet-arg arg]... <matrix.csv|->")
+	if len(args) == 0 || args[0] != "import" {
+		return usage
+	}
+	fs := flag.NewFlagSet("schedule import", flag.ContinueOnError)
+	format := fs.String("format", uptimeFleets, "output: fleets (a --fleets file) or tags (tag commands setting "+tagSchedule+")")
+	var fleetArgs stringList
+	fs.Var(&fleetArgs, "fleet-arg", "run flag added to every generated fleet, e.g. --fleet-arg=--subscription=Production (repeatable)")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usage
+	}
+	if *format != uptimeFleets && *format != uptimeTags {
+		return fmt.Errorf("unknown --format %q", *format)
+	}
+	path := fs.Arg(0)
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read uptime matrix: %w", err)
+	}
+	windows, err := parseUptimeMatrix(data)
+	if err != nil {
+		return fmt.Errorf("invalid uptime matrix %s: %w", path, err)
+	}
+	if *format == uptimeTags {
+		lines, err := uptimeTagCommands(windows)
+		if err != nil {
+			return err
+		}
+		for _, line := range lines {
+			fmt.Println(line)
+		}
+		return nil
+	}
+	file, err := uptimeFleetsFile(windows, fleetArgs)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(file)
+}
+
+// parseUptimeMatrix reads an uptime matrix as exported from a spreadsheet: a
+// header of a target column and weekday columns (mon … sun), then one row per
+// VM name pattern or tag:key=value selector whose cells hold the UTC window it
+// must be up on that day, e.g. 08-18 or 07:30-19:00, and are empty (or "off",
+// "-") on days it may stay down. Semicolon separated files, as written by
+// spreadsheets in many locales, and a UTF-8 byte order mark are accepted. Rows
+// with the same target and window are merged.
+func parseUptimeMatrix(data []byte) ([]*uptimeWindow, error) {
+	data = bytes.TrimPrefix(data, []byte("\ufeff"))
+	r := csv.NewReader(bytes.NewReader(data))
+	header, _, _ := bytes.Cut(data, []byte("\n"))
+	if bytes.Count(header, []byte(";")) > bytes.Count(header, []byte(",")) {
+		r.Comma = ';'
+	}
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	r.Comment = '#'
+	rows, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("the matrix is empty")
+	}
+	days := make([]time.Weekday, len(rows[0]))
+	for i, name := range rows[0][1:] {
+		day, ok := parseWeekday(name)
+		if !ok {
+			return nil, fmt.Errorf("column %d: %q is not a weekday, expected mon … sun", i+2, name)
+		}
+		if containsWeekday(days[1:i+1], day) {
+			return nil, fmt.Errorf("column %d: %s is given twice", i+2, name)
+		}
+		days[i+1] = day
+	}
+	if len(days) < 2 {
+		return nil, fmt.Errorf("the header has no weekday columns")
+	}
+
+	var windows []*uptimeWindow
+	merged := map[string]*uptimeWindow{}
+	for n, row := range rows[1:] {
+		line := n + 2
+		target := strings.TrimSpace(row[0])
+		if target == "" && strings.TrimSpace(strings.Join(row, "")) == "" {
+			continue
+		}
+		if err := validUptimeTarget(target); err != nil {
+			return nil, fmt.Errorf("row %d: %w", line, err)
+		}
+		if len(row) > len(days) {
+			return nil, fmt.Errorf("row %d: %d cells, but the header has %d columns", line, len(row), len(days))
+		}
+		for i, cell := range row[1:] {
+			cell = strings.TrimSpace(cell)
+			if cell == "" || cell == "-" || strings.EqualFold(cell, "off") {
+				continue
+			}
+			start, end, err := parseUptimeCell(cell)
+			if err != nil {
+				return nil, fmt.Errorf("row %d, %s: %w", line, strings.ToLower(days[i+1].String()[:3]), err)
+			}
+			key := fmt.Sprintf("%s|%s|%s", strings.ToLower(target), start, end)
+			w, ok := merged[key]
+			if !ok {
+				w = &uptimeWindow{target: target, start: start, end: end}
+				merged[key] = w
+				windows = append(windows, w)
+			}
+			if !containsWeekday(w.days, days[i+1]) {
+				w.days = append(w.days, days[i+1])
+			}
+		}
+	}
+	if len(windows) == 0 {
+		return nil, fmt.Errorf("no row has an uptime window")
+	}
+	return windows, nil
+}
+
+// parseUptimeCell parses a HH[:MM]-HH[:MM] window
+func parseUptimeCell(cell string) (time.Duration, time.Duration, error) {
+	m := uptimeCell.FindStringSubmatch(cell)
+	if m == nil {
+		return 0, 0, fmt.Errorf("invalid window %q: expected HH-HH or HH:MM-HH:MM", cell)
+	}
+	clock := func(hours, minutes string) (time.Duration, bool) {
+		h, _ := strconv.Atoi(hours)
+		min, _ := strconv.Atoi(minutes)
+		d := time.Duration(h)*time.Hour + time.Duration(min)*time.Minute
+		return d, min < 60 && d <= 24*time.Hour
+	}
+	start, ok1 := clock(m[1], m[2])
+	end, ok2 := clock(m[3], m[4])
+	if !ok1 || !ok2 || start == 24*time.Hour {
+		return 0, 0, fmt.Errorf("invalid window %q: times must be between 00:00 and 24:00", cell)
+	}
+	if start == end {
+		return 0, 0, fmt.Errorf("invalid window %q: it starts and ends at the same time", cell)
+	}
+	return start, end, nil
+}
+
+// validUptimeTarget checks the target cell of a matrix row
+func validUptimeTarget(target string) error {
+	if target == "" {
+		return fmt.Errorf("the target is empty")
+	}
+	if selector, ok := strings.CutPrefix(target, uptimeTargetTagPrefix); ok {
+		if key, _, ok := strings.Cut(selector, "="); !ok || key == "" {
+			return fmt.Errorf("invalid target %q: expected tag:key=value", target)
+		}
+		return nil
+	}
+	_, err := parseNamePatterns([]string{target})
+	return err
+}
+
+// selectionArgs returns the run flags selecting the VMs of the window
+func (w *uptimeWindow) selectionArgs() []string {
+	if selector, ok := strings.CutPrefix(w.target, uptimeTargetTagPrefix); ok {
+		return []string{"--tag", selector}
+	}
+	return []string{"--name-filter", w.target}
+}
+
+// weekdays returns the days of the window shifted by shift days, as schedule
+// weekdays from monday to sunday
+func (w *uptimeWindow) weekdays(shift int) []string {
+	var out []string
+	for _, d := range mondayFirst {
+		for _, day := range w.days {
+			if (int(day)+shift)%7 == int(d) {
+				out = append(out, strings.ToLower(d.String()[:3]))
+			}
+		}
+	}
+	return out
+}
+
+// stopDay is how many days after its start the window ends
+func (w *uptimeWindow) stopDay() int {
+	if w.end <= w.start || w.end == 24*time.Hour {
+		return 1
+	}
+	return 0
+}
+
+// String formats the window for the schedule tag, e.g. "mon,tue 08:00-18:00"
+func (w *uptimeWindow) String() string {
+	return fmt.Sprintf("%s %s-%s", strings.Join(w.weekdays(0), ","), clockTime(w.start), clockTime(w.end))
+}
+
+// uptimeFleetsFile turns windows into a --fleets file with two fleets per
+// window: one starting its VMs when it opens, one deallocating them when it
+// closes. extraArgs are added to every fleet.
+func uptimeFleetsFile(windows []*uptimeWindow, extraArgs []string) (*fleetsFile, error) {
+	file := &fleetsFile{}
+	used := map[string]bool{}
+	for _, w := range windows {
+		base := uptimeFleetName(w)
+		for _, f := range []struct {
+			action string
+			at     time.Duration
+			shift  int
+		}{{"start", w.start, 0}, {"deallocate", w.end % (24 * time.Hour), w.stopDay()}} {
+			name := base + "-" + f.action
+			for i := 2; used[name]; i++ {
+				name = fmt.Sprintf("%s-%s-%d", base, f.action, i)
+			}
+			used[name] = true
+			args := append(append(append([]string{}, extraArgs...), "--action", f.action), w.selectionArgs()...)
+			cfg := fleetConfig{Name: name, Args: args, Schedule: &fleetSchedule{At: clockTime(f.at), Weekdays: w.weekdays(f.shift)}}
+			f, err := newFleet(cfg)
+			if err != nil {
+				return nil, fmt.Errorf("fleet %s for %s: %w", name, w.target, err)
+			}
+			if f.opts.journalPath != "" {
+				return nil, fmt.Errorf("--fleet-arg cannot set --journal: fleets may not share a journal, add one to each fleet instead")
+			}
+			file.Fleets = append(file.Fleets, cfg)
+		}
+	}
+	return file, nil
+}
+
+// fleetNameUnsafe matches the runs of characters fleet names cannot contain
+var fleetNameUnsafe = regexp.MustCompile(`[^a-z0-9]+`)
+
+// uptimeFleetName derives a fleet name prefix from the target and start of w
+func uptimeFleetName(w *uptimeWindow) string {
+	name := strings.Trim(fleetNameUnsafe.ReplaceAllString(strings.ToLower(w.target), "-"), "-")
+	if len(name) > 40 {
+		name = strings.TrimRight(name[:40], "-")
+	}
+	if name == "" {
+		name = "vms"
+	}
+	return fmt.Sprintf("%s-%s", name, strings.ReplaceAll(clockTime(w.start), ":", ""))
+}
+
+// uptimeTagCommands returns one tag command per target, setting the schedule
+// tag to its windows, separated by "; "
+func uptimeTagCommands(windows []*uptimeWindow) ([]string, error) {
+	var targets []string
+	values := map[string][]string{}
+	byTarget := map[string]*uptimeWindow{}
+	for _, w := range windows {
+		key := strings.ToLower(w.target)
+		if _, ok := byTarget[key]; !ok {
+			byTarget[key] = w
+			targets = append(targets, key)
+		}
+		values[key] = append(values[key], w.String())
+	}
+	var lines []string
+	for _, key := range targets {
+		w := byTarget[key]
+		value := strings.Join(values[key], "; ")
+		if len(value) > maxTagValueLength {
+			return nil, fmt.Errorf("the windows of %s do not fit in a %d character tag value", w.target, maxTagValueLength)
+		}
+		selection := "--name-filter " + shellQuote(w.target)
+		if selector, ok := strings.CutPrefix(w.target, uptimeTargetTagPrefix); ok {
+			selection = "--selector " + shellQuote(selector)
+		}
+		lines = append(lines, fmt.Sprintf("vmstarter tag %s --set %s", selection, shellQuote(tagSchedule+"="+value)))
+	}
+	return lines, nil
+}
+
+// mondayFirst lists the weekdays in the order of an uptime matrix
+var mondayFirst = []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday, time.Sunday}
+
+// parseWeekday parses a weekday header such as mon, Monday or MO
+func parseWeekday(name string) (time.Weekday, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if len(name) < 2 {
+		return 0, false
+	}
+	for _, d := range mondayFirst {
+		if strings.HasPrefix(strings.ToLower(d.String()), name) {
+			return d, true
+		}
+	}
+	return 0, false
+}
+
+func containsWeekday(days []time.Weekday, day time.Weekday) bool {
+	for _, d := range days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// clockTime formats a time of day as HH:MM
+func clockTime(d time.Duration) string {
+	return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+}
+
+// shellQuote quotes s for POSIX shells
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseUptimeMatrix(t *testing.T) {
+	tests := []struct {
+		name    string
+		matrix  string
+		want    []string // target and window of each result
+		wantErr bool
+	}{
+		{
+			name:   "comma separated",
+			matrix: "vm,mon,tue,wed\nweb-*,08-18,08-18,\ndb-1,07:30-19:00,off,-\n",
+			want:   []string{"web-* mon,tue 08:00-18:00", "db-1 mon 07:30-19:00"},
+		},
+		{
+			name:   "semicolons, byte order mark and full day names",
+			matrix: "\ufefftarget;Monday;Sunday\ntag:env=dev;8-18;8-18\n",
+			want:   []string{"tag:env=dev mon,sun 08:00-18:00"},
+		},
+		{
+			name:   "rows of a target with the same window are merged",
+			matrix: "vm,mon,tue\nweb-1,08-18,\nWEB-1,,08-18\n",
+			want:   []string{"web-1 mon,tue 08:00-18:00"},
+		},
+		{
+			name:   "different windows are kept apart",
+			matrix: "vm,mon,tue\nweb-1,08-18,09-17\n",
+			want:   []string{"web-1 mon 08:00-18:00", "web-1 tue 09:00-17:00"},
+		},
+		{
+			name:   "windows across midnight and to the end of the day",
+			matrix: "vm,fri,sat\nbatch,22-06,12-24\n",
+			want:   []string{"batch fri 22:00-06:00", "batch sat 12:00-24:00"},
+		},
+		{
+			name:   "comments and blank rows",
+			matrix: "vm,mon\n# nightly jobs\n\n,\nweb-1,08-18\n",
+			want:   []string{"web-1 mon 08:00-18:00"},
+		},
+		{name: "empty", matrix: "", wantErr: true},
+		{name: "no weekday columns", matrix: "vm\nweb-1\n", wantErr: true},
+		{name: "unknown weekday", matrix: "vm,mon,xyz\nweb-1,08-18,08-18\n", wantErr: true},
+		{name: "ambiguous weekday", matrix: "vm,t\nweb-1,08-18\n", wantErr: true},
+		{name: "weekday given twice", matrix: "vm,mon,Monday\nweb-1,08-18,\n", wantErr: true},
+		{name: "no window", matrix: "vm,mon\nweb-1,off\n", wantErr: true},
+		{name: "invalid window", matrix: "vm,mon\nweb-1,8am-6pm\n", wantErr: true},
+		{name: "window out of the day", matrix: "vm,mon\nweb-1,08-25\n", wantErr: true},
+		{name: "window of no time", matrix: "vm,mon\nweb-1,08-08\n", wantErr: true},
+		{name: "missing target", matrix: "vm,mon\n,08-18\n", wantErr: true},
+		{name: "invalid tag target", matrix: "vm,mon\ntag:env,08-18\n", wantErr: true},
+		{name: "invalid name pattern", matrix: "vm,mon\nweb-[,08-18\n", wantErr: true},
+		{name: "more cells than columns", matrix: "vm,mon\nweb-1,08-18,08-18\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		windows, err := parseUptimeMatrix([]byte(tt.matrix))
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: parseUptimeMatrix succeeded, want an error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: parseUptimeMatrix: %v", tt.name, err)
+			continue
+		}
+		var got []string
+		for _, w := range windows {
+			got = append(got, w.target+" "+w.String())
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: parseUptimeMatrix = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// vmUsage is the uptime attributable to VMStarter for one VM
+type vmUsage struct {
+	SubscriptionID string  `json:"subscriptionId"`
+	ResourceGroup  string  `json:"resourceGroup"`
+	Name           string  `json:"name"`
+	ID             string  `json:"id"`
+	Team           string  `json:"team,omitempty"`
+	Starts         int     `json:"starts"`
+	Hours          float64 `json:"hours"`
+	Running        bool    `json:"running"` // started and not powered down by VMStarter since
+
+	upSince time.Time
+}
+
+// runUsage implements the usage command: it replays the operation journal and
+// reports, per VM, the hours between VMStarter's starts and its stops
+func runUsage(ctx context.Context, reporter *errorReporter, args []string) error {
+	fs := flag.NewFlagSet("usage", flag.ContinueOnError)
+	journalPath := fs.String("journal", "", "operation journal to account from (required)")
+	sinceFlag := fs.String("since", "30d", "accounting period ending now, e.g. 30d, 2w or 12h")
+	format := fs.String("format", listText, "output format: text or json")
+	team := fs.String("team", "", "only report the VMs of this team (as recorded with --team-tag)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *journalPath == "" {
+		return fmt.Errorf("--journal is required")
+	}
+	period, err := parsePeriod(*sinceFlag)
+	if err != nil {
+		return err
+	}
+	if *format != listText && *format != listJSON {
+		return fmt.Errorf("unknown --format %q", *format)
+	}
+
+	now := time.Now().UTC()
+	usage, err := journalUsage(*journalPath, now.Add(-period), now)
+	if err != nil {
+		return err
+	}
+	if *team != "" {
+		var own []*vmUsage
+		for _, u := range usage {
+			if u.Team == *team {
+				own = append(own, u)
+			}
+		}
+		usage = own
+	}
+	if *format == listJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(usage)
+	}
+	// Group the table by team, keeping the hours order within each team
+	sort.SliceStable(usage, func(i, j int) bool { return usage[i].Team < usage[j].Team })
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TEAM\tSUBSCRIPTION\tRESOURCE GROUP\tNAME\tSTARTS\tHOURS\t")
+	var total, teamTotal float64
+	for i, u := range usage {
+		running := ""
+		if u.Running {
+			running = "running"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%.1f\t%s\n", u.Team, u.SubscriptionID, u.ResourceGroup, u.Name, u.Starts, u.Hours, running)
+		total += u.Hours
+		teamTotal += u.Hours
+		if i+1 == len(usage) || usage[i+1].Team != u.Team {
+			if u.Team != "" {
+				fmt.Fprintf(tw, "%s\t\t\tSUBTOTAL\t\t%.1f\t\n", u.Team, teamTotal)
+			}
+			teamTotal = 0
+		}
+	}
+	fmt.Fprintf(tw, "\t\t\tTOTAL\t\t%.1f\t\n", total)
+	return tw.Flush()
+}
+
+// parsePeriod parses a Go duration, extended with d (days) and w (weeks) suffixes
+func parsePeriod(s string) (time.Duration, error) {
+	units := map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour}
+	for suffix, unit := range units {
+		if n, err := strconv.Atoi(strings.TrimSuffix(s, suffix)); err == nil && strings.HasSuffix(s, suffix) && n > 0 {
+			return time.Duration(n) * unit, nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid period %q: expected e.g. 30d, 2w or 12h", s)
+	}
+	return d, nil
+}
+
+// journalUsage replays the done records of the journal at path. A VM is up from
+// an accepted start until the next accepted power-down; time outside [from, to]
+// is not counted. The result is sorted by hours, highest first.
+func journalUsage(path string, from, to time.Time) ([]*vmUsage, error) {
+	vms := map[string]*vmUsage{}
+	credit := func(u *vmUsage, until time.Time) {
+		start := u.upSince
+		if start.Before(from) {
+			start = from
+		}
+		if until.After(start) {
+			u.Hours += until.Sub(start).Hours()
+		}
+	}
+	err := readJournal(path, func(rec *journalRecord) {
+		if rec.Phase != journalDone || rec.ResourceID == "" || rec.Time.After(to) {
+			return
+		}
+		key := strings.ToLower(rec.ResourceID)
+		u, ok := vms[key]
+		if !ok {
+			u = &vmUsage{
+				SubscriptionID: subscriptionOf(rec.ResourceID),
+				ResourceGroup:  parseResourceGroup(rec.ResourceID),
+				Name:           rec.ResourceID[strings.LastIndex(rec.ResourceID, "/")+1:],
+				ID:             rec.ResourceID,
+			}
+			vms[key] = u
+		}
+		if rec.Team != "" {
+			u.Team = rec.Team
+		}
+		switch action := vmAction(rec.Action); {
+		case action == actionStart:
+			if !rec.Time.Before(from) {
+				u.Starts++
+			}
+			if !u.Running {
+				u.Running, u.upSince = true, rec.Time
+			}
+		case action.powersDown() && u.Running:
+			credit(u, rec.Time)
+			u.Running = false
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	usage := []*vmUsage{}
+	for _, u := range vms {
+		if u.Running {
+			credit(u, to)
+		}
+		u.Hours = math.Round(u.Hours*100) / 100
+		if u.Hours > 0 || u.Starts > 0 {
+			usage = append(usage, u)
+		}
+	}
+	sort.Slice(usage, func(i, j int) bool {
+		if usage[i].Hours != usage[j].Hours {
+			return usage[i].Hours > usage[j].Hours
+		}
+		return usage[i].ID < usage[j].ID
+	})
+	return usage, nil
+}
+
+// subscriptionOf extracts the subscription ID from a resource ID
+func subscriptionOf(resourceID string) string {
+	parts := strings.Split(resourceID, "/")
+	for i := 0; i+1 < len(parts); i++ {
+		if strings.EqualFold(parts[i], "subscriptions") {
+			return parts[i+1]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Statuses of an Azure-AsyncOperation; all but InProgress end it
+const (
+	operationInProgress = "InProgress"
+	operationSucceeded  = "Succeeded"
+	operationFailed     = "Failed"
+	operationCanceled   = "Canceled"
+)
+
+// errOperationFailed is wrapped by the error of actions whose long-running
+// operation failed, was canceled or did not complete in time
+var errOperationFailed = errors.New("operation did not succeed")
+
+// operationWait follows the long-running operation of every accepted action
+// until it ends, polling every interval for at most timeout
+type operationWait struct {
+	interval time.Duration
+	timeout  time.Duration
+}
+
+// applies reports whether the operation of res must be followed: accepted
+// actions that ARM answered with an operation to poll
+func (w *operationWait) applies(res *vmResult) bool {
+	return w != nil && res.outcome() == outcomeAccepted && res.Operation != ""
+}
+
+// awaits reports whether the execute stage follows res up before reporting it
+func (p *pipeline) awaits(res *vmResult) bool {
+	return p.wait.applies(res) || p.deadline.applies(res)
+}
+
+// await follows res up: it waits for its operation with --wait, then for the
+// VM to be running with --vm-deadline
+func (p *pipeline) await(ctx context.Context, res *vmResult) {
+	if p.wait.applies(res) {
+		p.awaitOperation(ctx, res)
+	}
+	if p.deadline.applies(res) {
+		p.awaitRunning(ctx, res)
+	}
+}
+
+// awaitOperation polls the operation of res until it ends and reports its
+// final status in res; failures carry the error of the operation
+func (p *pipeline) awaitOperation(ctx context.Context, res *vmResult) {
+	t, w := res.Target, p.wait
+	began := time.Now()
+	status, armErr := "", (*armError)(nil)
+	for {
+		token, err := p.access.current(ctx)
+		if err == nil {
+			status, armErr, err = pollOperation(ctx, res.Operation, token)
+		}
+		if err != nil {
+			slog.Error("Failed to poll the operation", vmAttrs(t), "action", res.Action, "error", err)
+		} else if status == operationSucceeded || status == operationFailed || status == operationCanceled {
+			break
+		}
+		wait := min(w.interval, time.Until(began.Add(w.timeout)))
+		if wait <= 0 {
+			res.Err = fmt.Errorf("%w: still %s after --wait-timeout %s", errOperationFailed, orUnknown(status), w.timeout)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			res.Err = fmt.Errorf("%w: still %s when the run was canceled", errOperationFailed, orUnknown(status))
+			return
+		case <-time.After(wait):
+		}
+	}
+	res.OperationStatus = status
+	elapsed := time.Since(began).Round(time.Second)
+	if status != operationSucceeded {
+		res.ARMError = armErr
+		if armErr != nil {
+			res.Err = fmt.Errorf("%w: %s (%s)", errOperationFailed, strings.ToLower(status), armErr.Code)
+		} else {
+			res.Err = fmt.Errorf("%w: %s", errOperationFailed, strings.ToLower(status))
+		}
+		return
+	}
+	slog.Info("Operation completed", vmAttrs(t), "action", res.Action, "elapsed", elapsed)
+	if res.Action == actionStart {
+		t.transition(vmStateRunning)
+	} else {
+		t.transition(vmStateCompleted)
+	}
+}
+
+// pollOperation checks a long-running operation once. Azure-AsyncOperation
+// URLs return its status; Location URLs answer 202 while it is in progress and
+// 200 or 204 once it succeeded. A failed operation comes with its error.
+func pollOperation(ctx context.Context, operationURL, token string) (string, *armError, error) {
+	resp, err := sendRequest(ctx, http.MethodGet, operationURL, token, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Status string    `json:"status"`
+		Error  *armError `json:"error"`
+	}
+	switch {
+	case resp.StatusCode == http.StatusAccepted:
+		return operationInProgress, nil, nil
+	case resp.StatusCode == http.StatusNoContent:
+		return operationSucceeded, nil, nil
+	case resp.StatusCode == http.StatusOK:
+		if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&body); err != nil && err != io.EOF {
+			return "", nil, fmt.Errorf("failed to parse JSON: %w", err)
+		}
+		if body.Status == "" {
+			// A Location URL answering with the final resource
+			return operationSucceeded, nil, nil
+		}
+		return body.Status, body.Error, nil
+	case resp.StatusCode >= http.StatusBadRequest:
+		// Location URLs report a failed operation with its error status
+		if armErr := readARMError(resp); armErr != nil {
+			return operationFailed, armErr, nil
+		}
+	}
+	return "", nil, fmt.Errorf("unexpected status: %d", resp.StatusCode)
+}
+
+// orUnknown returns status, or "unknown" when it is empty
+func orUnknown(status string) string {
+	if status == "" {
+		return "unknown"
+	}
+	return status
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Webhook signature headers
+const (
+	webhookSignatureHeader = "X-VMStarter-Signature"
+	webhookTimestampHeader = "X-VMStarter-Timestamp"
+)
+
+// webhookSink POSTs every result to a URL, signing the body with HMAC-SHA256
+// and retrying transient failures with exponential backoff
+type webhookSink struct {
+	url        string
+	secret     []byte
+	maxRetries int
+	runID      string
+	labels     map[string]string
+
+	queue chan []byte
+	wg    sync.WaitGroup
+}
+
+// newWebhookSink starts the delivery worker
+func newWebhookSink(url, secret string, maxRetries int, runID string, labels map[string]string) *webhookSink {
+	w := &webhookSink{
+		url:        url,
+		secret:     []byte(secret),
+		maxRetries: maxRetries,
+		runID:      runID,
+		labels:     labels,
+		queue:      make(chan []byte, 256),
+	}
+	w.wg.Add(1)
+	go w.worker()
+	return w
+}
+
+func (w *webhookSink) publish(res *vmResult) {
+	rec := res.record(w.runID)
+	rec.Labels = w.labels
+	body, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	w.queue <- body
+}
+
+func (w *webhookSink) close() {
+	close(w.queue)
+	w.wg.Wait()
+}
+
+func (w *webhookSink) worker() {
+	defer w.wg.Done()
+	for body := range w.queue {
+		if err := w.deliver(body); err != nil {
+			slog.Error("Failed to deliver webhook", "error", err)
+		}
+	}
+}
+
+// sign returns the hex HMAC-SHA256 of "<timestamp>.<body>"
+func (w *webhookSink) sign(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, w.secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliver sends body, retrying network errors, 429 and 5xx responses
+func (w *webhookSink) deliver(body []byte) error {
+	client := &http.Client{Timeout: 10 * time.Second}
+	var lastErr error
+	for attempt := 0; attempt <= w.maxRetries; attempt++ {
+		if attempt > 0 {
+			// 1s, 2s, 4s, ... capped at 30s, with up to 50% jitter
+			backoff := time.Second << (attempt - 1)
+			if backoff > 30*time.Second {
+				backoff = 30 * time.Second
+			}
+			time.Sleep(backoff + time.Duration(rand.Int63n(int64(backoff/2))))
+		}
+
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, w.url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(webhookTimestampHeader, timestamp)
+		req.Header.Set(webhookSignatureHeader, "sha256="+w.sign(timestamp, body))
+
+		resp, err := client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 300 {
+			return nil
+		}
+		lastErr = fmt.Errorf("unexpected status: %d", resp.StatusCode)
+		if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+			return lastErr
+		}
+	}
+	return fmt.Errorf("giving up after %d attempts: %w", w.maxRetries+1, lastErr)
+}
@@ -0,0 +1,81 @@
+package main
+
+import "sync"
+
+// workerPool executes the targets that are not part of a batch in parallel:
+// at most limit at a time overall and, when perSubscription is positive, at
+// most perSubscription within one subscription. Waiting targets are queued per
+// subscription and started round-robin across subscriptions, so that a huge
+// subscription discovered first does not keep the others waiting until it is
+// drained; within a subscription they are started in submission order.
+type workerPool struct {
+	limit           int
+	perSubscription int
+
+	mu      sync.Mutex
+	queues  map[string][]func()
+	order   []string // subscriptions in the order they were first submitted
+	next    int      // index in order of the subscription served next
+	running int
+	bySub   map[string]int
+	wg      sync.WaitGroup
+}
+
+func newWorkerPool(limit, perSubscription int) *workerPool {
+	return &workerPool{limit: max(limit, 1), perSubscription: perSubscription, queues: map[string][]func(){}, bySub: map[string]int{}}
+}
+
+// submit queues run, which executes a target of subscription
+func (w *workerPool) submit(subscription string, run func()) {
+	w.wg.Add(1)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.queues[subscription]; !ok {
+		w.order = append(w.order, subscription)
+	}
+	w.queues[subscription] = append(w.queues[subscription], run)
+	w.dispatch()
+}
+
+// dispatch starts the queued tasks that fit within the limits; w.mu is held
+func (w *workerPool) dispatch() {
+	for w.running < w.limit {
+		subscription, run, ok := w.take()
+		if !ok {
+			return
+		}
+		w.running++
+		w.bySub[subscription]++
+		go func() {
+			run()
+			w.mu.Lock()
+			w.running--
+			w.bySub[subscription]--
+			w.dispatch()
+			w.mu.Unlock()
+			w.wg.Done()
+		}()
+	}
+}
+
+// take dequeues the next task of the first subscription, starting from the
+// one whose turn it is, that has a task waiting and is below its limit
+func (w *workerPool) take() (string, func(), bool) {
+	for i := range w.order {
+		n := (w.next + i) % len(w.order)
+		subscription := w.order[n]
+		queue := w.queues[subscription]
+		if len(queue) == 0 || (w.perSubscription > 0 && w.bySub[subscription] >= w.perSubscription) {
+			continue
+		}
+		w.queues[subscription] = queue[1:]
+		w.next = (n + 1) % len(w.order)
+		return subscription, queue[0], true
+	}
+	return "", nil, false
+}
+
+// wait blocks until every submitted task has completed
+func (w *workerPool) wait() {
+	w.wg.Wait()
+}